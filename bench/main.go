@@ -0,0 +1,368 @@
+// Command bench is a reproducible load harness for the proxy. It starts
+// a fake upstream serving synthetic modules from memory through the
+// GOPROXY protocol, runs the proxy binary against it with a fresh cache
+// (backend type artifactory), and drives list, info, mod and zip
+// requests: first a cold pass that fetches every version once, then a
+// warm phase of random requests for a fixed duration. Latency
+// percentiles and throughput per endpoint are printed and optionally
+// written as JSON; with -baseline, the run fails if any endpoint's p95
+// latency or throughput regressed by more than -tolerance. The same
+// paths are benchmarked in process, against a fake version control host,
+// by BenchmarkFill and BenchmarkServe in cmd/server_test.go.
+//
+//	go run ./bench -duration 30s -json bench.json
+//	go run ./bench -baseline bench.json -tolerance 0.15
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	proxyBin    = flag.String("proxy", "", "proxy binary (default: build ./cmd)")
+	modules     = flag.Int("modules", 20, "number of synthetic modules")
+	versions    = flag.Int("versions", 10, "versions per module")
+	zipKB       = flag.Int("zip-kb", 256, "approximate zip size in KiB")
+	concurrency = flag.Int("c", 16, "concurrent clients")
+	duration    = flag.Duration("duration", 10*time.Second, "length of the warm phase")
+	latencyMS   = flag.Int("upstream-latency", 5, "added upstream latency in ms")
+	seed        = flag.Int64("seed", 1, "random seed")
+	jsonOut     = flag.String("json", "", "write results as JSON to this file")
+	baseline    = flag.String("baseline", "", "compare against results in this JSON file")
+	tolerance   = flag.Float64("tolerance", 0.10, "allowed regression against the baseline")
+)
+
+const srcRepo = "bench.example"
+
+// result summarizes one endpoint.
+type result struct {
+	Requests int     `json:"requests"`
+	Errors   int     `json:"errors"`
+	RPS      float64 `json:"rps"`
+	P50      float64 `json:"p50_ms"`
+	P95      float64 `json:"p95_ms"`
+	P99      float64 `json:"p99_ms"`
+}
+
+func main() {
+	flag.Parse()
+	log.SetFlags(0)
+
+	up := newUpstream()
+	srv := httptest.NewServer(up)
+	defer srv.Close()
+
+	work, err := os.MkdirTemp("", "goproxy-bench")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(work)
+
+	bin := *proxyBin
+	if bin == "" {
+		bin = filepath.Join(work, "goproxy")
+		build := exec.Command("go", "build", "-o", bin, "./cmd")
+		build.Stdout, build.Stderr = os.Stdout, os.Stderr
+		if err := build.Run(); err != nil {
+			log.Fatalf("building proxy: %v", err)
+		}
+	}
+
+	base, stop, err := startProxy(bin, work, srv.URL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stop()
+
+	rng := rand.New(rand.NewSource(*seed))
+	results := map[string]*result{}
+
+	// Cold pass: every version once, in a seeded random order.
+	var cold []string
+	for m := 0; m < *modules; m++ {
+		for v := 0; v < *versions; v++ {
+			cold = append(cold, fmt.Sprintf("%s/%s/@v/%s.zip", base, modPath(m), version(v)))
+		}
+	}
+	rng.Shuffle(len(cold), func(i, j int) { cold[i], cold[j] = cold[j], cold[i] })
+	results["zip (cold)"] = run(cold, 0)
+
+	// Warm phase: random requests for cached versions.
+	kinds := []string{"list", "info", "mod", "zip"}
+	for _, kind := range kinds {
+		urls := make([]string, 10000)
+		for i := range urls {
+			m, v := rng.Intn(*modules), rng.Intn(*versions)
+			switch kind {
+			case "list":
+				urls[i] = fmt.Sprintf("%s/%s/@v/list", base, modPath(m))
+			default:
+				urls[i] = fmt.Sprintf("%s/%s/@v/%s.%s", base, modPath(m), version(v), kind)
+			}
+		}
+		results[kind] = run(urls, *duration/time.Duration(len(kinds)))
+	}
+
+	printResults(results)
+	if *jsonOut != "" {
+		data, _ := json.MarshalIndent(results, "", "  ")
+		if err := os.WriteFile(*jsonOut, data, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *baseline != "" && !compare(results, *baseline) {
+		stop()
+		os.Exit(1)
+	}
+}
+
+func modPath(m int) string { return fmt.Sprintf("%s/mod%03d", srcRepo, m) }
+func version(v int) string { return fmt.Sprintf("v1.0.%d", v) }
+
+// startProxy runs the proxy on a free port with a fresh cache and waits
+// until it answers.
+func startProxy(bin, work, upstreamURL string) (string, func(), error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	port := fmt.Sprint(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	cfg := filepath.Join(work, "config.yaml")
+	err = os.WriteFile(cfg, []byte(fmt.Sprintf("backend:\n  type: artifactory\n  url: %s\n", upstreamURL)), 0644)
+	if err != nil {
+		return "", nil, err
+	}
+	logf, err := os.Create(filepath.Join(work, "proxy.log"))
+	if err != nil {
+		return "", nil, err
+	}
+	cmd := exec.Command(bin)
+	cmd.Env = append(os.Environ(),
+		"PORT="+port,
+		"CACHE_DIR="+filepath.Join(work, "cache"),
+		"CONFIG_FILE="+cfg,
+		"SRC_REPO="+srcRepo,
+	)
+	cmd.Stdout, cmd.Stderr = logf, logf
+	if err := cmd.Start(); err != nil {
+		return "", nil, err
+	}
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+			logf.Close()
+		})
+	}
+
+	base := "http://127.0.0.1:" + port
+	for i := 0; i < 100; i++ {
+		if resp, err := http.Get(base + "/api/version"); err == nil {
+			resp.Body.Close()
+			return base, stop, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	stop()
+	return "", nil, fmt.Errorf("proxy did not start; see %s", logf.Name())
+}
+
+// run requests urls with the configured concurrency. With d > 0 it
+// cycles through urls until d has passed; otherwise it requests each
+// url once.
+func run(urls []string, d time.Duration) *result {
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		errors    int
+		next      int
+		wg        sync.WaitGroup
+	)
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency}}
+	start := time.Now()
+	deadline := start.Add(d)
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				if (d == 0 && next >= len(urls)) || (d > 0 && time.Now().After(deadline)) {
+					mu.Unlock()
+					return
+				}
+				u := urls[next%len(urls)]
+				next++
+				mu.Unlock()
+
+				t := time.Now()
+				resp, err := client.Get(u)
+				ok := err == nil && resp.StatusCode == http.StatusOK
+				if err == nil {
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				elapsed := time.Since(t)
+
+				mu.Lock()
+				latencies = append(latencies, elapsed)
+				if !ok {
+					errors++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	total := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	pct := func(p float64) float64 {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return float64(latencies[int(p*float64(len(latencies)-1))].Microseconds()) / 1000
+	}
+	return &result{
+		Requests: len(latencies),
+		Errors:   errors,
+		RPS:      float64(len(latencies)) / total.Seconds(),
+		P50:      pct(0.50),
+		P95:      pct(0.95),
+		P99:      pct(0.99),
+	}
+}
+
+func printResults(results map[string]*result) {
+	var names []string
+	for n := range results {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	fmt.Printf("%-12s %9s %7s %10s %9s %9s %9s\n", "endpoint", "requests", "errors", "req/s", "p50 ms", "p95 ms", "p99 ms")
+	for _, n := range names {
+		r := results[n]
+		fmt.Printf("%-12s %9d %7d %10.1f %9.2f %9.2f %9.2f\n", n, r.Requests, r.Errors, r.RPS, r.P50, r.P95, r.P99)
+	}
+}
+
+// compare reports whether results are within the tolerance of the
+// baseline, printing every regression.
+func compare(results map[string]*result, path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var base map[string]*result
+	if err := json.Unmarshal(data, &base); err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+	ok := true
+	for name, b := range base {
+		r, found := results[name]
+		if !found {
+			continue
+		}
+		if b.P95 > 0 && r.P95 > b.P95*(1+*tolerance) {
+			fmt.Printf("REGRESSION %s: p95 %.2fms, baseline %.2fms\n", name, r.P95, b.P95)
+			ok = false
+		}
+		if r.RPS < b.RPS*(1-*tolerance) {
+			fmt.Printf("REGRESSION %s: %.1f req/s, baseline %.1f req/s\n", name, r.RPS, b.RPS)
+			ok = false
+		}
+		if r.Errors > b.Errors {
+			fmt.Printf("REGRESSION %s: %d errors, baseline %d\n", name, r.Errors, b.Errors)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// upstream is a fake artifact store serving synthetic modules from
+// memory. Artifacts are generated deterministically on first use.
+type upstream struct {
+	mu   sync.Mutex
+	zips map[string][]byte
+}
+
+func newUpstream() *upstream { return &upstream{zips: map[string][]byte{}} }
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(time.Duration(*latencyMS) * time.Millisecond)
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	mod, file, ok := strings.Cut(path, "/@v/")
+	if !ok || !strings.HasPrefix(mod, srcRepo+"/") {
+		http.NotFound(w, r)
+		return
+	}
+	if file == "list" {
+		for v := 0; v < *versions; v++ {
+			fmt.Fprintln(w, version(v))
+		}
+		return
+	}
+	ext := filepath.Ext(file)
+	v := strings.TrimSuffix(file, ext)
+	switch ext {
+	case ".info":
+		json.NewEncoder(w).Encode(map[string]string{"Version": v, "Time": "2024-01-01T00:00:00Z"})
+	case ".mod":
+		fmt.Fprintf(w, "module %s\n\ngo 1.21\n", mod)
+	case ".zip":
+		w.Write(u.zip(mod, v))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (u *upstream) zip(mod, v string) []byte {
+	key := mod + "@" + v
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if z, ok := u.zips[key]; ok {
+		return z
+	}
+	h := fnv.New64a()
+	io.WriteString(h, key)
+	rng := rand.New(rand.NewSource(int64(h.Sum64()) + *seed))
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, _ := zw.Create(key + "/go.mod")
+	fmt.Fprintf(f, "module %s\n\ngo 1.21\n", mod)
+	for i := 0; i*16 < *zipKB; i++ {
+		f, _ := zw.Create(fmt.Sprintf("%s/file%d.go", key, i))
+		fmt.Fprintf(f, "package mod\n\n// %x\n", randBytes(rng, 12<<10))
+	}
+	zw.Close()
+	u.zips[key] = buf.Bytes()
+	return u.zips[key]
+}
+
+func randBytes(rng *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	rng.Read(b)
+	return b
+}
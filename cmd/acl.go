@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/module"
+)
+
+// ACLRule restricts the modules under Prefix to the listed identities
+// and to members of the listed directory groups. Groups are matched
+// case-insensitively against either the full group DN or its CN, so
+// "platform" matches "CN=platform,OU=Groups,DC=example,DC=com".
+type ACLRule struct {
+	Prefix     string   `yaml:"prefix"`
+	Identities []string `yaml:"identities"`
+	Groups     []string `yaml:"groups"`
+}
+
+// aclFor returns the longest ACL rule matching module, configured or
+// synced from SCIM, or nil when the module is unrestricted.
+func aclFor(module string) *ACLRule {
+	rules := append(append([]ACLRule{}, config.ACL...), syncedACL()...)
+	var best *ACLRule
+	for i := range rules {
+		a := &rules[i]
+		if !hasPathPrefix(module, a.Prefix) {
+			continue
+		}
+		if best == nil || len(a.Prefix) > len(best.Prefix) {
+			best = a
+		}
+	}
+	return best
+}
+
+// allows reports whether a caller with identity and groups passes the
+// rule.
+func (a *ACLRule) allows(identity string, groups []string) bool {
+	for _, id := range a.Identities {
+		if id == identity {
+			return true
+		}
+	}
+	for _, want := range a.Groups {
+		for _, g := range groups {
+			if strings.EqualFold(want, g) || strings.EqualFold(want, groupCN(g)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// groupCN returns the value of the leading CN of a group DN, or dn
+// itself if it does not start with one.
+func groupCN(dn string) string {
+	first, _, _ := strings.Cut(dn, ",")
+	k, v, ok := strings.Cut(first, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(k), "cn") {
+		return dn
+	}
+	return strings.TrimSpace(v)
+}
+
+// enforceACL is router middleware rejecting callers that are not
+// allowed by the ACL rule of the requested module.
+func enforceACL(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, err := module.UnescapePath(mux.Vars(r)["module"])
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch err := checkACL(r.Context(), path); {
+		case errors.Is(err, errAuthRequired):
+			w.Header().Set("WWW-Authenticate", `Basic realm="goproxy"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+		case errors.Is(err, errGroupsUnavailable):
+			http.Error(w, "group resolution unavailable", http.StatusServiceUnavailable)
+		case err != nil:
+			httpError(w, err)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+var (
+	errAuthRequired      = errors.New("authentication required")
+	errGroupsUnavailable = errors.New("group resolution unavailable")
+)
+
+// checkACL reports whether the caller of ctx may access the module
+// path: nil, errAuthRequired for anonymous callers of a restricted
+// module, errGroupsUnavailable, or an errPolicyDenied error.
+func checkACL(ctx context.Context, path string) error {
+	a := aclFor(path)
+	if a == nil {
+		return nil
+	}
+	c := callerFrom(ctx)
+	if c.signed {
+		return nil
+	}
+	if c == anonymous {
+		return errAuthRequired
+	}
+	// Listed identities need no group lookup, so an unreachable
+	// directory does not lock them out.
+	var groups []string
+	if len(a.Groups) > 0 && !a.allows(c.Identity, nil) {
+		var err error
+		if groups, err = groupsOf(ctx, c.Identity); err != nil {
+			slog.ErrorContext(ctx, "resolving groups", "identity", c.Identity, "err", err)
+			return errGroupsUnavailable
+		}
+		groups = append(groups, teamsOf(c.Identity)...)
+	}
+	if !a.allows(c.Identity, groups) {
+		return kindError{c.Identity + " may not access " + path, errPolicyDenied}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// useGroups caches groups as the directory groups of each identity and
+// points group resolution at an unreachable directory, so identities
+// not cached cannot be resolved.
+func useGroups(t *testing.T, groups map[string][]string, expired bool) {
+	keepState(t)
+	config.LDAP = LDAPConfig{URL: "ldap://127.0.0.1:1", Timeout: time.Second}
+	expires := time.Now().Add(time.Hour)
+	if expired {
+		expires = time.Now().Add(-time.Hour)
+	}
+	groupCache.Lock()
+	for id, g := range groups {
+		groupCache.m[id] = groupEntry{groups: g, expires: expires}
+	}
+	groupCache.Unlock()
+	t.Cleanup(func() {
+		groupCache.Lock()
+		groupCache.m = make(map[string]groupEntry)
+		groupCache.Unlock()
+	})
+}
+
+func withCaller(c *caller) context.Context {
+	return context.WithValue(context.Background(), callerKey{}, c)
+}
+
+func TestCheckACL(t *testing.T) {
+	useGroups(t, map[string][]string{"carol": {"CN=Platform,OU=Groups,DC=example,DC=com"}, "dave": {"CN=sales,DC=example,DC=com"}}, false)
+	config.ACL = []ACLRule{
+		{Prefix: "example.com/secret", Identities: []string{"alice"}, Groups: []string{"platform"}},
+		{Prefix: "example.com/secret/public", Identities: []string{"bob"}},
+	}
+	for _, tt := range []struct {
+		name   string
+		caller *caller
+		path   string
+		want   error // nil if allowed
+	}{
+		{"unrestricted", anonymous, "example.com/open", nil},
+		{"sibling of a prefix", anonymous, "example.com/secretive", nil},
+		{"anonymous", anonymous, "example.com/secret", errAuthRequired},
+		{"listed identity", &caller{Identity: "alice"}, "example.com/secret/sub", nil},
+		{"other identity", &caller{Identity: "mallory"}, "example.com/secret", errGroupsUnavailable},
+		{"group CN", &caller{Identity: "carol"}, "example.com/secret", nil},
+		{"other group", &caller{Identity: "dave"}, "example.com/secret", errPolicyDenied},
+		{"longest prefix", &caller{Identity: "alice"}, "example.com/secret/public", errPolicyDenied},
+		{"longest prefix allows", &caller{Identity: "bob"}, "example.com/secret/public/v2", nil},
+		{"signed URL", &caller{Identity: "signed-url:admin", signed: true}, "example.com/secret", nil},
+	} {
+		err := checkACL(withCaller(tt.caller), tt.path)
+		if (tt.want == nil) != (err == nil) || (tt.want != nil && !errors.Is(err, tt.want)) {
+			t.Errorf("%s: checkACL(%s) = %v, want %v", tt.name, tt.path, err, tt.want)
+		}
+	}
+}
+
+// TestCheckACLStaleGroups checks that groups whose cache entry expired
+// are still used while the directory is unreachable.
+func TestCheckACLStaleGroups(t *testing.T) {
+	useGroups(t, map[string][]string{"carol": {"CN=platform,DC=example,DC=com"}}, true)
+	config.ACL = []ACLRule{{Prefix: "example.com/secret", Groups: []string{"platform"}}}
+	if err := checkACL(withCaller(&caller{Identity: "carol"}), "example.com/secret"); err != nil {
+		t.Errorf("checkACL = %v, want the stale groups used", err)
+	}
+}
+
+func TestEnforceACL(t *testing.T) {
+	useGroups(t, nil, false)
+	config.ACL = []ACLRule{
+		{Prefix: "example.com/secret", Identities: []string{"alice"}},
+		{Prefix: "example.com/team", Groups: []string{"platform"}},
+	}
+	r := mux.NewRouter()
+	r.Handle("/{module:.+}/@v/list", enforceACL(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	for _, tt := range []struct {
+		caller *caller
+		path   string
+		want   int
+	}{
+		{anonymous, "/example.com/open/@v/list", http.StatusOK},
+		{anonymous, "/example.com/secret/@v/list", http.StatusUnauthorized},
+		{&caller{Identity: "alice"}, "/example.com/secret/@v/list", http.StatusOK},
+		{&caller{Identity: "bob"}, "/example.com/secret/@v/list", http.StatusForbidden},
+		{&caller{Identity: "alice"}, "/example.com/team/@v/list", http.StatusServiceUnavailable},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil).WithContext(withCaller(tt.caller)))
+		if w.Code != tt.want {
+			t.Errorf("%s for %s: status %d, want %d", tt.path, tt.caller.Identity, w.Code, tt.want)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: 401 without WWW-Authenticate", tt.path)
+		}
+	}
+}
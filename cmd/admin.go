@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/module"
+)
+
+// registerAdminRoutes installs the admin API on r, which is expected to
+// be mounted at /admin. Every route requires the admin scope.
+func registerAdminRoutes(r *mux.Router) {
+	admin := func(path string, h http.HandlerFunc, methods ...string) {
+		r.HandleFunc(path, requireScope(scopeAdmin, h)).Methods(methods...)
+	}
+
+	admin("/", dashboard, http.MethodGet)
+	admin("/quarantine", listQuarantined, http.MethodGet)
+	admin("/quarantine/{module:.+}/@v/{version}/release", releaseQuarantined, http.MethodPost)
+	admin("/approvals", listApprovals, http.MethodGet)
+	admin("/approvals/{module:.+}/@v/{version}/approve", approveVersion, http.MethodPost)
+	admin("/reports/usage", getUsageReport, http.MethodGet)
+	admin("/reports/usage", postUsageReport, http.MethodPost)
+	admin("/reports/owners", getOwnerReports, http.MethodGet)
+	admin("/reports/owners", postOwnerReports, http.MethodPost)
+	admin("/stats", getStats, http.MethodGet)
+	admin("/mirror/{module:.+}", postMirror, http.MethodPost)
+	admin("/jobs", listJobs, http.MethodGet)
+	admin("/jobs/{id}", getJob, http.MethodGet)
+	admin("/index", getIndex, http.MethodGet)
+	admin("/index/hashes", getHashes, http.MethodGet)
+	admin("/consistency", postConsistency, http.MethodPost)
+	admin("/verify", getVerifyReport, http.MethodGet)
+	admin("/verify", postVerify, http.MethodPost)
+	admin("/cache", getCacheStats, http.MethodGet)
+	admin("/maintenance", getMaintenance, http.MethodGet)
+	admin("/maintenance", setMaintenance, http.MethodPost, http.MethodDelete)
+	admin("/reload", postReload, http.MethodPost)
+	admin("/cache/{module:.+}/@v/{version}", purge, http.MethodDelete)
+	admin("/cache/{module:.+}", purge, http.MethodDelete)
+	admin("/cluster/events", clusterEvents, http.MethodPost)
+	admin("/scim", getSCIM, http.MethodGet)
+	admin("/scim/sync", postSCIMSync, http.MethodPost)
+	admin("/sign", postSign, http.MethodPost)
+	admin("/exec", listExec, http.MethodGet)
+	admin("/telemetry", getTelemetry, http.MethodGet)
+	admin("/blocks", listBlocks, http.MethodGet)
+	admin("/blocks/{module:.+}/@v/{version}", blockVersion, http.MethodPost, http.MethodDelete)
+	admin("/tenants/{prefix:.+}", exportTenant, http.MethodGet)
+	admin("/tenants/{prefix:.+}", importTenant, http.MethodPost)
+}
+
+// registerAPIRoutes installs the client-facing API on r, which is
+// expected to be mounted at /api.
+func registerAPIRoutes(r *mux.Router) {
+	r.HandleFunc("/builds/{id}", getBuild).Methods(http.MethodGet)
+	r.HandleFunc("/version", getVersion).Methods(http.MethodGet)
+	r.HandleFunc("/gosum", postGoSum).Methods(http.MethodPost)
+	r.HandleFunc("/checksumdb", getChecksumDB).Methods(http.MethodGet)
+	r.HandleFunc("/modules/{module:.+}/health", getModuleHealth).Methods(http.MethodGet)
+
+	versions := r.PathPrefix("/versions").Subrouter()
+	versions.Use(requireServed, enforceACL)
+	versions.HandleFunc("/{module:.+}", getVersions).Methods(http.MethodGet)
+
+	mod := r.PathPrefix("/mod").Subrouter()
+	mod.Use(requireServed, enforceACL)
+	mod.HandleFunc("/{module:.+}/@v/{version}", getModInfo).Methods(http.MethodGet)
+}
+
+// requireServed is router middleware answering 404 for a module path
+// that does not unescape or that the proxy does not serve, before any
+// upstream is asked about it.
+func requireServed(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, err := module.UnescapePath(mux.Vars(r)["module"])
+		if err != nil {
+			httpError(w, kindError{err.Error(), errNotFound})
+			return
+		}
+		if !servesModule(path) {
+			httpError(w, kindError{fmt.Sprintf("%s is not served by this proxy", path), errNotFound})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON writes v as an indented JSON response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		slog.Warn("writing response", "err", err)
+	}
+}
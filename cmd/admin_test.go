@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRepoURL(t *testing.T) {
+	m := repoMapping{Src: "go.example.com", Dest: "git.example.com/org"}
+	for _, tt := range []struct {
+		name, want string
+		found      bool
+	}{
+		{"go.example.com/repo", "git.example.com/org/repo", true},
+		{"go.example.com/repo/sub/v2", "git.example.com/org/repo", true},
+		{"go.example.com", "", false},
+		{"go.example.com/", "", false},
+	} {
+		got, err := m.repoURL(tt.name)
+		if !tt.found {
+			if !errors.Is(err, errNotFound) {
+				t.Errorf("repoURL(%q) error = %v, want not found", tt.name, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("repoURL(%q) = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestRequireServed(t *testing.T) {
+	keepState(t)
+	routing.Store(&routingTable{mappings: []*mapping{{repoMapping: repoMapping{Src: "go.example.com"}}}})
+
+	r := mux.NewRouter()
+	r.Use(requireServed)
+	r.HandleFunc("/{module:.+}", func(w http.ResponseWriter, r *http.Request) {})
+	for path, want := range map[string]int{
+		"/go.example.com/repo":   http.StatusOK,
+		"/go.example.com/!repo":  http.StatusOK,
+		"/github.com/other/repo": http.StatusNotFound,
+		"/go.example.com/Repo":   http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("GET %s: status %d, want %d", path, w.Code, want)
+		}
+	}
+}
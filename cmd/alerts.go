@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// AlertsConfig configures where security-relevant events are reported.
+// Alerts are always logged; WebhookURL additionally receives each alert
+// as a JSON POST.
+type AlertsConfig struct {
+	WebhookURL string `yaml:"webhook_url"`
+}
+
+// Alert is the payload posted to the alerts webhook.
+type Alert struct {
+	Kind     string            `json:"kind"`
+	Priority string            `json:"priority"` // "normal" or "high"
+	Message  string            `json:"message"`
+	Time     time.Time         `json:"time"`
+	Fields   map[string]string `json:"fields,omitempty"`
+}
+
+// sendAlert logs the alert and delivers it to the webhook, if any, in
+// the background so the request that triggered it is not delayed.
+func sendAlert(kind, message string, fields map[string]string) {
+	deliverAlert(Alert{Kind: kind, Priority: "normal", Message: message, Time: time.Now().UTC(), Fields: fields})
+}
+
+// sendHighPriorityAlert is sendAlert for events that warrant paging
+// someone.
+func sendHighPriorityAlert(kind, message string, fields map[string]string) {
+	deliverAlert(Alert{Kind: kind, Priority: "high", Message: message, Time: time.Now().UTC(), Fields: fields})
+}
+
+func deliverAlert(a Alert) {
+	slog.Warn("alert", "priority", a.Priority, "kind", a.Kind, "message", a.Message, "fields", a.Fields)
+
+	url := config.Alerts.WebhookURL
+	if url == "" {
+		return
+	}
+	go func() {
+		body, err := json.Marshal(a)
+		if err != nil {
+			slog.Error("alert webhook", "err", err)
+			return
+		}
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			slog.Error("alert webhook", "err", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			slog.Error("alert webhook", "status", resp.Status)
+		}
+	}()
+}
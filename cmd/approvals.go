@@ -0,0 +1,154 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ApprovalsConfig designates sensitive module prefixes whose new
+// versions must be approved by Required distinct admins before they
+// are served to anyone.
+type ApprovalsConfig struct {
+	Prefixes []string `yaml:"prefixes"`
+	Required int      `yaml:"required"`
+}
+
+type approval struct {
+	By string    `json:"by"`
+	At time.Time `json:"at"`
+}
+
+// approvalsRequired returns the number of approvals new versions of
+// module need, or 0 if module is not under an approvals prefix.
+func approvalsRequired(module string) int {
+	ac := config.Approvals
+	for _, p := range ac.Prefixes {
+		if hasPathPrefix(module, p) {
+			if ac.Required < 2 {
+				return 2
+			}
+			return ac.Required
+		}
+	}
+	return 0
+}
+
+// approve records an approval of module@version by the given admin and
+// releases the version once enough distinct admins have approved it.
+func approve(module, version, by string) (*quarantineRecord, error) {
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+
+	q, err := readQuarantine(module, version)
+	if err != nil || q == nil {
+		return nil, err
+	}
+	if q.State == stateReleased || q.RequiredApprovals == 0 {
+		return q, nil
+	}
+	for _, a := range q.Approvals {
+		if a.By == by {
+			return q, errAlreadyApproved
+		}
+	}
+
+	q.Approvals = append(q.Approvals, approval{By: by, At: time.Now().UTC()})
+	if len(q.Approvals) >= q.RequiredApprovals {
+		release(q, by)
+	}
+	return q, saveQuarantine(q)
+}
+
+type approvalError string
+
+func (e approvalError) Error() string { return string(e) }
+
+const errAlreadyApproved = approvalError("already approved by this admin; a different admin must approve")
+
+// pendingApprovals returns the quarantined versions awaiting approvals.
+func pendingApprovals() ([]*quarantineRecord, error) {
+	records, err := quarantinedRecords()
+	if err != nil {
+		return nil, err
+	}
+	pending := records[:0]
+	for _, q := range records {
+		if q.RequiredApprovals > 0 {
+			pending = append(pending, q)
+		}
+	}
+	return pending, nil
+}
+
+// listApprovals serves GET /admin/approvals.
+func listApprovals(w http.ResponseWriter, r *http.Request) {
+	pending, err := pendingApprovals()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, pending)
+}
+
+// approveVersion serves POST /admin/approvals/{module}/@v/{version}/approve.
+func approveVersion(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	by := callerFrom(r.Context()).Identity
+
+	q, err := approve(vars["module"], vars["version"], by)
+	if err == errAlreadyApproved {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if q == nil {
+		http.Error(w, "no pending approval", http.StatusNotFound)
+		return
+	}
+	slog.InfoContext(r.Context(), "approval", "module", q.Module, "version", q.Version, "by", by, "approvals", len(q.Approvals), "required", q.RequiredApprovals, "state", q.State)
+	writeJSON(w, http.StatusOK, q)
+}
+
+var dashboardTmpl = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head><title>goproxy admin</title></head>
+<body>
+<h1>Pending approvals</h1>
+{{if .Approvals}}
+<table border="1" cellpadding="4">
+<tr><th>Module</th><th>Version</th><th>Fetched</th><th>Scan</th><th>Approvals</th></tr>
+{{range .Approvals}}
+<tr>
+<td>{{.Module}}</td><td>{{.Version}}</td><td>{{.Since.Format "2006-01-02 15:04:05"}}</td>
+<td>{{if .Scan}}{{if .Scan.Passed}}passed{{else}}failed{{end}}{{else}}-{{end}}</td>
+<td>{{len .Approvals}}/{{.RequiredApprovals}}{{range .Approvals}} {{.By}}{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>None.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// dashboard serves GET /admin/, a read-only HTML overview for admins.
+func dashboard(w http.ResponseWriter, r *http.Request) {
+	pending, err := pendingApprovals()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := dashboardTmpl.Execute(w, map[string]any{"Approvals": pending}); err != nil {
+		slog.ErrorContext(r.Context(), "dashboard", "err", err)
+	}
+}
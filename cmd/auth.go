@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TokenConfig describes one client credential. Clients present Token
+// either as a bearer token or as the password of HTTP basic auth (which
+// is what the go command sends for a .netrc entry).
+type TokenConfig struct {
+	Identity string   `yaml:"identity"`
+	Token    string   `yaml:"token"`
+	Scopes   []string `yaml:"scopes"`
+}
+
+// Scopes understood by the proxy.
+const (
+	scopeAdmin  = "admin"  // admin API
+	scopeCanary = "canary" // may download quarantined versions
+)
+
+// caller is the identity attached to a request by identify.
+type caller struct {
+	Identity string
+	Scopes   []string
+
+	// signed is set for requests authorized by a signed URL.
+	signed bool
+}
+
+var anonymous = &caller{Identity: "anonymous"}
+
+func (c *caller) hasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type callerKey struct{}
+
+// callerFrom returns the caller of the request, or anonymous.
+func callerFrom(ctx context.Context) *caller {
+	if c, ok := ctx.Value(callerKey{}).(*caller); ok {
+		return c
+	}
+	return anonymous
+}
+
+// requestToken extracts the credential presented by the client, if any.
+func requestToken(r *http.Request) string {
+	if _, pass, ok := r.BasicAuth(); ok {
+		return pass
+	}
+	if tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(tok)
+	}
+	return ""
+}
+
+// tokensFile holds the tokens of Config.TokensFile as last loaded.
+var tokensFile struct {
+	sync.Mutex
+	tokens  []TokenConfig
+	mtime   time.Time
+	checked time.Time
+}
+
+// parseTokens reads a tokens file.
+func parseTokens(path string) ([]TokenConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []TokenConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&tokens); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	for i, t := range tokens {
+		if t.Identity == "" || t.Token == "" {
+			return nil, fmt.Errorf("%s: [%d]: identity and token are required", path, i)
+		}
+	}
+	return tokens, nil
+}
+
+// setupTokensFile loads Config.TokensFile, if set.
+func setupTokensFile(path string) error {
+	tokensFile.Lock()
+	defer tokensFile.Unlock()
+	tokensFile.tokens = nil
+	if path == "" {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if tokensFile.tokens, err = parseTokens(path); err != nil {
+		return err
+	}
+	tokensFile.mtime, tokensFile.checked = fi.ModTime(), time.Now()
+	return nil
+}
+
+// fileTokens returns the tokens of Config.TokensFile, reloading it if it
+// changed, at most every 10 seconds. A file that fails to load keeps
+// the previous tokens in effect.
+func fileTokens() []TokenConfig {
+	path := config.TokensFile
+	if path == "" {
+		return nil
+	}
+	tokensFile.Lock()
+	defer tokensFile.Unlock()
+	if time.Since(tokensFile.checked) < 10*time.Second {
+		return tokensFile.tokens
+	}
+	tokensFile.checked = time.Now()
+	fi, err := os.Stat(path)
+	if err != nil || fi.ModTime().Equal(tokensFile.mtime) {
+		return tokensFile.tokens
+	}
+	tokens, err := parseTokens(path)
+	if err != nil {
+		slog.Error("reloading tokens", "err", err)
+		return tokensFile.tokens
+	}
+	tokensFile.tokens, tokensFile.mtime = tokens, fi.ModTime()
+	slog.Info("reloaded tokens", "file", path, "tokens", len(tokens))
+	return tokens
+}
+
+func lookupToken(tok string) *caller {
+	if tok == "" {
+		return nil
+	}
+	// Compare against every token in constant time so that response
+	// timing reveals neither a matching prefix nor which entry matched.
+	var found *caller
+	tokens := routes().tokens
+	for _, t := range append(tokens[:len(tokens):len(tokens)], fileTokens()...) {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(tok)) == 1 && found == nil {
+			found = &caller{Identity: t.Identity, Scopes: t.Scopes}
+		}
+	}
+	return found
+}
+
+// identify attaches the caller matching the request's credential (a
+// configured token or a JWT), URL signature or client certificate to
+// the request context. Requests without a known credential proceed as
+// anonymous.
+func identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sc, err := signedCaller(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		tok := requestToken(r)
+		if sc != nil {
+			r = r.WithContext(context.WithValue(r.Context(), callerKey{}, sc))
+		} else if c := lookupToken(tok); c != nil {
+			r = r.WithContext(context.WithValue(r.Context(), callerKey{}, c))
+		} else if config.OIDC.Issuer != "" && looksLikeJWT(tok) {
+			c, err := jwtCaller(r.Context(), tok)
+			if errors.Is(err, errUpstreamUnavailable) {
+				httpError(w, err)
+				return
+			}
+			if err != nil {
+				// Unlike an unknown token, an invalid JWT is rejected
+				// rather than served as anonymous, to tell the client
+				// to get a new one.
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "invalid token: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), callerKey{}, c))
+		} else if c := certCaller(r); c != nil {
+			r = r.WithContext(context.WithValue(r.Context(), callerKey{}, c))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAuth is router middleware rejecting anonymous requests with
+// 401. It is in the global chain when Config.RequireAuth is set. The
+// open paths stay open.
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if callerFrom(r.Context()) != anonymous || openPath(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="goproxy"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+	})
+}
+
+// openPath reports whether r is to a path reached without credentials:
+// the health probes, and the GitHub webhook, which carries a signature
+// instead.
+func openPath(r *http.Request) bool {
+	return r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || (r.URL.Path == githubHookPath && r.Method == http.MethodPost)
+}
+
+// requireScope rejects callers that lack scope.
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := callerFrom(r.Context())
+		if c == anonymous {
+			w.Header().Set("WWW-Authenticate", `Basic realm="goproxy"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if !c.hasScope(scope) {
+			http.Error(w, c.Identity+" lacks scope "+scope, http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
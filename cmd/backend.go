@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// A backend resolves module versions from the upstream the proxy fronts.
+// Module paths passed to a backend are the paths clients request.
+type backend interface {
+	// List returns the known versions of the module, in any order.
+	List(ctx context.Context, name string) ([]string, error)
+
+	// Fetch writes <version>.info, go.mod and source.zip for
+	// name@version into destDir. Unlike List, name is the escaped
+	// module path, as used in the cache layout.
+	Fetch(ctx context.Context, name, version, destDir string, policy FetchPolicy) error
+}
+
+// BackendConfig selects and configures the backend.
+//
+// Type "git" (the default) clones repositories under DEST_REPO, with
+// the git binary or, if Native is set, the built-in go-git client. Types
+// "artifactory" and "nexus" read from a Go repository of an artifact
+// store through its GOPROXY-compatible REST API, e.g.
+//
+//	https://artifactory.example.com/artifactory/api/go/go-virtual
+//	https://nexus.example.com/repository/go-proxy
+//
+// Type "directory" serves source snapshots below Dir. See dirBackend.
+type BackendConfig struct {
+	Type string `yaml:"type"`
+	URL  string `yaml:"url"`
+
+	// Username and Password are sent as basic auth; Token, if set, is
+	// sent as a bearer token instead.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Token    string `yaml:"token"`
+
+	// PathPrefix, if set, replaces SRC_REPO (or the mount's src_repo)
+	// in module paths before they are looked up in the artifact store.
+	PathPrefix string `yaml:"path_prefix"`
+
+	// Native makes the git backend use go-git, so that the proxy never
+	// runs an external git or go binary.
+	Native bool `yaml:"native"`
+
+	// Dir is the root of the directory backend.
+	Dir string `yaml:"dir"`
+}
+
+func newBackend(bc BackendConfig, m repoMapping) (backend, error) {
+	switch bc.Type {
+	case "", "git":
+		if bc.Native {
+			return nativeGitBackend{m}, nil
+		}
+		if _, err := exec.LookPath("git"); err != nil {
+			return nil, fmt.Errorf("git backend: %v (set backend.native to use the built-in client)", err)
+		}
+		return gitBackend{m}, nil
+	case "artifactory", "nexus":
+		if bc.URL == "" {
+			return nil, fmt.Errorf("backend %s: url is required", bc.Type)
+		}
+		return &artifactBackend{BackendConfig: bc, src: m.Src, client: http.DefaultClient}, nil
+	case "directory":
+		if bc.Dir == "" {
+			return nil, fmt.Errorf("backend directory: dir is required")
+		}
+		if fi, err := os.Stat(bc.Dir); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("backend directory: %s is not a directory", bc.Dir)
+		}
+		return dirBackend{root: bc.Dir, src: m.Src}, nil
+	default:
+		return nil, fmt.Errorf("unknown backend type %q", bc.Type)
+	}
+}
+
+// artifactBackend reads modules from an artifact store that implements
+// the GOPROXY protocol, as both Artifactory and Nexus Go repositories do.
+type artifactBackend struct {
+	BackendConfig
+	src    string // module path prefix replaced by PathPrefix
+	client *http.Client
+}
+
+// upstreamPath maps an escaped client module path to the escaped path
+// under which the module is stored upstream.
+func (b *artifactBackend) upstreamPath(name string) (string, error) {
+	path, err := module.UnescapePath(name)
+	if err != nil {
+		return "", err
+	}
+	if b.PathPrefix != "" && hasPathPrefix(path, b.src) {
+		path = b.PathPrefix + strings.TrimPrefix(path, b.src)
+	}
+	return module.EscapePath(path)
+}
+
+func (b *artifactBackend) get(ctx context.Context, name, suffix string) (*http.Response, error) {
+	path, err := b.upstreamPath(name)
+	if err != nil {
+		return nil, err
+	}
+	u := strings.TrimSuffix(b.URL, "/") + "/" + path + "/" + suffix
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if b.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.Token)
+	} else if b.Username != "" {
+		req.SetBasicAuth(b.Username, b.Password)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errUpstreamUnavailable, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, upstreamStatusError(b.Type+" "+path+"/"+suffix, resp.StatusCode, resp.Status)
+	}
+	return resp, nil
+}
+
+func (b *artifactBackend) List(ctx context.Context, name string) ([]string, error) {
+	escaped, err := module.EscapePath(name)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.get(ctx, escaped, "@v/list")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var versions []string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if v := strings.TrimSpace(sc.Text()); v != "" {
+			versions = append(versions, v)
+		}
+	}
+	return versions, sc.Err()
+}
+
+func (b *artifactBackend) Fetch(ctx context.Context, name, version, destDir string, policy FetchPolicy) error {
+	slog.DebugContext(ctx, "fetch", "backend", b.Type, "module", name, "version", version)
+
+	ev, err := module.EscapeVersion(version)
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		suffix, dest string
+		limit        int64
+	}{
+		{"@v/" + ev + ".info", version + ".info", 1 << 20},
+		{"@v/" + ev + ".mod", "go.mod", 16 << 20},
+		{"@v/" + ev + ".zip", "source.zip", policy.MaxZipBytes},
+	}
+	for _, f := range files {
+		if err := b.download(ctx, name, f.suffix, filepath.Join(destDir, f.dest), f.limit); err != nil {
+			return err
+		}
+	}
+	return b.recordUpstreamOrigin(destDir, version)
+}
+
+// GoMod returns the upstream go.mod of name@version, as Fetch would
+// store it.
+func (b *artifactBackend) GoMod(ctx context.Context, name, version string) ([]byte, error) {
+	ev, err := module.EscapeVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.get(ctx, name, "@v/"+ev+".mod")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+}
+
+// recordUpstreamOrigin records the Origin of the upstream .info, if it
+// has one; an artifact repository that is itself a Go proxy passes on
+// where it got the version from.
+func (b *artifactBackend) recordUpstreamOrigin(destDir, version string) error {
+	data, err := os.ReadFile(filepath.Join(destDir, version+".info"))
+	if err != nil {
+		return err
+	}
+	var info struct{ Origin *Origin }
+	if json.Unmarshal(data, &info) != nil || info.Origin == nil {
+		return nil
+	}
+	return recordOrigin(destDir, info.Origin)
+}
+
+// download copies one upstream file to dest, failing with errTooLarge
+// if it exceeds limit bytes.
+func (b *artifactBackend) download(ctx context.Context, name, suffix, dest string, limit int64) error {
+	resp, err := b.get(ctx, name, suffix)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength > limit {
+		return fmt.Errorf("%s/%s: %w (%d > %d bytes)", name, suffix, errTooLarge, resp.ContentLength, limit)
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	n, err := copyBuffered(f, io.LimitReader(resp.Body, limit+1))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if n > limit {
+		return fmt.Errorf("%s/%s: %w (> %d bytes)", name, suffix, errTooLarge, limit)
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A blobStore is object storage holding the files of cached versions
+// as individual blobs, such as an S3 bucket or a directory shared by
+// the replicas. blobRemote lays versions out in it and makes it a
+// remoteStore.
+type blobStore interface {
+	// Get opens the blob at key. It returns an error wrapping
+	// os.ErrNotExist if there is none.
+	Get(ctx context.Context, key string) (io.ReadCloser, blobInfo, error)
+
+	// Put stores body, of the size and digest in info, at key.
+	Put(ctx context.Context, key string, body io.ReadSeeker, info blobInfo) error
+
+	// Stat describes the blob at key, like Get.
+	Stat(ctx context.Context, key string) (blobInfo, error)
+
+	// List returns the keys starting with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+
+	// Delete removes the blob at key.
+	Delete(ctx context.Context, key string) error
+}
+
+// blobInfo describes a blob. SHA256 is hex-encoded and may be empty if
+// the store does not know it. PlainSHA256 is, for a blob demoted to
+// cold storage, the digest of its decompressed content, likewise.
+type blobInfo struct {
+	Size        int64
+	SHA256      string
+	PlainSHA256 string
+}
+
+// blobRemote stores the files of name@version under
+// <namespace>/<name>/@v/ in the layout of the module proxy protocol,
+// with the provenance as <version>.provenance.json. The provenance is
+// written last and removed first, so a version is complete whenever it
+// is present.
+type blobRemote struct {
+	blobs blobStore
+}
+
+// blobSuffixes maps the files of a cache entry, but the .info, to the
+// suffix of their blob after the version.
+var blobSuffixes = map[string]string{
+	"go.mod":       ".mod",
+	"source.zip":   ".zip",
+	provenanceFile: ".provenance.json",
+}
+
+func blobKey(name, version, file string) string {
+	suffix := ".info"
+	if file != version+".info" {
+		suffix = blobSuffixes[file]
+	}
+	return path.Join(cacheNS, name, "@v", version+suffix)
+}
+
+func (s blobRemote) Pull(ctx context.Context, name, version, dir string) error {
+	if _, err := s.blobs.Stat(ctx, blobKey(name, version, provenanceFile)); err != nil {
+		return err
+	}
+	limit := fetchPolicyFor(name).MaxZipBytes
+	for _, file := range artifactFiles(version) {
+		if err := s.pull(ctx, blobKey(name, version, file), filepath.Join(dir, file), limit); err != nil {
+			return fmt.Errorf("%s@%s: %s: %w", name, version, file, err)
+		}
+	}
+	return nil
+}
+
+// pull downloads the blob at key to dest, verifying its digest if the
+// store knows it. A blob demoted to cold storage is decompressed, to at
+// most limit bytes, and the result verified against its plain digest.
+func (s blobRemote) pull(ctx context.Context, key, dest string, limit int64) error {
+	body, info, err := s.blobs.Get(ctx, key)
+	compressed := false
+	if errors.Is(err, os.ErrNotExist) {
+		if zbody, zinfo, zerr := s.blobs.Get(ctx, key+compressedSuffix); zerr == nil {
+			body, info, err, compressed = zbody, zinfo, nil, true
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	h, plain := sha256.New(), sha256.New()
+	if compressed {
+		err = decompress(io.MultiWriter(f, plain), io.TeeReader(body, h), limit)
+	} else {
+		_, err = copyBuffered(io.MultiWriter(f, h), body)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); info.SHA256 != "" && got != info.SHA256 {
+		return fmt.Errorf("digest mismatch (got sha256:%s, stored sha256:%s)", got, info.SHA256)
+	}
+	if got := hex.EncodeToString(plain.Sum(nil)); compressed && info.PlainSHA256 != "" && got != info.PlainSHA256 {
+		return fmt.Errorf("digest mismatch after decompressing (got sha256:%s, stored sha256:%s)", got, info.PlainSHA256)
+	}
+	return nil
+}
+
+func (s blobRemote) Push(ctx context.Context, name, version, dir string) error {
+	// artifactFiles lists the provenance last.
+	for _, file := range artifactFiles(version) {
+		if err := s.push(ctx, filepath.Join(dir, file), blobKey(name, version, file)); err != nil {
+			return fmt.Errorf("%s@%s: %s: %w", name, version, file, err)
+		}
+	}
+	return nil
+}
+
+func (s blobRemote) push(ctx context.Context, src, key string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := copyBuffered(h, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return s.blobs.Put(ctx, key, f, blobInfo{Size: size, SHA256: hex.EncodeToString(h.Sum(nil))})
+}
+
+// Stat returns the digests of the stored files of name@version. Files
+// demoted to cold storage have the digest of their decompressed
+// content, unless they were demoted before it was recorded.
+func (s blobRemote) Stat(ctx context.Context, name, version string) (map[string]string, error) {
+	digests := map[string]string{}
+	for _, file := range artifactFiles(version) {
+		key := blobKey(name, version, file)
+		info, err := s.blobs.Stat(ctx, key)
+		if errors.Is(err, os.ErrNotExist) {
+			if zinfo, zerr := s.blobs.Stat(ctx, key+compressedSuffix); zerr == nil {
+				info, err = blobInfo{SHA256: zinfo.PlainSHA256}, nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info.SHA256 != "" {
+			digests[file] = "sha256:" + info.SHA256
+		}
+	}
+	return digests, nil
+}
+
+func (s blobRemote) Delete(ctx context.Context, name, version string) error {
+	if _, err := s.blobs.Stat(ctx, blobKey(name, version, provenanceFile)); err != nil {
+		return err
+	}
+	files := artifactFiles(version)
+	for i := len(files) - 1; i >= 0; i-- {
+		keys := []string{blobKey(name, version, files[i])}
+		if slices.Contains(compressible, files[i]) {
+			keys = append(keys, keys[0]+compressedSuffix)
+		}
+		for _, key := range keys {
+			if err := s.blobs.Delete(ctx, key); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Versions lists the stored versions of name.
+func (s blobRemote) Versions(ctx context.Context, name string) ([]string, error) {
+	prefix := path.Join(cacheNS, name, "@v") + "/"
+	keys, err := s.blobs.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, key := range keys {
+		v, ok := strings.CutSuffix(strings.TrimPrefix(key, prefix), blobSuffixes[provenanceFile])
+		if ok && !strings.Contains(v, "/") {
+			versions = append(versions, v)
+		}
+	}
+	return versions, nil
+}
+
+// DiskStorageConfig configures a blob store in a directory, typically
+// a volume shared by the replicas.
+type DiskStorageConfig struct {
+	Path string `yaml:"path"`
+}
+
+// diskBlobs is a blobStore in a directory. Digests are computed on
+// demand rather than stored.
+type diskBlobs struct {
+	root string
+}
+
+func newDiskBlobs(cfg DiskStorageConfig) (diskBlobs, error) {
+	if cfg.Path == "" {
+		return diskBlobs{}, fmt.Errorf("disk storage: path is required")
+	}
+	return diskBlobs{root: cfg.Path}, os.MkdirAll(cfg.Path, 0755)
+}
+
+func (d diskBlobs) path(key string) string {
+	return filepath.Join(d.root, filepath.FromSlash(key))
+}
+
+func (d diskBlobs) Get(ctx context.Context, key string) (io.ReadCloser, blobInfo, error) {
+	f, err := os.Open(d.path(key))
+	if err != nil {
+		return nil, blobInfo{}, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, blobInfo{}, err
+	}
+	return f, blobInfo{Size: fi.Size()}, nil
+}
+
+func (d diskBlobs) Put(ctx context.Context, key string, body io.ReadSeeker, info blobInfo) error {
+	dest := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = copyBuffered(tmp, body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+func (d diskBlobs) Stat(ctx context.Context, key string) (blobInfo, error) {
+	f, err := os.Open(d.path(key))
+	if err != nil {
+		return blobInfo{}, err
+	}
+	defer f.Close()
+	h, plain := sha256.New(), sha256.New()
+	size, err := copyBuffered(h, f)
+	if err != nil {
+		return blobInfo{}, err
+	}
+	info := blobInfo{Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}
+	if strings.HasSuffix(key, compressedSuffix) {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return blobInfo{}, err
+		}
+		if err := decompress(plain, f, math.MaxInt64); err != nil {
+			return blobInfo{}, err
+		}
+		info.PlainSHA256 = hex.EncodeToString(plain.Sum(nil))
+	}
+	return info, nil
+}
+
+func (d diskBlobs) List(ctx context.Context, prefix string) ([]string, error) {
+	// Walk the deepest directory the prefix names in full.
+	dir := prefix[:strings.LastIndex(prefix, "/")+1]
+	var keys []string
+	err := filepath.WalkDir(d.path(dir), func(p string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(d.root, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) && !strings.HasPrefix(e.Name(), ".put-") {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return keys, err
+}
+
+func (d diskBlobs) Delete(ctx context.Context, key string) error {
+	return os.Remove(d.path(key))
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Blocked versions are the kill switch for a discovered malicious
+// release: every file of a blocked version answers 410 Gone with the
+// security advisory, whether or not it is cached, and the version
+// disappears from /@v/list. Blocks are kept in CacheDir/.blocks.json,
+// outside the cache entries so purges do not lift them, and are spread
+// to the other replicas over the cluster bus.
+//
+// A zip-only block, e.g. for a license problem, refuses only the zip:
+// the .info and .mod stay available, with policyHeader naming the
+// restriction, so that the go command can still load the module graph
+// through the version and select around it.
+
+// versionBlock is one blocked module version.
+type versionBlock struct {
+	Module    string    `json:"module"` // escaped module path
+	Version   string    `json:"version"`
+	Advisory  string    `json:"advisory"`
+	BlockedBy string    `json:"blocked_by"`
+	BlockedAt time.Time `json:"blocked_at"`
+	ZipOnly   bool      `json:"zip_only,omitempty"`
+
+	// Lifted is set on bus events that remove a block.
+	Lifted bool `json:"lifted,omitempty"`
+}
+
+var (
+	blocksMu sync.Mutex
+	blocks   map[string]*versionBlock // keyed by module@version
+)
+
+func blocksPath() string {
+	return filepath.Join(CacheDir, ".blocks.json")
+}
+
+// loadBlocks reads the persisted blocks; it must be called once before
+// the server starts.
+func loadBlocks() error {
+	blocksMu.Lock()
+	defer blocksMu.Unlock()
+	blocks = make(map[string]*versionBlock)
+	data, err := os.ReadFile(blocksPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*versionBlock
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("%s: %v", blocksPath(), err)
+	}
+	for _, b := range list {
+		blocks[b.Module+"@"+b.Version] = b
+	}
+	return nil
+}
+
+// blockList returns the current blocks sorted by time. The caller must
+// hold blocksMu.
+func blockList() []*versionBlock {
+	list := make([]*versionBlock, 0, len(blocks))
+	for _, b := range blocks {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].BlockedAt.Before(list[j].BlockedAt) })
+	return list
+}
+
+// applyBlock adds or, if b.Lifted, removes a block and persists the
+// result.
+func applyBlock(b *versionBlock) error {
+	inv := invalidation{Module: b.Module, Version: b.Version}
+	if err := inv.check(); err != nil || b.Version == "" {
+		return fmt.Errorf("invalid block for %s", inv)
+	}
+
+	blocksMu.Lock()
+	defer blocksMu.Unlock()
+	key := b.Module + "@" + b.Version
+	if b.Lifted {
+		delete(blocks, key)
+	} else {
+		blocks[key] = b
+	}
+	data, err := json.MarshalIndent(blockList(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := blocksPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, blocksPath())
+}
+
+// blockOf returns the block of module@version, or nil.
+func blockOf(module, version string) *versionBlock {
+	blocksMu.Lock()
+	defer blocksMu.Unlock()
+	return blocks[module+"@"+version]
+}
+
+// policyHeader explains a restriction of the served version to
+// clients, e.g. "zip-blocked; advisory=\"...\"".
+const policyHeader = "X-Goproxy-Policy"
+
+// blocks reports whether b, which may be nil, refuses the ext file.
+func (b *versionBlock) blocks(ext string) bool {
+	return b != nil && (!b.ZipOnly || ext == "zip")
+}
+
+// policyNotice renders the policyHeader value for b.
+func (b *versionBlock) policyNotice() string {
+	kind := "blocked"
+	if b.ZipOnly {
+		kind = "zip-blocked"
+	}
+	return kind + "; advisory=" + strconv.Quote(headerSafe(b.Advisory))
+}
+
+// headerSafe replaces the characters a header value cannot carry.
+func headerSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// enforceBlocks is router middleware answering 410 for blocked versions.
+func enforceBlocks(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		b := blockOf(vars["module"], vars["version"])
+		if b == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set(policyHeader, b.policyNotice())
+		if !b.blocks(vars["ext"]) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		httpError(w, kindError{fmt.Sprintf("%s@%s has been blocked: %s", b.Module, b.Version, b.Advisory), errGone})
+	})
+}
+
+// listBlocks serves GET /admin/blocks.
+func listBlocks(w http.ResponseWriter, r *http.Request) {
+	blocksMu.Lock()
+	list := blockList()
+	blocksMu.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+// blockVersion serves POST /admin/blocks/{module}/@v/{version} with a
+// JSON body {"advisory": "...", "zip_only": false}, and DELETE on the
+// same path to lift the block. The change is applied locally, then
+// published on the cluster bus; as for purges, the response is 200 only
+// if every peer acknowledged.
+func blockVersion(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	b := &versionBlock{
+		Module:    vars["module"],
+		Version:   vars["version"],
+		BlockedBy: callerFrom(r.Context()).Identity,
+		BlockedAt: time.Now().UTC(),
+		Lifted:    r.Method == http.MethodDelete,
+	}
+	if !b.Lifted {
+		var req struct {
+			Advisory string `json:"advisory"`
+			ZipOnly  bool   `json:"zip_only"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Advisory == "" {
+			http.Error(w, `body must be {"advisory": "...", "zip_only": false}`, http.StatusBadRequest)
+			return
+		}
+		b.Advisory, b.ZipOnly = req.Advisory, req.ZipOnly
+	}
+
+	if err := applyBlock(b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	peers, err := publish(r.Context(), busEvent{Kind: eventBlock, Block: b})
+	if err != nil {
+		http.Error(w, "publishing block: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	status := http.StatusOK
+	for _, res := range peers {
+		if res != "ok" {
+			status = http.StatusBadGateway
+		}
+	}
+	if b.Lifted {
+		slog.InfoContext(r.Context(), "block lifted", "module", b.Module, "version", b.Version, "by", b.BlockedBy)
+	} else {
+		sendAlert("version-blocked", "module version blocked", map[string]string{
+			"module":   b.Module,
+			"version":  b.Version,
+			"advisory": b.Advisory,
+			"zip_only": strconv.FormatBool(b.ZipOnly),
+			"by":       b.BlockedBy,
+		})
+	}
+	writeJSON(w, status, map[string]any{"block": b, "peers": peers})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/module"
+)
+
+// A request for a module file passes through several stages: resolving
+// a query, listing versions, fetching from the backend with retries,
+// rewriting the artifacts and writing the response. Each has its own
+// limit, but together they could keep a client waiting far longer than
+// any one of them. requestBudget gives the request a single deadline,
+// the module's FetchPolicy.Budget, that every stage draws on: contexts
+// derived from the request carry it to HTTP calls and subprocesses,
+// fetch attempts and retry backoff stop when it runs out, and the
+// response must be written before it, or shortly after if the budget
+// ran out in an earlier stage, so the client still gets a 504.
+
+// budgetGrace is how long after the budget an error response may still
+// be written.
+const budgetGrace = 5 * time.Second
+
+// budgetContext returns ctx bounded by the budget of path.
+func budgetContext(ctx context.Context, path string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, fetchPolicyFor(path).Budget)
+}
+
+// requestBudget is middleware applying the module's budget to the
+// request context and the response's write deadline.
+func requestBudget(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := mux.Vars(r)["module"]
+		if p, err := module.UnescapePath(path); err == nil {
+			path = p
+		}
+		ctx, cancel := budgetContext(r.Context(), path)
+		defer cancel()
+		if deadline, ok := ctx.Deadline(); ok {
+			// Not every ResponseWriter supports it; the context still
+			// bounds the stages before the response is written.
+			http.NewResponseController(w).SetWriteDeadline(deadline.Add(budgetGrace))
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// detached returns a context with the deadline and values of ctx but
+// not its cancellation, for work shared with other requests that must
+// go on when this request's client goes away. It is still canceled when
+// a shutdown gives up on the work in flight (see baseCtx).
+func detached(ctx context.Context) (context.Context, context.CancelFunc) {
+	d := context.WithoutCancel(ctx)
+	var cancel context.CancelFunc
+	if deadline, ok := ctx.Deadline(); ok {
+		d, cancel = context.WithDeadline(d, deadline)
+	} else {
+		d, cancel = context.WithCancel(d)
+	}
+	stop := context.AfterFunc(baseCtx, cancel)
+	return d, func() {
+		stop()
+		cancel()
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/module"
+)
+
+// Clients tag requests with a build ID in this header. Every module
+// version served under an ID is appended to a per-build log under
+// CacheDir/.builds, from which /api/builds/{id} assembles the build's
+// dependency manifest, leaving out modules whose ACLs the caller does
+// not pass. Any client may send the header, so the logs are bounded:
+// a log stops growing at MaxEntries, at most MaxBuilds are kept, the
+// least recently written removed first, and logs not written for
+// KeepFor are swept every hour.
+const buildIDHeader = "X-Build-ID"
+
+var validBuildID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// BuildsConfig bounds the per-build logs.
+type BuildsConfig struct {
+	// KeepFor is how long a log is kept after it was last written
+	// (default 7 days).
+	KeepFor time.Duration `yaml:"keep_for"`
+
+	// MaxEntries caps the entries of one log (default 10000); files
+	// served to the build after that are not recorded.
+	MaxEntries int `yaml:"max_entries"`
+
+	// MaxBuilds caps the number of logs (default 1000).
+	MaxBuilds int `yaml:"max_builds"`
+}
+
+func checkBuilds(c BuildsConfig) error {
+	if c.KeepFor < 0 || c.MaxEntries < 0 || c.MaxBuilds < 0 {
+		return fmt.Errorf("builds: limits must not be negative")
+	}
+	return nil
+}
+
+func (c BuildsConfig) withDefaults() BuildsConfig {
+	if c.KeepFor == 0 {
+		c.KeepFor = 7 * 24 * time.Hour
+	}
+	if c.MaxEntries == 0 {
+		c.MaxEntries = 10000
+	}
+	if c.MaxBuilds == 0 {
+		c.MaxBuilds = 1000
+	}
+	return c
+}
+
+// buildLog is what is known of the log of a build without reading it.
+type buildLog struct {
+	entries  int // -1 until counted
+	modified time.Time
+}
+
+// builds indexes the logs under CacheDir/.builds, loaded on first use.
+var builds struct {
+	sync.Mutex
+	logs map[string]*buildLog // by build ID
+}
+
+// loadBuildLogs fills builds.logs from the directory if it is not yet
+// loaded. builds must be locked.
+func loadBuildLogs() {
+	if builds.logs != nil {
+		return
+	}
+	builds.logs = make(map[string]*buildLog)
+	files, _ := os.ReadDir(filepath.Join(CacheDir, ".builds"))
+	for _, f := range files {
+		id, ok := strings.CutSuffix(f.Name(), ".jsonl")
+		fi, err := f.Info()
+		if !ok || err != nil {
+			continue
+		}
+		builds.logs[id] = &buildLog{entries: -1, modified: fi.ModTime()}
+	}
+}
+
+// removeBuildLog removes the log of build id. builds must be locked.
+func removeBuildLog(id string) {
+	if err := os.Remove(buildLogPath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("removing build log", "build", id, "err", err)
+	}
+	delete(builds.logs, id)
+}
+
+// countEntries returns the number of lines of the log of build id.
+func countEntries(id string) int {
+	f, err := os.Open(buildLogPath(id))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	n := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		n++
+	}
+	return n
+}
+
+type buildEvent struct {
+	Module  string    `json:"module"`
+	Version string    `json:"version"`
+	File    string    `json:"file"` // info, mod or zip
+	Time    time.Time `json:"time"`
+}
+
+// BuildModule is one entry of a build manifest.
+type BuildModule struct {
+	Module      string    `json:"module"`
+	Version     string    `json:"version"`
+	Files       []string  `json:"files"`
+	FirstServed time.Time `json:"first_served"`
+}
+
+func buildLogPath(id string) string {
+	return filepath.Join(CacheDir, ".builds", id+".jsonl")
+}
+
+// recordBuild notes that file (info, mod or zip) of escaped module
+// path name at version was served to the build tagged on r, if any.
+func recordBuild(r *http.Request, name, version, file string) {
+	id := r.Header.Get(buildIDHeader)
+	if id == "" || !validBuildID.MatchString(id) {
+		return
+	}
+	path, err := module.UnescapePath(name)
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(buildEvent{Module: path, Version: version, File: file, Time: time.Now().UTC()})
+	if err != nil {
+		return
+	}
+
+	c := config.Builds.withDefaults()
+	builds.Lock()
+	defer builds.Unlock()
+	loadBuildLogs()
+	l := builds.logs[id]
+	if l == nil || time.Since(l.modified) > c.KeepFor {
+		if l != nil {
+			removeBuildLog(id)
+		}
+		for len(builds.logs) >= c.MaxBuilds {
+			removeBuildLog(oldestBuild())
+		}
+		l = &buildLog{}
+		builds.logs[id] = l
+	}
+	if l.entries < 0 {
+		l.entries = countEntries(id)
+	}
+	if l.entries >= c.MaxEntries {
+		return
+	}
+	l.entries++
+	l.modified = time.Now()
+
+	logPath := buildLogPath(id)
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		slog.ErrorContext(r.Context(), "build log", "err", err)
+		return
+	}
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "build log", "err", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		slog.ErrorContext(r.Context(), "build log", "err", err)
+	}
+}
+
+// oldestBuild returns the ID of the least recently written log. builds
+// must be locked and hold at least one.
+func oldestBuild() string {
+	var oldest string
+	var at time.Time
+	for id, l := range builds.logs {
+		if oldest == "" || l.modified.Before(at) {
+			oldest, at = id, l.modified
+		}
+	}
+	return oldest
+}
+
+// sweepBuilds removes the logs not written within keepFor.
+func sweepBuilds(keepFor time.Duration) {
+	builds.Lock()
+	defer builds.Unlock()
+	loadBuildLogs()
+	for id, l := range builds.logs {
+		if time.Since(l.modified) > keepFor {
+			removeBuildLog(id)
+		}
+	}
+}
+
+// startBuildSweep removes expired build logs every hour.
+func startBuildSweep() {
+	go func() {
+		for {
+			sweepBuilds(config.Builds.withDefaults().KeepFor)
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// buildManifest aggregates the log of build id into one entry per
+// module version, sorted by module path and version.
+func buildManifest(id string) ([]BuildModule, error) {
+	builds.Lock()
+	defer builds.Unlock()
+	loadBuildLogs()
+	if l := builds.logs[id]; l == nil || time.Since(l.modified) > config.Builds.withDefaults().KeepFor {
+		return nil, fs.ErrNotExist
+	}
+
+	f, err := os.Open(buildLogPath(id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	byKey := map[string]*BuildModule{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e buildEvent
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue
+		}
+		key := e.Module + "@" + e.Version
+		m := byKey[key]
+		if m == nil {
+			m = &BuildModule{Module: e.Module, Version: e.Version, FirstServed: e.Time}
+			byKey[key] = m
+		}
+		if !contains(m.Files, e.File) {
+			m.Files = append(m.Files, e.File)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	mods := make([]BuildModule, 0, len(byKey))
+	for _, m := range byKey {
+		sort.Strings(m.Files)
+		mods = append(mods, *m)
+	}
+	sort.Slice(mods, func(i, j int) bool {
+		if mods[i].Module != mods[j].Module {
+			return mods[i].Module < mods[j].Module
+		}
+		return mods[i].Version < mods[j].Version
+	})
+	return mods, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// getBuild serves GET /api/builds/{id}, without the modules the
+// caller's ACLs do not let it fetch. With ?format=text it returns one
+// "module version" line per entry instead of JSON.
+func getBuild(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !validBuildID.MatchString(id) {
+		http.Error(w, "invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	mods, err := buildManifest(id)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "unknown build "+id, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	allowed := mods[:0]
+	for _, m := range mods {
+		switch err := checkACL(r.Context(), m.Module); {
+		case errors.Is(err, errGroupsUnavailable):
+			http.Error(w, "group resolution unavailable", http.StatusServiceUnavailable)
+			return
+		case err == nil:
+			allowed = append(allowed, m)
+		}
+	}
+	mods = allowed
+
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		for _, m := range mods {
+			fmt.Fprintln(w, m.Module, m.Version)
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"build": id, "modules": mods})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// useBuildsDir points the build logs at a fresh directory for the test.
+func useBuildsDir(t *testing.T, c BuildsConfig) {
+	keepState(t)
+	CacheDir, config.Builds = t.TempDir(), c
+	builds.logs = nil
+	t.Cleanup(func() { builds.logs = nil })
+}
+
+func recordFor(id, module, version string) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(buildIDHeader, id)
+	recordBuild(r, module, version, "zip")
+}
+
+func TestBuildLogsBounded(t *testing.T) {
+	useBuildsDir(t, BuildsConfig{MaxEntries: 3, MaxBuilds: 2})
+	for _, v := range []string{"v1.0.0", "v1.0.1", "v1.0.2", "v1.0.3"} {
+		recordFor("a", "example.com/m", v)
+	}
+	mods, err := buildManifest("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mods) != 3 {
+		t.Errorf("build a has %d modules, want 3: %+v", len(mods), mods)
+	}
+
+	recordFor("b", "example.com/m", "v1.0.0")
+	recordFor("c", "example.com/m", "v1.0.0")
+	if _, err := buildManifest("a"); err == nil {
+		t.Error("least recently written build kept beyond max_builds")
+	}
+	if _, err := os.Stat(buildLogPath("a")); err == nil {
+		t.Error("log of the removed build left on disk")
+	}
+	for _, id := range []string{"b", "c"} {
+		if _, err := buildManifest(id); err != nil {
+			t.Errorf("build %s: %v", id, err)
+		}
+	}
+
+	// Logs of an earlier process are counted against the limits.
+	builds.logs = nil
+	for range 5 {
+		recordFor("c", "example.com/n", "v1.0.0")
+	}
+	if n := countEntries("c"); n != 3 {
+		t.Errorf("reloaded build c has %d entries, want 3", n)
+	}
+}
+
+func TestBuildLogsExpire(t *testing.T) {
+	useBuildsDir(t, BuildsConfig{KeepFor: time.Hour})
+	recordFor("old", "example.com/m", "v1.0.0")
+	recordFor("new", "example.com/m", "v1.0.0")
+	builds.logs["old"].modified = time.Now().Add(-2 * time.Hour)
+	if _, err := buildManifest("old"); err == nil {
+		t.Error("expired build served")
+	}
+	sweepBuilds(time.Hour)
+	if _, err := os.Stat(buildLogPath("old")); err == nil {
+		t.Error("expired log not swept")
+	}
+	if _, err := os.Stat(buildLogPath("new")); err != nil {
+		t.Errorf("current log swept: %v", err)
+	}
+}
+
+func TestGetBuildFiltersACL(t *testing.T) {
+	useBuildsDir(t, BuildsConfig{})
+	config.ACL = []ACLRule{{Prefix: "example.com/secret", Identities: []string{"alice"}}}
+	recordFor("ci-1", "example.com/public", "v1.0.0")
+	recordFor("ci-1", "example.com/secret", "v1.0.0")
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/builds/{id}", getBuild)
+	for _, tt := range []struct {
+		caller *caller
+		want   []string
+	}{
+		{anonymous, []string{"example.com/public"}},
+		{&caller{Identity: "bob"}, []string{"example.com/public"}},
+		{&caller{Identity: "alice"}, []string{"example.com/public", "example.com/secret"}},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/builds/ci-1", nil)
+		req = req.WithContext(context.WithValue(req.Context(), callerKey{}, tt.caller))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp struct{ Modules []BuildModule }
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v: %s", tt.caller.Identity, err, w.Body)
+		}
+		var got []string
+		for _, m := range resp.Modules {
+			got = append(got, m.Module)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s sees %v, want %v", tt.caller.Identity, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// An air-gapped proxy cannot fetch anything, so its cache is filled
+// from bundles: gzipped tarballs of cached versions, made by
+//
+//	goproxy bundle export -o bundle.tar.gz [-manifest file]... [module[@version]]...
+//
+// on a connected instance and loaded with
+//
+//	goproxy bundle import [-force] bundle.tar.gz
+//
+// on the other side. Both run with the environment and config file of
+// the proxy whose cache they read or fill. The bundle starts with
+// manifest.json, listing each version with the SHA-256 of its files and
+// the go.sum hash of its zip; the files follow under
+// <module>/@v/<version>/. An import checks every file against the
+// manifest and the zip against its hash before the version enters the
+// cache, then publishes it to the remote store, or quarantines it as a
+// fetch would.
+
+const bundleFormat = 1
+
+// bundleManifest is the first file of a bundle.
+type bundleManifest struct {
+	Format    int           `json:"format"`
+	CreatedAt time.Time     `json:"created_at"`
+	Namespace string        `json:"namespace"`
+	Versions  []bundleEntry `json:"versions"`
+}
+
+type bundleEntry struct {
+	Module  string            `json:"module"` // escaped module path
+	Version string            `json:"version"`
+	GoSum   string            `json:"gosum"`
+	Files   map[string]string `json:"files"` // SHA-256 by file name
+}
+
+// runBundle runs the bundle subcommand with args, reading the startup
+// settings with getenv.
+func runBundle(getenv func(string) string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: goproxy bundle export|import ...")
+	}
+	s, err := newServer(getenv)
+	if err != nil {
+		return err
+	}
+	if err := s.install(); err != nil {
+		return err
+	}
+	switch args[0] {
+	case "export":
+		return bundleExport(args[1:])
+	case "import":
+		return bundleImport(args[1:])
+	}
+	return fmt.Errorf("unknown bundle command %q", args[0])
+}
+
+// bundleExport writes the selected versions to a bundle. Selections
+// with a version are fetched if they are not cached; those without
+// name every cached version of the modules under a path.
+func bundleExport(args []string) (err error) {
+	fs := flag.NewFlagSet("bundle export", flag.ContinueOnError)
+	out := fs.String("o", "bundle.tar.gz", "bundle file to write")
+	var manifests []string
+	fs.Func("manifest", "go.sum, go.mod or module@version list naming more versions (repeatable)", func(v string) error {
+		manifests = append(manifests, v)
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	selected := fs.Args()
+	for _, file := range manifests {
+		entries, err := readWarmManifest(file)
+		if err != nil {
+			return err
+		}
+		for _, m := range entries {
+			if p, _, _ := strings.Cut(m, "@"); servesModule(p) {
+				selected = append(selected, m)
+			}
+		}
+	}
+	if len(selected) == 0 {
+		return fmt.Errorf("nothing selected")
+	}
+	versions, err := bundleSelect(context.Background(), selected)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(*out)
+		}
+	}()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	man := bundleManifest{Format: bundleFormat, CreatedAt: time.Now().UTC(), Namespace: cacheNS}
+	for _, e := range versions {
+		be := bundleEntry{Module: e.Module, Version: e.Version, Files: make(map[string]string)}
+		for _, name := range artifactFiles(e.Version) {
+			if be.Files[name], err = fileSHA256(filepath.Join(e.Dir, name)); err != nil {
+				return err
+			}
+		}
+		if be.GoSum, err = dirhash.HashZip(filepath.Join(e.Dir, "source.zip"), dirhash.Hash1); err != nil {
+			return err
+		}
+		man.Versions = append(man.Versions, be)
+	}
+	data, err := json.MarshalIndent(man, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tarWrite(tw, "manifest.json", data); err != nil {
+		return err
+	}
+	for _, e := range versions {
+		for _, name := range artifactFiles(e.Version) {
+			data, err := os.ReadFile(filepath.Join(e.Dir, name))
+			if err != nil {
+				return err
+			}
+			if err := tarWrite(tw, path.Join(e.Module, "@v", e.Version, name), data); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	slog.Info("bundle exported", "file", *out, "versions", len(versions))
+	return nil
+}
+
+// bundleSelect resolves the selections to cached versions, fetching
+// exact versions that are missing. Quarantined and blocked versions are
+// left out.
+func bundleSelect(ctx context.Context, selected []string) ([]cacheEntry, error) {
+	want := make(map[string]bool)
+	var prefixes []string
+	for _, s := range selected {
+		p, v, _ := strings.Cut(s, "@")
+		if err := checkWarmEntry(s); err != nil {
+			return nil, err
+		}
+		escaped, err := module.EscapePath(p)
+		if err != nil {
+			return nil, err
+		}
+		if v == "" || v == "latest" {
+			prefixes = append(prefixes, p)
+			continue
+		}
+		dir := entryDir(escaped, v)
+		for _, name := range []string{v + ".info", "go.mod", "source.zip"} {
+			if err := ensureCached(ctx, escaped, v, filepath.Join(dir, name)); err != nil {
+				return nil, fmt.Errorf("%s: %v", s, err)
+			}
+		}
+		want[escaped+"@"+v] = true
+	}
+
+	var out []cacheEntry
+	err := walkCache(func(e cacheEntry) error {
+		p, err := module.UnescapePath(e.Module)
+		if err != nil {
+			return nil
+		}
+		if !want[e.Module+"@"+e.Version] && !slices.ContainsFunc(prefixes, func(pre string) bool { return hasPathPrefix(p, pre) }) {
+			return nil
+		}
+		if isQuarantined(anonymous, e.Module, e.Version) || blockOf(e.Module, e.Version) != nil {
+			slog.Warn("bundle: leaving out quarantined or blocked version", "module", p, "version", e.Version)
+			return nil
+		}
+		if !validEntry(e.Module, e.Version) {
+			return nil
+		}
+		out = append(out, e)
+		return nil
+	})
+	return out, err
+}
+
+func tarWrite(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func fileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// bundleImport loads a bundle into the cache and the remote store.
+// Versions already cached are kept unless -force is given.
+func bundleImport(args []string) error {
+	fs := flag.NewFlagSet("bundle import", flag.ContinueOnError)
+	force := fs.Bool("force", false, "replace versions that are already cached")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: goproxy bundle import [-force] bundle.tar.gz")
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != "manifest.json" {
+		return fmt.Errorf("%s: not a bundle: manifest.json must come first", fs.Arg(0))
+	}
+	var man bundleManifest
+	if err := json.NewDecoder(io.LimitReader(tr, 64<<20)).Decode(&man); err != nil {
+		return fmt.Errorf("manifest.json: %v", err)
+	}
+	if man.Format != bundleFormat {
+		return fmt.Errorf("bundle format %d is not supported", man.Format)
+	}
+	if man.Namespace != cacheNS {
+		return fmt.Errorf("bundle holds %s artifacts, this proxy serves %s ones", man.Namespace, cacheNS)
+	}
+	expected := make(map[string]*bundleEntry)
+	for i := range man.Versions {
+		e := &man.Versions[i]
+		p, err := module.UnescapePath(e.Module)
+		if err != nil || module.CheckPath(p) != nil || !semver.IsValid(e.Version) || e.Version != semver.Canonical(e.Version) {
+			return fmt.Errorf("manifest.json: invalid version %s@%s", e.Module, e.Version)
+		}
+		expected[e.Module+"@"+e.Version] = e
+	}
+
+	staging, err := os.MkdirTemp(CacheDir, ".bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	// Files are checked as they are unpacked: each must be listed in the
+	// manifest with the hash it has.
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		dir, name := path.Split(hdr.Name)
+		mod, version, ok := strings.Cut(strings.TrimSuffix(dir, "/"), "/@v/")
+		e := expected[mod+"@"+version]
+		if !ok || e == nil || e.Files[name] == "" || hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("%s is not listed in the manifest", hdr.Name)
+		}
+		dest := filepath.Join(staging, filepath.FromSlash(mod), version, name)
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		out, err := os.Create(dest)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(out, h), tr)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != e.Files[name] {
+			return fmt.Errorf("%s: SHA-256 %s, manifest says %s", hdr.Name, got, e.Files[name])
+		}
+	}
+
+	imported, skipped := 0, 0
+	for _, e := range man.Versions {
+		src := filepath.Join(staging, filepath.FromSlash(e.Module), e.Version)
+		for name := range e.Files {
+			if _, err := os.Stat(filepath.Join(src, name)); err != nil {
+				return fmt.Errorf("%s@%s: %s is missing from the bundle", e.Module, e.Version, name)
+			}
+		}
+		if sum, err := dirhash.HashZip(filepath.Join(src, "source.zip"), dirhash.Hash1); err != nil || sum != e.GoSum {
+			return fmt.Errorf("%s@%s: zip does not match its go.sum hash %s", e.Module, e.Version, e.GoSum)
+		}
+		var prov provenance
+		data, err := os.ReadFile(filepath.Join(src, provenanceFile))
+		if err == nil {
+			err = json.Unmarshal(data, &prov)
+		}
+		if err != nil || prov.Namespace != cacheNS || prov.Module != e.Module || prov.Version != e.Version {
+			return fmt.Errorf("%s@%s: provenance does not match the manifest", e.Module, e.Version)
+		}
+		if validEntry(e.Module, e.Version) && !*force {
+			skipped++
+			continue
+		}
+		if err := importBundleEntry(e.Module, e.Version, src); err != nil {
+			return fmt.Errorf("%s@%s: %v", e.Module, e.Version, err)
+		}
+		imported++
+	}
+	slog.Info("bundle imported", "file", fs.Arg(0), "imported", imported, "already_cached", skipped)
+	return nil
+}
+
+// importBundleEntry moves a checked version from src into the cache and
+// publishes it as afterFetch would, but synchronously.
+func importBundleEntry(name, version, src string) error {
+	dest := entryDir(name, version)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	entries.forget(name, version)
+	forgetNegative(name, version)
+	if err := os.Rename(src, dest); err != nil {
+		return err
+	}
+	if quarantineApplies(name) {
+		if err := quarantineNew(name, version); err != nil {
+			return err
+		}
+		scanQuarantined(name, version)
+		return nil
+	}
+	if store == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	if err := store.Push(ctx, name, version, dest); err != nil {
+		return fmt.Errorf("pushing to the remote store: %v", err)
+	}
+	return nil
+}
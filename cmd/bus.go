@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// The cluster bus carries events that must reach every replica: cache
+// invalidations, changes of quarantine state and version blocks, which
+// are otherwise kept per instance. Two transports are available:
+//
+//   - "peers" posts each event to every configured peer and waits for
+//     their acknowledgement, so publishers learn which replicas applied
+//     it. This is what makes purges read-your-writes.
+//   - "redis" publishes to a Redis channel all replicas subscribe to.
+//     Delivery is fire-and-forget; the publisher only learns how many
+//     subscribers received the event.
+type clusterBus interface {
+	// Publish delivers e to the other replicas and reports the outcome
+	// per replica, where the transport can tell.
+	Publish(ctx context.Context, e busEvent) (map[string]string, error)
+}
+
+// Event kinds.
+const (
+	eventInvalidate  = "invalidate"
+	eventQuarantine  = "quarantine"
+	eventBlock       = "block"
+	eventMaintenance = "maintenance"
+)
+
+type busEvent struct {
+	Kind   string    `json:"kind"`
+	Origin string    `json:"origin"`
+	Time   time.Time `json:"time"`
+
+	Invalidation *invalidation     `json:"invalidation,omitempty"`
+	Quarantine   *quarantineRecord `json:"quarantine,omitempty"`
+	Block        *versionBlock     `json:"block,omitempty"`
+	Maintenance  *maintenanceState `json:"maintenance,omitempty"`
+}
+
+var (
+	bus clusterBus = noBus{}
+
+	// instanceID identifies this process on the bus.
+	instanceID = func() string {
+		host, _ := os.Hostname()
+		b := make([]byte, 4)
+		rand.Read(b)
+		return host + "-" + hex.EncodeToString(b)
+	}()
+)
+
+func newBus(cc ClusterConfig) (clusterBus, error) {
+	switch cc.Bus {
+	case "":
+		if len(cc.Peers) > 0 {
+			return &peerBus{cc}, nil
+		}
+		return noBus{}, nil
+	case "peers":
+		return &peerBus{cc}, nil
+	case "redis":
+		if cc.Redis.Addr == "" {
+			return nil, fmt.Errorf("cluster.redis.addr is required for the redis bus")
+		}
+		b := &redisBus{cfg: cc.Redis, channel: cc.Channel}
+		if b.channel == "" {
+			b.channel = "goproxy-events"
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown cluster bus %q", cc.Bus)
+	}
+}
+
+// startBus starts receiving the events of b, if it has to subscribe to
+// them. The peers bus receives them as requests instead.
+func startBus(b clusterBus) {
+	if b, ok := b.(*redisBus); ok {
+		go b.subscribe()
+	}
+}
+
+// publish stamps e and publishes it on the bus.
+func publish(ctx context.Context, e busEvent) (map[string]string, error) {
+	e.Origin = instanceID
+	e.Time = time.Now().UTC()
+	return bus.Publish(ctx, e)
+}
+
+// publishAsync publishes e in the background, logging failures.
+func publishAsync(e busEvent) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if _, err := publish(ctx, e); err != nil {
+			slog.Error("bus: publishing", "event", e.Kind, "err", err)
+		}
+	}()
+}
+
+// handleEvent applies an event received from another replica.
+func handleEvent(e busEvent) error {
+	if e.Origin == instanceID {
+		return nil
+	}
+	switch e.Kind {
+	case eventInvalidate:
+		if e.Invalidation == nil {
+			return fmt.Errorf("invalidate event without invalidation")
+		}
+		if err := e.Invalidation.check(); err != nil {
+			return err
+		}
+		return purgeLocal(*e.Invalidation)
+	case eventQuarantine:
+		if e.Quarantine == nil {
+			return fmt.Errorf("quarantine event without record")
+		}
+		return mergeQuarantine(e.Quarantine)
+	case eventBlock:
+		if e.Block == nil {
+			return fmt.Errorf("block event without block")
+		}
+		return applyBlock(e.Block)
+	case eventMaintenance:
+		if e.Maintenance == nil {
+			return fmt.Errorf("maintenance event without state")
+		}
+		return applyMaintenance(e.Maintenance)
+	default:
+		slog.Warn("bus: ignoring unknown event", "event", e.Kind, "origin", e.Origin)
+		return nil
+	}
+}
+
+// noBus is used by single-instance deployments.
+type noBus struct{}
+
+func (noBus) Publish(context.Context, busEvent) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+// peerBus fans events out to the configured peers over HTTP.
+type peerBus struct {
+	cc ClusterConfig
+}
+
+func (b *peerBus) Publish(ctx context.Context, e busEvent) (map[string]string, error) {
+	timeout := b.cc.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	results := map[string]string{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range b.cc.Peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			err := postPeer(ctx, peer, "/admin/cluster/events", body)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				slog.ErrorContext(ctx, "bus: publishing", "event", e.Kind, "peer", peer, "err", err)
+				results[peer] = err.Error()
+				return
+			}
+			results[peer] = "ok"
+		}(peer)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// clusterEvents serves POST /admin/cluster/events, the receiving end of
+// the peers bus.
+func clusterEvents(w http.ResponseWriter, r *http.Request) {
+	var e busEvent
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, "bad event", http.StatusBadRequest)
+		return
+	}
+	if err := handleEvent(e); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"applied": e.Kind})
+}
+
+// redisBus publishes events on a Redis pub/sub channel.
+type redisBus struct {
+	cfg     RedisConfig
+	channel string
+
+	mu   sync.Mutex
+	conn *redisConn // publishing connection, dialed lazily
+}
+
+func (b *redisBus) Publish(ctx context.Context, e busEvent) (map[string]string, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if b.conn == nil {
+			if b.conn, err = dialRedis(b.cfg); err != nil {
+				return nil, err
+			}
+		}
+		if d, ok := ctx.Deadline(); ok {
+			b.conn.conn.SetDeadline(d)
+		}
+		reply, err := b.conn.do("PUBLISH", b.channel, string(body))
+		if err == nil {
+			b.conn.conn.SetDeadline(time.Time{})
+			slog.DebugContext(ctx, "bus: published", "event", e.Kind, "subscribers", reply)
+			return map[string]string{"redis": "ok"}, nil
+		}
+		b.conn.Close()
+		b.conn = nil
+		if attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+// subscribe receives events until the process exits, reconnecting with
+// backoff when the connection drops.
+func (b *redisBus) subscribe() {
+	backoff := time.Second
+	for {
+		err := b.subscribeOnce()
+		slog.Warn("bus: redis subscription", "err", err, "retry_in", backoff)
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func (b *redisBus) subscribeOnce() error {
+	c, err := dialRedis(b.cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.send("SUBSCRIBE", b.channel); err != nil {
+		return err
+	}
+	for {
+		reply, err := c.receive()
+		if err != nil {
+			return err
+		}
+		msg, ok := reply.([]any)
+		if !ok || len(msg) != 3 || msg[0] != "message" {
+			continue // subscription confirmations
+		}
+		payload, _ := msg[2].(string)
+		var e busEvent
+		if err := json.Unmarshal([]byte(payload), &e); err != nil {
+			slog.Warn("bus: bad event", "err", err)
+			continue
+		}
+		if err := handleEvent(e); err != nil {
+			slog.Error("bus: applying", "event", e.Kind, "origin", e.Origin, "err", err)
+		}
+	}
+}
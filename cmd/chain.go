@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/gorilla/mux"
+)
+
+// The request checks are named middleware that the config may order
+// and select: the global chain runs for every route, and each module
+// root ("/" or a mount path) runs its own chain after it. A chain that
+// is not configured keeps the default below. The checks that make the
+// protocol work or that cannot be turned off (module path validation,
+// mount authentication, blocks and query resolution) always run after
+// the configured chain, as do tracing and metrics before it.
+
+// MiddlewareConfig configures the middleware chains.
+type MiddlewareConfig struct {
+	// Global runs for every route (default log, auth if require_auth
+	// is set, policy).
+	Global []string `yaml:"global"`
+
+	// Routes set the chains of module roots (default budget, acl,
+	// quota, priority).
+	Routes []RouteChain `yaml:"routes"`
+}
+
+// RouteChain is the middleware chain of the module root at Prefix.
+type RouteChain struct {
+	Prefix string   `yaml:"prefix"`
+	Chain  []string `yaml:"chain"`
+}
+
+// namedMiddleware are the middleware chains may list.
+var namedMiddleware = map[string]mux.MiddlewareFunc{
+	"log":      logRequests,   // access log line per request
+	"auth":     requireAuth,   // 401 for anonymous callers
+	"policy":   enforcePolicy, // external authorization (OPA)
+	"budget":   requestBudget, // per-request fetch deadline
+	"acl":      enforceACL,    // module ACLs
+	"quota":    enforceQuota,  // per-team quotas
+	"priority": prioritize,    // rate limits and bandwidth by class
+}
+
+var defaultRouteChain = []string{"budget", "acl", "quota", "priority"}
+
+func defaultGlobalChain() []string {
+	if config.RequireAuth {
+		return []string{"log", "auth", "policy"}
+	}
+	return []string{"log", "policy"}
+}
+
+// checkMiddleware validates the chains of c against mounts. A chain may
+// not leave out a check that c turns on elsewhere: auth under
+// require_auth or policy with a policy URL, which run for every route,
+// or acl when there are module ACLs and quota with download quotas,
+// which a route chain may leave to the global one.
+func checkMiddleware(c Config, mounts []*mount) error {
+	mc := c.Middleware
+	check := func(where string, chain []string) error {
+		for i, name := range chain {
+			if namedMiddleware[name] == nil {
+				return fmt.Errorf("middleware: %s: unknown middleware %q", where, name)
+			}
+			if slices.Contains(chain[:i], name) {
+				return fmt.Errorf("middleware: %s: %s is listed twice", where, name)
+			}
+		}
+		return nil
+	}
+	if err := check("global", mc.Global); err != nil {
+		return err
+	}
+	if c.RequireAuth && mc.Global != nil && !slices.Contains(mc.Global, "auth") {
+		return fmt.Errorf("middleware: global: require_auth is set but auth is not listed")
+	}
+	if c.Policy.URL != "" && mc.Global != nil && !slices.Contains(mc.Global, "policy") {
+		return fmt.Errorf("middleware: global: policy.url is set but policy is not listed")
+	}
+	seen := make(map[string]bool)
+	for _, rc := range mc.Routes {
+		if !isModuleRoot(rc.Prefix, mounts) {
+			return fmt.Errorf("middleware: %s is neither / nor a mount path", rc.Prefix)
+		}
+		if seen[rc.Prefix] {
+			return fmt.Errorf("middleware: %s is configured twice", rc.Prefix)
+		}
+		seen[rc.Prefix] = true
+		if err := check(rc.Prefix, rc.Chain); err != nil {
+			return err
+		}
+		if len(c.ACL) > 0 && !slices.Contains(rc.Chain, "acl") && !slices.Contains(mc.Global, "acl") {
+			return fmt.Errorf("middleware: %s: acl rules are configured but acl is not listed", rc.Prefix)
+		}
+		if hasQuotas(c.SCIM) && !slices.Contains(rc.Chain, "quota") && !slices.Contains(mc.Global, "quota") {
+			return fmt.Errorf("middleware: %s: scim download quotas are configured but quota is not listed", rc.Prefix)
+		}
+	}
+	return nil
+}
+
+// isModuleRoot reports whether prefix is the root or the path of one
+// of mounts.
+func isModuleRoot(prefix string, mounts []*mount) bool {
+	if prefix == "/" {
+		return true
+	}
+	for _, m := range mounts {
+		if m.Path == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+func middlewareOf(names []string) []mux.MiddlewareFunc {
+	mw := make([]mux.MiddlewareFunc, len(names))
+	for i, name := range names {
+		mw[i] = namedMiddleware[name]
+	}
+	return mw
+}
+
+// globalChain returns the middleware run for every route.
+func globalChain() []mux.MiddlewareFunc {
+	if config.Middleware.Global != nil {
+		return middlewareOf(config.Middleware.Global)
+	}
+	return middlewareOf(defaultGlobalChain())
+}
+
+// routeChain returns the middleware of the module root at prefix.
+func routeChain(prefix string) []mux.MiddlewareFunc {
+	for _, rc := range config.Middleware.Routes {
+		if rc.Prefix == prefix {
+			return middlewareOf(rc.Chain)
+		}
+	}
+	return middlewareOf(defaultRouteChain)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckMiddleware(t *testing.T) {
+	mounts := []*mount{{MountConfig: MountConfig{Path: "/team"}}}
+	acl := []ACLRule{{Prefix: "example.com/secret", Identities: []string{"alice"}}}
+	policy := PolicyConfig{URL: "http://opa:8181/v1/data/goproxy/allow"}
+	quotas := SCIMConfig{Teams: []TeamMapping{{Team: "ci", DailyDownloads: 100}}}
+	for _, tt := range []struct {
+		name string
+		c    Config
+		err  string // substring of the error, "" if accepted
+	}{
+		{"defaults", Config{RequireAuth: true, ACL: acl, Policy: policy, SCIM: quotas}, ""},
+		{"unknown", Config{Middleware: MiddlewareConfig{Global: []string{"log", "cors"}}}, `unknown middleware "cors"`},
+		{"twice", Config{Middleware: MiddlewareConfig{Global: []string{"log", "log"}}}, "listed twice"},
+		{"unknown prefix", Config{Middleware: MiddlewareConfig{Routes: []RouteChain{{Prefix: "/other", Chain: []string{}}}}}, "neither / nor a mount path"},
+		{"prefix twice", Config{Middleware: MiddlewareConfig{Routes: []RouteChain{{Prefix: "/", Chain: []string{}}, {Prefix: "/", Chain: []string{}}}}}, "configured twice"},
+
+		{"auth dropped", Config{RequireAuth: true, Middleware: MiddlewareConfig{Global: []string{"log", "policy"}}}, "auth is not listed"},
+		{"auth kept", Config{RequireAuth: true, Middleware: MiddlewareConfig{Global: []string{"auth"}}}, ""},
+
+		{"policy dropped", Config{Policy: policy, Middleware: MiddlewareConfig{Global: []string{"log"}}}, "policy is not listed"},
+		{"policy dropped, none configured", Config{Middleware: MiddlewareConfig{Global: []string{"log"}}}, ""},
+		{"policy kept", Config{Policy: policy, Middleware: MiddlewareConfig{Global: []string{"policy", "log"}}}, ""},
+
+		{"acl dropped", Config{ACL: acl, Middleware: MiddlewareConfig{Routes: []RouteChain{{Prefix: "/", Chain: []string{"budget"}}}}}, "/: acl rules are configured"},
+		{"acl dropped on a mount", Config{ACL: acl, Middleware: MiddlewareConfig{Routes: []RouteChain{{Prefix: "/team", Chain: []string{}}}}}, "/team: acl rules"},
+		{"acl in global", Config{ACL: acl, Middleware: MiddlewareConfig{Global: []string{"acl"}, Routes: []RouteChain{{Prefix: "/", Chain: []string{}}}}}, ""},
+
+		{"quota dropped", Config{SCIM: quotas, Middleware: MiddlewareConfig{Routes: []RouteChain{{Prefix: "/", Chain: []string{"budget", "acl"}}}}}, "/: scim download quotas"},
+		{"quota dropped, no limits", Config{SCIM: SCIMConfig{Teams: []TeamMapping{{Team: "ci"}}}, Middleware: MiddlewareConfig{Routes: []RouteChain{{Prefix: "/", Chain: []string{}}}}}, ""},
+		{"quota in global", Config{SCIM: quotas, Middleware: MiddlewareConfig{Global: []string{"quota"}, Routes: []RouteChain{{Prefix: "/team", Chain: []string{}}}}}, ""},
+	} {
+		err := checkMiddleware(tt.c, mounts)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got %v, want an error containing %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// TestBuildRoutingChecksMiddleware checks that the routing tables built
+// at startup and on reload reject a chain that drops a configured check.
+func TestBuildRoutingChecksMiddleware(t *testing.T) {
+	rm := repoMapping{Src: "example.com", Dest: "git.example.com/org"}
+	c := Config{Policy: PolicyConfig{URL: "http://opa:8181/v1/data/goproxy/allow"}, Middleware: MiddlewareConfig{Global: []string{"log"}}}
+	if _, err := buildRouting(c, rm, missingBackend{rm}); err == nil || !strings.Contains(err.Error(), "policy is not listed") {
+		t.Errorf("buildRouting = %v, want the policy chain rejected", err)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// Rewritten modules can never be verified by sum.golang.org, whose
+// hashes are of the upstream artifacts. The proxy can therefore run its
+// own checksum database: a transparent log, signed with a note key,
+// of the go.sum lines of the versions it serves, served under
+// /sumdb/<name>/ like a proxied database. Clients set GOSUMDB to its
+// verifier key and regain verification: a version whose content
+// changes after it was first looked up fails to verify, as it would
+// with sum.golang.org.
+//
+// A version is added to the log on its first lookup, with the hashes
+// of the zip and go.mod this proxy serves. Only versions the proxy
+// serves to every caller are added, since the log, tiles included, is
+// readable by anyone who may read one record; other modules are not
+// found, and clients keep them in GONOSUMDB or GOPRIVATE.
+//
+// The log lives in CacheDir/.checksumdb and has a single writer: in a
+// cluster, one replica runs the database and the others proxy it
+// through sumdb.databases.
+
+// ChecksumDBConfig configures the private checksum database.
+type ChecksumDBConfig struct {
+	// Name is the database name, e.g. sum.goproxy.example.com. A key
+	// is generated for it at first start if KeyFile does not exist.
+	Name string `yaml:"name"`
+
+	// KeyFile holds the note signer key (default
+	// <CACHE_DIR>/.checksumdb/signer.key).
+	KeyFile string `yaml:"key_file"`
+}
+
+func (cc ChecksumDBConfig) enabled() bool { return cc.Name != "" || cc.KeyFile != "" }
+
+// checksumDB is the private checksum database, or nil.
+var checksumDB *privateSumDB
+
+// privateSumDB implements sumdb.ServerOps on an append-only file of
+// records, kept in memory with the stored hashes of the tree.
+type privateSumDB struct {
+	name     string
+	signer   note.Signer
+	verifier string // verifier key of signer
+	file     string
+
+	mu      sync.Mutex
+	records [][]byte
+	hashes  memHashes
+	lookup  map[string]int64 // by module@version
+	signed  []byte           // signed tree head of len(records)
+	pending map[string]chan struct{}
+}
+
+// memHashes is a tlog.HashReader over the stored hashes.
+type memHashes []tlog.Hash
+
+func (h memHashes) ReadHashes(indexes []int64) ([]tlog.Hash, error) {
+	out := make([]tlog.Hash, len(indexes))
+	for i, idx := range indexes {
+		if idx < 0 || idx >= int64(len(h)) {
+			return nil, fmt.Errorf("hash %d: %w", idx, fs.ErrNotExist)
+		}
+		out[i] = h[idx]
+	}
+	return out, nil
+}
+
+// setupChecksumDB loads or creates the signer key and loads the log.
+func setupChecksumDB(cc ChecksumDBConfig) error {
+	checksumDB = nil
+	if !cc.enabled() {
+		return nil
+	}
+	dir := filepath.Join(CacheDir, ".checksumdb")
+	keyFile := cc.KeyFile
+	if keyFile == "" {
+		keyFile = filepath.Join(dir, "signer.key")
+	}
+	skey, err := os.ReadFile(keyFile)
+	if errors.Is(err, fs.ErrNotExist) && cc.Name != "" {
+		skey, err = generateSumDBKey(keyFile, cc.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("checksum_db: %v", err)
+	}
+	signer, err := note.NewSigner(strings.TrimSpace(string(skey)))
+	if err != nil {
+		return fmt.Errorf("checksum_db: %s: %v", keyFile, err)
+	}
+	if cc.Name != "" && signer.Name() != cc.Name {
+		return fmt.Errorf("checksum_db: %s is the key of %s, not %s", keyFile, signer.Name(), cc.Name)
+	}
+	if sumDBURL(signer.Name()) != "" {
+		return fmt.Errorf("checksum_db: %s is also listed in sumdb.databases", signer.Name())
+	}
+	vkey, err := verifierKey(strings.TrimSpace(string(skey)))
+	if err != nil {
+		return fmt.Errorf("checksum_db: %s: %v", keyFile, err)
+	}
+
+	db := &privateSumDB{
+		name:     signer.Name(),
+		signer:   signer,
+		verifier: vkey,
+		file:     filepath.Join(dir, signer.Name(), "records"),
+		lookup:   make(map[string]int64),
+		pending:  make(map[string]chan struct{}),
+	}
+	if err := db.load(); err != nil {
+		return fmt.Errorf("checksum_db: %v", err)
+	}
+	checksumDB = db
+	slog.Info("checksum database", "name", db.name, "records", len(db.records), "verifier_key", vkey)
+	return nil
+}
+
+// generateSumDBKey creates a signer key for name in file.
+func generateSumDBKey(file, name string) ([]byte, error) {
+	skey, vkey, err := note.GenerateKey(rand.Reader, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintln(f, skey); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	slog.Warn("checksum database: generated a new signer key; back it up, losing it invalidates the database", "file", file, "verifier_key", vkey)
+	return []byte(skey), nil
+}
+
+// verifierKey derives the verifier key of an Ed25519 signer key,
+// PRIVATE+KEY+<name>+<hash>+<base64 of 0x01 and the seed>.
+func verifierKey(skey string) (string, error) {
+	f := strings.SplitN(skey, "+", 5)
+	if len(f) != 5 || f[0] != "PRIVATE" || f[1] != "KEY" {
+		return "", fmt.Errorf("malformed signer key")
+	}
+	key, err := base64.StdEncoding.DecodeString(f[4])
+	if err != nil || len(key) != 1+ed25519.SeedSize || key[0] != 1 {
+		return "", fmt.Errorf("malformed signer key")
+	}
+	pub := ed25519.NewKeyFromSeed(key[1:]).Public().(ed25519.PublicKey)
+	return note.NewEd25519VerifierKey(f[2], pub)
+}
+
+// The records file holds each record as its length in decimal, a
+// newline and the record.
+
+// load reads the records file and rebuilds the tree. A record cut short
+// by a crash is dropped.
+func (db *privateSumDB) load() error {
+	if err := os.MkdirAll(filepath.Dir(db.file), 0755); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(db.file)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	r := bufio.NewReader(bytes.NewReader(data))
+	var good int64
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		n, perr := strconv.Atoi(strings.TrimSuffix(line, "\n"))
+		rec := make([]byte, max(n, 0))
+		if err != nil || perr != nil || n <= 0 {
+			err = fmt.Errorf("malformed length %q", line)
+		} else {
+			_, err = io.ReadFull(r, rec)
+		}
+		if err != nil {
+			slog.Warn("checksum database: dropping the incomplete end of the records file", "file", db.file, "offset", good, "err", err)
+			if err := os.Truncate(db.file, good); err != nil {
+				return err
+			}
+			break
+		}
+		if err := db.add(rec); err != nil {
+			return err
+		}
+		good += int64(len(line) + n)
+	}
+	return db.sign()
+}
+
+// add appends rec to the in-memory tree. db.mu must be held, or db not
+// yet published.
+func (db *privateSumDB) add(rec []byte) error {
+	path, version, ok := recordKey(rec)
+	if !ok {
+		return fmt.Errorf("record %d is malformed", len(db.records))
+	}
+	id := int64(len(db.records))
+	hashes, err := tlog.StoredHashes(id, rec, db.hashes)
+	if err != nil {
+		return err
+	}
+	db.records = append(db.records, rec)
+	db.hashes = append(db.hashes, hashes...)
+	db.lookup[path+"@"+version] = id
+	return nil
+}
+
+// recordKey returns the module and version of a record, from its first
+// go.sum line.
+func recordKey(rec []byte) (string, string, bool) {
+	line, _, _ := bytes.Cut(rec, []byte("\n"))
+	f := strings.Fields(string(line))
+	if len(f) != 3 {
+		return "", "", false
+	}
+	return f[0], strings.TrimSuffix(f[1], "/go.mod"), true
+}
+
+// sign signs the head of the tree. db.mu must be held.
+func (db *privateSumDB) sign() error {
+	n := int64(len(db.records))
+	h, err := tlog.TreeHash(n, db.hashes)
+	if err != nil {
+		return err
+	}
+	signed, err := note.Sign(&note.Note{Text: string(tlog.FormatTree(tlog.Tree{N: n, Hash: h}))}, db.signer)
+	if err != nil {
+		return err
+	}
+	db.signed = signed
+	return nil
+}
+
+// appendRecord writes rec to the records file and adds it to the tree,
+// returning its id.
+func (db *privateSumDB) appendRecord(rec []byte) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	f, err := os.OpenFile(db.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	_, err = fmt.Fprintf(f, "%d\n%s", len(rec), rec)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("writing checksum database record: %v", err)
+	}
+	if err := db.add(rec); err != nil {
+		return 0, err
+	}
+	if err := db.sign(); err != nil {
+		return 0, err
+	}
+	return int64(len(db.records)) - 1, nil
+}
+
+func (db *privateSumDB) Signed(ctx context.Context) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.signed, nil
+}
+
+func (db *privateSumDB) ReadRecords(ctx context.Context, id, n int64) ([][]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if id < 0 || n < 0 || id+n > int64(len(db.records)) {
+		return nil, fmt.Errorf("records %d-%d: %w", id, id+n-1, fs.ErrNotExist)
+	}
+	return slices.Clone(db.records[id : id+n]), nil
+}
+
+func (db *privateSumDB) ReadTileData(ctx context.Context, t tlog.Tile) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return tlog.ReadTileData(t, db.hashes)
+}
+
+// Lookup returns the record of m, adding it on first lookup. Concurrent
+// first lookups of a version wait for one of them.
+func (db *privateSumDB) Lookup(ctx context.Context, m module.Version) (int64, error) {
+	key := m.Path + "@" + m.Version
+	for {
+		db.mu.Lock()
+		id, ok := db.lookup[key]
+		wait, busy := db.pending[key]
+		if !ok && !busy {
+			db.pending[key] = make(chan struct{})
+		}
+		db.mu.Unlock()
+		if ok {
+			return id, nil
+		}
+		if !busy {
+			break
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	defer func() {
+		db.mu.Lock()
+		close(db.pending[key])
+		delete(db.pending, key)
+		db.mu.Unlock()
+	}()
+
+	rec, err := db.newRecord(ctx, m)
+	if err != nil {
+		slog.InfoContext(ctx, "checksum database: lookup failed", "module", m.Path, "version", m.Version, "err", err)
+		if permanent(err) {
+			// The go command reports a missing record as not found.
+			return 0, &fs.PathError{Op: "lookup", Path: key, Err: fs.ErrNotExist}
+		}
+		return 0, err
+	}
+	return db.appendRecord(rec)
+}
+
+// newRecord returns the go.sum lines of m, computed from the artifacts
+// this proxy serves.
+func (db *privateSumDB) newRecord(ctx context.Context, m module.Version) ([]byte, error) {
+	if !servesModule(m.Path) {
+		return nil, kindError{fmt.Sprintf("%s is not served by this proxy", m.Path), errNotFound}
+	}
+	if aclFor(m.Path) != nil {
+		return nil, kindError{fmt.Sprintf("%s is restricted by an ACL", m.Path), errNotFound}
+	}
+
+	// Records are permanent and shared by every client, so they are
+	// only added for generally available versions.
+	escaped, err := module.EscapePath(m.Path)
+	if err != nil {
+		return nil, kindError{err.Error(), errNotFound}
+	}
+	if isQuarantined(anonymous, escaped, m.Version) {
+		return nil, kindError{fmt.Sprintf("%s@%s is quarantined pending review", m.Path, m.Version), errNotFound}
+	}
+	zipHash, err := goSumHash(ctx, m.Path, m.Version, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	modHash, err := goSumHash(ctx, m.Path, m.Version, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%s %s %s\n%s %s/go.mod %s\n", m.Path, m.Version, zipHash, m.Path, m.Version, modHash)), nil
+}
+
+// serveChecksumDB serves the private database's endpoints; path is the
+// request path below /sumdb/<name>.
+func serveChecksumDB(w http.ResponseWriter, r *http.Request, path string) {
+	r2 := r.Clone(r.Context())
+	r2.URL.Path, r2.URL.RawPath = "/"+path, ""
+	w.Header().Set("Cache-Control", "no-cache")
+	if strings.HasPrefix(path, "tile/") && !strings.Contains(path, ".p/") {
+		w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+	}
+	sumdb.NewServer(checksumDB).ServeHTTP(w, r2)
+}
+
+// getChecksumDB serves GET /api/checksumdb: what a client needs to use
+// the private checksum database.
+func getChecksumDB(w http.ResponseWriter, r *http.Request) {
+	if checksumDB == nil {
+		http.Error(w, "no checksum database is configured", http.StatusNotFound)
+		return
+	}
+	db := checksumDB
+	db.mu.Lock()
+	n := len(db.records)
+	db.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"name":         db.name,
+		"verifier_key": db.verifier,
+		"records":      n,
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// With --tls-client-ca, clients such as CI runners in a service mesh can
+// authenticate with a certificate instead of a token. The caller's
+// identity is taken from the verified certificate, so ACLs, groups and
+// the access log apply to it as to a token's identity. A token or
+// signed URL presented as well takes precedence.
+
+// ClientCertConfig maps client certificates to callers.
+type ClientCertConfig struct {
+	// IdentityFrom selects the certificate field used as the identity:
+	// "cn" (subject common name, the default), "uri" (the first URI
+	// SAN, e.g. a SPIFFE ID), "dns" or "email" (the first such SAN).
+	IdentityFrom string `yaml:"identity_from"`
+
+	// Scopes grants scopes to certificate identities.
+	Scopes map[string][]string `yaml:"scopes"`
+}
+
+// checkClientCerts validates the client certificate configuration.
+func checkClientCerts(cc ClientCertConfig) error {
+	switch cc.IdentityFrom {
+	case "", "cn", "uri", "dns", "email":
+		return nil
+	}
+	return fmt.Errorf("client_certs: identity_from: unknown field %q", cc.IdentityFrom)
+}
+
+// certIdentity returns the identity of cert as selected by from, or ""
+// if the certificate lacks that field.
+func certIdentity(cert *x509.Certificate, from string) string {
+	switch from {
+	case "uri":
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	default:
+		return strings.TrimSpace(cert.Subject.CommonName)
+	}
+	return ""
+}
+
+// certCaller returns the caller of a request authenticated with a
+// verified client certificate, or nil.
+func certCaller(r *http.Request) *caller {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cc := config.ClientCerts
+	id := certIdentity(r.TLS.VerifiedChains[0][0], cc.IdentityFrom)
+	if id == "" || id == anonymous.Identity {
+		return nil
+	}
+	return &caller{Identity: id, Scopes: cc.Scopes[id]}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// A version evicted from the local cache is one rarely downloaded, and
+// the remote store then holds its only copy on this instance. With
+// storage.compress set to "zstd", the sweeper demotes the versions it
+// evicts to cold storage: it recompresses their zip and go.mod blobs in
+// the store, <version>.zip becoming <version>.zip.zst. The compressed
+// blob is written before the plain one is deleted, so the version is
+// complete in the store throughout, and a blob that does not shrink is
+// left as it is. The compressed blob records the digest of the plain
+// one. Pulls take either form, decompress on the fly up to the
+// max_zip_bytes of the module and check that digest, so replicas with
+// or without the setting share the store.
+
+// compressedSuffix ends the key of a blob demoted to cold storage.
+const compressedSuffix = ".zst"
+
+// compressible are the files of a version recompressed on demotion.
+var compressible = []string{"go.mod", "source.zip"}
+
+// A storeDemoter is a remoteStore that can move a stored version to
+// cold storage.
+type storeDemoter interface {
+	Demote(ctx context.Context, name, version string) (saved int64, err error)
+}
+
+func checkCompress(sc StorageConfig) error {
+	switch {
+	case sc.Compress == "":
+	case sc.Compress != "zstd":
+		return fmt.Errorf("storage.compress must be zstd, not %q", sc.Compress)
+	case sc.Type == "" || sc.Type == "oci":
+		return fmt.Errorf("storage.compress needs an s3, gcs or disk store")
+	}
+	return nil
+}
+
+// Demote recompresses the blobs of name@version and returns the bytes
+// saved.
+func (s blobRemote) Demote(ctx context.Context, name, version string) (int64, error) {
+	if _, err := s.blobs.Stat(ctx, blobKey(name, version, provenanceFile)); err != nil {
+		return 0, err
+	}
+	var saved int64
+	for _, file := range compressible {
+		n, err := s.compress(ctx, blobKey(name, version, file))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return saved, fmt.Errorf("%s@%s: %s: %w", name, version, file, err)
+		}
+		saved += n
+	}
+	return saved, nil
+}
+
+// compress replaces the blob at key by its compressed form, unless that
+// is no smaller. It returns an error wrapping os.ErrNotExist if the
+// blob is compressed already.
+func (s blobRemote) compress(ctx context.Context, key string) (int64, error) {
+	body, info, err := s.blobs.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	tmp, err := os.CreateTemp("", "demote-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	plain, compressed := sha256.New(), sha256.New()
+	zw, err := zstd.NewWriter(io.MultiWriter(tmp, compressed), zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	if err != nil {
+		return 0, err
+	}
+	size, err := copyBuffered(zw, io.TeeReader(body, plain))
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	// The plain blob is deleted below: make sure it was read intact.
+	if got := hex.EncodeToString(plain.Sum(nil)); info.SHA256 != "" && got != info.SHA256 {
+		return 0, fmt.Errorf("digest mismatch (got sha256:%s, stored sha256:%s)", got, info.SHA256)
+	}
+	zsize, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if zsize >= size {
+		return 0, nil
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	zinfo := blobInfo{Size: zsize, SHA256: hex.EncodeToString(compressed.Sum(nil)), PlainSHA256: hex.EncodeToString(plain.Sum(nil))}
+	if err := s.blobs.Put(ctx, key+compressedSuffix, tmp, zinfo); err != nil {
+		return 0, err
+	}
+	if err := s.blobs.Delete(ctx, key); err != nil {
+		return 0, err
+	}
+	return size - zsize, nil
+}
+
+// decompress writes the decompressed blob read from r, of at most limit
+// bytes, to w. It reads r to its end, for the digest of the compressed
+// blob to cover all of it.
+func decompress(w io.Writer, r io.Reader, limit int64) error {
+	zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(limit)))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	lw := &limitedWriter{w: w, n: limit}
+	if _, err := copyBuffered(lw, zr); err != nil {
+		if lw.exceeded || errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+			return fmt.Errorf("%w (> %d bytes decompressed)", errTooLarge, limit)
+		}
+		return err
+	}
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+// demoteEvicted demotes the evicted versions, given as module@version,
+// in the background.
+func demoteEvicted(evicted []string) {
+	sd, ok := store.(storeDemoter)
+	if !ok || config.Storage.Compress == "" || len(evicted) == 0 {
+		return
+	}
+	go func() {
+		for _, key := range evicted {
+			i := strings.LastIndex(key, "@")
+			name, version := key[:i], key[i+1:]
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+			saved, err := sd.Demote(ctx, name, version)
+			cancel()
+			switch {
+			case errors.Is(err, os.ErrNotExist):
+				// Never pushed, e.g. quarantined.
+			case err != nil:
+				slog.Error("store demote", "module", name, "version", version, "err", err)
+			default:
+				eviction.Lock()
+				eviction.stats.Demotions++
+				eviction.stats.DemotionSavedBytes += saved
+				eviction.Unlock()
+				slog.Info("store demote", "module", name, "version", version, "saved_bytes", saved)
+			}
+		}
+	}()
+}
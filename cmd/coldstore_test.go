@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDemoteAndPull(t *testing.T) {
+	const name, version = "example.com/m", "v1.0.0"
+	dir := writeTestEntry(t, name, version)
+	zip := bytes.Repeat([]byte("compressible "), 1<<12)
+	if err := os.WriteFile(filepath.Join(dir, "source.zip"), zip, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeProvenance(name, version); err != nil {
+		t.Fatal(err)
+	}
+	blobs := diskBlobs{root: t.TempDir()}
+	s := blobRemote{blobs: blobs}
+	ctx := context.Background()
+	if err := s.Push(ctx, name, version, dir); err != nil {
+		t.Fatal(err)
+	}
+	before, err := s.Stat(ctx, name, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := s.Demote(ctx, name, version)
+	if err != nil || saved <= 0 {
+		t.Fatalf("Demote = %d, %v", saved, err)
+	}
+	zkey := blobKey(name, version, "source.zip") + compressedSuffix
+	if _, err := blobs.Stat(ctx, zkey); err != nil {
+		t.Fatalf("no compressed zip: %v", err)
+	}
+	after, err := s.Stat(ctx, name, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after["source.zip"] == "" || after["source.zip"] != before["source.zip"] {
+		t.Errorf("digest of the demoted zip = %q, want %q", after["source.zip"], before["source.zip"])
+	}
+
+	dest := t.TempDir()
+	if err := s.Pull(ctx, name, version, dest); err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dest, "source.zip")); !bytes.Equal(got, zip) {
+		t.Error("pulled zip differs")
+	}
+
+	if err := s.pull(ctx, blobKey(name, version, "source.zip"), filepath.Join(dest, "source.zip"), 1<<10); !errors.Is(err, errTooLarge) {
+		t.Errorf("pull beyond the limit: %v, want too large", err)
+	}
+}
+
+func TestPullChecksPlainDigest(t *testing.T) {
+	blobs := &plainDigestBlobs{diskBlobs{root: t.TempDir()}, strings.Repeat("0", 64)}
+	s := blobRemote{blobs: blobs}
+	ctx := context.Background()
+	const key = "ns/example.com/m/@v/v1.0.0.zip"
+	src := filepath.Join(t.TempDir(), "zip")
+	if err := os.WriteFile(src, bytes.Repeat([]byte("x"), 1<<12), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.push(ctx, src, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.compress(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	err := s.pull(ctx, key, filepath.Join(t.TempDir(), "zip"), 1<<20)
+	if err == nil || !strings.Contains(err.Error(), "after decompressing") {
+		t.Errorf("pull of a blob whose content differs: %v", err)
+	}
+}
+
+// plainDigestBlobs reports a fixed digest of the decompressed content.
+type plainDigestBlobs struct {
+	diskBlobs
+	plain string
+}
+
+func (b *plainDigestBlobs) Get(ctx context.Context, key string) (_ io.ReadCloser, info blobInfo, err error) {
+	body, info, err := b.diskBlobs.Get(ctx, key)
+	if strings.HasSuffix(key, compressedSuffix) {
+		info.PlainSHA256 = b.plain
+	}
+	return body, info, err
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// The go command sends queries such as @main or @<commit> as requests
+// for /@v/<query>.info and expects the canonical version in return:
+// the tag at that commit, or else a pseudo-version derived from the
+// closest tag below it. Resolving a query needs the commit graph of the
+// repository, so the git backend keeps a bare, treeless clone of each
+// repository under CacheDir/.graphs holding just commits and refs. It
+// is fetched again at most once per CommitGraphConfig.TTL, or when a
+// query names a commit it does not know yet.
+
+// CommitGraphConfig configures the commit graphs used to resolve
+// version queries.
+type CommitGraphConfig struct {
+	// TTL is how long a graph is used before it is fetched again
+	// (default 1m).
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// A resolver maps version queries such as branch names and commit
+// hashes to canonical versions.
+type resolver interface {
+	Resolve(ctx context.Context, path, query string) (string, error)
+}
+
+type commitGraph struct {
+	mu      sync.Mutex
+	dir     string
+	fetched time.Time
+}
+
+var commitGraphs = struct {
+	sync.Mutex
+	m map[string]*commitGraph
+}{m: make(map[string]*commitGraph)}
+
+func commitGraphOf(repoURL string) *commitGraph {
+	commitGraphs.Lock()
+	defer commitGraphs.Unlock()
+	g, ok := commitGraphs.m[repoURL]
+	if !ok {
+		g = &commitGraph{dir: filepath.Join(CacheDir, ".graphs", repoURL+".git")}
+		commitGraphs.m[repoURL] = g
+	}
+	return g
+}
+
+var errUnknownRevision = kindError{"unknown revision", errNotFound}
+
+// gitAuthEnv passes token to git in a header instead of the URL, so it
+// is never written to the graph's config. Configuration already passed
+// in GIT_CONFIG_* variables is kept.
+func gitAuthEnv(token string) []string {
+	n, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+	return append(os.Environ(),
+		"GIT_TERMINAL_PROMPT=0",
+		fmt.Sprintf("GIT_CONFIG_COUNT=%d", n+1),
+		fmt.Sprintf("GIT_CONFIG_KEY_%d=http.extraHeader", n),
+		fmt.Sprintf("GIT_CONFIG_VALUE_%d=Authorization: Basic %s", n, base64.StdEncoding.EncodeToString([]byte(user+":"+token))),
+	)
+}
+
+// git runs git in the graph.
+func (g *commitGraph) git(ctx context.Context, token string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = g.dir
+	cmd.Env = gitAuthEnv(token)
+	out, err := runOutput(ctx, cmd)
+	if err != nil {
+		err = fmt.Errorf("git %s: %w", args[0], gitError(err))
+	}
+	return strings.TrimSpace(string(out)), err
+}
+
+// update clones or fetches the graph unless it was fetched within the
+// TTL. force fetches regardless. g.mu must be held.
+func (g *commitGraph) update(ctx context.Context, m repoMapping, repoURL string, force bool) error {
+	ttl := config.CommitGraph.TTL
+	if ttl == 0 {
+		ttl = time.Minute
+	}
+	if !force && time.Since(g.fetched) < ttl {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(g.dir, "HEAD")); err != nil {
+		if err := os.MkdirAll(filepath.Dir(g.dir), 0755); err != nil {
+			return err
+		}
+		os.RemoveAll(g.dir)
+		cmd := exec.CommandContext(ctx, "git", "clone", "--bare", "--quiet", "--filter=tree:0", "https://"+repoURL, g.dir)
+		cmd.Env = gitAuthEnv(m.Token)
+		if _, err := runOutput(ctx, cmd); err != nil {
+			os.RemoveAll(g.dir)
+			return fmt.Errorf("git clone: %w", gitError(err))
+		}
+		if _, err := g.git(ctx, m.Token, "config", "remote.origin.fetch", "+refs/heads/*:refs/heads/*"); err != nil {
+			return err
+		}
+	} else if _, err := g.git(ctx, m.Token, "fetch", "--quiet", "--prune", "--tags", "origin"); err != nil {
+		return err
+	}
+	g.fetched = time.Now()
+	return nil
+}
+
+// commit returns the full hash of the commit rev names, fetching the
+// graph once more if rev is unknown.
+func (g *commitGraph) commit(ctx context.Context, m repoMapping, repoURL, rev string) (string, error) {
+	if rev == "" || strings.HasPrefix(rev, "-") {
+		return "", fmt.Errorf("invalid revision %q: %w", rev, errNotFound)
+	}
+	before := g.fetched
+	if err := g.update(ctx, m, repoURL, false); err != nil {
+		return "", err
+	}
+	hash, err := g.git(ctx, m.Token, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err != nil && g.fetched.Equal(before) {
+		if err := g.update(ctx, m, repoURL, true); err != nil {
+			return "", err
+		}
+		hash, err = g.git(ctx, m.Token, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %w %s", repoURL, errUnknownRevision, rev)
+	}
+	return hash, nil
+}
+
+// Resolve returns the canonical version of path at query: the highest
+// tag on the resolved commit, or a pseudo-version based on the highest
+// tag reachable from it. Only the tags that list also takes as the
+// module's versions are considered; see tagVersion.
+func (b gitBackend) Resolve(ctx context.Context, path, query string) (string, error) {
+	repoURL, err := b.repoURL(path)
+	if err != nil {
+		return "", err
+	}
+	g := commitGraphOf(repoURL)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	hash, err := g.commit(ctx, b.repoMapping, repoURL, query)
+	if err != nil {
+		return "", err
+	}
+
+	_, pathMajor, _ := module.SplitPathVersion(path)
+	major := strings.TrimPrefix(pathMajor, "/")
+	highest := func(tags string) string {
+		best := ""
+		for _, t := range strings.Fields(tags) {
+			v, ok := b.tagVersion(path, t)
+			if !ok {
+				continue
+			}
+			if best == "" || semver.Compare(v, best) > 0 {
+				best = v
+			}
+		}
+		return best
+	}
+
+	tags, err := g.git(ctx, b.Token, "tag", "--points-at", hash)
+	if err != nil {
+		return "", err
+	}
+	if v := highest(tags); v != "" {
+		return v, nil
+	}
+	if tags, err = g.git(ctx, b.Token, "tag", "--merged", hash); err != nil {
+		return "", err
+	}
+	ct, err := g.git(ctx, b.Token, "log", "-1", "--format=%ct", hash)
+	if err != nil {
+		return "", err
+	}
+	sec, err := strconv.ParseInt(ct, 10, 64)
+	if err != nil {
+		return "", err
+	}
+	return module.PseudoVersion(major, highest(tags), time.Unix(sec, 0), hash[:12]), nil
+}
+
+// commitOf returns the full commit hash of a pseudo-version.
+func (b gitBackend) commitOf(ctx context.Context, name, version string) (string, error) {
+	rev, err := module.PseudoVersionRev(version)
+	if err != nil {
+		return "", err
+	}
+	repoURL, err := b.repoURL(name)
+	if err != nil {
+		return "", err
+	}
+	g := commitGraphOf(repoURL)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.commit(ctx, b.repoMapping, repoURL, rev)
+}
+
+// resolveQueries is middleware redirecting .info requests for a
+// non-canonical version, such as a semantic version query, a branch
+// name or a commit hash, to the canonical version it resolves to, so
+// every check keyed by version applies to the version actually served.
+func resolveQueries(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		query := vars["version"]
+		if vars["ext"] != "info" || query == "" || (semver.IsValid(query) && query == semver.Canonical(query)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path, err := module.UnescapePath(vars["module"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), fetchPolicyFor(path).Timeout)
+		defer cancel()
+		var version string
+		if q, ok := parseSemverQuery(query); ok {
+			version, err = resolveSemverQuery(ctx, r, vars["module"], query, q)
+		} else if res, ok := upstreamFor(path).(resolver); ok {
+			version, err = res.Resolve(ctx, path, query)
+		} else {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "resolving query", "module", path, "query", query, "err", err)
+			httpError(w, fmt.Errorf("%s@%s: %w", path, query, err))
+			return
+		}
+		u := *r.URL
+		u.Path = strings.TrimSuffix(r.URL.Path, query+".info") + version + ".info"
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, u.String(), http.StatusFound)
+	})
+}
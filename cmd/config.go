@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the optional settings loaded from the YAML file named by
+// the CONFIG_FILE environment variable. Every field has a usable zero
+// value, so the proxy runs without a config file at all.
+type Config struct {
+	// Listen, CacheDir, SrcRepo, DestRepo, RepoToken and RepoUser are
+	// the startup settings, overridden by their environment variables
+	// and flags. See settings.
+	Listen    string `yaml:"listen"`
+	CacheDir  string `yaml:"cache_dir"`
+	SrcRepo   string `yaml:"src_repo"`
+	DestRepo  string `yaml:"dest_repo"`
+	RepoToken string `yaml:"repo_token"`
+	RepoUser  string `yaml:"repo_user"`
+
+	// Backend selects where module versions are resolved from.
+	Backend BackendConfig `yaml:"backend"`
+
+	// Mappings map further module path prefixes to their repositories.
+	Mappings []MappingConfig `yaml:"mappings"`
+
+	// DualStack also serves the modules under SRC_REPO by their paths
+	// under DEST_REPO, as MappingConfig.DualStack does for a mapping.
+	DualStack bool `yaml:"dual_stack"`
+
+	// Mounts serve the module endpoints under additional roots.
+	Mounts []MountConfig `yaml:"mounts"`
+
+	// Workspace publishes modules from a local go.work or go.mod.
+	Workspace WorkspaceConfig `yaml:"workspace"`
+
+	// Rewrite configures the repackaging of rewritten zips.
+	Rewrite RewriteConfig `yaml:"rewrite"`
+
+	// Storage selects shared storage behind the local cache.
+	Storage StorageConfig `yaml:"storage"`
+
+	// Cluster lists the peer replicas of this instance.
+	Cluster ClusterConfig `yaml:"cluster"`
+
+	// Fetch is the default fetch policy applied to every module.
+	Fetch FetchPolicy `yaml:"fetch"`
+
+	// Modules lists per-prefix overrides of the default fetch policy.
+	// The longest matching prefix wins.
+	Modules []ModuleOverride `yaml:"modules"`
+
+	// ListCache configures caching of version lists.
+	ListCache ListCacheConfig `yaml:"list_cache"`
+
+	// UnknownModuleList selects the /@v/list answer for modules whose
+	// repository does not exist: "not_found" (default) or "empty".
+	UnknownModuleList string `yaml:"unknown_module_list"`
+
+	// ResponseCache configures caching of version files by clients.
+	ResponseCache ResponseCacheConfig `yaml:"response_cache"`
+
+	// NotFound configures caching of 404 and 410 answers.
+	NotFound NotFoundConfig `yaml:"not_found"`
+
+	// CommitGraph configures resolution of branch and commit queries.
+	CommitGraph CommitGraphConfig `yaml:"commit_graph"`
+
+	// Ownership gates the first mirror of a new module path.
+	Ownership OwnershipConfig `yaml:"ownership"`
+
+	// PrivatePrefixes are module path prefixes that must never be
+	// resolved from a public upstream. See guardPrivate.
+	PrivatePrefixes []string `yaml:"private_prefixes"`
+
+	// Honeytokens are decoy module path prefixes; any request for them
+	// raises a high-priority alert.
+	Honeytokens []string `yaml:"honeytokens"`
+
+	Alerts AlertsConfig `yaml:"alerts"`
+
+	// Sanitize redacts error responses.
+	Sanitize SanitizeConfig `yaml:"sanitize"`
+
+	// Notice is the support notice appended to client-visible errors.
+	Notice NoticeConfig `yaml:"notice"`
+
+	// Hardening enables stricter server defaults. See harden.
+	Hardening bool `yaml:"hardening"`
+
+	// ShutdownTimeout bounds the drain on SIGTERM or SIGINT (default
+	// 30s).
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// Tokens are the credentials accepted from clients.
+	Tokens []TokenConfig `yaml:"tokens"`
+
+	// TokensFile names a YAML file with more tokens, in the format of
+	// Tokens, reloaded when it changes.
+	TokensFile string `yaml:"tokens_file"`
+
+	// RequireAuth rejects requests without a known token or a valid
+	// URL signature with 401, except for the health probes.
+	RequireAuth bool `yaml:"require_auth"`
+
+	// OIDC accepts JWTs issued by an identity provider as tokens.
+	OIDC OIDCConfig `yaml:"oidc"`
+
+	// ClientCerts maps verified TLS client certificates to callers.
+	ClientCerts ClientCertConfig `yaml:"client_certs"`
+
+	// Middleware orders and selects the request checks.
+	Middleware MiddlewareConfig `yaml:"middleware"`
+
+	// ACL restricts module prefixes to identities and directory groups.
+	ACL []ACLRule `yaml:"acl"`
+
+	// LDAP resolves the groups referenced by ACL rules.
+	LDAP LDAPConfig `yaml:"ldap"`
+
+	// SCIM syncs teams from the identity provider into ACL rules.
+	SCIM SCIMConfig `yaml:"scim"`
+
+	// SignedURLs enables credential-less, time-limited download links.
+	SignedURLs SignedURLConfig `yaml:"signed_urls"`
+
+	// Policy delegates authorization to an external policy engine.
+	Policy PolicyConfig `yaml:"policy"`
+
+	Quarantine QuarantineConfig `yaml:"quarantine"`
+	Approvals  ApprovalsConfig  `yaml:"approvals"`
+
+	// SumDB configures the checksum databases proxied under /sumdb.
+	SumDB SumDBConfig `yaml:"sumdb"`
+
+	// ChecksumDB runs a checksum database of the versions this proxy
+	// serves.
+	ChecksumDB ChecksumDBConfig `yaml:"checksum_db"`
+
+	// Toolchain sets the go toolchain the host must provide.
+	Toolchain ToolchainConfig `yaml:"toolchain"`
+
+	// Verify configures the periodic re-verification of cached versions
+	// against their upstream.
+	Verify VerifyConfig `yaml:"verify"`
+
+	// HideVersions hides versions matching patterns from version
+	// lists and @latest.
+	HideVersions []HideRule `yaml:"hide_versions"`
+
+	// Renames redirect renamed module paths to their new ones.
+	Renames []RenameRule `yaml:"renames"`
+
+	// Tracing configures the export of OpenTelemetry traces.
+	Tracing TracingConfig `yaml:"tracing"`
+
+	// Log configures the level and format of the log.
+	Log LogConfig `yaml:"log"`
+
+	// Health configures the readiness checks of /readyz.
+	Health HealthConfig `yaml:"health"`
+
+	// Warm lists the modules cached at startup.
+	Warm WarmConfig `yaml:"warm"`
+
+	// Setup configures the client setup endpoint, /setup.
+	Setup SetupConfig `yaml:"setup"`
+
+	// Hooks configures the repository webhooks that prefetch pushed
+	// tags.
+	Hooks HooksConfig `yaml:"hooks"`
+
+	// Maintenance configures maintenance mode, in which the cache is
+	// served but not filled.
+	Maintenance MaintenanceConfig `yaml:"maintenance"`
+
+	// Priority configures the serving priority classes of tokens.
+	Priority PriorityConfig `yaml:"priority"`
+
+	// MaxSubprocesses bounds the git, go and scanner subprocesses
+	// running at once (default four per CPU).
+	MaxSubprocesses int `yaml:"max_subprocesses"`
+
+	// Eviction caps the size of the local cache.
+	Eviction EvictionConfig `yaml:"eviction"`
+
+	// Builds bounds the per-build logs of X-Build-ID.
+	Builds BuildsConfig `yaml:"builds"`
+
+	// Usage configures the periodic stale-module report.
+	Usage UsageConfig `yaml:"usage_report"`
+
+	// OwnerReports configures the periodic reports to module owners.
+	OwnerReports OwnerReportsConfig `yaml:"owner_reports"`
+
+	// Metrics configures the opt-in per-prefix metrics.
+	Metrics MetricsConfig `yaml:"metrics"`
+
+	// Telemetry configures the opt-in aggregate usage reports.
+	Telemetry TelemetryConfig `yaml:"telemetry"`
+}
+
+// FetchPolicy bounds the work done when a module version is fetched
+// from the destination repository. Zero fields mean "inherit".
+type FetchPolicy struct {
+	Timeout      time.Duration `yaml:"timeout"`
+	MaxZipBytes  int64         `yaml:"max_zip_bytes"`
+	Retries      int           `yaml:"retries"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+
+	// ListTimeout bounds listing the module's versions upstream.
+	ListTimeout time.Duration `yaml:"list_timeout"`
+
+	// Budget bounds a whole client request for the module, across
+	// every stage. See requestBudget. It defaults to the time the
+	// fetch attempts and backoffs alone may take.
+	Budget time.Duration `yaml:"budget"`
+}
+
+// ModuleOverride applies a FetchPolicy to all modules under Prefix.
+type ModuleOverride struct {
+	Prefix      string `yaml:"prefix"`
+	FetchPolicy `yaml:",inline"`
+}
+
+var defaultFetchPolicy = FetchPolicy{
+	Timeout:      5 * time.Minute,
+	MaxZipBytes:  500 << 20, // same limit the go command enforces
+	Retries:      0,
+	RetryBackoff: time.Second,
+	ListTimeout:  time.Minute,
+}
+
+var config Config
+
+// configFile is the path of the config file, if any.
+var configFile string
+
+// loadConfig reads and validates the config file at path.
+func loadConfig(path string) (Config, error) {
+	if path == "" {
+		return Config{}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	return parseConfig(path, data)
+}
+
+// parseConfig parses and validates data, the config file at path.
+func parseConfig(path string, data []byte) (Config, error) {
+	var c Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && err != io.EOF {
+		return c, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	switch c.Usage.Action {
+	case "", "flag", "evict":
+	default:
+		return c, fmt.Errorf("%s: usage_report.action must be flag or evict", path)
+	}
+
+	for i, m := range c.Modules {
+		if m.Prefix == "" {
+			return c, fmt.Errorf("%s: modules[%d]: prefix is required", path, i)
+		}
+	}
+	for i, a := range c.ACL {
+		if a.Prefix == "" {
+			return c, fmt.Errorf("%s: acl[%d]: prefix is required", path, i)
+		}
+		if len(a.Groups) > 0 && c.LDAP.URL == "" && c.SCIM.URL == "" {
+			return c, fmt.Errorf("%s: acl[%d]: groups require ldap.url or scim.url", path, i)
+		}
+	}
+	for i, t := range c.SCIM.Teams {
+		if t.Team == "" {
+			return c, fmt.Errorf("%s: scim.teams[%d]: team is required", path, i)
+		}
+	}
+	return c, nil
+}
+
+// merge returns p with every zero field replaced by the value from base.
+func (p FetchPolicy) merge(base FetchPolicy) FetchPolicy {
+	if p.Timeout == 0 {
+		p.Timeout = base.Timeout
+	}
+	if p.MaxZipBytes == 0 {
+		p.MaxZipBytes = base.MaxZipBytes
+	}
+	if p.Retries == 0 {
+		p.Retries = base.Retries
+	}
+	if p.RetryBackoff == 0 {
+		p.RetryBackoff = base.RetryBackoff
+	}
+	if p.ListTimeout == 0 {
+		p.ListTimeout = base.ListTimeout
+	}
+	if p.Budget == 0 {
+		p.Budget = base.Budget
+	}
+	return p
+}
+
+// fetchPolicyFor returns the effective fetch policy for module: the
+// longest matching per-prefix override, then the global fetch section,
+// then the built-in defaults.
+func fetchPolicyFor(module string) FetchPolicy {
+	var best *ModuleOverride
+	for i := range config.Modules {
+		m := &config.Modules[i]
+		if !hasPathPrefix(module, m.Prefix) {
+			continue
+		}
+		if best == nil || len(m.Prefix) > len(best.Prefix) {
+			best = m
+		}
+	}
+
+	p := config.Fetch.merge(defaultFetchPolicy)
+	if best != nil {
+		p = best.FetchPolicy.merge(p)
+	}
+	if p.Budget == 0 {
+		p.Budget = time.Duration(p.Retries+1)*p.Timeout + time.Duration(p.Retries)*p.RetryBackoff
+	}
+	return p
+}
+
+// hasPathPrefix reports whether the slash-separated path s begins with
+// the element-wise prefix.
+func hasPathPrefix(s, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(s, prefix) {
+		return false
+	}
+	return len(s) == len(prefix) || s[len(prefix)] == '/'
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// indexEntry describes one cached version in a metadata index.
+type indexEntry struct {
+	Module  string           `json:"module"`
+	Version string           `json:"version"`
+	Sizes   map[string]int64 `json:"sizes"`
+	Origin  *Origin          `json:"origin,omitempty"`
+}
+
+func (e indexEntry) key() string { return e.Module + "@" + e.Version }
+
+// localIndex lists the cached versions of this instance.
+func localIndex() ([]indexEntry, error) {
+	var index []indexEntry
+	err := walkCache(func(e cacheEntry) error {
+		ie := indexEntry{Module: e.Module, Version: e.Version, Sizes: map[string]int64{}}
+		if p, err := readProvenance(e.Module, e.Version); err == nil {
+			ie.Origin = p.Origin
+		}
+		for _, f := range artifactFiles(e.Version) {
+			if fi, err := os.Stat(filepath.Join(e.Dir, f)); err == nil {
+				ie.Sizes[f] = fi.Size()
+			}
+		}
+		index = append(index, ie)
+		return nil
+	})
+	sort.Slice(index, func(i, j int) bool { return index[i].key() < index[j].key() })
+	return index, err
+}
+
+// localHashes returns the SHA-256 of each artifact file of name@version.
+func localHashes(name, version string) (map[string]string, error) {
+	hashes := map[string]string{}
+	for _, f := range artifactFiles(version) {
+		fh, err := os.Open(filepath.Join(entryDir(name, version), f))
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		_, err = copyBuffered(h, fh)
+		fh.Close()
+		if err != nil {
+			return nil, err
+		}
+		hashes[f] = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	}
+	return hashes, nil
+}
+
+// getIndex serves GET /admin/index, the metadata index of this instance.
+func getIndex(w http.ResponseWriter, r *http.Request) {
+	index, err := localIndex()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"namespace": cacheNS, "entries": index})
+}
+
+// getHashes serves GET /admin/index/hashes?module=&version=.
+func getHashes(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name, version := q.Get("module"), q.Get("version")
+	// Both end up in a file path: only a valid module path and a
+	// canonical version may.
+	path, err := module.UnescapePath(name)
+	if err == nil {
+		err = module.Check(path, version)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hashes, err := localHashes(name, version)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "not cached", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, hashes)
+}
+
+// A storeStater is a remoteStore that can report the digests of a
+// stored version without downloading it.
+type storeStater interface {
+	Stat(ctx context.Context, name, version string) (map[string]string, error)
+}
+
+// ConsistencyRequest is the body of POST /admin/consistency. Exactly one
+// of Peer (base URL of another instance) or Store (the configured
+// remote store) selects what to compare against.
+type ConsistencyRequest struct {
+	Peer      string `json:"peer"`
+	PeerToken string `json:"peer_token"`
+	Store     bool   `json:"store"`
+	// Sample is the number of versions present on both sides whose
+	// hashes are compared. 0 compares sizes only; -1 compares all.
+	Sample int `json:"sample"`
+}
+
+// Divergence is one difference found by the consistency checker.
+type Divergence struct {
+	Module  string `json:"module"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"` // missing_local, missing_remote, size_mismatch, hash_mismatch, error
+	Detail  string `json:"detail,omitempty"`
+}
+
+// ConsistencyReport is the result of a consistency check.
+type ConsistencyReport struct {
+	Against     string       `json:"against"`
+	CheckedAt   time.Time    `json:"checked_at"`
+	Local       int          `json:"local"`
+	Remote      int          `json:"remote,omitempty"`
+	Sampled     int          `json:"sampled"`
+	Divergences []Divergence `json:"divergences"`
+}
+
+// postConsistency serves POST /admin/consistency.
+func postConsistency(w http.ResponseWriter, r *http.Request) {
+	var req ConsistencyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		rep *ConsistencyReport
+		err error
+	)
+	switch {
+	case req.Peer != "" && !req.Store:
+		rep, err = checkPeer(r.Context(), req)
+	case req.Store && req.Peer == "":
+		if store == nil {
+			http.Error(w, "no remote store configured", http.StatusBadRequest)
+			return
+		}
+		rep, err = checkStore(r.Context(), req)
+	default:
+		http.Error(w, "specify exactly one of peer or store", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// peerGet fetches an admin endpoint of a peer instance into v.
+func peerGet(ctx context.Context, req ConsistencyRequest, path string, v any) error {
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(req.Peer, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	if req.PeerToken != "" {
+		hreq.Header.Set("Authorization", "Bearer "+req.PeerToken)
+	}
+	resp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func checkPeer(ctx context.Context, req ConsistencyRequest) (*ConsistencyReport, error) {
+	local, err := localIndex()
+	if err != nil {
+		return nil, err
+	}
+	var remote struct {
+		Namespace string       `json:"namespace"`
+		Entries   []indexEntry `json:"entries"`
+	}
+	if err := peerGet(ctx, req, "/admin/index", &remote); err != nil {
+		return nil, err
+	}
+	if remote.Namespace != cacheNS {
+		return nil, fmt.Errorf("peer serves namespace %q, this instance %q", remote.Namespace, cacheNS)
+	}
+
+	rep := &ConsistencyReport{Against: req.Peer, CheckedAt: time.Now().UTC(), Local: len(local), Remote: len(remote.Entries), Divergences: []Divergence{}}
+	remoteByKey := map[string]indexEntry{}
+	for _, e := range remote.Entries {
+		remoteByKey[e.key()] = e
+	}
+
+	var common []indexEntry
+	for _, e := range local {
+		re, ok := remoteByKey[e.key()]
+		delete(remoteByKey, e.key())
+		if !ok {
+			rep.Divergences = append(rep.Divergences, Divergence{Module: e.Module, Version: e.Version, Kind: "missing_remote"})
+			continue
+		}
+		if d := diffSizes(e.Sizes, re.Sizes); d != "" {
+			rep.Divergences = append(rep.Divergences, Divergence{Module: e.Module, Version: e.Version, Kind: "size_mismatch", Detail: d})
+			continue
+		}
+		common = append(common, e)
+	}
+	for _, e := range remoteByKey {
+		rep.Divergences = append(rep.Divergences, Divergence{Module: e.Module, Version: e.Version, Kind: "missing_local"})
+	}
+
+	for _, e := range sample(common, req.Sample) {
+		rep.Sampled++
+		var theirs map[string]string
+		q := url.Values{"module": {e.Module}, "version": {e.Version}}
+		if err := peerGet(ctx, req, "/admin/index/hashes?"+q.Encode(), &theirs); err != nil {
+			rep.Divergences = append(rep.Divergences, Divergence{Module: e.Module, Version: e.Version, Kind: "error", Detail: err.Error()})
+			continue
+		}
+		rep.compareHashes(e, theirs)
+	}
+	sortDivergences(rep.Divergences)
+	return rep, nil
+}
+
+func checkStore(ctx context.Context, req ConsistencyRequest) (*ConsistencyReport, error) {
+	st, ok := store.(storeStater)
+	if !ok {
+		return nil, fmt.Errorf("remote store does not support consistency checks")
+	}
+	local, err := localIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	rep := &ConsistencyReport{Against: "store", CheckedAt: time.Now().UTC(), Local: len(local), Divergences: []Divergence{}}
+	sampled := map[string]bool{}
+	for _, e := range sample(local, req.Sample) {
+		sampled[e.key()] = true
+	}
+	for _, e := range local {
+		if q, _ := readQuarantine(e.Module, e.Version); q != nil && q.State == stateQuarantined {
+			continue // not pushed until released
+		}
+		theirs, err := st.Stat(ctx, e.Module, e.Version)
+		if errors.Is(err, os.ErrNotExist) {
+			rep.Divergences = append(rep.Divergences, Divergence{Module: e.Module, Version: e.Version, Kind: "missing_remote"})
+			continue
+		}
+		if err != nil {
+			rep.Divergences = append(rep.Divergences, Divergence{Module: e.Module, Version: e.Version, Kind: "error", Detail: err.Error()})
+			continue
+		}
+		if sampled[e.key()] {
+			rep.Sampled++
+			rep.compareHashes(e, theirs)
+		}
+	}
+	sortDivergences(rep.Divergences)
+	return rep, nil
+}
+
+func (rep *ConsistencyReport) compareHashes(e indexEntry, theirs map[string]string) {
+	ours, err := localHashes(e.Module, e.Version)
+	if err != nil {
+		rep.Divergences = append(rep.Divergences, Divergence{Module: e.Module, Version: e.Version, Kind: "error", Detail: err.Error()})
+		return
+	}
+	var bad []string
+	for f, h := range ours {
+		if f == provenanceFile {
+			continue // records local fetch time, differs legitimately
+		}
+		// The store has no digest of files demoted before it
+		// recorded the digest of their decompressed content.
+		if t, ok := theirs[f]; ok && t != h {
+			bad = append(bad, f)
+		}
+	}
+	if len(bad) > 0 {
+		sort.Strings(bad)
+		rep.Divergences = append(rep.Divergences, Divergence{Module: e.Module, Version: e.Version, Kind: "hash_mismatch", Detail: strings.Join(bad, ",")})
+	}
+}
+
+func diffSizes(a, b map[string]int64) string {
+	var bad []string
+	for f, n := range a {
+		if f != provenanceFile && b[f] != n {
+			bad = append(bad, f)
+		}
+	}
+	sort.Strings(bad)
+	return strings.Join(bad, ",")
+}
+
+// sample returns n randomly chosen entries, or all of them if n < 0.
+func sample(entries []indexEntry, n int) []indexEntry {
+	if n < 0 || n >= len(entries) {
+		return entries
+	}
+	picked := append([]indexEntry(nil), entries...)
+	rand.Shuffle(len(picked), func(i, j int) { picked[i], picked[j] = picked[j], picked[i] })
+	return picked[:n]
+}
+
+func sortDivergences(ds []Divergence) {
+	sort.Slice(ds, func(i, j int) bool {
+		if ds[i].Module != ds[j].Module {
+			return ds[i].Module < ds[j].Module
+		}
+		return ds[i].Version < ds[j].Version
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+// dirBackend serves modules from source checkouts on the local
+// filesystem, for teams that release by copying source rather than by
+// tagging. A module path under SRC_REPO (or the mount's src_repo) maps
+// to the directory of the same relative path below Dir. Its versions
+// are either
+//
+//   - listed in a versions.json manifest in that directory, each naming
+//     the snapshot directory (relative to the module directory) and
+//     optionally the release time:
+//
+//     [{"version": "v1.2.0", "dir": "releases/1.2.0", "time": "2024-05-01T00:00:00Z"}]
+//
+//   - or, without a manifest, its subdirectories named by a canonical
+//     semantic version, released at their modification time.
+//
+// Zips are built with the same rules the go command applies, so files
+// it would ignore (nested modules, vendor directories, VCS metadata)
+// are left out and invalid trees are rejected.
+type dirBackend struct {
+	root string
+	src  string
+}
+
+const dirManifest = "versions.json"
+
+// dirVersion is one entry of a versions.json manifest.
+type dirVersion struct {
+	Version string    `json:"version"`
+	Dir     string    `json:"dir"`
+	Time    time.Time `json:"time"`
+}
+
+// moduleDir returns the directory of the module path.
+func (b dirBackend) moduleDir(path string) (string, error) {
+	if err := module.CheckPath(path); err != nil {
+		return "", err
+	}
+	rel, ok := strings.CutPrefix(path, b.src+"/")
+	if !ok {
+		return "", fmt.Errorf("%s is not under %s: %w", path, b.src, errNotFound)
+	}
+	return filepath.Join(b.root, filepath.FromSlash(rel)), nil
+}
+
+// versions returns the versions of the module at dir.
+func (b dirBackend) versions(dir string) ([]dirVersion, error) {
+	data, err := os.ReadFile(filepath.Join(dir, dirManifest))
+	if err == nil {
+		var vs []dirVersion
+		if err := json.Unmarshal(data, &vs); err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Join(dir, dirManifest), err)
+		}
+		for _, v := range vs {
+			if !semver.IsValid(v.Version) || v.Version != semver.Canonical(v.Version) {
+				return nil, fmt.Errorf("%s: %q is not a canonical version", filepath.Join(dir, dirManifest), v.Version)
+			}
+			if !filepath.IsLocal(v.Dir) {
+				return nil, fmt.Errorf("%s: dir %q must be inside the module directory", filepath.Join(dir, dirManifest), v.Dir)
+			}
+		}
+		return vs, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", dir, errNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var vs []dirVersion
+	for _, e := range entries {
+		if !e.IsDir() || !semver.IsValid(e.Name()) || e.Name() != semver.Canonical(e.Name()) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, dirVersion{Version: e.Name(), Dir: e.Name(), Time: fi.ModTime()})
+	}
+	return vs, nil
+}
+
+func (b dirBackend) List(ctx context.Context, name string) ([]string, error) {
+	dir, err := b.moduleDir(name)
+	if err != nil {
+		return nil, err
+	}
+	vs, err := b.versions(dir)
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, v := range vs {
+		result = append(result, v.Version)
+	}
+	return result, nil
+}
+
+func (b dirBackend) Fetch(ctx context.Context, name, version, destDir string, policy FetchPolicy) error {
+	path, err := module.UnescapePath(name)
+	if err != nil {
+		return err
+	}
+	dir, err := b.moduleDir(path)
+	if err != nil {
+		return err
+	}
+	vs, err := b.versions(dir)
+	if err != nil {
+		return err
+	}
+	var snap *dirVersion
+	for i := range vs {
+		if vs[i].Version == version {
+			snap = &vs[i]
+		}
+	}
+	if snap == nil {
+		return fmt.Errorf("%s@%s: no such version in %s: %w", path, version, dir, errNotFound)
+	}
+	src := filepath.Join(dir, snap.Dir)
+	slog.DebugContext(ctx, "dir", "src", src)
+
+	if snap.Time.IsZero() {
+		fi, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		snap.Time = fi.ModTime()
+	}
+	return writeDirArtifacts(path, version, src, snap.Time, destDir, policy)
+}
+
+// writeDirArtifacts writes the .info, go.mod and zip of path@version,
+// released at t, from the source tree at src. A tree without go.mod
+// gets the one the go command would synthesize.
+func writeDirArtifacts(path, version, src string, t time.Time, destDir string, policy FetchPolicy) error {
+	info, err := json.Marshal(Info{Version: version, Time: t.UTC().Format(time.RFC3339)})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(destDir, version+".info"), info, 0644); err != nil {
+		return err
+	}
+
+	gomod, err := os.ReadFile(filepath.Join(src, "go.mod"))
+	if errors.Is(err, fs.ErrNotExist) {
+		gomod, err = []byte(fmt.Sprintf("module %s\n", path)), nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(destDir, "go.mod"), gomod, 0644); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(destDir, "source.zip"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	lw := &limitedWriter{w: f, n: policy.MaxZipBytes}
+	err = modzip.CreateFromDir(lw, module.Version{Path: path, Version: version}, src)
+	if lw.exceeded {
+		return fmt.Errorf("%s@%s: %w (> %d bytes)", path, version, errTooLarge, policy.MaxZipBytes)
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
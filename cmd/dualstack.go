@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/module"
+)
+
+// A dual-stack mapping also serves its modules under their upstream
+// paths: with dual_stack set on the mapping of pegasus-cloud.com/aes to
+// github.com/trusted-cloud, github.com/trusted-cloud/foo is served from
+// the cache entry of pegasus-cloud.com/aes/foo, so consumers importing
+// either path share one fetch, one quarantine and one set of blocks and
+// ACLs. The .info and version lists are the same under both paths; the
+// .mod and .zip are derived from the cached ones by mapping the paths
+// back to upstream's, and kept next to them in the entry.
+
+// dualStackDir is the directory of an entry holding its files as served
+// under the upstream path.
+const dualStackDir = "dual-stack"
+
+type dualStackKey struct{}
+
+// dualStackPaths is middleware serving requests for a module under the
+// Dest of a dual-stack mapping as requests for the module under its
+// Src, remembering the requested path for handler.
+func dualStackPaths(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		path, err := module.UnescapePath(vars["module"])
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m := dualStackMappingFor(path)
+		if m == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		src, err := module.EscapePath(m.Src + path[len(m.Dest):])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		vs := make(map[string]string, len(vars))
+		for k, v := range vars {
+			vs[k] = v
+		}
+		vs["module"] = src
+		r = mux.SetURLVars(r, vs)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), dualStackKey{}, path)))
+	})
+}
+
+// dualStackMappingFor returns the dual-stack mapping with the longest
+// Dest that is a path prefix of path, or nil. A path that is also under
+// a Src is always served as that.
+func dualStackMappingFor(path string) *mapping {
+	if mappingFor(path) != nil {
+		return nil
+	}
+	var best *mapping
+	for _, m := range routes().mappings {
+		if m.dualStack && hasPathPrefix(path, m.Dest) && (best == nil || len(m.Dest) > len(best.Dest)) {
+			best = m
+		}
+	}
+	return best
+}
+
+// dualStackRewrites maps paths under the Src of every dual-stack mapping
+// back to its Dest.
+func dualStackRewrites() []pathRewrite {
+	var rw []pathRewrite
+	for _, m := range routes().mappings {
+		if m.dualStack {
+			rw = append(rw, pathRewrite{upstream: m.Src, client: m.Dest})
+		}
+	}
+	return rw
+}
+
+// upstreamPathOf returns the module path requested under a dual-stack
+// Dest, if r is such a request.
+func upstreamPathOf(r *http.Request) (string, bool) {
+	path, ok := r.Context().Value(dualStackKey{}).(string)
+	return path, ok
+}
+
+// dualStackFile returns the copy of filename, the cached go.mod or
+// source.zip of name@version, as served under path, deriving it if it
+// is missing or older than filename.
+func dualStackFile(ctx context.Context, name, version, filename, path string) (string, error) {
+	out := filepath.Join(entryDir(name, version), dualStackDir, filepath.Base(filename))
+	if derivedFresh(out, filename) {
+		return out, nil
+	}
+	err := fills.do(ctx, "dual-stack:"+name+"@"+version+"/"+filepath.Base(filename), func(ctx context.Context) error {
+		if derivedFresh(out, filename) {
+			return nil
+		}
+		if filepath.Base(filename) == "go.mod" {
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				return err
+			}
+			data, _, err = rewriteGoMod(data, dualStackRewrites())
+			if err != nil {
+				return fmt.Errorf("%s@%s: go.mod: %v", path, version, err)
+			}
+			return writeFileAtomic(out, data)
+		}
+		return deriveDualStackZip(ctx, filename, out, path, version, fetchPolicyFor(name))
+	})
+	return out, err
+}
+
+// deriveDualStackZip writes the zip at filename repackaged under
+// path@version to out.
+func deriveDualStackZip(ctx context.Context, filename, out, path, version string, policy FetchPolicy) error {
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(out), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, in)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := rewriteZip(ctx, tmp.Name(), path, version, dualStackRewrites(), policy.MaxZipBytes); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), out)
+}
+
+// derivedFresh reports whether the derived file out exists and is not older
+// than the file src it was derived from.
+func derivedFresh(out, src string) bool {
+	o, err := os.Stat(out)
+	if err != nil {
+		return false
+	}
+	s, err := os.Stat(src)
+	return err == nil && !o.ModTime().Before(s.ModTime())
+}
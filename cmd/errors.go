@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Errors of the fetch pipeline. Backends, the cache and the policy
+// checks wrap one of these, e.g. fmt.Errorf("%s: %w", path, errNotFound),
+// and httpError maps them to a status in one place. The distinction
+// matters to clients: the go command falls back to the next proxy in
+// GOPROXY only on 404 and 410, and stops on anything else.
+var (
+	// errNotFound: the module or version does not exist upstream.
+	errNotFound = errors.New("not found")
+
+	// errGone: the version existed but may no longer be served.
+	errGone = errors.New("gone")
+
+	// errUpstreamUnavailable: the upstream failed or could not be
+	// reached; the request may succeed later.
+	errUpstreamUnavailable = errors.New("upstream unavailable")
+
+	// errPolicyDenied: the proxy's policy refuses the request.
+	errPolicyDenied = errors.New("denied by policy")
+
+	// errTooLarge: the module zip exceeds the MaxZipBytes of its fetch
+	// policy.
+	errTooLarge = errors.New("module zip exceeds size limit")
+
+	// errMaintenance: the proxy is in maintenance mode and does not fill
+	// its cache.
+	errMaintenance = errors.New("in maintenance")
+
+	// errRateLimited: the caller exceeded a rate limit of its priority
+	// class.
+	errRateLimited = errors.New("rate limited")
+)
+
+// kindError is an error with its own message that is also one of the
+// errors above.
+type kindError struct {
+	msg  string
+	kind error
+}
+
+func (e kindError) Error() string { return e.msg }
+func (e kindError) Unwrap() error { return e.kind }
+
+// rateLimitError is errRateLimited with the time until the caller may
+// retry.
+type rateLimitError struct {
+	msg  string
+	wait time.Duration
+}
+
+func (e rateLimitError) Error() string { return e.msg }
+func (e rateLimitError) Unwrap() error { return errRateLimited }
+
+// retryError is a kindError with the time until the request may
+// succeed.
+type retryError struct {
+	kindError
+	wait time.Duration
+}
+
+// statusOf returns the HTTP status for err.
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errGone):
+		return http.StatusGone
+	case errors.Is(err, errPolicyDenied), errors.Is(err, errTooLarge):
+		return http.StatusForbidden
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, errUpstreamUnavailable):
+		return http.StatusBadGateway
+	case errors.Is(err, errMaintenance):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errRateLimited):
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// httpError responds with err and its status.
+func httpError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errMaintenance) {
+		w.Header().Set("Retry-After", retryAfter())
+	}
+	var rl rateLimitError
+	if errors.As(err, &rl) {
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(rl.wait.Seconds()))))
+	}
+	var re retryError
+	if errors.As(err, &re) {
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(re.wait.Seconds()))))
+	}
+	metrics.errors.inc(errorKind(err))
+	http.Error(w, err.Error(), statusOf(err))
+}
+
+// permanent reports whether retrying after err cannot succeed.
+func permanent(err error) bool {
+	return errors.Is(err, errNotFound) || errors.Is(err, errGone) ||
+		errors.Is(err, errPolicyDenied) || errors.Is(err, errTooLarge)
+}
+
+// upstreamStatusError classifies an unsuccessful upstream HTTP response.
+func upstreamStatusError(what string, code int, status string) error {
+	msg := what + ": " + status
+	switch code {
+	case http.StatusNotFound:
+		return kindError{msg, errNotFound}
+	case http.StatusGone:
+		return kindError{msg, errGone}
+	}
+	return kindError{msg, errUpstreamUnavailable}
+}
+
+// gitError classifies a failed git command run with runOutput by its
+// stderr. A missing repository or ref is errNotFound; anything else,
+// such as a network or authentication failure, is
+// errUpstreamUnavailable.
+func gitError(err error) error {
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return err
+	}
+	stderr := strings.TrimSpace(string(ee.Stderr))
+	if stderr != "" {
+		err = fmt.Errorf("%v: %s", err, stderr)
+	}
+	lower := strings.ToLower(stderr)
+	for _, s := range []string{"not found", "does not exist", "couldn't find remote ref", "no such ref", "unknown revision"} {
+		if strings.Contains(lower, s) {
+			return fmt.Errorf("%v: %w", err, errNotFound)
+		}
+	}
+	return fmt.Errorf("%v: %w", err, errUpstreamUnavailable)
+}
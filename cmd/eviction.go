@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Without a budget the cache directory grows with every version ever
+// requested. With one, a sweeper scans the cache every Interval and,
+// while it holds more than MaxBytes or MaxEntries, removes entries in
+// the order of the policy: least recently downloaded first ("lru"), or
+// least often downloaded first ("lfu"). Evicted versions are fetched
+// again, or pulled from the remote store, on their next request.
+
+// EvictionConfig configures the size budget of the local cache.
+type EvictionConfig struct {
+	// MaxBytes caps the total size of the cached versions; 0 is
+	// unlimited.
+	MaxBytes int64 `yaml:"max_bytes"`
+
+	// MaxEntries caps the number of cached versions; 0 is unlimited.
+	MaxEntries int `yaml:"max_entries"`
+
+	// Policy is "lru" (default) or "lfu".
+	Policy string `yaml:"policy"`
+
+	// Interval is the time between sweeps (default 1m).
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (c EvictionConfig) enabled() bool {
+	return c.MaxBytes > 0 || c.MaxEntries > 0
+}
+
+// CacheStats reports the size of the cache and the evictions so far.
+type CacheStats struct {
+	Bytes          int64     `json:"bytes"`
+	Entries        int       `json:"entries"`
+	MaxBytes       int64     `json:"max_bytes,omitempty"`
+	MaxEntries     int       `json:"max_entries,omitempty"`
+	Policy         string    `json:"policy,omitempty"`
+	Evictions      int64     `json:"evictions"`
+	EvictedBytes   int64     `json:"evicted_bytes"`
+	LastSweep      time.Time `json:"last_sweep"`
+	LastSweepError string    `json:"last_sweep_error,omitempty"`
+
+	// Demotions counts the evicted versions recompressed in the store.
+	Demotions          int64 `json:"demotions,omitempty"`
+	DemotionSavedBytes int64 `json:"demotion_saved_bytes,omitempty"`
+}
+
+var eviction = struct {
+	sync.Mutex
+	stats     CacheStats
+	downloads map[string]int64 // by module@version, since startup
+}{downloads: make(map[string]int64)}
+
+// countDownload records a download of module@version for the lfu
+// policy.
+func countDownload(module, version string) {
+	eviction.Lock()
+	eviction.downloads[module+"@"+version]++
+	eviction.Unlock()
+}
+
+// sizedEntry is a cache entry as seen by a sweep.
+type sizedEntry struct {
+	cacheEntry
+	bytes     int64
+	last      time.Time
+	downloads int64
+}
+
+// sweepCache scans the cache and evicts entries until it is within c.
+func sweepCache(c EvictionConfig) error {
+	var all []sizedEntry
+	var total int64
+	err := walkCache(func(e cacheEntry) error {
+		if !validEntry(e.Module, e.Version) {
+			return nil // still being filled
+		}
+		se := sizedEntry{cacheEntry: e, bytes: dirSize(e.Dir), last: lastAccess(e.Dir)}
+		total += se.bytes
+		all = append(all, se)
+		return nil
+	})
+
+	eviction.Lock()
+	for i := range all {
+		all[i].downloads = eviction.downloads[all[i].Module+"@"+all[i].Version]
+	}
+	eviction.Unlock()
+
+	if err == nil {
+		sort.Slice(all, func(i, j int) bool {
+			a, b := all[i], all[j]
+			if c.Policy == "lfu" && a.downloads != b.downloads {
+				return a.downloads < b.downloads
+			}
+			return a.last.Before(b.last)
+		})
+	}
+	var gone []string
+	var evictedBytes int64
+	for err == nil && len(all) > 0 && over(c, total, len(all)) {
+		e := all[0]
+		all = all[1:]
+		if rerr := removeEntry(e.Dir); rerr != nil {
+			slog.Error("evicting", "module", e.Module, "version", e.Version, "err", rerr)
+			continue
+		}
+		entries.forget(e.Module, e.Version)
+		addTombstone(e.Module, e.Version)
+		gone = append(gone, e.Module+"@"+e.Version)
+		total -= e.bytes
+		evictedBytes += e.bytes
+		slog.Info("evicted", "module", e.Module, "version", e.Version, "bytes", e.bytes)
+	}
+
+	demoteEvicted(gone)
+
+	eviction.Lock()
+	defer eviction.Unlock()
+	for _, key := range gone {
+		delete(eviction.downloads, key)
+	}
+	s := &eviction.stats
+	s.MaxBytes, s.MaxEntries, s.Policy = c.MaxBytes, c.MaxEntries, c.Policy
+	s.LastSweep = time.Now().UTC()
+	s.LastSweepError = ""
+	if err != nil {
+		s.LastSweepError = err.Error()
+		return err
+	}
+	s.Bytes, s.Entries = total, len(all)
+	s.Evictions += int64(len(gone))
+	s.EvictedBytes += evictedBytes
+	return nil
+}
+
+// over reports whether a cache of the given size exceeds c.
+func over(c EvictionConfig, bytes int64, n int) bool {
+	return (c.MaxBytes > 0 && bytes > c.MaxBytes) || (c.MaxEntries > 0 && n > c.MaxEntries)
+}
+
+// checkEviction validates the eviction config.
+func checkEviction(c EvictionConfig) error {
+	if c.Policy != "" && c.Policy != "lru" && c.Policy != "lfu" {
+		return fmt.Errorf("eviction policy must be lru or lfu, not %q", c.Policy)
+	}
+	if c.MaxBytes < 0 || c.MaxEntries < 0 {
+		return fmt.Errorf("eviction limits must not be negative")
+	}
+	return nil
+}
+
+// startEviction runs the sweeper if a budget is configured.
+func startEviction() {
+	c := config.Eviction
+	if !c.enabled() {
+		return
+	}
+	if c.Policy == "" {
+		c.Policy = "lru"
+	}
+	if c.Interval == 0 {
+		c.Interval = time.Minute
+	}
+	go func() {
+		for {
+			if err := sweepCache(c); err != nil {
+				slog.Error("cache sweep", "err", err)
+			}
+			time.Sleep(c.Interval)
+		}
+	}()
+}
+
+// getCacheStats serves GET /admin/cache, the size of the cache as of
+// the last sweep and the evictions since startup.
+func getCacheStats(w http.ResponseWriter, r *http.Request) {
+	eviction.Lock()
+	stats := eviction.stats
+	eviction.Unlock()
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every subprocess the proxy runs (git, scan commands) is recorded as an
+// execEvent: appended to CacheDir/.exec.jsonl for forensics and kept in
+// memory for GET /admin/exec. Credentials are redacted from the argv
+// before it is recorded anywhere.
+
+// execEvent is one subprocess execution.
+type execEvent struct {
+	ID          int64     `json:"id"`
+	Start       time.Time `json:"start"`
+	Argv        []string  `json:"argv"`
+	Dir         string    `json:"dir,omitempty"`
+	DurationMS  int64     `json:"duration_ms"`
+	ExitCode    int       `json:"exit_code"` // -1 if the process did not run to completion
+	OutputBytes int       `json:"output_bytes"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// execLogSize is the number of events kept in memory.
+const execLogSize = 2000
+
+var execLog struct {
+	sync.Mutex
+	nextID int64
+	events []execEvent // oldest first
+}
+
+// redactArgv removes credentials from a command line.
+func redactArgv(argv []string) []string {
+	out := make([]string, len(argv))
+	for i, a := range argv {
+		a = urlCredentials.ReplaceAllString(a, "${1}***@")
+		for _, tok := range repoTokens() {
+			a = strings.ReplaceAll(a, tok, "***")
+		}
+		out[i] = a
+	}
+	return out
+}
+
+// recordExec records the execution of cmd that started at start.
+func recordExec(cmd *exec.Cmd, start time.Time, outputBytes int, err error) {
+	e := execEvent{
+		Start:       start.UTC(),
+		Argv:        redactArgv(cmd.Args),
+		Dir:         cmd.Dir,
+		DurationMS:  time.Since(start).Milliseconds(),
+		ExitCode:    -1,
+		OutputBytes: outputBytes,
+	}
+	if cmd.ProcessState != nil {
+		e.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	if err != nil {
+		e.Error = redactArgv([]string{err.Error()})[0]
+	}
+	observeExec(cmd.Args[0], time.Since(start), err)
+
+	execLog.Lock()
+	execLog.nextID++
+	e.ID = execLog.nextID
+	execLog.events = append(execLog.events, e)
+	if len(execLog.events) > execLogSize {
+		execLog.events = execLog.events[len(execLog.events)-execLogSize:]
+	}
+	execLog.Unlock()
+
+	data, _ := json.Marshal(e)
+	f, ferr := os.OpenFile(filepath.Join(CacheDir, ".exec.jsonl"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if ferr != nil {
+		slog.Error("exec log", "err", ferr)
+		return
+	}
+	defer f.Close()
+	f.Write(append(data, '\n'))
+}
+
+// waitDelay bounds how long the output of a subprocess is read after it
+// was killed: git leaves helpers such as git-remote-https behind that
+// hold its pipes open.
+const waitDelay = 5 * time.Second
+
+// runCombinedOutput is cmd.CombinedOutput, run in a slot of the
+// subprocess pool and recorded in the exec log.
+func runCombinedOutput(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	release, err := acquireProc(ctx, cmd.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	_, span := startSpan(ctx, "exec "+filepath.Base(cmd.Args[0]), spanInternal)
+	span.set("process.command_args", strings.Join(redactArgv(cmd.Args), " "))
+	if cmd.WaitDelay == 0 {
+		cmd.WaitDelay = waitDelay
+	}
+	inFlight.procs.Add(1)
+	defer inFlight.procs.Add(-1)
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	recordExec(cmd, start, len(out), err)
+	span.end(err)
+	return out, err
+}
+
+// runOutput is cmd.Output, run in a slot of the subprocess pool and
+// recorded in the exec log. The bytes counted include stderr.
+func runOutput(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	release, err := acquireProc(ctx, cmd.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	_, span := startSpan(ctx, "exec "+filepath.Base(cmd.Args[0]), spanInternal)
+	span.set("process.command_args", strings.Join(redactArgv(cmd.Args), " "))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if cmd.WaitDelay == 0 {
+		cmd.WaitDelay = waitDelay
+	}
+	inFlight.procs.Add(1)
+	defer inFlight.procs.Add(-1)
+	start := time.Now()
+	out, err := cmd.Output()
+	recordExec(cmd, start, len(out)+stderr.Len(), err)
+	span.end(err)
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		ee.Stderr = stderr.Bytes()
+	}
+	return out, err
+}
+
+// listExec serves GET /admin/exec. Query parameters filter the events:
+// cmd (argv[0]), failed=true, since (RFC 3339) and limit (default 100,
+// newest first).
+func listExec(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	failed := q.Get("failed") == "true"
+	name := q.Get("cmd")
+
+	execLog.Lock()
+	events := []execEvent{}
+	for i := len(execLog.events) - 1; i >= 0 && len(events) < limit; i-- {
+		e := execLog.events[i]
+		if e.Start.Before(since) {
+			break
+		}
+		if failed && e.ExitCode == 0 && e.Error == "" {
+			continue
+		}
+		if name != "" && (len(e.Argv) == 0 || filepath.Base(e.Argv[0]) != name) {
+			continue
+		}
+		events = append(events, e)
+	}
+	execLog.Unlock()
+	writeJSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+)
+
+func TestRunCombinedOutputSpan(t *testing.T) {
+	old := tracer
+	defer func() { tracer = old }()
+	tracer.spans, tracer.ratio = make(chan otlpSpan, 1), 1
+
+	cmd := exec.Command("sh", "-c", "echo out; echo err >&2; exit 3")
+	out, err := runCombinedOutput(context.Background(), cmd)
+	if err == nil || string(out) != "out\nerr\n" {
+		t.Errorf("runCombinedOutput = %q, %v", out, err)
+	}
+	select {
+	case sp := <-tracer.spans:
+		if sp.Name != "exec sh" || sp.Status == nil || sp.Status.Code != statusError {
+			t.Errorf("span %s with status %+v, want a failed exec sh", sp.Name, sp.Status)
+		}
+	default:
+		t.Error("no span recorded")
+	}
+}
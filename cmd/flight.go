@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// On a cache miss many clients often ask for the same version at once,
+// e.g. every job of a CI fan-out running go mod download. Filling a
+// cache entry, by a pull from the remote store or a fetch from the
+// backend, writes to and on failure removes the entry's directory, so
+// concurrent fills of one entry would corrupt each other, besides
+// repeating the same clone or download. fills lets one fill per
+// module@version run at a time and hands its result to everyone who
+// asked meanwhile. A fill writes the .info, go.mod and zip together, so
+// the file asked for is not part of its key. It is part of the key of
+// lookups, which shares the lookup of each file, including the check
+// that the file is there once a fill is done, among the callers that
+// asked for that file.
+var (
+	lookups = &flightGroup{m: make(map[string]*flight), lookup: true}
+	fills   = &flightGroup{m: make(map[string]*flight)}
+)
+
+// flightGroup runs one call per key at a time; callers arriving while
+// it runs wait for it and share its error, like
+// golang.org/x/sync/singleflight.
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flight
+
+	// lookup is set for groups whose calls only wait for fills, and so
+	// are not counted as fills in flight.
+	lookup bool
+}
+
+type flight struct {
+	done chan struct{}
+	err  error
+
+	// waiters counts the callers still waiting; when the last one's
+	// context is done, cancel stops the call.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// do runs fn for key unless a call for key is in flight, in which case
+// it waits for that call's error. fn gets a context with the deadline
+// of the first caller but not its cancellation, since the others depend
+// on it; the others stop waiting when their own context is done. Once
+// every caller has stopped waiting, e.g. because its client went away,
+// fn's context is canceled, which kills its subprocesses; a caller
+// arriving meanwhile waits for fn to return and starts a call anew.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(context.Context) error) error {
+	for {
+		g.mu.Lock()
+		f, ok := g.m[key]
+		if ok && f.waiters == 0 {
+			g.mu.Unlock()
+			select {
+			case <-f.done:
+				continue
+			case <-ctx.Done():
+				return fmt.Errorf("waiting for %s: %w", key, ctx.Err())
+			}
+		}
+		var fctx context.Context
+		if !ok {
+			f = &flight{done: make(chan struct{})}
+			fctx, f.cancel = detached(ctx)
+			g.m[key] = f
+		}
+		f.waiters++
+		g.mu.Unlock()
+		stop := context.AfterFunc(ctx, func() { g.leave(f) })
+
+		if ok {
+			select {
+			case <-f.done:
+				stop()
+				return f.err
+			case <-ctx.Done():
+				return fmt.Errorf("waiting for %s: %w", key, ctx.Err())
+			}
+		}
+
+		return g.lead(fctx, key, f, fn, stop)
+	}
+}
+
+// lead runs fn as the call f for key and hands its error to the callers
+// waiting for it; stop stops f from watching the leader's context. f is
+// removed and its waiters are released even if fn panics, with an error
+// in place of fn's.
+func (g *flightGroup) lead(ctx context.Context, key string, f *flight, fn func(context.Context) error, stop func() bool) error {
+	f.err = fmt.Errorf("%s: call panicked", key)
+	defer func() {
+		stop()
+		g.mu.Lock()
+		delete(g.m, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.err = g.run(ctx, f, fn)
+	return f.err
+}
+
+// run runs fn for f, counted as a fill in flight, unless g is a lookup
+// group, until it returns or panics.
+func (g *flightGroup) run(ctx context.Context, f *flight, fn func(context.Context) error) error {
+	if !g.lookup {
+		inFlight.fills.Add(1)
+		defer inFlight.fills.Add(-1)
+	}
+	defer f.cancel()
+	return fn(ctx)
+}
+
+// leave stops f waiting for a caller whose context is done.
+func (g *flightGroup) leave(f *flight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f.waiters--; f.waiters == 0 {
+		f.cancel()
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFlightGroupSharesCall(t *testing.T) {
+	g := &flightGroup{m: make(map[string]*flight)}
+	release := make(chan struct{})
+	var calls atomic.Int32
+	want := errors.New("fill failed")
+	fn := func(ctx context.Context) error {
+		calls.Add(1)
+		<-release
+		return want
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- g.do(context.Background(), "example.com/m@v1.0.0", fn)
+		}()
+	}
+	waitFor(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		f := g.m["example.com/m@v1.0.0"]
+		return f != nil && f.waiters == 3
+	})
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != want {
+			t.Errorf("do = %v, want %v", err, want)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d calls, want 1", n)
+	}
+}
+
+func TestFlightGroupCancelsAbandonedCall(t *testing.T) {
+	g := &flightGroup{m: make(map[string]*flight)}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	started := make(chan struct{})
+	go g.do(ctx, "example.com/m@v1.0.0", func(fctx context.Context) error {
+		close(started)
+		<-fctx.Done()
+		stopped <- fctx.Err()
+		return fctx.Err()
+	})
+	<-started
+	cancel()
+	if err := <-stopped; !errors.Is(err, context.Canceled) {
+		t.Errorf("call stopped with %v, want canceled", err)
+	}
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	g := &flightGroup{m: make(map[string]*flight)}
+	const key = "example.com/m@v1.0.0"
+	release := make(chan struct{})
+	followed := make(chan error, 1)
+	go func() {
+		defer func() { recover() }()
+		g.do(context.Background(), key, func(context.Context) error {
+			<-release
+			panic("boom")
+		})
+	}()
+	waitFor(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.m[key] != nil
+	})
+	go func() {
+		followed <- g.do(context.Background(), key, func(context.Context) error { return nil })
+	}()
+	waitFor(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.m[key].waiters == 2
+	})
+	close(release)
+	if err := <-followed; err == nil {
+		t.Error("waiter of a panicked call got no error")
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.m) != 0 {
+		t.Errorf("%d calls left in the group after a panic", len(g.m))
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GCSConfig configures a blob store in a Google Cloud Storage bucket.
+// Requests are authorized with tokens from the metadata server, which
+// on GKE with workload identity are those of the Kubernetes service
+// account's Google service account.
+type GCSConfig struct {
+	Bucket string `yaml:"bucket"`
+	// Prefix is prepended to every object name.
+	Prefix string `yaml:"prefix"`
+	// Endpoint overrides https://storage.googleapis.com, e.g. for an
+	// emulator.
+	Endpoint string `yaml:"endpoint"`
+	// AccessToken is used instead of the metadata server when set.
+	AccessToken string `yaml:"access_token"`
+	// ChunkSize is the size of the chunks of resumable uploads, which
+	// are used for objects larger than one chunk (default 8 MiB,
+	// rounded down to a multiple of 256 KiB).
+	ChunkSize int64 `yaml:"chunk_size"`
+}
+
+const (
+	gcsDefaultEndpoint = "https://storage.googleapis.com"
+	gcsChunkUnit       = 256 << 10
+	gcsMetadataToken   = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// gcsStore is a minimal client of the Cloud Storage JSON API, covering
+// what blobStore needs. In a bucket with object versioning, every
+// overwrite or delete keeps the previous generation, so Put skips
+// objects that already hold the same content, and Get reads the
+// generation Stat saw, so the digest always matches the bytes.
+type gcsStore struct {
+	cfg    GCSConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// gcsObject is the part of an object resource gcsStore uses.
+type gcsObject struct {
+	Name       string            `json:"name"`
+	Size       string            `json:"size"`
+	Generation string            `json:"generation"`
+	Metadata   map[string]string `json:"metadata"`
+}
+
+func newGCSStore(cfg GCSConfig) (*gcsStore, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("gcs: bucket is required")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = gcsDefaultEndpoint
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = 8 << 20
+	}
+	cfg.ChunkSize = max(cfg.ChunkSize/gcsChunkUnit, 1) * gcsChunkUnit
+	return &gcsStore{cfg: cfg, client: http.DefaultClient}, nil
+}
+
+func (s *gcsStore) name(key string) string {
+	if s.cfg.Prefix == "" {
+		return key
+	}
+	return s.cfg.Prefix + "/" + key
+}
+
+func (s *gcsStore) objectURL(key string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", s.cfg.Endpoint, url.PathEscape(s.cfg.Bucket), url.PathEscape(s.name(key)))
+}
+
+// accessToken returns a token from the config or the metadata server,
+// fetching a new one shortly before the last expires.
+func (s *gcsStore) accessToken(ctx context.Context) (string, error) {
+	if s.cfg.AccessToken != "" {
+		return s.cfg.AccessToken, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Before(s.expires) {
+		return s.token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcsMetadataToken, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("gcs: metadata server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("gcs: metadata server: %s", resp.Status)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", fmt.Errorf("gcs: decoding token: %v", err)
+	}
+	s.token = tok.AccessToken
+	s.expires = time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second - time.Minute)
+	return s.token, nil
+}
+
+// do sends an authorized request.
+func (s *gcsStore) do(ctx context.Context, method, u string, body io.Reader, header http.Header) (*http.Response, error) {
+	token, err := s.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return s.client.Do(req)
+}
+
+// gcsError turns an unsuccessful response into an error, wrapping
+// os.ErrNotExist for a missing object.
+func gcsError(resp *http.Response, key string) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("gcs: %s: %w", key, os.ErrNotExist)
+	}
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&e)
+	if e.Error.Message != "" {
+		return fmt.Errorf("gcs: %s %s: %s: %s", resp.Request.Method, key, resp.Status, e.Error.Message)
+	}
+	return fmt.Errorf("gcs: %s %s: %s", resp.Request.Method, key, resp.Status)
+}
+
+func (s *gcsStore) object(ctx context.Context, key string) (*gcsObject, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.objectURL(key)+"?fields=name,size,generation,metadata", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, gcsError(resp, key)
+	}
+	var o gcsObject
+	if err := json.NewDecoder(resp.Body).Decode(&o); err != nil {
+		return nil, fmt.Errorf("gcs: decoding %s: %v", key, err)
+	}
+	return &o, nil
+}
+
+func (o *gcsObject) info() blobInfo {
+	size, _ := strconv.ParseInt(o.Size, 10, 64)
+	return blobInfo{Size: size, SHA256: o.Metadata["sha256"], PlainSHA256: o.Metadata["plain-sha256"]}
+}
+
+func (s *gcsStore) Stat(ctx context.Context, key string) (blobInfo, error) {
+	o, err := s.object(ctx, key)
+	if err != nil {
+		return blobInfo{}, err
+	}
+	return o.info(), nil
+}
+
+func (s *gcsStore) Get(ctx context.Context, key string) (io.ReadCloser, blobInfo, error) {
+	o, err := s.object(ctx, key)
+	if err != nil {
+		return nil, blobInfo{}, err
+	}
+	resp, err := s.do(ctx, http.MethodGet, s.objectURL(key)+"?alt=media&generation="+url.QueryEscape(o.Generation), nil, nil)
+	if err != nil {
+		return nil, blobInfo{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, blobInfo{}, gcsError(resp, key)
+	}
+	return resp.Body, o.info(), nil
+}
+
+func (s *gcsStore) Put(ctx context.Context, key string, body io.ReadSeeker, info blobInfo) error {
+	if o, err := s.object(ctx, key); err == nil && info.SHA256 != "" && o.Metadata["sha256"] == info.SHA256 {
+		return nil // already there; do not add a generation
+	}
+	metadata := map[string]string{"sha256": info.SHA256}
+	if info.PlainSHA256 != "" {
+		metadata["plain-sha256"] = info.PlainSHA256
+	}
+	meta, err := json.Marshal(gcsObject{Name: s.name(key), Metadata: metadata})
+	if err != nil {
+		return err
+	}
+	if info.Size > s.cfg.ChunkSize {
+		return s.putResumable(ctx, key, body, info.Size, meta)
+	}
+	return s.putMultipart(ctx, key, body, meta)
+}
+
+func (s *gcsStore) uploadURL(uploadType string) string {
+	return fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=%s", s.cfg.Endpoint, url.PathEscape(s.cfg.Bucket), uploadType)
+}
+
+// putMultipart uploads a small object in one request.
+func (s *gcsStore) putMultipart(ctx context.Context, key string, body io.Reader, meta []byte) error {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+	if err != nil {
+		return err
+	}
+	part.Write(meta)
+	if part, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/octet-stream"}}); err != nil {
+		return err
+	}
+	if _, err := copyBuffered(part, body); err != nil {
+		return err
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodPost, s.uploadURL("multipart"), &buf, http.Header{"Content-Type": {"multipart/related; boundary=" + mw.Boundary()}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return gcsError(resp, key)
+	}
+	return nil
+}
+
+// putResumable uploads a large object in chunks through a resumable
+// upload session. A chunk that fails is sent again from the offset the
+// service reports, so an interrupted zip upload does not start over.
+// A chunk after which the service reports no more bytes committed than
+// before counts as failed, and the upload gives up after maxRetries
+// failures in a row, or after as many attempts in all as the object has
+// chunks times 1+maxRetries, so that a service that keeps losing what
+// it received cannot hold it forever.
+func (s *gcsStore) putResumable(ctx context.Context, key string, body io.ReadSeeker, size int64, meta []byte) error {
+	resp, err := s.do(ctx, http.MethodPost, s.uploadURL("resumable"), bytes.NewReader(meta), http.Header{
+		"Content-Type":            {"application/json; charset=UTF-8"},
+		"X-Upload-Content-Length": {strconv.FormatInt(size, 10)},
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return gcsError(resp, key)
+	}
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return fmt.Errorf("gcs: %s: no upload session", key)
+	}
+
+	const maxRetries = 3
+	chunks := (size + s.cfg.ChunkSize - 1) / s.cfg.ChunkSize
+	var offset int64
+	for attempts, retries := int64(0), 0; ; attempts++ {
+		if attempts == chunks*(1+maxRetries) {
+			return fmt.Errorf("gcs: uploading %s: %d of %d bytes committed after %d attempts", key, offset, size, attempts)
+		}
+		n := min(s.cfg.ChunkSize, size-offset)
+		if _, err := body.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		header := http.Header{"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", offset, offset+n-1, size)}}
+		resp, err := s.do(ctx, http.MethodPut, session, io.LimitReader(body, n), header)
+		if err == nil {
+			resp.Body.Close()
+			committed := gcsCommitted(resp)
+			switch {
+			case resp.StatusCode == http.StatusOK, resp.StatusCode == http.StatusCreated:
+				return nil
+			case resp.StatusCode == http.StatusPermanentRedirect && committed > offset && committed <= size:
+				// 308: chunk received
+				offset, retries = committed, 0
+				continue
+			case resp.StatusCode == http.StatusPermanentRedirect:
+				err = fmt.Errorf("gcs: uploading %s: %d bytes committed after sending bytes %d-%d", key, committed, offset, offset+n-1)
+			case resp.StatusCode/100 == 4:
+				return fmt.Errorf("gcs: uploading %s: %s", key, resp.Status)
+			default:
+				err = fmt.Errorf("gcs: uploading %s: %s", key, resp.Status)
+			}
+		}
+		if retries++; retries > maxRetries || ctx.Err() != nil {
+			return err
+		}
+		// Ask how much arrived before sending the rest.
+		resp, qerr := s.do(ctx, http.MethodPut, session, http.NoBody, http.Header{"Content-Range": {fmt.Sprintf("bytes */%d", size)}})
+		if qerr != nil {
+			return err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusCreated:
+			return nil
+		case http.StatusPermanentRedirect:
+			if offset = gcsCommitted(resp); offset > size {
+				return fmt.Errorf("gcs: uploading %s: %d bytes committed of %d", key, offset, size)
+			}
+		default:
+			return err
+		}
+	}
+}
+
+// gcsCommitted returns the number of bytes a 308 response to a
+// resumable upload reports as received.
+func gcsCommitted(resp *http.Response) int64 {
+	_, last, ok := strings.Cut(resp.Header.Get("Range"), "-")
+	if !ok {
+		return 0
+	}
+	n, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n + 1
+}
+
+func (s *gcsStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		q := url.Values{"prefix": {s.name(prefix)}, "fields": {"items(name),nextPageToken"}}
+		if token != "" {
+			q.Set("pageToken", token)
+		}
+		u := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", s.cfg.Endpoint, url.PathEscape(s.cfg.Bucket), q.Encode())
+		resp, err := s.do(ctx, http.MethodGet, u, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Items         []gcsObject `json:"items"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = gcsError(resp, prefix)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range page.Items {
+			keys = append(keys, strings.TrimPrefix(o.Name, s.name("")))
+		}
+		if page.NextPageToken == "" {
+			return keys, nil
+		}
+		token = page.NextPageToken
+	}
+}
+
+// Delete removes the live generation of key. With object versioning it
+// becomes noncurrent and is kept as the bucket's lifecycle rules say;
+// Get never reads noncurrent generations.
+func (s *gcsStore) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.objectURL(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return gcsError(resp, key)
+	}
+	return nil
+}
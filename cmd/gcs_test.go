@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeUploads serves resumable upload sessions. Each chunk PUT is
+// answered by commit, given the bytes committed so far and the chunk's
+// first and last offsets, with the bytes committed after it.
+type fakeUploads struct {
+	mu        sync.Mutex
+	committed int64
+	puts      int
+	commit    func(committed, first, last int64) int64
+}
+
+func (u *fakeUploads) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if r.Method == http.MethodPost {
+		w.Header().Set("Location", "http://"+r.Host+"/session")
+		return
+	}
+	io.Copy(io.Discard, r.Body)
+	var first, last, size int64
+	cr := r.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(cr, "bytes %d-%d/%d", &first, &last, &size); err == nil {
+		u.puts++
+		u.committed = u.commit(u.committed, first, last)
+	} else if _, err := fmt.Sscanf(cr, "bytes */%d", &size); err != nil {
+		http.Error(w, "bad range "+cr, http.StatusBadRequest)
+		return
+	}
+	if u.committed == size {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if u.committed > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", u.committed-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+func TestPutResumable(t *testing.T) {
+	const chunk, size = gcsChunkUnit, 3 * gcsChunkUnit
+	for _, tt := range []struct {
+		name   string
+		commit func(committed, first, last int64) int64
+		ok     bool
+		puts   int
+	}{
+		{"every chunk", func(_, _, last int64) int64 { return last + 1 }, true, 3},
+		{"half a chunk", func(_, first, last int64) int64 { return min(first+chunk/2, last+1) }, true, 6},
+		{"nothing", func(c, _, _ int64) int64 { return c }, false, 4},
+		// Every second chunk is lost along with all but a byte.
+		{"lost", func(c, _, last int64) int64 {
+			if c >= chunk {
+				return 1
+			}
+			return last + 1
+		}, false, 12},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &fakeUploads{commit: tt.commit}
+			srv := httptest.NewServer(u)
+			defer srv.Close()
+			s, err := newGCSStore(GCSConfig{Bucket: "b", Endpoint: srv.URL, AccessToken: "t", ChunkSize: chunk})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.putResumable(context.Background(), "k", bytes.NewReader(make([]byte, size)), size, []byte("{}"))
+			if (err == nil) != tt.ok {
+				t.Errorf("putResumable = %v, want ok %v", err, tt.ok)
+			}
+			if u.puts != tt.puts {
+				t.Errorf("%d chunks sent, want %d", u.puts, tt.puts)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// nativeGitBackend is the git backend implemented with go-git instead
+// of the git binary, so the proxy can run from a scratch image. It
+// produces the same .info, go.mod and zip as gitBackend: the zip holds
+// every file tracked at the version under the <module>@<version>/
+// prefix, as git archive does. Symlinks are left out, since the go
+// command rejects them in module zips anyway.
+type nativeGitBackend struct {
+	repoMapping
+}
+
+func (b nativeGitBackend) auth() *githttp.BasicAuth {
+	return &githttp.BasicAuth{Username: user, Password: b.Token}
+}
+
+// nativeGitError classifies a go-git transport error like gitError.
+func nativeGitError(err error) error {
+	if errors.Is(err, transport.ErrRepositoryNotFound) || errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return fmt.Errorf("%v: %w", err, errNotFound)
+	}
+	return fmt.Errorf("%v: %w", err, errUpstreamUnavailable)
+}
+
+func (b nativeGitBackend) List(ctx context.Context, name string) ([]string, error) {
+	versions, _, err := b.ListRefs(ctx, name, "")
+	return versions, err
+}
+
+func (b nativeGitBackend) ListRefs(ctx context.Context, name, since string) ([]string, string, error) {
+	repoURL, err := b.repoURL(name)
+	if err != nil {
+		return nil, "", err
+	}
+	slog.DebugContext(ctx, "git (native) ls-remote", "repo", repoURL)
+
+	remote := git.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{
+		Name: "origin",
+		URLs: []string{"https://" + repoURL},
+	})
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: b.auth()})
+	if err != nil {
+		return nil, "", nativeGitError(err)
+	}
+	var tags []*plumbing.Reference
+	var adv []byte
+	for _, ref := range refs {
+		if ref.Name().IsTag() {
+			tags = append(tags, ref)
+			adv = fmt.Appendf(adv, "%s\t%s\n", ref.Hash(), ref.Name())
+		}
+	}
+	hash := refsHash(adv)
+	if hash == since {
+		return nil, hash, nil
+	}
+	result := []string{}
+	for _, ref := range tags {
+		result = append(result, ref.Name().Short())
+	}
+	return result, hash, nil
+}
+
+// cloneVersion makes a shallow in-memory clone of version, which like
+// git clone -b may name a tag or a branch, and returns its commit and
+// the ref it was found under.
+func (b nativeGitBackend) cloneVersion(ctx context.Context, repoURL, version string) (*object.Commit, plumbing.ReferenceName, error) {
+	var lastErr error
+	for _, refName := range []plumbing.ReferenceName{
+		plumbing.NewTagReferenceName(version),
+		plumbing.NewBranchReferenceName(version),
+	} {
+		repo, err := git.CloneContext(ctx, memory.NewStorage(), nil, &git.CloneOptions{
+			URL:           "https://" + repoURL,
+			Auth:          b.auth(),
+			ReferenceName: refName,
+			SingleBranch:  true,
+			Depth:         1,
+			Tags:          git.NoTags,
+		})
+		if errors.Is(err, plumbing.ErrReferenceNotFound) || errors.Is(err, git.NoMatchingRefSpecError{}) {
+			lastErr = err
+			continue
+		}
+		if err != nil {
+			return nil, "", nativeGitError(err)
+		}
+		ref, err := repo.Reference(refName, true)
+		if err != nil {
+			return nil, "", err
+		}
+		var commit *object.Commit
+		if tag, terr := repo.TagObject(ref.Hash()); terr == nil {
+			commit, err = tag.Commit()
+		} else {
+			commit, err = repo.CommitObject(ref.Hash())
+		}
+		return commit, refName, err
+	}
+	return nil, "", fmt.Errorf("%s: version %s: %v: %w", repoURL, version, lastErr, errNotFound)
+}
+
+func (b nativeGitBackend) Fetch(ctx context.Context, name, version, destDir string, policy FetchPolicy) error {
+	repoURL, err := b.repoURL(name)
+	if err != nil {
+		return err
+	}
+	dir := b.subdir(name)
+	slog.DebugContext(ctx, "git (native) clone", "repo", repoURL, "version", version, "dir", dir)
+
+	// Tags of modules in a subdirectory carry the directory as prefix.
+	ref := version
+	if dir != "" {
+		ref = dir + "/" + version
+	}
+	commit, refName, err := b.cloneVersion(ctx, repoURL, ref)
+	if err != nil {
+		return err
+	}
+
+	info, err := json.Marshal(Info{
+		Version: version,
+		Time:    commit.Committer.When.Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(destDir, version+".info"), info, 0644); err != nil {
+		return err
+	}
+
+	gomod, err := commit.File(path.Join(dir, "go.mod"))
+	if err != nil {
+		return fmt.Errorf("%s@%s: go.mod: %v", name, version, err)
+	}
+	contents, err := gomod.Contents()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(destDir, "go.mod"), []byte(contents), 0644); err != nil {
+		return err
+	}
+
+	if err := writeCommitZip(commit, dir, fmt.Sprintf("%s@%s/", name, version), filepath.Join(destDir, "source.zip"), policy.MaxZipBytes); err != nil {
+		return err
+	}
+	return recordOrigin(destDir, &Origin{
+		VCS:    "git",
+		URL:    "https://" + repoURL,
+		Subdir: dir,
+		Ref:    refName.String(),
+		Hash:   commit.Hash.String(),
+	})
+}
+
+// writeCommitZip archives the files of commit below dir (all files if
+// dir is empty) under prefix into dest, failing with errTooLarge once
+// the archive exceeds maxBytes.
+func writeCommitZip(commit *object.Commit, dir, prefix, dest string, maxBytes int64) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	lw := &limitedWriter{w: f, n: maxBytes}
+	zw := zip.NewWriter(lw)
+	files, err := commit.Files()
+	if err != nil {
+		return err
+	}
+	err = files.ForEach(func(file *object.File) error {
+		if file.Mode == filemode.Symlink {
+			return nil
+		}
+		name := file.Name
+		if dir != "" {
+			var ok bool
+			if name, ok = strings.CutPrefix(name, dir+"/"); !ok {
+				return nil
+			}
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     prefix + name,
+			Method:   zip.Deflate,
+			Modified: commit.Committer.When,
+		})
+		if err != nil {
+			return err
+		}
+		r, err := file.Reader()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = copyBuffered(w, r)
+		return err
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if lw.exceeded {
+		return fmt.Errorf("%s: %w (> %d bytes)", prefix, errTooLarge, maxBytes)
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// limitedWriter fails writes that would take it past n bytes.
+type limitedWriter struct {
+	w        io.Writer
+	n        int64
+	exceeded bool
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		l.exceeded = true
+		return 0, errTooLarge
+	}
+	n, err := l.w.Write(p)
+	l.n -= int64(n)
+	return n, err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+// A mirrored repository's go.mod declares the module path it has
+// upstream, e.g. github.com/trusted-cloud/foo, not the path clients
+// request, e.g. pegasus-cloud.com/aes/foo, and the go command rejects
+// the mismatch. Artifacts in the rewritten namespace therefore have
+// every upstream path mapped back to the client namespace: the module,
+// require and replace directives of go.mod, both the .mod file and the
+// copy in the zip, and the path prefix of the zip's entries (see
+// rewriteZip).
+
+// pathRewrite maps module paths under upstream to paths under client.
+type pathRewrite struct {
+	upstream, client string
+}
+
+// pathRewrites returns the rewrites of the configured mappings, mounts
+// and artifact store path prefix.
+func pathRewrites() []pathRewrite {
+	var rw []pathRewrite
+	for _, m := range routes().mappings {
+		if m.Dest != "" {
+			rw = append(rw, pathRewrite{m.Dest, m.Src})
+		}
+	}
+	for _, m := range routes().mounts {
+		if m.upstream != nil && m.mapping.Dest != "" {
+			rw = append(rw, pathRewrite{m.mapping.Dest, m.mapping.Src})
+		}
+	}
+	if p := config.Backend.PathPrefix; p != "" {
+		rw = append(rw, pathRewrite{p, SrcRepo})
+	}
+	return rw
+}
+
+// rewritePath maps p by the rewrite with the longest matching upstream
+// prefix. It reports whether p changed.
+func rewritePath(p string, rw []pathRewrite) (string, bool) {
+	best := -1
+	for i, r := range rw {
+		if hasPathPrefix(p, r.upstream) && (best < 0 || len(r.upstream) > len(rw[best].upstream)) {
+			best = i
+		}
+	}
+	if best < 0 || rw[best].upstream == rw[best].client {
+		return p, false
+	}
+	return rw[best].client + strings.TrimPrefix(p, rw[best].upstream), true
+}
+
+// rewriteGoMod rewrites the module, require and replace paths of a
+// go.mod. Paths are replaced in the syntax tree, so comments and layout
+// are kept. It reports whether anything changed.
+func rewriteGoMod(data []byte, rw []pathRewrite) ([]byte, bool, error) {
+	// Parse keeps replace directives, which ParseLax drops, but rejects
+	// directives newer than this build knows.
+	f, err := modfile.Parse("go.mod", data, nil)
+	if err != nil {
+		if f, err = modfile.ParseLax("go.mod", data, nil); err != nil {
+			return nil, false, err
+		}
+	}
+	changed := false
+	rewrite := func(p *string, line *modfile.Line) {
+		if line == nil {
+			return
+		}
+		np, ok := rewritePath(*p, rw)
+		if !ok {
+			return
+		}
+		for i, tok := range line.Token {
+			if tok == *p || tok == modfile.AutoQuote(*p) {
+				line.Token[i] = modfile.AutoQuote(np)
+				break
+			}
+		}
+		*p, changed = np, true
+	}
+	if f.Module != nil {
+		rewrite(&f.Module.Mod.Path, f.Module.Syntax)
+	}
+	for _, r := range f.Require {
+		rewrite(&r.Mod.Path, r.Syntax)
+	}
+	for _, r := range f.Replace {
+		if r.Syntax == nil {
+			continue
+		}
+		// The line holds the old path before "=>" and the new after it.
+		arrow := 0
+		for i, tok := range r.Syntax.Token {
+			if tok == "=>" {
+				arrow = i
+			}
+		}
+		before := &modfile.Line{Token: r.Syntax.Token[:arrow]}
+		rewrite(&r.Old.Path, before)
+		if r.New.Version != "" { // not a directory
+			rewrite(&r.New.Path, &modfile.Line{Token: r.Syntax.Token[arrow:]})
+		}
+	}
+	if !changed {
+		return data, false, nil
+	}
+	out, err := f.Format()
+	return out, true, err
+}
+
+// rewriteArtifacts rewrites the go.mod and zip of name@version in dir,
+// usually its cache entry, in place.
+func rewriteArtifacts(ctx context.Context, dir, name, version string, policy FetchPolicy) error {
+	rw := pathRewrites()
+	if len(rw) == 0 {
+		return nil
+	}
+	path, err := module.UnescapePath(name)
+	if err != nil {
+		return err
+	}
+	gomod := filepath.Join(dir, "go.mod")
+	data, err := os.ReadFile(gomod)
+	if err != nil {
+		return err
+	}
+	out, changed, err := rewriteGoMod(data, rw)
+	if err != nil {
+		return fmt.Errorf("%s@%s: go.mod: %v", name, version, err)
+	}
+	if changed {
+		if err := writeFileAtomic(gomod, out); err != nil {
+			return err
+		}
+	}
+	return rewriteZip(ctx, filepath.Join(dir, "source.zip"), path, version, rw, policy.MaxZipBytes)
+}
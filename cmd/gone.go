@@ -0,0 +1,171 @@
+package main
+
+import (
+	clist "container/list"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The go command treats 404 and 410 alike, falling back to the next
+// proxy in GOPROXY, but they tell operators and caches different
+// things: 404 means the upstream does not have the version, 410 that it
+// had it once. 410 is served for blocked versions (see blocklist.go),
+// for versions the upstream itself answers 410 for, and for versions
+// this proxy cached before, which were evicted or purged and are now
+// missing upstream, e.g. a deleted tag. The removal leaves a tombstone
+// in CacheDir/.tombstones that records the version existed.
+//
+// Either answer is remembered in memory for NotFoundConfig.CacheFor, so
+// clients probing many proxies or versions that do not exist do not
+// load the upstream, and is sent with a max-age of the same length. At
+// most maxNegatives answers are kept, the least recently used dropped
+// first.
+
+// NotFoundConfig configures the caching of negative answers.
+type NotFoundConfig struct {
+	// CacheFor is how long a version's 404 or 410 is reused (default
+	// one minute); a negative value disables caching.
+	CacheFor time.Duration `yaml:"cache_for"`
+}
+
+func notFoundTTL() time.Duration {
+	ttl := config.NotFound.CacheFor
+	if ttl == 0 {
+		ttl = time.Minute
+	}
+	return ttl
+}
+
+// negativeHit is a negative answer served from memory.
+type negativeHit struct{ error }
+
+func (e negativeHit) Unwrap() error { return e.error }
+
+type negativeAnswer struct {
+	key     string // module@version
+	err     error
+	expires time.Time
+}
+
+// negatives holds the remembered answers, the most recently used first.
+// Expired answers are dropped when they are looked up or pushed out by
+// newer ones.
+var negatives = struct {
+	sync.Mutex
+	lru  *clist.List // of *negativeAnswer
+	keys map[string]*clist.Element
+}{lru: clist.New(), keys: make(map[string]*clist.Element)}
+
+// maxNegatives bounds the negative answers kept in memory.
+const maxNegatives = 10000
+
+// cachedNegative returns the remembered negative answer for
+// module@version, or nil.
+func cachedNegative(module, version string) error {
+	negatives.Lock()
+	defer negatives.Unlock()
+	key := module + "@" + version
+	el, ok := negatives.keys[key]
+	if !ok {
+		return nil
+	}
+	a := el.Value.(*negativeAnswer)
+	if time.Now().After(a.expires) {
+		negatives.lru.Remove(el)
+		delete(negatives.keys, key)
+		return nil
+	}
+	negatives.lru.MoveToFront(el)
+	return negativeHit{a.err}
+}
+
+// rememberNegative remembers err for module@version if it is a 404 or
+// 410, and turns a 404 for a tombstoned version into a 410.
+func rememberNegative(module, version string, err error) error {
+	if errors.Is(err, errNotFound) && hasTombstone(module, version) {
+		err = kindError{fmt.Sprintf("%s@%s is no longer available upstream: %v", module, version, err), errGone}
+	}
+	ttl := notFoundTTL()
+	if ttl < 0 || !(errors.Is(err, errNotFound) || errors.Is(err, errGone)) {
+		return err
+	}
+	negatives.Lock()
+	defer negatives.Unlock()
+	key := module + "@" + version
+	a := &negativeAnswer{key, err, time.Now().Add(ttl)}
+	if el, ok := negatives.keys[key]; ok {
+		el.Value = a
+		negatives.lru.MoveToFront(el)
+		return err
+	}
+	negatives.keys[key] = negatives.lru.PushFront(a)
+	for negatives.lru.Len() > maxNegatives {
+		el := negatives.lru.Back()
+		delete(negatives.keys, negatives.lru.Remove(el).(*negativeAnswer).key)
+	}
+	return err
+}
+
+// forgetNegative drops the negative answers for module@version, or for
+// every version of module if version is empty.
+func forgetNegative(module, version string) {
+	negatives.Lock()
+	defer negatives.Unlock()
+	if version != "" {
+		if el, ok := negatives.keys[module+"@"+version]; ok {
+			negatives.lru.Remove(el)
+			delete(negatives.keys, module+"@"+version)
+		}
+		return
+	}
+	for k, el := range negatives.keys {
+		if strings.HasPrefix(k, module+"@") {
+			negatives.lru.Remove(el)
+			delete(negatives.keys, k)
+		}
+	}
+}
+
+// setNegativeHeaders sets the caching headers of a 404 or 410 for err.
+func setNegativeHeaders(w http.ResponseWriter, err error) {
+	if code := statusOf(err); code != http.StatusNotFound && code != http.StatusGone {
+		return
+	}
+	ttl := notFoundTTL()
+	if ttl < 0 {
+		w.Header().Set("Cache-Control", "no-store")
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(ttl/time.Second)))
+	// RFC 9211 Cache-Status tells a remembered answer from a fresh one.
+	var hit negativeHit
+	if errors.As(err, &hit) {
+		w.Header().Set("Cache-Status", "goproxy; hit")
+	} else {
+		w.Header().Set("Cache-Status", "goproxy; fwd=miss; stored")
+	}
+}
+
+func tombstonePath(module, version string) string {
+	return filepath.Join(CacheDir, ".tombstones", module, version)
+}
+
+// addTombstone records that module@version was cached. Whatever removes
+// a complete cache entry for good (eviction, purges) must call it.
+func addTombstone(module, version string) {
+	p := tombstonePath(module, version)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err == nil {
+		os.WriteFile(p, nil, 0644)
+	}
+}
+
+func hasTombstone(module, version string) bool {
+	_, err := os.Stat(tombstonePath(module, version))
+	return err == nil
+}
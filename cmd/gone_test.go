@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNegativesBounded(t *testing.T) {
+	keepState(t)
+	CacheDir = t.TempDir()
+	defer func() {
+		negatives.lru.Init()
+		clear(negatives.keys)
+	}()
+	notFound := kindError{"not found", errNotFound}
+	for i := range maxNegatives + 10 {
+		rememberNegative("example.com/m", fmt.Sprintf("v1.0.%d", i), notFound)
+	}
+	if n := len(negatives.keys); n != maxNegatives {
+		t.Errorf("%d answers, want %d", n, maxNegatives)
+	}
+	if err := cachedNegative("example.com/m", "v1.0.0"); err != nil {
+		t.Errorf("least recently used answer kept: %v", err)
+	}
+	last := fmt.Sprintf("v1.0.%d", maxNegatives+9)
+	if err := cachedNegative("example.com/m", last); !errors.Is(err, errNotFound) {
+		t.Errorf("cachedNegative(%s) = %v", last, err)
+	}
+
+	negatives.keys["example.com/m@v1.0.1000"].Value.(*negativeAnswer).expires = time.Now().Add(-time.Second)
+	if err := cachedNegative("example.com/m", "v1.0.1000"); err != nil {
+		t.Errorf("expired answer returned: %v", err)
+	}
+	if _, ok := negatives.keys["example.com/m@v1.0.1000"]; ok {
+		t.Error("expired answer kept after lookup")
+	}
+
+	forgetNegative("example.com/m", last)
+	if err := cachedNegative("example.com/m", last); err != nil {
+		t.Errorf("forgotten answer returned: %v", err)
+	}
+	forgetNegative("example.com/m", "")
+	if n, l := len(negatives.keys), negatives.lru.Len(); n != 0 || l != 0 {
+		t.Errorf("%d answers (%d listed) after forgetting the module", n, l)
+	}
+}
+
+func TestRememberNegativeTombstone(t *testing.T) {
+	keepState(t)
+	CacheDir = t.TempDir()
+	defer func() {
+		negatives.lru.Init()
+		clear(negatives.keys)
+	}()
+	addTombstone("example.com/m", "v1.0.0")
+	err := rememberNegative("example.com/m", "v1.0.0", kindError{"not found", errNotFound})
+	if !errors.Is(err, errGone) {
+		t.Errorf("rememberNegative for a tombstoned version = %v, want gone", err)
+	}
+	if err := cachedNegative("example.com/m", "v1.0.0"); !errors.Is(err, errGone) {
+		t.Errorf("cachedNegative = %v, want gone", err)
+	}
+}
@@ -54,10 +54,10 @@
 // - MODULE/@latest (optional)
 //
 //	These two endpoints request information about the available
-//	versions of a module, and are implemented by 'go list -m'
-//	commands: /@v/list uses -versions to query the tags in the
-//	version-control system that hosts the module, and /@latest uses
-//	the query "module@latest" to obtain the current version.
+//	versions of a module: /@v/list lists the tags in the
+//	version-control system that hosts the module, and /@latest picks
+//	the current version from that list in process, as do semantic
+//	version queries such as MODULE/@v/<v1.5.0.info.
 //
 //	Because the set of versions may change at any moment, caching the
 //	results of these queries inevitably results in the delivery of
@@ -70,130 +70,174 @@
 //	$ go get <module>
 package main
 
-// TODO: when should we emit StatusGone? (see github.com/golang/go/issues/30134)
-
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 )
 
-var CacheDir, DestRepoToken, DestRepo, SrcRepo, Port string
+// Startup configuration, published by (*Server).install.
+var CacheDir, DestRepo, SrcRepo, Listen string
 
+// user is sent with the repository tokens as basic auth.
 var user = "dummy"
 
 func main() {
-
-	Port = os.Getenv("PORT")
-	if Port == "" {
-		Port = "8078"
+	memLimit := flag.String("memory-limit", os.Getenv("MEMORY_LIMIT"), "soft memory limit, e.g. 2GiB (default: 90% of the cgroup limit)")
+	tlsCert := flag.String("tls-cert", os.Getenv("TLS_CERT"), "PEM certificate file to serve HTTPS with, together with --tls-key")
+	tlsKey := flag.String("tls-key", os.Getenv("TLS_KEY"), "PEM private key file of --tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", os.Getenv("TLS_CLIENT_CA"), "PEM CA bundle to require and verify client certificates with")
+	tlsClientOptional := flag.Bool("tls-client-cert-optional", os.Getenv("TLS_CLIENT_CERT_OPTIONAL") == "true", "accept clients without a certificate, e.g. to authenticate with tokens")
+	acmeDomains := flag.String("acme-domains", os.Getenv("ACME_DOMAINS"), "comma-separated host names to serve HTTPS for with Let's Encrypt certificates")
+	acmeEmail := flag.String("acme-email", os.Getenv("ACME_EMAIL"), "contact address for the ACME account")
+	acmeCache := flag.String("acme-cache", os.Getenv("ACME_CACHE"), "directory of obtained certificates (default: CACHE_DIR/.acme)")
+	acmeHTTP := flag.String("acme-http", os.Getenv("ACME_HTTP"), "address, e.g. :80, to answer HTTP-01 challenges and redirect to HTTPS on")
+	getenv := settingFlags(flag.CommandLine, os.Getenv)
+	flag.Parse()
+
+	if flag.Arg(0) == "bundle" {
+		if err := runBundle(getenv, flag.Args()[1:]); err != nil {
+			log.Fatalf("bundle: %v", err)
+		}
+		return
 	}
-
-	CacheDir = os.Getenv("CACHE_DIR")
-	if CacheDir == "" {
-		CacheDir = "/tmp/cache"
+	s, err := newServer(getenv)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
 	}
-
-	DestRepoToken = os.Getenv("REPO_TOKEN")
-	if DestRepoToken == "" {
-		log.Fatal("Error: REPO_TOKEN environment variable not set")
+	s.TLS = TLSOptions{
+		CertFile:           *tlsCert,
+		KeyFile:            *tlsKey,
+		ClientCAFile:       *tlsClientCA,
+		ClientCertOptional: *tlsClientOptional,
+		ACMEDomains:        splitList(*acmeDomains),
+		ACMEEmail:          *acmeEmail,
+		ACMECache:          *acmeCache,
+		ACMEHTTPAddr:       *acmeHTTP,
 	}
-
-	SrcRepo = removeSchemeAndTrailingSlash(os.Getenv("SRC_REPO"))
-	if SrcRepo == "" {
-		log.Fatal("Error: SRC_REPO environment variable not set")
+	if err := s.TLS.check(); err != nil {
+		log.Fatalf("Error: %v", err)
 	}
-
-	DestRepo = removeSchemeAndTrailingSlash(os.Getenv("DEST_REPO"))
-	if DestRepo == "" {
-		log.Fatal("Error: DEST_REPO environment variable not set")
+	if err := s.install(); err != nil {
+		log.Fatalf("%v", err)
 	}
-
-	log.Println("Proxy Module Cache Directory:", CacheDir)
-
-	if err := os.MkdirAll(CacheDir, 0755); err != nil {
-		log.Fatalf("creating cache: %v", err)
+	if err := setupMemory(*memLimit); err != nil {
+		log.Fatalf("%v", err)
 	}
+	if err := s.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	log.Println("Mapping module from", SrcRepo, "to", DestRepo)
-	log.Println("Token is required for", DestRepo, ":", DestRepoToken)
-	log.Println("Starting server on :", Port)
-
-	router := mux.NewRouter()
-	router.HandleFunc("/{module:.+}/@v/list", list).Methods(http.MethodGet)
-	router.HandleFunc("/{module:.+}/@v/{version}.{ext}", handler).Methods(http.MethodGet)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", Port), isValidPkg(router)))
+// registerModuleRoutes installs the GOPROXY protocol endpoints for
+// modules under any of srcs on r, the module root at prefix, behind the
+// given middleware and the root's configured chain (see chain.go).
+func registerModuleRoutes(r *mux.Router, prefix string, srcs []string, mw ...mux.MiddlewareFunc) {
+	r.Use(mw...)
+	r.Use(redirectRenamed)
+	r.Use(isValidPkg(srcs))
+	r.Use(routeChain(prefix)...)
+	r.Use(enforceBlocks)
+	r.Use(resolveQueries)
+	r.HandleFunc("/{module:.+}/@v/list", list).Methods(http.MethodGet)
+	r.HandleFunc("/{module:.+}/@latest", latest).Methods(http.MethodGet)
+	r.HandleFunc("/{module:.+}/@v/{version}.{ext}", handler).Methods(http.MethodGet)
 }
 
-func isValidPkg(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !strings.HasPrefix(r.URL.Path, "/"+SrcRepo) {
+func isValidPkg(srcs []string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, src := range srcs {
+				if strings.HasPrefix(mux.Vars(r)["module"], src) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
 			http.Error(w, fmt.Sprintf("%s is ignored", r.URL), http.StatusNotFound)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
+		})
+	}
 }
 
 func list(w http.ResponseWriter, r *http.Request) {
-
-	log.Println("list", r.URL.Path)
-
-	mod := mux.Vars(r)["module"]
-
-	mod, err := module.UnescapePath(mod)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	escaped := mux.Vars(r)["module"]
+	if _, err := module.UnescapePath(escaped); err != nil {
+		httpError(w, kindError{err.Error(), errNotFound})
 		return
 	}
-
-	versions, err := listVersionsGit(mod)
+	versions, err := visibleVersions(r, escaped)
+	// Only a module the upstream lacks has no versions; a path naming
+	// no module stays not found.
+	var nr noRepoError
+	if errors.Is(err, errNotFound) && !errors.As(err, &nr) && config.UnknownModuleList == unknownListEmpty {
+		versions, err = nil, nil
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		httpError(w, err)
 		return
 	}
 
 	w.Header().Set("Cache-Control", "no-store")
-	for _, v := range versions {
-		fmt.Fprintln(w, v)
-	}
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	streamVersions(w, versions)
 }
 
 // listVersionsGit runs 'git ls-remote --tags <GIT_HTTP_REPO>'
 // and returns an unordered list of tags of the specified repo.
-func listVersionsGit(name string) ([]string, error) {
-
-	result := []string{}
+func listVersionsGit(ctx context.Context, m repoMapping, name string) ([]string, error) {
+	versions, _, err := listRefsGit(ctx, m, name, "")
+	return versions, err
+}
 
-	repoURL := buildGitRepoURL(name)
-	log.Println("git ", repoURL)
+// listRefsGit is listVersionsGit that also returns the hash of the
+// advertised tags, and returns no versions without parsing them if it
+// equals since.
+func listRefsGit(ctx context.Context, m repoMapping, name, since string) ([]string, string, error) {
+	repoURL, err := m.repoURL(name)
+	if err != nil {
+		return nil, "", err
+	}
+	slog.DebugContext(ctx, "git ls-remote", "repo", repoURL)
 
-	gitURL := fmt.Sprintf("https://%s:%s@%s", user, DestRepoToken, repoURL)
-	cmd := exec.Command("git", "ls-remote", "--tags", gitURL)
+	gitURL := fmt.Sprintf("https://%s:%s@%s", user, m.Token, repoURL)
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--tags", gitURL)
 
 	// Execute the git command
-	stdout, err := cmd.StdoutPipe()
+	stdout, err := runOutput(ctx, cmd)
 	if err != nil {
-		return nil, err
+		return nil, "", gitError(err)
 	}
-
-	if err := cmd.Start(); err != nil {
-		return nil, err
+	refs := refsHash(stdout)
+	if refs == since {
+		return nil, refs, nil
 	}
+	result, err := parseTags(stdout, m, name)
+	return result, refs, err
+}
 
-	// Use rev | cut -d/ -f1 | rev to extract tag names
-	reader := bufio.NewReader(stdout)
+// parseTags returns the versions of module name that the tags in the
+// output of git ls-remote name; see tagVersion.
+func parseTags(stdout []byte, m repoMapping, name string) ([]string, error) {
+	result := []string{}
+	reader := bufio.NewReader(bytes.NewReader(stdout))
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
@@ -202,25 +246,38 @@ func listVersionsGit(name string) ([]string, error) {
 			}
 			return nil, err
 		}
-
-		line = strings.TrimSpace(line) // Remove leading/trailing whitespace
-		segments := strings.Split(line, "/")
-
-		// Check if the line contains enough segments to be a tag
-		if len(segments) > 2 && strings.Contains(line, "refs/tags/") { // More robust tag check
-			tagName := segments[len(segments)-1] // Get the last element
-
-			// fmt.Println(tagName)
-			result = append(result, tagName)
+		_, ref, _ := strings.Cut(strings.TrimSpace(line), "\t")
+		tag, ok := strings.CutPrefix(ref, "refs/tags/")
+		if !ok {
+			continue
+		}
+		if v, ok := m.tagVersion(name, tag); ok {
+			result = append(result, v)
 		}
-
 	}
+	return result, nil
+}
 
-	if err := cmd.Wait(); err != nil {
-		return nil, err
+// tagVersion returns the version of module name that tag names, if it
+// names one: a canonical semantic version, prefixed with the module's
+// directory in the repository, of the module's major version. Tags of
+// other modules in the repository, and peeled tags, name none.
+func (m repoMapping) tagVersion(name, tag string) (string, bool) {
+	if dir := m.subdir(name); dir != "" {
+		var ok bool
+		if tag, ok = strings.CutPrefix(tag, dir+"/"); !ok {
+			return "", false
+		}
 	}
-
-	return result, nil
+	if !semver.IsValid(tag) || tag != semver.Canonical(tag) {
+		return "", false
+	}
+	_, pathMajor, _ := module.SplitPathVersion(name)
+	major := strings.TrimPrefix(pathMajor, "/")
+	if vm := semver.Major(tag); vm != major && !(major == "" && (vm == "v0" || vm == "v1")) {
+		return "", false
+	}
+	return tag, true
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
@@ -230,38 +287,211 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	version := vars["version"]
 	ext := vars["ext"]
 
-	var filename, mimetype string
+	if err := checkVersion(version); err != nil {
+		httpError(w, err)
+		return
+	}
 
+	var filename, mimetype string
 	switch ext {
 	case "info":
-		filename = filepath.Join(CacheDir, module, version, version+".info")
+		filename = filepath.Join(entryDir(module, version), version+".info")
 		mimetype = "application/json"
-		log.Println("info", r.URL.Path)
 	case "mod":
-		filename = filepath.Join(CacheDir, module, version, "go.mod")
+		filename = filepath.Join(entryDir(module, version), "go.mod")
 		mimetype = "text/plain; charset=UTF-8"
-		log.Println("mod ", r.URL.Path)
 	case "zip":
-		filename = filepath.Join(CacheDir, module, version, "source.zip")
+		filename = filepath.Join(entryDir(module, version), "source.zip")
 		mimetype = "application/zip"
-		log.Println("zip ", r.URL.Path)
+	case "sum":
+		serveGoSum(w, r, module, version)
+		return
 	default:
 		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
 	}
 
-	for !serveCachedFile(w, r, filename, mimetype) {
-		if err := fetchAndCache(module, version); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := ensureCached(r.Context(), module, version, filename); err != nil {
+		setNegativeHeaders(w, err)
+		httpError(w, err)
+		return
+	}
+	if path, ok := upstreamPathOf(r); ok && ext != "info" {
+		var err error
+		if filename, err = dualStackFile(r.Context(), module, version, filename, path); err != nil {
+			httpError(w, err)
 			return
 		}
 	}
+	serveVersionFile(w, r, module, version, ext, filename, mimetype)
+}
+
+// ensureCached makes sure filename of module@version is in the cache,
+// pulling it from the remote store or fetching it from the backend,
+// unless the proxy is in maintenance mode. Concurrent misses of the
+// same version share one fill. A version the upstream lacks is answered
+// from memory for a while (see gone.go).
+func ensureCached(ctx context.Context, module, version, filename string) error {
+	if cached(module, version, filename) {
+		countLookup(module, "hit")
+		return nil
+	}
+	if err := cachedNegative(module, version); err != nil {
+		return err
+	}
+	err := lookups.do(ctx, module+"@"+version+"/"+filepath.Base(filename), func(ctx context.Context) error {
+		// A fill started for another file of the version may have found
+		// that file cached but not this one; fill again until a fill
+		// has checked for this file.
+		for {
+			checked := false
+			err := fillVersion(ctx, module, version, filename, &checked)
+			if err != nil || checked || cached(module, version, filename) {
+				return err
+			}
+		}
+	})
+	return rememberNegative(module, version, err)
+}
+
+// fillVersion fills module@version unless filename of it is cached,
+// holding the version's fill, and sets checked if it was this call that
+// checked for filename rather than one for another file.
+func fillVersion(ctx context.Context, module, version, filename string, checked *bool) error {
+	return fills.do(ctx, module+"@"+version, func(ctx context.Context) error {
+		*checked = true
+		// A fill that just finished may have brought it, or the version
+		// is cached but not yet checked.
+		if verifyCached(module, version, filename) {
+			countLookup(module, "hit")
+			return nil
+		}
+		if err := checkRecoveries(module, version); err != nil {
+			return err
+		}
+		if err := checkMaintenance(); err != nil {
+			return err
+		}
+		// Only the caller that starts a fill pays for it; joining one
+		// in flight costs nothing.
+		if err := takeFetch(ctx); err != nil {
+			return err
+		}
+		if pullFromStore(ctx, module, version) {
+			countLookup(module, "store")
+			return nil
+		}
+		countLookup(module, "upstream")
+		if err := verifyOwnership(ctx, module); err != nil {
+			if errors.Is(err, errPolicyDenied) {
+				slog.WarnContext(ctx, "ownership", "module", module, "err", err)
+			}
+			return err
+		}
+		return fetchWithRetries(ctx, module, version)
+	})
+}
+
+// fetchWithRetries fetches module@version into the cache, retrying as
+// allowed by the module's fetch policy and ctx's deadline, and runs
+// afterFetch. Callers must hold the version's fill.
+func fetchWithRetries(ctx context.Context, module, version string) error {
+	if err := fetchRetrying(ctx, module, version); err != nil {
+		return err
+	}
+	// The digests were just taken from the files.
+	entries.add(module, version)
+	noteFetchSuccess(module, version)
+	afterFetch(module, version)
+	return nil
+}
+
+// fetchRetrying runs up to 1+Retries attempts of fetchAndCache, each
+// limited to the policy's Timeout, until ctx is done. Failed attempts
+// are recorded for the module's health report.
+func fetchRetrying(ctx context.Context, module, version string) error {
+	policy := fetchPolicyFor(module)
+	fetch := func() error {
+		err := fetchAndCache(ctx, module, version, policy)
+		// Every client that wanted it went away: no fault upstream.
+		if err != nil && !errors.Is(err, context.Canceled) {
+			noteFetchFailure(module, version, err)
+		}
+		return err
+	}
+	err := fetch()
+	for attempt := 1; err != nil && attempt <= policy.Retries; attempt++ {
+		if permanent(err) || ctx.Err() != nil {
+			break
+		}
+		slog.WarnContext(ctx, "fetch failed", "module", module, "version", version, "attempt", attempt, "attempts", policy.Retries+1, "err", err)
+		select {
+		case <-time.After(policy.RetryBackoff):
+		case <-ctx.Done():
+			return fmt.Errorf("%w; no budget left to retry", err)
+		}
+		err = fetch()
+	}
+	return err
+}
+
+// afterFetch runs the hooks for a version that was just fetched from
+// the backend: quarantined versions are scanned, all others are
+// published to the remote store.
+func afterFetch(module, version string) {
+	checkFetchedToolchain(module, version)
+	if quarantineApplies(module) {
+		go scanQuarantined(module, version)
+	} else {
+		pushToStore(module, version)
+	}
+}
+
+// serveVersionFile serves a cached artifact of module@version, subject
+// to the version's quarantine state.
+func serveVersionFile(w http.ResponseWriter, r *http.Request, module, version, ext, filename, mimetype string) {
+	if isQuarantined(callerFrom(r.Context()), module, version) {
+		httpError(w, kindError{fmt.Sprintf("%s@%s is quarantined pending review", module, version), errPolicyDenied})
+		return
+	}
+	w.Header().Set("Cache-Control", cacheControl(r, version))
+	var served, hot bool
+	if ext == "info" {
+		// Accept selects the extended .info.
+		w.Header().Set("Vary", "Accept")
+	}
+	if ext == "info" && wantsOrigin(r) {
+		served = serveExtendedInfo(w, module, version, filename)
+	} else if data, modTime, ok := hotFiles.load(module, version, ext, filename); ok {
+		w.Header().Set("Content-Type", mimetype)
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+		served, hot = true, true
+	} else {
+		served = serveCachedFile(w, r, filename, mimetype)
+	}
+	if !served {
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, fmt.Sprintf("%s not found after fetch", r.URL.Path), http.StatusInternalServerError)
+		return
+	}
+	if hot && !hotFiles.touchDue(filename) {
+		countDownload(module, version)
+	} else {
+		touchAccess(module, version)
+	}
+	recordBuild(r, module, version, ext)
+	if ext == "zip" {
+		recordDownload(r, module, version)
+	}
 }
 
 func serveCachedFile(w http.ResponseWriter, r *http.Request, cachePath string, mime string) bool {
 
-	w.Header().Set("Cache-Control", "no-store")
 	w.Header().Set("Content-Type", mime)
 
+	if config.Hardening {
+		return serveRegularFile(w, r, cachePath)
+	}
 	if _, err := os.Stat(cachePath); err == nil {
 		http.ServeFile(w, r, cachePath)
 		return true
@@ -269,139 +499,267 @@ func serveCachedFile(w http.ResponseWriter, r *http.Request, cachePath string, m
 	return false
 }
 
-func fetchAndCache(name, version string) error {
+func fetchAndCache(ctx context.Context, name, version string, policy FetchPolicy) (err error) {
 
-	repoURL := buildGitRepoURL(name)
-	log.Println("git ", repoURL)
+	ctx, cancel := context.WithTimeout(ctx, policy.Timeout)
+	defer cancel()
+	ctx, span := startSpan(ctx, "fetch", spanInternal)
+	span.set("module", name)
+	span.set("version", version)
+	defer func() { span.end(err) }()
 
-	// Create a temporary directory for the git clone
-	cloneTempDir, err := os.MkdirTemp("", "git-clone-temp")
-	if err != nil {
+	if err := checkVersion(version); err != nil {
 		return err
 	}
-	defer os.RemoveAll(cloneTempDir) // Clean up the clone temp dir when the program exits
-
 	// create cached directory
-	destDir := filepath.Join(CacheDir, name, version)
+	destDir := entryDir(name, version)
+	_, derr := os.Stat(destDir)
+	created := errors.Is(derr, fs.ErrNotExist)
 	if err := os.MkdirAll(destDir, 0755); err != nil {
 		return err
 	}
+	// Don't leave a partial entry behind for serveCachedFile to find,
+	// nor the quarantine record of a version that was never fetched.
+	// Only a directory this fetch created is removed whole.
+	_, serr := os.Stat(quarantinePath(name, version))
+	evicted := serr == nil
+	defer func() {
+		if err != nil {
+			if created {
+				os.RemoveAll(destDir)
+			} else {
+				removeEntry(destDir)
+				if !evicted {
+					os.Remove(quarantinePath(name, version))
+					os.Remove(destDir)
+				}
+			}
+			entries.forget(name, version)
+		}
+	}()
 
-	// 5. Construct the git clone command with the token and branch
-	cloneURL := fmt.Sprintf("https://dummy:%s@%s", DestRepoToken, repoURL)
-
-	cmd := exec.Command("git", "clone", "-b", version, cloneURL, cloneTempDir)
+	if quarantineApplies(name) {
+		if err := quarantineNew(name, version); err != nil {
+			return err
+		}
+	}
 
-	// 6. Execute the git clone command
-	if output, err := cmd.CombinedOutput(); err != nil {
-		log.Println(string(output))
+	release, err := acquireFetchSlot(ctx)
+	if err != nil {
 		return err
 	}
+	defer release()
+	if err := upstreamFor(name).Fetch(ctx, name, version, destDir, policy); err != nil {
+		// A subprocess killed at the deadline reports only its signal.
+		if ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+			return fmt.Errorf("%v: %w", err, ctx.Err())
+		}
+		return err
+	}
+	if cacheNS == nsRewritten {
+		if err := rewriteArtifacts(ctx, destDir, name, version, policy); err != nil {
+			return err
+		}
+	}
+	return writeProvenance(name, version)
+}
+
+// cached reports whether filename of name@version is in the cache and
+// the entry was checked since the process started (see verifyCached).
+func cached(name, version, filename string) bool {
+	if hotFiles.has(filename) {
+		return true
+	}
+	if _, err := os.Stat(filename); err != nil {
+		return false
+	}
+	return entries.has(name, version)
+}
+
+// verifyCached is cached that, the first time the process serves
+// name@version, also checks that the entry belongs to the current
+// namespace and that its files match their digests, evicting it if they
+// do not. Callers must hold the version's fill, since an eviction must
+// not race a fill of the same directory.
+func verifyCached(name, version, filename string) bool {
+	if cached(name, version, filename) {
+		return true
+	}
+	if _, err := os.Stat(filename); err != nil {
+		return false
+	}
+	if !validEntry(name, version) {
+		return false
+	}
+	if file, err := checkIntegrity(name, version); err != nil {
+		evictCorrupt(name, version, file, err)
+		return false
+	}
+	entries.add(name, version)
+	return true
+}
 
-	// 7. Get the git log date
-	logCmd := exec.Command("git", "log", "-1", "--format=%cI")
-	logCmd.Dir = cloneTempDir // Set the working directory to the cloned repo
+// repoMapping maps module paths under Src to repositories under Dest,
+// which are accessed with Token.
+type repoMapping struct {
+	Src, Dest, Token string
+}
 
-	// Set the GIT_PAGER environment variable to "cat"
-	env := os.Environ()
-	env = append(env, "GIT_PAGER=cat")
-	logCmd.Env = env
+// gitBackend fetches modules by cloning the mapped repository.
+type gitBackend struct {
+	repoMapping
+}
 
-	logOutput, err := logCmd.CombinedOutput()
+func (b gitBackend) List(ctx context.Context, name string) ([]string, error) {
+	return listVersionsGit(ctx, b.repoMapping, name)
+}
+
+func (b gitBackend) ListRefs(ctx context.Context, name, since string) ([]string, string, error) {
+	return listRefsGit(ctx, b.repoMapping, name, since)
+}
+
+// Fetch builds the artifacts of version from a shallow fetch of just
+// that tag or branch, without checking out a working tree. For a module
+// in a subdirectory of its repository only the trees are fetched and
+// the blobs under the subdirectory are filled in by a sparse checkout,
+// so a large monorepo costs no more than the module itself.
+func (b gitBackend) Fetch(ctx context.Context, name, version, destDir string, policy FetchPolicy) error {
+
+	repoURL, err := b.repoURL(name)
 	if err != nil {
-		log.Println(string(logOutput))
 		return err
 	}
+	dir := b.subdir(name)
+	slog.DebugContext(ctx, "git clone", "repo", repoURL, "dir", dir)
 
-	logDate := strings.TrimSpace(string(logOutput))
+	// Create a temporary directory for the git repository
+	cloneTempDir, err := mkdirTemp("git-clone-temp")
+	if err != nil {
+		return err
+	}
+	defer removeTemp(cloneTempDir)
 
-	// 8. Create the Info struct
-	info := Info{
-		Version: version,
-		Time:    logDate,
+	git := func(args ...string) ([]byte, error) {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = cloneTempDir
+		cmd.Env = append(os.Environ(), "GIT_PAGER=cat", "GIT_TERMINAL_PROMPT=0")
+		out, err := runOutput(ctx, cmd)
+		if err != nil {
+			var ee *exec.ExitError
+			if errors.As(err, &ee) {
+				slog.DebugContext(ctx, "git", "stderr", string(ee.Stderr))
+			}
+			return nil, gitError(err)
+		}
+		return out, nil
 	}
 
-	// 9. Marshal the Info struct to JSON
-	jsonData, err := json.Marshal(info)
-	if err != nil {
-		return err
+	// Pseudo-versions are fetched by commit. Tags of modules in a
+	// subdirectory carry the directory as prefix.
+	ref := version
+	switch {
+	case module.IsPseudoVersion(version):
+		if ref, err = b.commitOf(ctx, name, version); err != nil {
+			return err
+		}
+	case dir != "":
+		ref = dir + "/" + version
+	}
+	cloneURL := fmt.Sprintf("https://dummy:%s@%s", b.Token, repoURL)
+	fetch := []string{"fetch", "--depth=1", "--no-tags", "origin", ref}
+	if dir != "" {
+		fetch = []string{"fetch", "--depth=1", "--no-tags", "--filter=blob:none", "origin", ref}
+	}
+	steps := [][]string{
+		{"init", "-q"},
+		{"remote", "add", "origin", cloneURL},
+		fetch,
+	}
+	if dir != "" {
+		steps = append(steps,
+			[]string{"sparse-checkout", "set", dir},
+			[]string{"checkout", "-q", "FETCH_HEAD"},
+		)
+	}
+	for _, args := range steps {
+		if _, err := git(args...); err != nil {
+			return err
+		}
 	}
 
-	// 10. Create the filename and destination path for info
-	infoFilename := fmt.Sprintf("%s.info", version)
-	infoDestPath := filepath.Join(destDir, infoFilename)
+	tree, gomodPath := "FETCH_HEAD", "FETCH_HEAD:go.mod"
+	if dir != "" {
+		tree, gomodPath = "FETCH_HEAD:"+dir, "FETCH_HEAD:"+dir+"/go.mod"
+	}
 
-	// 11. Write the JSON data to the file in the tmp directory
-	err = os.WriteFile(infoDestPath, jsonData, 0644)
+	logOutput, err := git("log", "-1", "--format=%H %cI", "FETCH_HEAD")
 	if err != nil {
 		return err
 	}
-
-	// 12. Copy go.mod to the tmp directory
-	sourceGoMod := filepath.Join(cloneTempDir, "go.mod") // Source path in the cloned repo
-	destGoMod := filepath.Join(destDir, "go.mod")        // Destination in the tmp directory
-
-	err = copyFile(sourceGoMod, destGoMod)
+	hash, commitTime, _ := strings.Cut(strings.TrimSpace(string(logOutput)), " ")
+	jsonData, err := json.Marshal(Info{
+		Version: version,
+		Time:    commitTime,
+	})
 	if err != nil {
 		return err
 	}
-
-	// 13. Create the zip archive
-	prefix := fmt.Sprintf("%s@%s/", name, version) // Correct prefix format
-	zipCmd := exec.Command("git", "archive",
-		fmt.Sprintf("--prefix=%s", prefix), // Use formatted prefix
-		"--format", "zip",
-		"--output", "source.zip",
-		version, // Specify the tag for the archive
-		".")
-
-	zipCmd.Dir = cloneTempDir // Execute the command within the cloned repo
-
-	if output, err := zipCmd.CombinedOutput(); err != nil {
-		log.Println(string(output))
+	if err := os.WriteFile(filepath.Join(destDir, version+".info"), jsonData, 0644); err != nil {
 		return err
 	}
 
-	sourceZip := filepath.Join(cloneTempDir, "source.zip") // Source path in the cloned repo
-	destZip := filepath.Join(destDir, "source.zip")        // Destination in the tmp directory
-
-	err = copyFile(sourceZip, destZip)
+	gomod, err := git("cat-file", "blob", gomodPath)
 	if err != nil {
 		return err
 	}
+	if err := os.WriteFile(filepath.Join(destDir, "go.mod"), gomod, 0644); err != nil {
+		return err
+	}
 
-	return nil
+	prefix := fmt.Sprintf("%s@%s/", name, version)
+	destZip := filepath.Join(destDir, "source.zip")
+	if _, err := git("archive", "--prefix="+prefix, "--format=zip", "--output="+destZip, tree); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(destZip); err != nil {
+		return err
+	} else if fi.Size() > policy.MaxZipBytes {
+		return fmt.Errorf("%s@%s: %w (%d > %d bytes)", name, version, errTooLarge, fi.Size(), policy.MaxZipBytes)
+	}
+	origin := &Origin{VCS: "git", URL: "https://" + repoURL, Subdir: dir, Hash: hash}
+	if !module.IsPseudoVersion(version) {
+		origin.Ref = "refs/tags/" + ref
+	}
+	return recordOrigin(destDir, origin)
 }
 
-func buildGitRepoURL(name string) string {
-	escapedPrefix := regexp.QuoteMeta(SrcRepo)
+// noRepoError is the errNotFound of a module path naming no repository.
+type noRepoError struct{ kindError }
+
+// repoURL returns the repository of module name. A name that is the
+// prefix itself, naming no repository under it, is not found.
+func (m repoMapping) repoURL(name string) (string, error) {
+	escapedPrefix := regexp.QuoteMeta(m.Src)
 	re := regexp.MustCompile("^" + escapedPrefix)
 	segment := strings.Split(re.ReplaceAllString(name, ""), "/")
+	if len(segment) < 2 || segment[1] == "" {
+		return "", noRepoError{kindError{fmt.Sprintf("%s names no repository under %s", name, m.Src), errNotFound}}
+	}
 	pkg := segment[1]
 
-	return filepath.Join(DestRepo, pkg)
+	return filepath.Join(m.Dest, pkg), nil
 }
 
-// copyFile copies a file from source to destination
-func copyFile(source, destination string) error {
-	sourceFile, err := os.Open(source)
-	if err != nil {
-		return err
-	}
-	defer sourceFile.Close()
-
-	destFile, err := os.Create(destination)
-	if err != nil {
-		return err
+// subdir returns the directory of module name within its repository,
+// empty for a module at the repository root. A trailing major version
+// suffix such as /v2 names no directory.
+func (m repoMapping) subdir(name string) string {
+	rest := strings.TrimPrefix(name, m.Src+"/")
+	_, dir, _ := strings.Cut(rest, "/")
+	if prefix, major, ok := module.SplitPathVersion("/" + dir); ok && major != "" {
+		dir = prefix
 	}
-	defer destFile.Close()
-
-	_, err = io.Copy(destFile, sourceFile)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return strings.Trim(dir, "/")
 }
 
 func removeSchemeAndTrailingSlash(url string) string {
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCheckVersion(t *testing.T) {
+	for _, tt := range []struct {
+		version string
+		ok      bool
+	}{
+		{"v1.0.0", true},
+		{"v2.0.0+incompatible", true},
+		{"v0.0.0-20240101000000-0123456789ab", true},
+		{"v1.0.0-!r!c.1", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"v1.0.0/..", false},
+		{`v1.0.0\..`, false},
+		{"v1.0", false},
+		{"master", false},
+		{"v1.0.0-RC.1", false}, // unescaped upper case
+	} {
+		if err := checkVersion(tt.version); (err == nil) != tt.ok {
+			t.Errorf("checkVersion(%q) = %v", tt.version, err)
+		}
+	}
+}
+
+// TestFailedFetchRemovesOnlyItsEntry checks that a request for a
+// version naming another directory is refused, and that a failed fetch
+// leaves the entries of other modules and the state of an evicted
+// version alone.
+func TestFailedFetchRemovesOnlyItsEntry(t *testing.T) {
+	keepState(t)
+	rm := repoMapping{Src: "ex.com", Dest: "git.example.com/org"}
+	m := &mapping{repoMapping: rm, upstream: missingBackend{rm}}
+	routing.Store(&routingTable{mappings: []*mapping{m}, upstream: m.upstream})
+
+	sibling := writeTestEntry(t, "ex.com/org/other", "v1.0.0")
+	r := mux.NewRouter()
+	r.HandleFunc("/{module:.+}/@v/{version}.{ext}", handler)
+	for _, path := range []string{"/ex.com/org/foo/@v/...zip", "/ex.com/org/foo/@v/..mod", "/ex.com/org/foo/@v/v1.0.0.zip"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(sibling, "source.zip")); err != nil {
+		t.Errorf("sibling entry removed: %v", err)
+	}
+
+	// An evicted version keeps its quarantine record when filling it
+	// again fails.
+	dir := entryDir("ex.com/org/gone", "v1.0.0")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, quarantineFile), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetchAndCache(context.Background(), "ex.com/org/gone", "v1.0.0", FetchPolicy{Timeout: time.Second}); err == nil {
+		t.Fatal("fetch from a missing repository succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, quarantineFile)); err != nil {
+		t.Errorf("quarantine record removed: %v", err)
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	const out = "1111111111111111111111111111111111111111\tHEAD\n" +
+		"1111111111111111111111111111111111111111\trefs/heads/main\n" +
+		"2222222222222222222222222222222222222222\trefs/tags/v1.0.0\n" +
+		"3333333333333333333333333333333333333333\trefs/tags/v1.0.0^{}\n" +
+		"2222222222222222222222222222222222222222\trefs/tags/v1.1\n" +
+		"2222222222222222222222222222222222222222\trefs/tags/v2.0.0\n" +
+		"2222222222222222222222222222222222222222\trefs/tags/cli/v0.3.0\n" +
+		"2222222222222222222222222222222222222222\trefs/tags/cli/v2.1.0\n" +
+		"2222222222222222222222222222222222222222\trefs/tags/cli/sub/v0.1.0\n" +
+		"2222222222222222222222222222222222222222\trefs/tags/release-1\n"
+	m := repoMapping{Src: "example.com", Dest: "git.example.com/org"}
+	for name, want := range map[string][]string{
+		"example.com/repo":        {"v1.0.0"},
+		"example.com/repo/v2":     {"v2.0.0"},
+		"example.com/repo/cli":    {"v0.3.0"},
+		"example.com/repo/cli/v2": {"v2.1.0"},
+		"example.com/repo/other":  {},
+	} {
+		got, err := parseTags([]byte(out), m, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("parseTags for %s = %v, want %v", name, got, want)
+		}
+	}
+}
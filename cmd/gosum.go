@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// A consumer moving from the upstream module paths, e.g.
+// github.com/trusted-cloud/foo, to the ones this proxy serves, e.g.
+// pegasus-cloud.com/aes/foo, needs go.sum lines for the rewritten
+// artifacts, whose hashes differ from upstream's. POST /api/gosum takes
+// the consumer's go.sum and returns those lines, computed from the
+// proxy's own go.mod and zip of each version, fetching versions that
+// are not cached yet. Lines for paths the proxy does not rewrite are
+// left out.
+//
+// GET /<module>/@v/<version>.sum returns the go.sum lines of a single
+// version in the same way, for tooling and air-gapped consumers that
+// pin hashes without running the go command.
+
+// maxGoSumLines bounds the go.sum a single request may translate.
+const maxGoSumLines = 5000
+
+// maxGoSumFetches bounds the versions a single request fills. Lines of
+// further versions not cached yet are reported with an error, for the
+// go.sum to be sent again once these are cached.
+const maxGoSumFetches = 32
+
+// GoSumEntry reports the translation of one go.sum line.
+type GoSumEntry struct {
+	Old   string `json:"old"`
+	New   string `json:"new,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// GoSumPatch is the response of POST /api/gosum.
+type GoSumPatch struct {
+	// GoSum holds the new lines in go.sum order, ready to append.
+	GoSum   string       `json:"go_sum"`
+	Entries []GoSumEntry `json:"entries"`
+}
+
+// postGoSum serves POST /api/gosum.
+func postGoSum(w http.ResponseWriter, r *http.Request) {
+	var lines []string
+	sc := bufio.NewScanner(io.LimitReader(r.Body, 4<<20))
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(lines) > maxGoSumLines {
+		http.Error(w, fmt.Sprintf("go.sum has more than %d lines", maxGoSumLines), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// All fills share the request's deadline, the default fetch budget.
+	ctx, cancel := budgetContext(r.Context(), "")
+	defer cancel()
+	fetches := maxGoSumFetches
+	patch := GoSumPatch{Entries: []GoSumEntry{}}
+	var out []string
+	seen := make(map[string]bool)
+	rw := pathRewrites()
+	for _, line := range lines {
+		f := strings.Fields(line)
+		if len(f) != 3 {
+			patch.Entries = append(patch.Entries, GoSumEntry{Old: line, Error: "malformed line"})
+			continue
+		}
+		newPath, ok := rewritePath(f[0], rw)
+		if !ok {
+			continue
+		}
+		version, modOnly := strings.CutSuffix(f[1], "/go.mod")
+		e := GoSumEntry{Old: line}
+		if hash, err := goSumHash(ctx, newPath, version, modOnly, &fetches); err != nil {
+			e.Error = err.Error()
+		} else {
+			e.New = fmt.Sprintf("%s %s %s", newPath, f[1], hash)
+			if !seen[e.New] {
+				seen[e.New] = true
+				out = append(out, e.New)
+			}
+		}
+		patch.Entries = append(patch.Entries, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return goSumLess(out[i], out[j]) })
+	if len(out) > 0 {
+		patch.GoSum = strings.Join(out, "\n") + "\n"
+	}
+	writeJSON(w, http.StatusOK, patch)
+}
+
+// goSumHash returns the go.sum hash of the go.mod, if modOnly, or else
+// the zip of path@version as this proxy serves it, subject to the
+// checks of the module endpoints. A version not cached is filled if
+// fetches is nil, or else if *fetches allows, which it counts down.
+func goSumHash(ctx context.Context, path, version string, modOnly bool, fetches *int) (string, error) {
+	if !semver.IsValid(version) || version != semver.Canonical(version) {
+		return "", fmt.Errorf("version %s is not canonical", version)
+	}
+	escaped, err := module.EscapePath(path)
+	if err != nil {
+		return "", err
+	}
+	if err := checkACL(ctx, path); err != nil {
+		return "", err
+	}
+	ext := "zip"
+	if modOnly {
+		ext = "mod"
+	}
+	if b := blockOf(escaped, version); b.blocks(ext) {
+		return "", fmt.Errorf("%s@%s has been blocked: %s", b.Module, b.Version, b.Advisory)
+	}
+	if isQuarantined(callerFrom(ctx), escaped, version) {
+		return "", fmt.Errorf("%s@%s is quarantined pending review", path, version)
+	}
+	dir := entryDir(escaped, version)
+	file := filepath.Join(dir, "source.zip")
+	if modOnly {
+		file = filepath.Join(dir, "go.mod")
+	}
+	if _, err := os.Stat(file); err != nil && fetches != nil {
+		if *fetches == 0 {
+			return "", fmt.Errorf("%s@%s is not cached, and this request filled %d versions already; send the go.sum again later", path, version, maxGoSumFetches)
+		}
+		*fetches--
+	}
+	if err := ensureCached(ctx, escaped, version, file); err != nil {
+		return "", err
+	}
+	return cachedGoSum(escaped, version, ext)
+}
+
+// entryGoSum returns the go.sum hashes of the zip and go.mod in the
+// cache entry dir, by extension.
+func entryGoSum(dir string) (map[string]string, error) {
+	zh, err := dirhash.HashZip(filepath.Join(dir, "source.zip"), dirhash.Hash1)
+	if err != nil {
+		return nil, err
+	}
+	mh, err := modHash(dir)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"zip": zh, "mod": mh}, nil
+}
+
+// cachedGoSum returns the go.sum hash of the zip or go.mod, by ext, of
+// the cached escaped@version: from its provenance, or else hashed.
+func cachedGoSum(escaped, version, ext string) (string, error) {
+	if p, err := readProvenance(escaped, version); err == nil && p.GoSum[ext] != "" {
+		return p.GoSum[ext], nil
+	}
+	dir := entryDir(escaped, version)
+	if ext == "mod" {
+		return modHash(dir)
+	}
+	return dirhash.HashZip(filepath.Join(dir, "source.zip"), dirhash.Hash1)
+}
+
+// serveGoSum serves GET /{module}/@v/{version}.sum, the go.sum lines of
+// escaped module path name at version, with the hashes of the zip and
+// go.mod as served at the requested path. A version whose zip is
+// blocked is denied, since its zip line cannot be given.
+func serveGoSum(w http.ResponseWriter, r *http.Request, name, version string) {
+	ctx := r.Context()
+	path, err := module.UnescapePath(name)
+	if err != nil {
+		httpError(w, kindError{err.Error(), errNotFound})
+		return
+	}
+	if p, ok := upstreamPathOf(r); ok {
+		path = p
+	}
+	if !semver.IsValid(version) || version != semver.Canonical(version) {
+		httpError(w, kindError{fmt.Sprintf("%s@%s: version is not canonical", path, version), errNotFound})
+		return
+	}
+	if isQuarantined(callerFrom(ctx), name, version) {
+		httpError(w, kindError{fmt.Sprintf("%s@%s is quarantined pending review", path, version), errPolicyDenied})
+		return
+	}
+	if b := blockOf(name, version); b.blocks("zip") {
+		httpError(w, kindError{fmt.Sprintf("%s@%s: the zip has been blocked, so its go.sum lines are not served: %s", path, version, b.Advisory), errPolicyDenied})
+		return
+	}
+	var lines []string
+	for _, f := range []struct{ ext, file, suffix string }{{"zip", "source.zip", ""}, {"mod", "go.mod", "/go.mod"}} {
+		filename := filepath.Join(entryDir(name, version), f.file)
+		if err := ensureCached(ctx, name, version, filename); err != nil {
+			setNegativeHeaders(w, err)
+			httpError(w, err)
+			return
+		}
+		var hash string
+		if p, ok := upstreamPathOf(r); !ok {
+			hash, err = cachedGoSum(name, version, f.ext)
+		} else if filename, err = dualStackFile(ctx, name, version, filename, p); err != nil {
+			httpError(w, err)
+			return
+		} else if f.ext == "zip" {
+			hash, err = dirhash.HashZip(filename, dirhash.Hash1)
+		} else {
+			hash, err = modHash(filepath.Dir(filename))
+		}
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		lines = append(lines, fmt.Sprintf("%s %s%s %s\n", path, version, f.suffix, hash))
+	}
+	w.Header().Set("Cache-Control", cacheControl(r, version))
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	io.WriteString(w, strings.Join(lines, ""))
+}
+
+// goSumLess orders go.sum lines as the go command writes them: by path,
+// then by version, with a version's /go.mod line after its zip line.
+func goSumLess(a, b string) bool {
+	af, bf := strings.Fields(a), strings.Fields(b)
+	if af[0] != bf[0] {
+		return af[0] < bf[0]
+	}
+	av, amod := strings.CutSuffix(af[1], "/go.mod")
+	bv, bmod := strings.CutSuffix(bf[1], "/go.mod")
+	if c := semver.Compare(av, bv); c != 0 {
+		return c < 0
+	}
+	return !amod && bmod
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+func TestGoSumLess(t *testing.T) {
+	want := []string{
+		"example.com/a v1.0.0 h1:x",
+		"example.com/a v1.0.0/go.mod h1:x",
+		"example.com/a v1.2.0 h1:x",
+		"example.com/a v1.10.0/go.mod h1:x",
+		"example.com/b v0.1.0 h1:x",
+	}
+	got := slices.Clone(want)
+	slices.Reverse(got)
+	sort.Slice(got, func(i, j int) bool { return goSumLess(got[i], got[j]) })
+	if !slices.Equal(got, want) {
+		t.Errorf("sorted:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestCachedGoSum(t *testing.T) {
+	const name, version = "example.com/m", "v1.0.0"
+	dir := writeTestEntry(t, name, version)
+	zf, err := os.Create(filepath.Join(dir, "source.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(zf)
+	w, _ := zw.Create(name + "@" + version + "/go.mod")
+	w.Write([]byte("module " + name + "\n"))
+	zw.Close()
+	zf.Close()
+	if err := writeProvenance(name, version); err != nil {
+		t.Fatal(err)
+	}
+
+	zh, err := dirhash.HashZip(filepath.Join(dir, "source.zip"), dirhash.Hash1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mh, err := modHash(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := readProvenance(name, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.GoSum["zip"] != zh || p.GoSum["mod"] != mh {
+		t.Fatalf("provenance go_sum = %v, want zip %s and mod %s", p.GoSum, zh, mh)
+	}
+
+	// The recorded hashes are served without reading the files.
+	os.Remove(filepath.Join(dir, "source.zip"))
+	if got, err := cachedGoSum(name, version, "zip"); err != nil || got != zh {
+		t.Errorf("cachedGoSum(zip) = %q, %v; want %q", got, err, zh)
+	}
+	if got, err := cachedGoSum(name, version, "mod"); err != nil || got != mh {
+		t.Errorf("cachedGoSum(mod) = %q, %v; want %q", got, err, mh)
+	}
+}
+
+func TestGoSumHashFetchBound(t *testing.T) {
+	keepState(t)
+	CacheDir, cacheNS = t.TempDir(), "test"
+	fetches := 0
+	_, err := goSumHash(context.Background(), "example.com/m", "v1.0.0", false, &fetches)
+	if err == nil || !strings.Contains(err.Error(), "not cached") {
+		t.Errorf("goSumHash beyond the fetch bound = %v, want not cached", err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// With config.Hardening the proxy runs with stricter defaults meant for
+// exposed deployments: restrictive response headers, server timeouts,
+// cache files served only as regular files, and 5xx bodies replaced by
+// an opaque error ID, since go and git output in them leaks toolchain
+// versions, internal hostnames and repository URLs. The full message is
+// logged under the same ID.
+
+// newHTTPServer returns the HTTP server for h, with timeouts when hardened.
+func newHTTPServer(addr string, h http.Handler) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: h}
+	if !config.Hardening {
+		return srv
+	}
+	srv.Handler = harden(h)
+	srv.ReadHeaderTimeout = 10 * time.Second
+	srv.IdleTimeout = 2 * time.Minute
+	srv.MaxHeaderBytes = 64 << 10
+	return srv
+}
+
+// harden sets security headers on every response and masks server
+// errors.
+func harden(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+		h.Set("Referrer-Policy", "no-referrer")
+		h.Set("Cross-Origin-Resource-Policy", "same-origin")
+		if r.TLS != nil {
+			h.Set("Strict-Transport-Security", "max-age=31536000")
+		}
+		next.ServeHTTP(&errorMasker{ResponseWriter: w, r: r}, r)
+	})
+}
+
+// errorMasker replaces the body of 5xx responses by an error ID.
+type errorMasker struct {
+	http.ResponseWriter
+	r      *http.Request
+	id     string
+	masked bool
+}
+
+func (m *errorMasker) WriteHeader(code int) {
+	if code < 500 {
+		m.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if m.id = requestIDFrom(m.r.Context()); m.id == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		m.id = hex.EncodeToString(b)
+	}
+	m.masked = true
+
+	h := m.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	m.ResponseWriter.WriteHeader(code)
+	fmt.Fprintf(m.ResponseWriter, "internal error (id %s)\n", m.id)
+}
+
+func (m *errorMasker) Unwrap() http.ResponseWriter { return m.ResponseWriter }
+
+func (m *errorMasker) Write(b []byte) (int, error) {
+	if m.masked {
+		slog.ErrorContext(m.r.Context(), "masked error", "id", m.id, "method", m.r.Method, "path", m.r.URL.Path, "body", string(b))
+		return len(b), nil
+	}
+	return m.ResponseWriter.Write(b)
+}
+
+// serveRegularFile serves path with http.ServeContent if it is a
+// regular file. Unlike http.ServeFile it never lists directories or
+// redirects index.html requests.
+func serveRegularFile(w http.ResponseWriter, r *http.Request, path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+	return true
+}
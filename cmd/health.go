@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// /healthz reports that the process is serving, for liveness probes.
+// /readyz runs the checks below, for readiness probes: the cache
+// directory is writable, the binaries the proxy runs are installed, and
+// every upstream answers, and, if configured, the warm list is cached
+// (see warm.go). Checks that need the network are cached for
+// HealthConfig.CacheFor, so frequent probes do not load the upstreams.
+// Concurrent probes wait for one run of the checks, which goes on when
+// the probe that started it gives up, so that a probe's own timeout is
+// never cached as an unready upstream.
+
+// HealthConfig configures the readiness checks.
+type HealthConfig struct {
+	// ProbeModule is a module path whose versions are listed to check
+	// each upstream, which also verifies the token. Without it, only
+	// that the upstream hosts answer is checked.
+	ProbeModule string `yaml:"probe_module"`
+
+	// CacheFor is how long a readiness result is reused (default 10s).
+	CacheFor time.Duration `yaml:"cache_for"`
+
+	// Timeout bounds each upstream check (default 5s).
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// prober is implemented by backends that can check their upstream
+// without a module path.
+type prober interface {
+	Probe(ctx context.Context) error
+}
+
+// HealthCheck is the result of one readiness check.
+type HealthCheck struct {
+	OK bool `json:"ok"`
+
+	// Required checks make the proxy unready when they fail.
+	Required bool   `json:"required"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Readiness is the response of /readyz.
+type Readiness struct {
+	Ready     bool                   `json:"ready"`
+	Checks    map[string]HealthCheck `json:"checks"`
+	CheckedAt time.Time              `json:"checked_at"`
+}
+
+var readiness struct {
+	sync.Mutex
+	last    *Readiness
+	running chan struct{} // closed when the run in progress is done
+}
+
+// checkReadiness returns the result of a run of the readiness checks
+// within CacheFor, starting one if there is none. If ctx is done first,
+// it returns an unready result that is not cached.
+func checkReadiness(ctx context.Context) *Readiness {
+	cacheFor := config.Health.CacheFor
+	if cacheFor == 0 {
+		cacheFor = 10 * time.Second
+	}
+	readiness.Lock()
+	if l := readiness.last; l != nil && time.Since(l.CheckedAt) < cacheFor {
+		readiness.Unlock()
+		return l
+	}
+	done := readiness.running
+	if done == nil {
+		done = make(chan struct{})
+		readiness.running = done
+		// The run keeps ctx's values, not its deadline: each check is
+		// bounded on its own.
+		rctx, cancel := detached(context.WithoutCancel(ctx))
+		go func() {
+			defer cancel()
+			rd := runReadinessChecks(rctx)
+			readiness.Lock()
+			readiness.last, readiness.running = rd, nil
+			readiness.Unlock()
+			close(done)
+		}()
+	}
+	readiness.Unlock()
+
+	select {
+	case <-done:
+		readiness.Lock()
+		defer readiness.Unlock()
+		return readiness.last
+	case <-ctx.Done():
+		return &Readiness{
+			Checks:    map[string]HealthCheck{"readiness": {Error: ctx.Err().Error()}},
+			CheckedAt: time.Now().UTC(),
+		}
+	}
+}
+
+// runReadinessChecks runs the readiness checks. Each upstream check is
+// bounded by HealthConfig.Timeout.
+func runReadinessChecks(ctx context.Context) *Readiness {
+	hc := config.Health
+	rd := &Readiness{Ready: true, Checks: make(map[string]HealthCheck), CheckedAt: time.Now().UTC()}
+	note := func(name string, required bool, err error) {
+		c := HealthCheck{OK: err == nil, Required: required}
+		if err != nil {
+			c.Error = string(sanitize([]byte(err.Error())))
+			if required {
+				rd.Ready = false
+			}
+		}
+		rd.Checks[name] = c
+	}
+
+	note("cache", true, checkCacheWritable())
+	_, err := exec.LookPath("git")
+	note("git", usesGitBinary(), err)
+	_, err = exec.LookPath("go")
+	note("go", config.Toolchain.MinVersion != "", err)
+	note("warm", config.Warm.GateReadiness, warmError())
+
+	timeout := hc.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	for name, b := range upstreamsToProbe() {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		note("upstream "+name, true, probeUpstream(ctx, b, hc.ProbeModule))
+		cancel()
+	}
+	return rd
+}
+
+// checkCacheWritable creates and removes a file in the cache directory.
+func checkCacheWritable() error {
+	f, err := os.CreateTemp(CacheDir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// usesGitBinary reports whether any backend runs the git binary.
+func usesGitBinary() bool {
+	for _, b := range upstreamsToProbe() {
+		if _, ok := b.(gitBackend); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamsToProbe returns the backends of the mappings and mounts by
+// the mapping's Src or the mount's path. The upstreams themselves are
+// not named, as the response is unauthenticated.
+func upstreamsToProbe() map[string]backend {
+	bs := make(map[string]backend)
+	for _, m := range routes().mappings {
+		bs["mapping "+m.Src] = m.upstream
+	}
+	for _, m := range routes().mounts {
+		if m.upstream != nil {
+			bs["mount "+m.Path] = m.upstream
+		}
+	}
+	return bs
+}
+
+// probeUpstream checks b by listing probeModule, if set and served by b,
+// or else with its Probe method.
+func probeUpstream(ctx context.Context, b backend, probeModule string) error {
+	if probeModule != "" && upstreamFor(probeModule) == b {
+		_, err := b.List(ctx, probeModule)
+		return err
+	}
+	if p, ok := b.(prober); ok {
+		return p.Probe(ctx)
+	}
+	return nil
+}
+
+// probeHost checks that the HTTPS server of the host of repository path
+// dest answers.
+func probeHost(ctx context.Context, dest string) error {
+	host, _, _ := strings.Cut(dest, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, "https://"+host+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUpstreamUnavailable, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return upstreamStatusError(host, resp.StatusCode, resp.Status)
+	}
+	return nil
+}
+
+func (b gitBackend) Probe(ctx context.Context) error       { return probeHost(ctx, b.Dest) }
+func (b nativeGitBackend) Probe(ctx context.Context) error { return probeHost(ctx, b.Dest) }
+
+// Probe requests the repository's root with the configured credentials.
+func (b *artifactBackend) Probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(b.URL, "/")+"/", nil)
+	if err != nil {
+		return err
+	}
+	if b.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.Token)
+	} else if b.Username != "" {
+		req.SetBasicAuth(b.Username, b.Password)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUpstreamUnavailable, err)
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%s: credentials rejected: %s", b.Type, resp.Status)
+	case resp.StatusCode >= 500:
+		return upstreamStatusError(b.Type, resp.StatusCode, resp.Status)
+	}
+	return nil
+}
+
+// Probe checks that the root is still a directory.
+func (b dirBackend) Probe(ctx context.Context) error {
+	fi, err := os.Stat(b.root)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", b.root)
+	}
+	return nil
+}
+
+// checkHealthConfig validates the probe module.
+func checkHealthConfig(hc HealthConfig) error {
+	if hc.ProbeModule == "" {
+		return nil
+	}
+	if err := module.CheckPath(hc.ProbeModule); err != nil {
+		return fmt.Errorf("health: probe_module: %v", err)
+	}
+	return nil
+}
+
+// serveHealthz serves GET /healthz.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// serveReadyz serves GET /readyz, with 503 while any required check
+// fails.
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	rd := checkReadiness(r.Context())
+	status := http.StatusOK
+	if !rd.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, rd)
+}
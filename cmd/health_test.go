@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// slowBackend answers its probe once release is closed.
+type slowBackend struct {
+	missingBackend
+	release chan struct{}
+}
+
+func (b slowBackend) Probe(ctx context.Context) error {
+	select {
+	case <-b.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestCheckReadinessOutlivesProbe(t *testing.T) {
+	keepState(t)
+	defer func() { readiness.last = nil }()
+	CacheDir = t.TempDir()
+	config.Health = HealthConfig{CacheFor: time.Hour}
+	b := slowBackend{release: make(chan struct{})}
+	routing.Store(&routingTable{mappings: []*mapping{{repoMapping: repoMapping{Src: "example.com"}, upstream: b}}})
+	readiness.last = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if rd := checkReadiness(ctx); rd.Ready {
+		t.Fatalf("readiness before the upstream answered: %+v", rd)
+	}
+	close(b.release)
+	rd := checkReadiness(context.Background())
+	if c := rd.Checks["upstream mapping example.com"]; !c.OK {
+		t.Errorf("upstream check = %+v, want OK", c)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// HideRule hides the versions matching Pattern, a glob such as
+// "*-internal.*" or "*-rc.*", from /@v/list, @latest and version
+// queries, unless the caller has one of Scopes. A hidden version is
+// still served to anyone allowed to request it by its exact version,
+// so builds pinned to it keep working.
+type HideRule struct {
+	Pattern string `yaml:"pattern"`
+
+	// Prefixes limits the rule to modules under these paths; empty
+	// applies it to all.
+	Prefixes []string `yaml:"prefixes"`
+
+	// Scopes lists the token scopes that see the versions anyway.
+	Scopes []string `yaml:"scopes"`
+}
+
+// checkHideRules validates the patterns of rules.
+func checkHideRules(rules []HideRule) error {
+	for _, r := range rules {
+		if r.Pattern == "" {
+			return fmt.Errorf("hide_versions: pattern is required")
+		}
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return fmt.Errorf("hide_versions: bad pattern %q: %v", r.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// applies reports whether r hides versions of the module path from c.
+func (r *HideRule) applies(modPath string, c *caller) bool {
+	for _, s := range r.Scopes {
+		if c.hasScope(s) {
+			return false
+		}
+	}
+	if len(r.Prefixes) == 0 {
+		return true
+	}
+	for _, p := range r.Prefixes {
+		if hasPathPrefix(modPath, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// hiddenFrom returns a predicate reporting whether a version of the
+// escaped module path is hidden from c, or nil if none is.
+func hiddenFrom(escaped string, c *caller) func(string) bool {
+	modPath, err := module.UnescapePath(escaped)
+	if err != nil {
+		return nil
+	}
+	var patterns []string
+	for i := range config.HideVersions {
+		if r := &config.HideVersions[i]; r.applies(modPath, c) {
+			patterns = append(patterns, r.Pattern)
+		}
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+	return func(v string) bool {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, v); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// hideScopes returns the scopes of c that reveal hidden versions, which
+// together with the canary scope determine what c sees.
+func hideScopes(c *caller) string {
+	var scopes []string
+	for _, r := range config.HideVersions {
+		for _, s := range r.Scopes {
+			if c.hasScope(s) {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	return strings.Join(scopes, ",")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Honeytokens are decoy module paths that appear nowhere in legitimate
+// go.mod files, for instance published only in a fake internal wiki page
+// or a planted .netrc. A request for one of them means somebody is
+// enumerating or replaying what they found, so it raises a high-priority
+// alert with everything known about the client. The request is then
+// answered like any unknown module, so the client learns nothing.
+
+// isHoneytoken reports whether the request path, under any mount, falls
+// under one of config.Honeytokens.
+func isHoneytoken(path string) bool {
+	path = strings.TrimPrefix(stripMount(path), "/")
+	for _, p := range config.Honeytokens {
+		if hasPathPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func honeytokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isHoneytoken(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		c := callerFrom(r.Context())
+		fields := map[string]string{
+			"path":       r.URL.Path,
+			"method":     r.Method,
+			"client":     r.RemoteAddr,
+			"identity":   c.Identity,
+			"user_agent": r.UserAgent(),
+			"host":       r.Host,
+		}
+		if v := r.Header.Get("X-Forwarded-For"); v != "" {
+			fields["forwarded_for"] = v
+		}
+		if v := r.Header.Get(buildIDHeader); v != "" {
+			fields["build_id"] = v
+		}
+		if r.TLS != nil {
+			fields["tls_server_name"] = r.TLS.ServerName
+		}
+		sendHighPriorityAlert("honeytoken", "request for decoy module path", fields)
+
+		http.Error(w, r.URL.Path+" not found", http.StatusNotFound)
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// A release is usually followed within minutes by the first go get of
+// it, which would otherwise wait for the clone and the zip. GitHub
+// notifies /hooks/github of tag pushes; the proxy maps the repository
+// back to the module path it serves it under, as repoURL does forwards,
+// and caches the new version in the background.
+//
+// Deliveries are authenticated by their X-Hub-Signature-256, an
+// HMAC-SHA256 of the body under the webhook secret, not by a token.
+
+// HooksConfig configures the repository webhooks.
+type HooksConfig struct {
+	// GitHubSecret is the secret of the GitHub webhook. Without it,
+	// /hooks/github is not served.
+	GitHubSecret string `yaml:"github_secret"`
+
+	// Timeout bounds the prefetch of a pushed version (default 10m).
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func registerHookRoutes(r *mux.Router) {
+	r.HandleFunc(strings.TrimPrefix(githubHookPath, "/hooks"), githubHook).Methods(http.MethodPost)
+}
+
+// githubHookPath is the path of the GitHub webhook, which openPath
+// lets callers reach without credentials.
+const githubHookPath = "/hooks/github"
+
+// githubPush holds the fields used of the payloads of the push and
+// create events.
+type githubPush struct {
+	Ref     string `json:"ref"`
+	RefType string `json:"ref_type"` // create only
+	Created bool   `json:"created"`  // push only
+	Deleted bool   `json:"deleted"`
+	Repo    struct {
+		HTMLURL string `json:"html_url"`
+	} `json:"repository"`
+}
+
+// githubHook serves POST /hooks/github.
+func githubHook(w http.ResponseWriter, r *http.Request) {
+	secret := config.Hooks.GitHubSecret
+	if secret == "" {
+		http.Error(w, "GitHub webhooks are not configured", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validHubSignature(secret, body, r.Header.Get("X-Hub-Signature-256")) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var p githubPush
+	switch event := r.Header.Get("X-GitHub-Event"); event {
+	case "ping":
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "push", "create":
+		if err := json.Unmarshal(body, &p); err != nil {
+			http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if event == "create" {
+			if p.RefType != "tag" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			p.Ref, p.Created = "refs/tags/"+p.Ref, true
+		}
+	default:
+		http.Error(w, fmt.Sprintf("event %s is not handled", event), http.StatusBadRequest)
+		return
+	}
+	tag, ok := strings.CutPrefix(p.Ref, "refs/tags/")
+	if !ok || !p.Created || p.Deleted {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	paths, version := pushedModules(removeSchemeAndTrailingSlash(p.Repo.HTMLURL), tag)
+	if len(paths) == 0 {
+		http.Error(w, fmt.Sprintf("%s %s is not the tag of a module this proxy serves", p.Repo.HTMLURL, tag), http.StatusNotFound)
+		return
+	}
+	for _, path := range paths {
+		go prefetchPushed(path, version)
+	}
+	slog.InfoContext(r.Context(), "hook: prefetching pushed tag", "repo", p.Repo.HTMLURL, "tag", tag, "modules", paths)
+	writeJSON(w, http.StatusAccepted, map[string]any{"modules": paths, "version": version})
+}
+
+// validHubSignature checks sig, "sha256=<hex>", against body.
+func validHubSignature(secret string, body []byte, sig string) bool {
+	got, ok := strings.CutPrefix(sig, "sha256=")
+	if !ok {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal([]byte(got), []byte(hex.EncodeToString(mac.Sum(nil))))
+}
+
+// pushedModules returns the module paths that tag of repo, a
+// repository URL without scheme, may be a version of, and the version.
+// A tag dir/vX.Y.Z is a version of the module in dir; a major version
+// from v2 on is that of the path with its /vN suffix, which is the
+// only one tried then.
+func pushedModules(repo, tag string) ([]string, string) {
+	dir, version := "", tag
+	if i := strings.LastIndex(tag, "/"); i >= 0 {
+		dir, version = tag[:i], tag[i+1:]
+	}
+	if !semver.IsValid(version) || version != semver.Canonical(version) {
+		return nil, ""
+	}
+	var candidates []repoMapping
+	for _, m := range routes().mappings {
+		candidates = append(candidates, m.repoMapping)
+	}
+	for _, m := range routes().mounts {
+		candidates = append(candidates, m.mapping)
+	}
+	var paths []string
+	for _, m := range candidates {
+		if m.Dest == "" {
+			continue
+		}
+		pkg, ok := strings.CutPrefix(repo, m.Dest+"/")
+		if !ok || pkg == "" || strings.Contains(pkg, "/") {
+			continue
+		}
+		path := m.Src + "/" + pkg
+		if dir != "" {
+			path += "/" + dir
+		}
+		if major := semver.Major(version); major != "v0" && major != "v1" {
+			path += "/" + major
+		}
+		if module.CheckPath(path) == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths, version
+}
+
+// prefetchPushed caches path@version and adds it to the cached version
+// list, so the next @latest sees it without waiting for the TTL, and
+// the version without waiting for a remembered 404 to expire.
+func prefetchPushed(path, version string) {
+	timeout := config.Hooks.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	escaped, err := module.EscapePath(path)
+	if err != nil {
+		slog.Warn("hook: prefetching pushed tag", "module", path, "version", version, "err", err)
+		return
+	}
+	// A request for the tag before it was pushed left a 404 behind.
+	forgetNegative(escaped, version)
+	if err := warmModule(ctx, path+"@"+version); err != nil {
+		slog.Warn("hook: prefetching pushed tag", "module", path, "version", version, "err", err)
+		return
+	}
+	addListedVersion(ctx, path, version)
+	forgetLatest(escaped)
+	slog.Info("hook: cached pushed tag", "module", path, "version", version)
+}
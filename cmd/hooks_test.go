@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPrefetchPushedForgetsNotFound checks that a tag requested before
+// it was pushed is served once the push is reported, rather than its
+// remembered 404.
+func TestPrefetchPushedForgetsNotFound(t *testing.T) {
+	keepState(t)
+	CacheDir, cacheNS = t.TempDir(), "test"
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFixture(t, src, 16)
+	rm := repoMapping{Src: "example.com", Dest: "git.example.com/org"}
+	m := &mapping{repoMapping: rm, upstream: fakeVCS{rm, src, 1}}
+	routing.Store(&routingTable{mappings: []*mapping{m}, upstream: m.upstream})
+	defer forgetNegative("example.com/m", "")
+
+	notFound := kindError{"example.com/m@v1.1.0: unknown revision", errNotFound}
+	rememberNegative("example.com/m", "v1.1.0", notFound)
+	if err := cachedNegative("example.com/m", "v1.1.0"); !errors.Is(err, errNotFound) {
+		t.Fatalf("cachedNegative before the push = %v", err)
+	}
+
+	prefetchPushed("example.com/m", "v1.1.0")
+	if err := cachedNegative("example.com/m", "v1.1.0"); err != nil {
+		t.Errorf("cachedNegative after the push = %v", err)
+	}
+	if !cached("example.com/m", "v1.1.0", filepath.Join(entryDir("example.com/m", "v1.1.0"), "source.zip")) {
+		t.Error("pushed version not cached")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	clist "container/list"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Resolving the module graph of a large build requests the .info and
+// .mod of thousands of versions, each a few hundred bytes. With
+// ResponseCacheConfig.MemoryMB set, the most recently served of these
+// files are kept in memory and served without touching the cache
+// directory. Zips are always served from disk. Entries are dropped with
+// the cache entry they belong to (see entryIndex.forget).
+
+// hotFile is a version file held in memory.
+type hotFile struct {
+	name            string // in the cache directory
+	module, version string
+	data            []byte
+	modTime         time.Time
+	touched         time.Time // when the access marker was last updated
+}
+
+// hotCache is an LRU of version files bounded by their total size.
+type hotCache struct {
+	mu        sync.Mutex
+	max, size int64
+	lru       *clist.List // of *hotFile, most recently used first
+	files     map[string]*clist.Element
+}
+
+var hotFiles = &hotCache{lru: clist.New(), files: make(map[string]*clist.Element)}
+
+// touchEvery bounds how often serving a file from memory updates the
+// access marker of its entry, which only needs to be good enough for
+// eviction.
+const touchEvery = time.Minute
+
+// setupHotCache sizes the in-memory cache, emptying it.
+func setupHotCache(rc ResponseCacheConfig) {
+	hotFiles.mu.Lock()
+	defer hotFiles.mu.Unlock()
+	hotFiles.max = int64(rc.MemoryMB) << 20
+	hotFiles.size = 0
+	hotFiles.lru.Init()
+	hotFiles.files = make(map[string]*clist.Element)
+}
+
+// has reports whether the file name is held in memory.
+func (c *hotCache) has(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.files[name]
+	return ok
+}
+
+// load returns the contents of name, the cached ext file of
+// module@version, from memory or else reading it into memory. It
+// reports false for zips, derived files, or with the cache disabled.
+func (c *hotCache) load(module, version, ext, name string) ([]byte, time.Time, bool) {
+	c.mu.Lock()
+	max := c.max
+	if e, ok := c.files[name]; ok {
+		c.lru.MoveToFront(e)
+		f := e.Value.(*hotFile)
+		c.mu.Unlock()
+		return f.data, f.modTime, true
+	}
+	c.mu.Unlock()
+	if max == 0 || ext == "zip" || filepath.Dir(name) != entryDir(module, version) {
+		return nil, time.Time{}, false
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	// A single file may take at most an eighth of the budget.
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() > max/8 {
+		return nil, time.Time{}, false
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	c.put(&hotFile{name: name, module: module, version: version, data: data, modTime: fi.ModTime(), touched: time.Now()})
+	return data, fi.ModTime(), true
+}
+
+func (c *hotCache) put(f *hotFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.files[f.name]; ok {
+		return
+	}
+	c.files[f.name] = c.lru.PushFront(f)
+	c.size += hotSize(f)
+	for c.size > c.max {
+		c.remove(c.lru.Back())
+	}
+}
+
+// hotSize approximates the memory held by f.
+func hotSize(f *hotFile) int64 {
+	return int64(len(f.data) + len(f.name) + 128)
+}
+
+// remove drops e. Callers hold c.mu.
+func (c *hotCache) remove(e *clist.Element) {
+	f := c.lru.Remove(e).(*hotFile)
+	delete(c.files, f.name)
+	c.size -= hotSize(f)
+}
+
+// touchDue reports whether the access marker of the entry of name
+// should be updated, noting that it is.
+func (c *hotCache) touchDue(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.files[name]
+	if !ok {
+		return true
+	}
+	f := e.Value.(*hotFile)
+	if time.Since(f.touched) < touchEvery {
+		return false
+	}
+	f.touched = time.Now()
+	return true
+}
+
+// forget drops the files of module@version, or of every version of
+// module if version is empty.
+func (c *hotCache) forget(module, version string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if f := e.Value.(*hotFile); f.module == module && (version == "" || f.version == version) {
+			c.remove(e)
+		}
+		e = next
+	}
+}
+
+// usage returns the bytes held and the number of files.
+func (c *hotCache) usage() (int64, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size, len(c.files)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A disk that rots, or a hand that edits the cache, can leave a version
+// whose files no longer match what was fetched. The provenance of each
+// version records the SHA-256 of its .info, go.mod and zip files, and
+// the first time a process serves the version it checks the files
+// against them, holding the version's fill so that concurrent requests
+// check and evict it once. A corrupt version is logged, counted in
+// goproxy_cache_corruptions_total and evicted, and the request that
+// found it fills it again from the store or upstream, as on any miss,
+// within its own deadline. If the same version turns out corrupt more
+// than maxRecoveries times in an hour the fault is not in the copy:
+// requests then fail with 502 and a Retry-After until the hour is over
+// rather than fetch it again. Versions cached before digests were
+// recorded are trusted as they are.
+
+// maxRecoveries bounds the re-fetches of a version found corrupt within
+// recoveryWindow.
+const (
+	maxRecoveries  = 3
+	recoveryWindow = time.Hour
+)
+
+// recoveries holds, by module@version, when the version was last found
+// corrupt within recoveryWindow.
+var recoveries = struct {
+	sync.Mutex
+	at map[string][]time.Time
+}{at: make(map[string][]time.Time)}
+
+// artifactDigests returns the SHA-256 of the files of the cache entry
+// of name@version, other than its provenance.
+func artifactDigests(name, version string) (map[string]string, error) {
+	dir := entryDir(name, version)
+	digests := make(map[string]string)
+	for _, file := range artifactFiles(version) {
+		if file == provenanceFile {
+			continue
+		}
+		sum, err := fileDigest(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		digests[file] = sum
+	}
+	return digests, nil
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkIntegrity compares the files of name@version with the digests in
+// its provenance. It returns the name of the first file that differs.
+func checkIntegrity(name, version string) (string, error) {
+	p, err := readProvenance(name, version)
+	if err != nil {
+		return provenanceFile, err
+	}
+	dir := entryDir(name, version)
+	for file, want := range p.Digests {
+		got, err := fileDigest(filepath.Join(dir, file))
+		if err != nil {
+			return file, err
+		}
+		if got != want {
+			return file, fmt.Errorf("sha256:%s, recorded sha256:%s", got, want)
+		}
+	}
+	return "", nil
+}
+
+// evictCorrupt removes the cache entry of name@version, whose file was
+// found to differ from its digest, so that the next lookup fills it
+// again, and counts one recovery. Callers must hold the version's fill.
+func evictCorrupt(name, version, file string, err error) {
+	slog.Error("cache corruption", "module", name, "version", version, "file", file, "err", err)
+	metrics.corruptions.inc(file)
+	if err := removeEntry(entryDir(name, version)); err != nil {
+		slog.Error("evicting corrupt version", "module", name, "version", version, "err", err)
+	}
+	entries.forget(name, version)
+
+	recoveries.Lock()
+	defer recoveries.Unlock()
+	key := name + "@" + version
+	recoveries.at[key] = append(recentRecoveries(key), time.Now())
+}
+
+// recentRecoveries returns the times name@version, given as key, was
+// found corrupt within recoveryWindow. recoveries must be locked.
+func recentRecoveries(key string) []time.Time {
+	at := recoveries.at[key]
+	for len(at) > 0 && time.Since(at[0]) > recoveryWindow {
+		at = at[1:]
+	}
+	if len(at) == 0 {
+		delete(recoveries.at, key)
+		return nil
+	}
+	recoveries.at[key] = at
+	return at
+}
+
+// checkRecoveries returns an errUpstreamUnavailable error if
+// name@version was found corrupt too often of late to fetch it again,
+// with the time until it may be.
+func checkRecoveries(name, version string) error {
+	recoveries.Lock()
+	defer recoveries.Unlock()
+	at := recentRecoveries(name + "@" + version)
+	n := len(at)
+	if n <= maxRecoveries {
+		return nil
+	}
+	msg := fmt.Sprintf("%s@%s was found corrupt %d times in the last %v; not fetching it again yet", name, version, n, recoveryWindow)
+	return retryError{kindError{msg, errUpstreamUnavailable}, recoveryWindow - time.Since(at[n-maxRecoveries-1])}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestEntry writes a cache entry of name@version with provenance
+// under a fresh CacheDir.
+func writeTestEntry(t *testing.T, name, version string) string {
+	t.Helper()
+	keepState(t)
+	CacheDir, cacheNS = t.TempDir(), "test"
+	dir := entryDir(name, version)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for file, data := range map[string]string{
+		version + ".info": `{"Version":"` + version + `"}`,
+		"go.mod":          "module " + name + "\n",
+		"source.zip":      "zip",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeProvenance(name, version); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestVerifyCachedEvictsCorruptOnce(t *testing.T) {
+	const name, version = "example.com/m", "v1.0.0"
+	dir := writeTestEntry(t, name, version)
+	gomod := filepath.Join(dir, "go.mod")
+	defer entries.forget(name, version)
+
+	if file, err := checkIntegrity(name, version); err != nil {
+		t.Fatalf("checkIntegrity of an intact entry: %s: %v", file, err)
+	}
+	if cached(name, version, gomod) {
+		t.Fatal("cached before the entry was checked")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "source.zip"), []byte("rot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if verifyCached(name, version, gomod) {
+		t.Fatal("corrupt entry verified")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("corrupt entry not evicted: %v", err)
+	}
+	// A second look finds nothing to evict and counts no recovery.
+	verifyCached(name, version, gomod)
+	recoveries.Lock()
+	n := len(recoveries.at[name+"@"+version])
+	delete(recoveries.at, name+"@"+version)
+	recoveries.Unlock()
+	if n != 1 {
+		t.Errorf("%d recoveries counted, want 1", n)
+	}
+
+	gomod = filepath.Join(writeTestEntry(t, name, version), "go.mod")
+	if !verifyCached(name, version, gomod) || !cached(name, version, gomod) {
+		t.Error("intact entry not verified")
+	}
+}
+
+func TestCheckRecoveriesRetryAfter(t *testing.T) {
+	const name, version = "example.com/m", "v1.0.1"
+	key := name + "@" + version
+	defer func() {
+		recoveries.Lock()
+		delete(recoveries.at, key)
+		recoveries.Unlock()
+	}()
+	keepState(t)
+	CacheDir, cacheNS = t.TempDir(), "test"
+	for range maxRecoveries {
+		evictCorrupt(name, version, "source.zip", errors.New("differs"))
+	}
+	if err := checkRecoveries(name, version); err != nil {
+		t.Fatalf("checkRecoveries after %d recoveries: %v", maxRecoveries, err)
+	}
+	evictCorrupt(name, version, "source.zip", errors.New("differs"))
+	err := checkRecoveries(name, version)
+	if !errors.Is(err, errUpstreamUnavailable) {
+		t.Fatalf("checkRecoveries = %v, want upstream unavailable", err)
+	}
+	w := httptest.NewRecorder()
+	httpError(w, err)
+	if w.Code != http.StatusBadGateway || w.Header().Get("Retry-After") == "" {
+		t.Errorf("status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
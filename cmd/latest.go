@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// latest serves MODULE/@latest, the .info of the version the go command
+// would pick for module@latest: the highest release that is not
+// retracted, else the highest such pre-release. Retractions are read
+// from the go.mod of the highest version, as the go command does. If
+// every version is retracted the highest one is served anyway; if there
+// is none, the module's default branch is resolved to a pseudo-version
+// when the backend can resolve queries. The result is cached for
+// ListCacheConfig.LatestTTL.
+func latest(w http.ResponseWriter, r *http.Request) {
+	escaped := mux.Vars(r)["module"]
+
+	c := callerFrom(r.Context())
+	if version, ok := cachedLatest(r.Context(), escaped, c); ok {
+		serveLatest(w, r, escaped, version)
+		return
+	}
+	versions, err := visibleVersions(r, escaped)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	var tagged []string
+	for _, v := range versions {
+		if semver.IsValid(v) && v == semver.Canonical(v) && !module.IsPseudoVersion(v) {
+			tagged = append(tagged, v)
+		}
+	}
+
+	var version string
+	if len(tagged) > 0 {
+		version = pickLatest(r.Context(), escaped, tagged)
+	} else {
+		path, _ := module.UnescapePath(escaped)
+		res, ok := upstreamFor(path).(resolver)
+		if !ok {
+			httpError(w, kindError{fmt.Sprintf("%s has no versions", path), errNotFound})
+			return
+		}
+		if version, err = res.Resolve(r.Context(), path, "HEAD"); err != nil {
+			httpError(w, err)
+			return
+		}
+		if isQuarantined(c, escaped, version) || blockOf(escaped, version) != nil {
+			httpError(w, kindError{fmt.Sprintf("%s has no versions", path), errNotFound})
+			return
+		}
+	}
+	rememberLatest(r.Context(), escaped, c, version)
+	serveLatest(w, r, escaped, version)
+}
+
+// serveLatest serves the .info of version as the @latest of escaped.
+func serveLatest(w http.ResponseWriter, r *http.Request, escaped, version string) {
+	filename := filepath.Join(entryDir(escaped, version), version+".info")
+	if err := ensureCached(r.Context(), escaped, version, filename); err != nil {
+		httpError(w, err)
+		return
+	}
+	serveVersionFile(w, r, escaped, version, "info", filename, "application/json")
+}
+
+// pickLatest chooses among tagged, sorted by precedence, honoring the
+// retractions of the highest version.
+func pickLatest(ctx context.Context, escaped string, tagged []string) string {
+	highest := tagged[len(tagged)-1]
+	retracted := retractionsOf(ctx, escaped, highest)
+
+	pick := ""
+	for _, v := range tagged {
+		if retracted(v) {
+			continue
+		}
+		if semver.Prerelease(v) == "" || pick == "" || semver.Prerelease(pick) != "" {
+			pick = v
+		}
+	}
+	if pick == "" {
+		return highest
+	}
+	return pick
+}
+
+// retractionsOf returns a predicate reporting whether a version is
+// retracted by the go.mod of module@version. Without a readable go.mod
+// nothing is retracted.
+func retractionsOf(ctx context.Context, escaped, version string) func(string) bool {
+	info, err := readModInfo(ctx, escaped, version)
+	if err != nil {
+		slog.WarnContext(ctx, "latest: reading retractions", "module", escaped, "version", version, "err", err)
+		return func(string) bool { return false }
+	}
+	return info.retracted
+}
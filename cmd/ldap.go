@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LDAPConfig locates the LDAP or Active Directory server that group
+// membership of authenticated callers is resolved from. A caller's
+// identity is looked up as the value of UserAttribute below BaseDN and
+// its groups are read from GroupAttribute.
+type LDAPConfig struct {
+	// URL is ldap://host[:389] or ldaps://host[:636].
+	URL          string `yaml:"url"`
+	BindDN       string `yaml:"bind_dn"`
+	BindPassword string `yaml:"bind_password"`
+	BaseDN       string `yaml:"base_dn"`
+
+	// UserAttribute defaults to sAMAccountName, GroupAttribute to
+	// memberOf, as used by Active Directory.
+	UserAttribute  string `yaml:"user_attribute"`
+	GroupAttribute string `yaml:"group_attribute"`
+
+	Timeout  time.Duration `yaml:"timeout"`
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+// groupCache remembers the groups resolved for each identity.
+var groupCache = struct {
+	sync.Mutex
+	m map[string]groupEntry
+}{m: make(map[string]groupEntry)}
+
+type groupEntry struct {
+	groups  []string
+	expires time.Time
+}
+
+// groupsOf returns the directory groups of identity, from the cache
+// while it is fresh. If the directory cannot be reached an expired
+// entry is still used rather than locking everyone out.
+func groupsOf(ctx context.Context, identity string) ([]string, error) {
+	lc := config.LDAP
+	if lc.URL == "" {
+		return nil, nil
+	}
+
+	groupCache.Lock()
+	e, ok := groupCache.m[identity]
+	groupCache.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.groups, nil
+	}
+
+	groups, err := lookupGroups(ctx, lc, identity)
+	if err != nil {
+		if ok {
+			return e.groups, nil
+		}
+		return nil, err
+	}
+
+	ttl := lc.CacheTTL
+	if ttl == 0 {
+		ttl = 10 * time.Minute
+	}
+	groupCache.Lock()
+	groupCache.m[identity] = groupEntry{groups: groups, expires: time.Now().Add(ttl)}
+	groupCache.Unlock()
+	return groups, nil
+}
+
+// lookupGroups binds to the directory and returns the group DNs of the
+// entries whose user attribute equals identity.
+func lookupGroups(ctx context.Context, lc LDAPConfig, identity string) ([]string, error) {
+	timeout := lc.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	c, err := dialLDAP(ctx, lc.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if err := c.bind(lc.BindDN, lc.BindPassword); err != nil {
+		return nil, err
+	}
+
+	userAttr := lc.UserAttribute
+	if userAttr == "" {
+		userAttr = "sAMAccountName"
+	}
+	groupAttr := lc.GroupAttribute
+	if groupAttr == "" {
+		groupAttr = "memberOf"
+	}
+	entries, err := c.search(lc.BaseDN, userAttr, identity, groupAttr)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for _, e := range entries {
+		groups = append(groups, e[strings.ToLower(groupAttr)]...)
+	}
+	return groups, nil
+}
+
+// ldapConn is a minimal LDAPv3 client (RFC 4511), enough for a simple
+// bind and an equality search. It is not safe for concurrent use.
+type ldapConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	msgID int
+}
+
+func dialLDAP(ctx context.Context, rawURL string) (*ldapConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		conn, err = d.DialContext(ctx, "tcp", hostPort(u.Host, "389"))
+	case "ldaps":
+		td := &tls.Dialer{NetDialer: d, Config: &tls.Config{ServerName: u.Hostname()}}
+		conn, err = td.DialContext(ctx, "tcp", hostPort(u.Host, "636"))
+	default:
+		return nil, fmt.Errorf("ldap: unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return &ldapConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func hostPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (c *ldapConn) Close() error {
+	c.send(berTLV(0x42, nil)) // UnbindRequest
+	return c.conn.Close()
+}
+
+// send writes protocolOp wrapped in an LDAPMessage.
+func (c *ldapConn) send(op []byte) error {
+	c.msgID++
+	_, err := c.conn.Write(berTLV(0x30, berInt(c.msgID), op))
+	return err
+}
+
+// receive reads one LDAPMessage and returns the tag and contents of its
+// protocolOp.
+func (c *ldapConn) receive() (byte, []byte, error) {
+	tag, msg, err := berRead(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != 0x30 {
+		return 0, nil, fmt.Errorf("ldap: unexpected message tag %#x", tag)
+	}
+	if _, _, msg, err = berNext(msg); err != nil { // messageID
+		return 0, nil, err
+	}
+	tag, op, _, err := berNext(msg)
+	return tag, op, err
+}
+
+// ldapResultError is a non-success LDAPResult.
+type ldapResultError struct {
+	code int
+	msg  string
+}
+
+func (e *ldapResultError) Error() string {
+	return fmt.Sprintf("ldap: result code %d: %s", e.code, e.msg)
+}
+
+// parseResult returns the error described by an LDAPResult, if any.
+func parseResult(b []byte) error {
+	_, code, b, err := berNext(b)
+	if err != nil {
+		return err
+	}
+	_, _, b, err = berNext(b) // matchedDN
+	if err != nil {
+		return err
+	}
+	_, msg, _, err := berNext(b)
+	if err != nil {
+		return err
+	}
+	if n := berToInt(code); n != 0 {
+		return &ldapResultError{code: n, msg: string(msg)}
+	}
+	return nil
+}
+
+// bind performs a simple bind. An empty dn binds anonymously.
+func (c *ldapConn) bind(dn, password string) error {
+	err := c.send(berTLV(0x60, // BindRequest
+		berInt(3),
+		berTLV(0x04, []byte(dn)),
+		berTLV(0x80, []byte(password)), // simple authentication
+	))
+	if err != nil {
+		return err
+	}
+	tag, op, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if tag != 0x61 {
+		return fmt.Errorf("ldap: unexpected bind response tag %#x", tag)
+	}
+	return parseResult(op)
+}
+
+// search returns the requested attributes of every entry below base
+// whose attribute attr equals value. Attribute names in the result are
+// lower-cased.
+func (c *ldapConn) search(base, attr, value string, attrs ...string) ([]map[string][]string, error) {
+	var list []byte
+	for _, a := range attrs {
+		list = append(list, berTLV(0x04, []byte(a))...)
+	}
+	err := c.send(berTLV(0x63, // SearchRequest
+		berTLV(0x04, []byte(base)),
+		berTLV(0x0a, []byte{2}), // scope: wholeSubtree
+		berTLV(0x0a, []byte{0}), // derefAliases: never
+		berInt(0),               // sizeLimit
+		berInt(0),               // timeLimit
+		berTLV(0x01, []byte{0}), // typesOnly: false
+		berTLV(0xa3, berTLV(0x04, []byte(attr)), berTLV(0x04, []byte(value))), // equalityMatch
+		berTLV(0x30, list),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []map[string][]string
+	for {
+		tag, op, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case 0x64: // SearchResultEntry
+			e, err := parseEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		case 0x73: // SearchResultReference, not followed
+		case 0x65: // SearchResultDone
+			return entries, parseResult(op)
+		default:
+			return nil, fmt.Errorf("ldap: unexpected search response tag %#x", tag)
+		}
+	}
+}
+
+func parseEntry(b []byte) (map[string][]string, error) {
+	_, _, b, err := berNext(b) // objectName
+	if err != nil {
+		return nil, err
+	}
+	_, attrs, _, err := berNext(b)
+	if err != nil {
+		return nil, err
+	}
+	e := make(map[string][]string)
+	for len(attrs) > 0 {
+		var attr []byte
+		if _, attr, attrs, err = berNext(attrs); err != nil {
+			return nil, err
+		}
+		_, typ, rest, err := berNext(attr)
+		if err != nil {
+			return nil, err
+		}
+		_, vals, _, err := berNext(rest)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(string(typ))
+		for len(vals) > 0 {
+			var v []byte
+			if _, v, vals, err = berNext(vals); err != nil {
+				return nil, err
+			}
+			e[name] = append(e[name], string(v))
+		}
+	}
+	return e, nil
+}
+
+// berTLV encodes one BER element with the concatenation of contents.
+func berTLV(tag byte, contents ...[]byte) []byte {
+	var body []byte
+	for _, c := range contents {
+		body = append(body, c...)
+	}
+	out := []byte{tag}
+	if n := len(body); n < 0x80 {
+		out = append(out, byte(n))
+	} else {
+		var l []byte
+		for ; n > 0; n >>= 8 {
+			l = append([]byte{byte(n)}, l...)
+		}
+		out = append(out, 0x80|byte(len(l)))
+		out = append(out, l...)
+	}
+	return append(out, body...)
+}
+
+// berInt encodes a non-negative INTEGER.
+func berInt(n int) []byte {
+	b := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(0x02, b)
+}
+
+func berToInt(b []byte) int {
+	n := 0
+	for _, c := range b {
+		n = n<<8 | int(c)
+	}
+	return n
+}
+
+var errBERShort = errors.New("ldap: truncated BER element")
+
+// berNext splits the first element off b.
+func berNext(b []byte) (tag byte, contents, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errBERShort
+	}
+	tag, n, b := b[0], int(b[1]), b[2:]
+	if n&0x80 != 0 {
+		k := n & 0x7f
+		if k == 0 || k > 4 || len(b) < k {
+			return 0, nil, nil, errBERShort
+		}
+		n, b = berToInt(b[:k]), b[k:]
+	}
+	if len(b) < n {
+		return 0, nil, nil, errBERShort
+	}
+	return tag, b[:n], b[n:], nil
+}
+
+// berRead reads one element from r.
+func berRead(r *bufio.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(hdr[1])
+	if n&0x80 != 0 {
+		k := n & 0x7f
+		if k == 0 || k > 4 {
+			return 0, nil, errBERShort
+		}
+		l := make([]byte, k)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return 0, nil, err
+		}
+		n = berToInt(l)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], body, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+// Before cache namespaces, entries lived directly below CacheDir, as
+// <module>/<version>/{<version>.info,go.mod,source.zip}, without a
+// provenance. The proxy ignores such entries and would fetch every
+// version again, so at startup migrateLegacyCache moves them into the
+// namespace of the running configuration and records their provenance.
+// That layout held whatever the backend of the time fetched, rewritten
+// or pristine, so an entry is adopted only once it is checked against
+// what the backend would fetch now: its zip must be a valid module zip
+// of the version, and its go.mod the one the upstream serves, where the
+// backend can tell without fetching the whole version. Migrated
+// versions are then pushed to the remote store, if one is configured,
+// in the background. A marker file makes the migration run once.
+
+// legacyMarker is created in CacheDir once the legacy layout has been
+// migrated.
+const legacyMarker = ".legacy-migrated"
+
+// legacyCheckTimeout bounds the upstream check of one legacy entry.
+const legacyCheckTimeout = 30 * time.Second
+
+// goModSource is implemented by backends that serve the go.mod of a
+// version without fetching the whole version.
+type goModSource interface {
+	GoMod(ctx context.Context, name, version string) ([]byte, error)
+}
+
+// legacyMigrated are the entries moved at startup, to be pushed to the
+// remote store.
+var legacyMigrated []cacheEntry
+
+// migrateLegacyCache moves the entries of the legacy layout into the
+// namespace of the running configuration. Entries that fail the checks
+// of migrateLegacyEntry are left in place and logged.
+func migrateLegacyCache() error {
+	marker := filepath.Join(CacheDir, legacyMarker)
+	if _, err := os.Stat(marker); err == nil {
+		return nil
+	}
+	des, err := os.ReadDir(CacheDir)
+	if err != nil {
+		return fmt.Errorf("migrating legacy cache: %v", err)
+	}
+	// Module paths have a dot in their first element, which tells them
+	// from the namespaces and the proxy's own state (.jobs, .acme, ...).
+	var tops []string
+	for _, de := range des {
+		if de.IsDir() && !strings.HasPrefix(de.Name(), ".") && strings.Contains(de.Name(), ".") {
+			tops = append(tops, de.Name())
+		}
+	}
+	if len(tops) == 0 {
+		return os.WriteFile(marker, nil, 0644)
+	}
+
+	var skipped int
+	for _, top := range tops {
+		err := filepath.WalkDir(filepath.Join(CacheDir, top), func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return err
+			}
+			version := d.Name()
+			if _, err := os.Stat(filepath.Join(path, version+".info")); err != nil {
+				return nil
+			}
+			rel, err := filepath.Rel(CacheDir, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			if err := migrateLegacyEntry(filepath.ToSlash(rel), version, path); err != nil {
+				slog.Warn("legacy cache: entry not migrated", "dir", path, "err", err)
+				skipped++
+			}
+			return filepath.SkipDir
+		})
+		if err != nil {
+			return fmt.Errorf("migrating legacy cache: %v", err)
+		}
+		removeEmptyDirs(filepath.Join(CacheDir, top))
+	}
+	slog.Info("legacy cache migrated", "entries", len(legacyMigrated), "skipped", skipped)
+	if skipped > 0 {
+		// Try again at the next start, e.g. after fixing permissions.
+		return nil
+	}
+	return os.WriteFile(marker, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0644)
+}
+
+// migrateLegacyEntry moves the legacy entry dir of name@version, an
+// escaped module path, to its entry directory. The entry must be
+// complete, its go.mod must declare the module path and it must pass
+// checkLegacyEntry. If the version was fetched again meanwhile, the
+// legacy copy is removed.
+func migrateLegacyEntry(name, version, dir string) error {
+	path, err := module.UnescapePath(name)
+	if err != nil {
+		return err
+	}
+	if !immutableVersion(version) {
+		return fmt.Errorf("%s is not a canonical version", version)
+	}
+	for _, f := range []string{"go.mod", "source.zip"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			return fmt.Errorf("incomplete entry: %v", err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return err
+	}
+	if mp := modfile.ModulePath(data); mp != path {
+		return fmt.Errorf("go.mod declares module %q", mp)
+	}
+	if err := checkLegacyEntry(name, version, dir, data); err != nil {
+		return err
+	}
+
+	dest := entryDir(name, version)
+	if _, err := os.Stat(dest); err == nil {
+		return os.RemoveAll(dir)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	fetched := time.Now()
+	if fi, err := os.Stat(filepath.Join(dir, version+".info")); err == nil {
+		fetched = fi.ModTime()
+	}
+	prov, err := json.MarshalIndent(provenance{
+		Namespace: cacheNS,
+		Backend:   "legacy",
+		Module:    name,
+		Version:   version,
+		FetchedAt: fetched.UTC(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, provenanceFile), prov, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(dir, dest); err != nil {
+		os.Remove(filepath.Join(dir, provenanceFile))
+		return err
+	}
+	legacyMigrated = append(legacyMigrated, cacheEntry{Module: name, Version: version, Dir: dest})
+	return nil
+}
+
+// checkLegacyEntry checks the legacy entry dir of name@version, an
+// escaped module path, whose go.mod is gomod, against what the backend
+// of the module would fetch now.
+func checkLegacyEntry(name, version, dir string, gomod []byte) error {
+	path, err := module.UnescapePath(name)
+	if err != nil {
+		return err
+	}
+	if _, err := modzip.CheckZip(module.Version{Path: path, Version: version}, filepath.Join(dir, "source.zip")); err != nil {
+		return err
+	}
+	src, ok := upstreamFor(name).(goModSource)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), legacyCheckTimeout)
+	defer cancel()
+	upstream, err := src.GoMod(ctx, name, version)
+	if err != nil {
+		return fmt.Errorf("checking go.mod upstream: %v", err)
+	}
+	if !bytes.Equal(upstream, gomod) {
+		return fmt.Errorf("go.mod differs from the upstream's, which the %s namespace serves", cacheNS)
+	}
+	return nil
+}
+
+// removeEmptyDirs removes the empty directories below and including
+// root, deepest first.
+func removeEmptyDirs(root string) {
+	var dirs []string
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i]) // fails unless empty
+	}
+}
+
+// startLegacyPush pushes the migrated entries to the remote store, one
+// at a time, in the background.
+func startLegacyPush() {
+	if store == nil || len(legacyMigrated) == 0 {
+		return
+	}
+	todo := legacyMigrated
+	go func() {
+		var failed int
+		for _, e := range todo {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+			err := store.Push(ctx, e.Module, e.Version, e.Dir)
+			cancel()
+			if err != nil {
+				slog.Error("legacy cache: store push", "module", e.Module, "version", e.Version, "err", err)
+				failed++
+			}
+		}
+		slog.Info("legacy cache: pushed to store", "entries", len(todo)-failed, "failed", failed)
+	}()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+// writeLegacyEntry writes an entry of the pre-namespace layout for
+// path@version with go.mod gomod.
+func writeLegacyEntry(t *testing.T, path, version, gomod string) string {
+	t.Helper()
+	dir := filepath.Join(CacheDir, path, version)
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "go.mod"), []byte(gomod), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for file, data := range map[string]string{version + ".info": `{"Version":"` + version + `"}`, "go.mod": gomod} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Create(filepath.Join(dir, "source.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := modzip.CreateFromDir(f, module.Version{Path: path, Version: version}, src); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestMigrateLegacyCache(t *testing.T) {
+	keepState(t)
+	defer func() { legacyMigrated = nil }()
+	CacheDir, cacheNS = t.TempDir(), nsPristine
+
+	// The upstream's go.mod of example.com/rewritten is not the one
+	// the legacy cache holds.
+	gomods := map[string]string{
+		"/example.com/pristine/@v/v1.0.0.mod":  "module example.com/pristine\n",
+		"/example.com/rewritten/@v/v1.0.0.mod": "module example.com/rewritten\n\ngo 1.21\n",
+		"/example.com/badzip/@v/v1.0.0.mod":    "module example.com/badzip\n",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gomod, ok := gomods[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(gomod))
+	}))
+	defer srv.Close()
+	b := &artifactBackend{BackendConfig: BackendConfig{Type: "artifactory", URL: srv.URL}, src: "example.com", client: srv.Client()}
+	routing.Store(&routingTable{mappings: []*mapping{{repoMapping: repoMapping{Src: "example.com"}, upstream: b}}, upstream: b})
+
+	writeLegacyEntry(t, "example.com/pristine", "v1.0.0", "module example.com/pristine\n")
+	rewritten := writeLegacyEntry(t, "example.com/rewritten", "v1.0.0", "module example.com/rewritten\n")
+	badzip := writeLegacyEntry(t, "example.com/badzip", "v1.0.0", "module example.com/badzip\n")
+	if err := os.WriteFile(filepath.Join(badzip, "source.zip"), []byte("not a zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateLegacyCache(); err != nil {
+		t.Fatal(err)
+	}
+	if !validEntry("example.com/pristine", "v1.0.0") {
+		t.Error("pristine entry not migrated into the pristine namespace")
+	}
+	for _, dir := range []string{rewritten, badzip} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("entry %s not left in place: %v", dir, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(CacheDir, legacyMarker)); err == nil {
+		t.Error("marker written although entries were skipped")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The proxy logs through log/slog: one line per request from
+// logRequests, with the module, version, endpoint, client address,
+// status and duration, and a line per notable event elsewhere. Every
+// request gets an ID, taken from its X-Request-Id header or generated,
+// which is echoed in the response and attached to everything logged
+// while serving it.
+
+// LogConfig configures logging.
+type LogConfig struct {
+	// Level is debug, info (the default), warn or error.
+	Level string `yaml:"level"`
+
+	// Format is text (the default) or json.
+	Format string `yaml:"format"`
+}
+
+type requestIDKey struct{}
+
+// setupLogging installs the default logger. Messages of the log
+// package, such as those of net/http, go through it too.
+func setupLogging(lc LogConfig) error {
+	var level slog.Level
+	if lc.Level != "" {
+		if err := level.UnmarshalText([]byte(lc.Level)); err != nil {
+			return fmt.Errorf("log level %q: %v", lc.Level, err)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch lc.Format {
+	case "", "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("log format %q: must be text or json", lc.Format)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+	return nil
+}
+
+// contextHandler adds the request ID of the context to every record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// requestIDFrom returns the ID of the request being served with ctx.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID assigns every request its ID.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || len(id) > 128 || strings.ContainsFunc(id, func(c rune) bool { return c <= ' ' || c > '~' }) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// clientIP returns the address r came from.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// logRequests is router middleware logging every matched request once
+// it is served.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		level := slog.LevelInfo
+		switch {
+		case rec.code >= 500:
+			level = slog.LevelError
+		case r.URL.Path == "/healthz" || r.URL.Path == "/readyz":
+			// Probes arrive every few seconds.
+			level = slog.LevelDebug
+		}
+		endpoint := endpointOf(r)
+		if strings.HasSuffix(r.URL.Path, "/@latest") {
+			endpoint = "latest"
+		}
+		vars := mux.Vars(r)
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("endpoint", endpoint),
+			slog.Int("status", rec.code),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("client_ip", clientIP(r)),
+		}
+		if c := callerFrom(r.Context()); c != anonymous {
+			attrs = append(attrs, slog.String("identity", c.Identity))
+		}
+		if m := vars["module"]; m != "" {
+			attrs = append(attrs, slog.String("module", m))
+		}
+		if v := vars["version"]; v != "" {
+			attrs = append(attrs, slog.String("version", v))
+		}
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
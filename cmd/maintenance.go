@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// During a storage migration the proxy should not fill its cache: a
+// fetch would write to storage being moved, and would fail at random
+// if the store is read-only. In maintenance mode, cache hits are served
+// as usual while misses answer 503 with Retry-After, which the go
+// command reports as a temporary failure. The mode starts from the
+// config, can be switched on and off through the admin API, and is
+// spread to the other replicas over the cluster bus. A switch through
+// the API lasts until the next restart.
+
+// MaintenanceConfig configures maintenance mode.
+type MaintenanceConfig struct {
+	// Enabled starts the proxy in maintenance mode.
+	Enabled bool `yaml:"enabled"`
+
+	// RetryAfter is sent to clients whose request needs a fetch
+	// (default 5m).
+	RetryAfter time.Duration `yaml:"retry_after"`
+
+	// Message is included in the responses.
+	Message string `yaml:"message"`
+}
+
+// maintenanceState is the current maintenance mode.
+type maintenanceState struct {
+	Enabled    bool      `json:"enabled"`
+	RetryAfter int       `json:"retry_after"` // seconds
+	Message    string    `json:"message,omitempty"`
+	ChangedBy  string    `json:"changed_by,omitempty"`
+	ChangedAt  time.Time `json:"changed_at"`
+}
+
+var maintenance struct {
+	mu    sync.Mutex
+	state maintenanceState
+}
+
+// setupMaintenance applies the configured initial mode.
+func setupMaintenance(mc MaintenanceConfig) error {
+	if mc.RetryAfter < 0 {
+		return fmt.Errorf("retry_after must not be negative")
+	}
+	return applyMaintenance(&maintenanceState{
+		Enabled:    mc.Enabled,
+		RetryAfter: int(mc.RetryAfter.Seconds()),
+		Message:    mc.Message,
+		ChangedBy:  "config",
+		ChangedAt:  time.Now().UTC(),
+	})
+}
+
+// applyMaintenance makes s the current mode.
+func applyMaintenance(s *maintenanceState) error {
+	if s.RetryAfter <= 0 {
+		s.RetryAfter = 300
+	}
+	maintenance.mu.Lock()
+	defer maintenance.mu.Unlock()
+	maintenance.state = *s
+	return nil
+}
+
+func currentMaintenance() maintenanceState {
+	maintenance.mu.Lock()
+	defer maintenance.mu.Unlock()
+	return maintenance.state
+}
+
+// checkMaintenance returns an errMaintenance error if the cache may not
+// be filled now.
+func checkMaintenance() error {
+	s := currentMaintenance()
+	if !s.Enabled {
+		return nil
+	}
+	msg := "the proxy is in maintenance and serves cached versions only"
+	if s.Message != "" {
+		msg += ": " + s.Message
+	}
+	return kindError{msg, errMaintenance}
+}
+
+// retryAfter returns the Retry-After value of the current mode.
+func retryAfter() string {
+	return strconv.Itoa(currentMaintenance().RetryAfter)
+}
+
+// getMaintenance serves GET /admin/maintenance.
+func getMaintenance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentMaintenance())
+}
+
+// setMaintenance serves POST /admin/maintenance, with an optional JSON
+// body {"message": "...", "retry_after": "10m"}, to start maintenance,
+// and DELETE to end it. As for blocks, the change is published on the
+// cluster bus and the response is 200 only if every peer acknowledged.
+func setMaintenance(w http.ResponseWriter, r *http.Request) {
+	s := &maintenanceState{
+		Enabled:    r.Method == http.MethodPost,
+		RetryAfter: int(config.Maintenance.RetryAfter.Seconds()),
+		ChangedBy:  callerFrom(r.Context()).Identity,
+		ChangedAt:  time.Now().UTC(),
+	}
+	if s.Enabled {
+		var req struct {
+			Message    string `json:"message"`
+			RetryAfter string `json:"retry_after"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, `body must be {"message": "...", "retry_after": "10m"}`, http.StatusBadRequest)
+			return
+		}
+		if req.RetryAfter != "" {
+			d, err := time.ParseDuration(req.RetryAfter)
+			if err != nil || d < 0 {
+				http.Error(w, "invalid retry_after: "+req.RetryAfter, http.StatusBadRequest)
+				return
+			}
+			s.RetryAfter = int(d.Seconds())
+		}
+		s.Message = req.Message
+	}
+
+	applyMaintenance(s)
+	peers, err := publish(r.Context(), busEvent{Kind: eventMaintenance, Maintenance: s})
+	if err != nil {
+		http.Error(w, "publishing maintenance mode: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	status := http.StatusOK
+	for _, res := range peers {
+		if res != "ok" {
+			status = http.StatusBadGateway
+		}
+	}
+	if s.Enabled {
+		sendAlert("maintenance-started", "proxy entered maintenance mode", map[string]string{
+			"message": s.Message,
+			"by":      s.ChangedBy,
+		})
+	} else {
+		slog.InfoContext(r.Context(), "maintenance mode ended", "by", s.ChangedBy)
+	}
+	writeJSON(w, status, map[string]any{"maintenance": s, "peers": peers})
+}
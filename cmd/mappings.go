@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// MappingConfig maps a further module path prefix to the repositories
+// it is mirrored from, next to the SRC_REPO → DEST_REPO mapping, so one
+// proxy can front several organizations. A module is resolved through
+// the mapping with the longest matching Src, so prefixes may nest:
+//
+//	mappings:
+//	  - src: pegasus-cloud.com/aes
+//	    dest: github.com/aes-team
+//	  - src: example.org/tools
+//	    dest: gitlab.example.org/tools
+//	    token: glpat-xxx
+//
+// Every mapping uses the top-level backend.
+type MappingConfig struct {
+	Src  string `yaml:"src"`
+	Dest string `yaml:"dest"`
+
+	// Token defaults to REPO_TOKEN.
+	Token string `yaml:"token"`
+
+	// DualStack also serves the modules under their Dest paths, with
+	// go.mod and zip naming those (see dualstack.go).
+	DualStack bool `yaml:"dual_stack"`
+}
+
+type mapping struct {
+	repoMapping
+	upstream  backend
+	dualStack bool
+}
+
+// buildMappings returns the mapping table of c: root, the SRC_REPO
+// mapping resolved from up, followed by the configured ones.
+func buildMappings(c Config, root repoMapping, up backend) ([]*mapping, error) {
+	mappings := []*mapping{{
+		repoMapping: root,
+		upstream:    up,
+		dualStack:   c.DualStack,
+	}}
+	if c.DualStack && root.Dest == "" {
+		return nil, fmt.Errorf("dual_stack requires DEST_REPO")
+	}
+	for i, mc := range c.Mappings {
+		m := &mapping{repoMapping: repoMapping{
+			Src:   removeSchemeAndTrailingSlash(mc.Src),
+			Dest:  removeSchemeAndTrailingSlash(mc.Dest),
+			Token: mc.Token,
+		}, dualStack: mc.DualStack}
+		if m.Src == "" || m.Dest == "" {
+			return nil, fmt.Errorf("mappings[%d]: src and dest are required", i)
+		}
+		if m.Token == "" {
+			m.Token = root.Token
+		}
+		for _, o := range mappings {
+			if o.Src == m.Src {
+				return nil, fmt.Errorf("mappings[%d]: src %s is already mapped to %s", i, m.Src, o.Dest)
+			}
+		}
+		var err error
+		if m.upstream, err = newBackend(c.Backend, m.repoMapping); err != nil {
+			return nil, fmt.Errorf("mappings[%d]: %v", i, err)
+		}
+		for _, o := range mappings {
+			if m.dualStack && o.dualStack && o.Dest == m.Dest {
+				return nil, fmt.Errorf("mappings[%d]: dest %s is already served for %s", i, m.Dest, o.Src)
+			}
+		}
+		mappings = append(mappings, m)
+		slog.Info("mapping", "src", m.Src, "dest", m.Dest, "dual_stack", m.dualStack)
+	}
+	return mappings, nil
+}
+
+// mappingFor returns the mapping with the longest Src that is a path
+// prefix of name, or nil.
+func mappingFor(name string) *mapping {
+	var best *mapping
+	for _, m := range routes().mappings {
+		if hasPathPrefix(name, m.Src) && (best == nil || len(m.Src) > len(best.Src)) {
+			best = m
+		}
+	}
+	return best
+}
+
+// mappedSrcs returns the module path prefixes served at the root.
+func mappedSrcs() []string {
+	return routes().srcs()
+}
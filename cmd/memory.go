@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The proxy holds module data in memory while it fetches (the native
+// git backend clones into memory) and copies artifacts between disk,
+// network and the remote store. Many concurrent large modules can push
+// the process over its container's memory limit. setupMemory sets a
+// soft limit for the garbage collector, from --memory-limit (or
+// MEMORY_LIMIT) or else from the cgroup limit, and sizes the copy
+// buffers and the number of concurrent fetches to fit it.
+
+var (
+	memoryLimit int64 // 0 if unlimited
+
+	copyBufSize = 32 << 10
+	copyBufs    = sync.Pool{New: func() any { b := make([]byte, copyBufSize); return &b }}
+
+	// fetchSlots bounds concurrent fetches; nil if unbounded.
+	fetchSlots *slotQueue
+)
+
+// parseSize parses a byte count such as 1073741824, 512MiB or 2G.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+		{"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12}, {"B", 1},
+	} {
+		if rest, ok := strings.CutSuffix(s, u.suffix); ok {
+			s, mult = strings.TrimSpace(rest), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// cgroupMemoryLimit returns the memory limit of the process's cgroup
+// (v2, then v1), or 0 if there is none.
+func cgroupMemoryLimit() int64 {
+	for _, path := range []string{
+		"/sys/fs/cgroup/memory.max",
+		"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+	} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil || n <= 0 || n >= 1<<60 { // "max", or v1's "unlimited"
+			return 0
+		}
+		return n
+	}
+	return 0
+}
+
+// setupMemory applies the memory limit. An explicit limit is used as
+// is; a cgroup limit is reduced by a tenth to leave room for memory the
+// runtime does not account for. GOMEMLIMIT and GOGC, if set, are left
+// to the runtime.
+func setupMemory(limit string) error {
+	switch {
+	case limit != "":
+		n, err := parseSize(limit)
+		if err != nil {
+			return fmt.Errorf("memory limit: %v", err)
+		}
+		memoryLimit = n
+	case os.Getenv("GOMEMLIMIT") != "":
+		memoryLimit = debug.SetMemoryLimit(-1)
+	default:
+		memoryLimit = cgroupMemoryLimit() / 10 * 9
+	}
+	if memoryLimit <= 0 {
+		memoryLimit = 0
+		return nil
+	}
+	debug.SetMemoryLimit(memoryLimit)
+
+	// With a limit in place the collector can run less often until the
+	// heap approaches it.
+	if os.Getenv("GOGC") == "" {
+		debug.SetGCPercent(200)
+	}
+
+	// One buffer per 4096th of the limit, between 32KiB and 1MiB.
+	copyBufSize = int(min(max(memoryLimit/4096, 32<<10), 1<<20))
+
+	// A fetch may hold a whole zip in memory.
+	maxZip := config.Fetch.MaxZipBytes
+	if maxZip == 0 {
+		maxZip = defaultFetchPolicy.MaxZipBytes
+	}
+	fetchSlots = newSlotQueue(int(max(1, memoryLimit/maxZip)))
+
+	slog.Info("memory limit", "bytes", memoryLimit, "fetches", fetchSlots.size, "copy_buffer", copyBufSize)
+	return nil
+}
+
+// acquireFetchSlot waits for room for one more fetch, behind waiters of
+// a higher priority class than the caller in ctx. The returned function
+// releases it.
+func acquireFetchSlot(ctx context.Context) (func(), error) {
+	if fetchSlots == nil {
+		return func() {}, nil
+	}
+	release, err := fetchSlots.acquire(ctx, classOf(callerFrom(ctx)))
+	if err != nil {
+		return nil, fmt.Errorf("waiting for memory to fetch: %w", err)
+	}
+	return release, nil
+}
+
+// copyBuffered is io.Copy with a buffer from the pool.
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	bp := copyBufs.Get().(*[]byte)
+	defer copyBufs.Put(bp)
+	return io.CopyBuffer(dst, src, *bp)
+}
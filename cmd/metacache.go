@@ -0,0 +1,289 @@
+package main
+
+import (
+	clist "container/list"
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version lists and @latest results are cached in memory by each
+// replica. With ListCacheConfig.Redis set they are also shared through
+// Redis, so one replica's git ls-remote serves the whole cluster until
+// the TTL expires. Redis is an optimization only: when it fails, the
+// proxy logs and asks the upstream as if it were not configured.
+
+// metaCache is the shared tier of the metadata cache.
+type metaCache struct {
+	cfg    RedisConfig
+	prefix string
+
+	mu   sync.Mutex
+	idle []*redisConn // dialed lazily, up to maxIdleRedis
+}
+
+// maxIdleRedis bounds the idle connections kept to Redis.
+const maxIdleRedis = 8
+
+var sharedMeta *metaCache // nil without Redis
+
+// setupMetaCache configures the shared metadata cache.
+func setupMetaCache(lc ListCacheConfig) {
+	sharedMeta = nil
+	if lc.Redis.Addr == "" {
+		return
+	}
+	prefix := lc.Prefix
+	if prefix == "" {
+		prefix = "goproxy:meta:"
+	}
+	sharedMeta = &metaCache{cfg: lc.Redis, prefix: prefix}
+}
+
+// do runs a command on a connection of its own, so that concurrent
+// commands do not wait for each other's round-trips, redialing once if
+// the connection broke.
+func (c *metaCache) do(ctx context.Context, args ...string) (any, error) {
+	for attempt := 0; ; attempt++ {
+		conn, err := c.conn(attempt > 0)
+		if err != nil {
+			return nil, err
+		}
+		if d, ok := ctx.Deadline(); ok {
+			conn.conn.SetDeadline(d)
+		}
+		reply, err := conn.do(args...)
+		if err == nil {
+			conn.conn.SetDeadline(time.Time{})
+			c.release(conn)
+			return reply, nil
+		}
+		conn.Close()
+		if _, ok := err.(redisError); ok || attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+// conn returns an idle connection, or a new one if there is none or
+// fresh is set.
+func (c *metaCache) conn(fresh bool) (*redisConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 && !fresh {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return conn, nil
+	}
+	c.mu.Unlock()
+	return dialRedis(c.cfg)
+}
+
+// release returns conn to the idle connections, or closes it if there
+// are enough.
+func (c *metaCache) release(conn *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= maxIdleRedis {
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+// get returns the value at key, if any.
+func (c *metaCache) get(ctx context.Context, key string) (string, bool) {
+	reply, err := c.do(ctx, "GET", c.prefix+key)
+	if err != nil {
+		slog.WarnContext(ctx, "metadata cache", "err", err)
+		return "", false
+	}
+	s, ok := reply.(string)
+	return s, ok
+}
+
+// set stores value at key for ttl.
+func (c *metaCache) set(ctx context.Context, key, value string, ttl time.Duration) {
+	if _, err := c.do(ctx, "SET", c.prefix+key, value, "PX", strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+		slog.WarnContext(ctx, "metadata cache", "err", err)
+	}
+}
+
+// del removes keys.
+func (c *metaCache) del(ctx context.Context, keys ...string) {
+	args := []string{"DEL"}
+	for _, k := range keys {
+		args = append(args, c.prefix+k)
+	}
+	if _, err := c.do(ctx, args...); err != nil {
+		slog.WarnContext(ctx, "metadata cache", "err", err)
+	}
+}
+
+// listing is a module's versions and the hash of the ref advertisement
+// they were parsed from, if the backend reports one.
+type listing struct {
+	versions []string
+	refs     string
+}
+
+// listVersions lists the module path upstream, unless another replica
+// did so within the TTL. It reports unchanged, and returns prev, when
+// the refs are those prev was listed from.
+func listVersions(ctx context.Context, path string, prev listing) (l listing, unchanged bool, err error) {
+	if sharedMeta != nil {
+		if s, ok := sharedMeta.get(ctx, "list:"+path); ok {
+			refs, _ := sharedMeta.get(ctx, "refs:"+path)
+			if refs != "" && refs == prev.refs {
+				return prev, true, nil
+			}
+			return listing{strings.Fields(s), refs}, false, nil
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, fetchPolicyFor(path).ListTimeout)
+	defer cancel()
+	if rl, ok := upstreamFor(path).(refLister); ok {
+		l.versions, l.refs, err = rl.ListRefs(ctx, path, prev.refs)
+	} else {
+		l.versions, err = upstreamFor(path).List(ctx, path)
+	}
+	if err != nil {
+		return listing{}, false, err
+	}
+	if l.refs != "" && l.refs == prev.refs {
+		l, unchanged = prev, true
+	}
+	if sharedMeta != nil {
+		sharedMeta.set(ctx, "list:"+path, strings.Join(l.versions, "\n"), listCacheTTL())
+		if l.refs != "" {
+			sharedMeta.set(ctx, "refs:"+path, l.refs, listCacheTTL())
+		}
+	}
+	return l, unchanged, nil
+}
+
+func listCacheTTL() time.Duration {
+	if ttl := config.ListCache.TTL; ttl != 0 {
+		return ttl
+	}
+	return time.Minute
+}
+
+func latestCacheTTL() time.Duration {
+	if ttl := config.ListCache.LatestTTL; ttl != 0 {
+		return ttl
+	}
+	return listCacheTTL()
+}
+
+// latestCache holds resolved @latest versions, the most recently used
+// first, up to maxLatest of them. Callers that may see quarantined or
+// hidden versions get their own entries. Expired entries are dropped
+// when they are looked up or pushed out by newer ones.
+var latestCache = struct {
+	sync.Mutex
+	lru  *clist.List // of *latestEntry
+	keys map[string]*clist.Element
+}{lru: clist.New(), keys: make(map[string]*clist.Element)}
+
+// maxLatest bounds the @latest results kept in memory.
+const maxLatest = 10000
+
+type latestEntry struct {
+	key     string
+	version string
+	expires time.Time
+}
+
+// lookupLatest returns the unexpired @latest version cached at key.
+func lookupLatest(key string) (string, bool) {
+	latestCache.Lock()
+	defer latestCache.Unlock()
+	el, ok := latestCache.keys[key]
+	if !ok {
+		return "", false
+	}
+	e := el.Value.(*latestEntry)
+	if time.Now().After(e.expires) {
+		latestCache.lru.Remove(el)
+		delete(latestCache.keys, key)
+		return "", false
+	}
+	latestCache.lru.MoveToFront(el)
+	return e.version, true
+}
+
+// storeLatest caches version at key for the latest TTL, dropping the
+// least recently used entries beyond maxLatest.
+func storeLatest(key, version string) {
+	latestCache.Lock()
+	defer latestCache.Unlock()
+	e := &latestEntry{key, version, time.Now().Add(latestCacheTTL())}
+	if el, ok := latestCache.keys[key]; ok {
+		el.Value = e
+		latestCache.lru.MoveToFront(el)
+		return
+	}
+	latestCache.keys[key] = latestCache.lru.PushFront(e)
+	for latestCache.lru.Len() > maxLatest {
+		el := latestCache.lru.Back()
+		delete(latestCache.keys, latestCache.lru.Remove(el).(*latestEntry).key)
+	}
+}
+
+func latestKey(escaped string, c *caller) string {
+	return "latest:" + escaped + "@" + strconv.FormatBool(c.hasScope(scopeCanary)) + ":" + hideScopes(c)
+}
+
+// cachedLatest returns the @latest version of escaped resolved for a
+// caller like c within the TTL, if it is still visible to c.
+func cachedLatest(ctx context.Context, escaped string, c *caller) (string, bool) {
+	key := latestKey(escaped, c)
+	version, ok := lookupLatest(key)
+	if !ok {
+		if sharedMeta == nil {
+			return "", false
+		}
+		if version, ok = sharedMeta.get(ctx, key); !ok {
+			return "", false
+		}
+		storeLatest(key, version)
+	}
+	if isQuarantined(c, escaped, version) || blockOf(escaped, version) != nil {
+		return "", false
+	}
+	return version, true
+}
+
+// rememberLatest caches version as the @latest of escaped for callers
+// like c.
+func rememberLatest(ctx context.Context, escaped string, c *caller, version string) {
+	key := latestKey(escaped, c)
+	storeLatest(key, version)
+	if sharedMeta != nil {
+		sharedMeta.set(ctx, key, version, latestCacheTTL())
+	}
+}
+
+// forgetLatest drops the cached @latest of escaped.
+func forgetLatest(escaped string) {
+	keys := []string{latestKey(escaped, anonymous), latestKey(escaped, &caller{Scopes: []string{scopeCanary}})}
+	prefix := "latest:" + escaped + "@"
+	latestCache.Lock()
+	for k, el := range latestCache.keys {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+			latestCache.lru.Remove(el)
+			delete(latestCache.keys, k)
+		}
+	}
+	latestCache.Unlock()
+	if sharedMeta != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		sharedMeta.del(ctx, keys...)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLatestCacheBounded(t *testing.T) {
+	defer func() {
+		latestCache.lru.Init()
+		clear(latestCache.keys)
+	}()
+	for i := range maxLatest + 10 {
+		storeLatest(fmt.Sprint(i), "v1.0.0")
+	}
+	if n := len(latestCache.keys); n != maxLatest {
+		t.Errorf("%d entries, want %d", n, maxLatest)
+	}
+	if _, ok := lookupLatest("0"); ok {
+		t.Error("least recently used entry kept")
+	}
+	if v, ok := lookupLatest(fmt.Sprint(maxLatest + 9)); !ok || v != "v1.0.0" {
+		t.Errorf("lookupLatest = %q, %v", v, ok)
+	}
+
+	latestCache.keys["1000"].Value.(*latestEntry).expires = time.Now().Add(-time.Second)
+	if _, ok := lookupLatest("1000"); ok {
+		t.Error("expired entry returned")
+	}
+	if _, ok := latestCache.keys["1000"]; ok {
+		t.Error("expired entry kept after lookup")
+	}
+}
+
+// TestMetaCacheConcurrent checks that a command waiting for its reply
+// does not hold up another.
+func TestMetaCacheConcurrent(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// The server answers the GET of "slow" only once "fast" is done.
+	slowSent, fastDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+				for {
+					cmd, err := c.receive()
+					if err != nil {
+						return
+					}
+					if args := cmd.([]any); args[1] == "p:slow" {
+						close(slowSent)
+						<-fastDone
+					}
+					fmt.Fprint(conn, "$2\r\nv1\r\n")
+				}
+			}()
+		}
+	}()
+
+	mc := &metaCache{cfg: RedisConfig{Addr: l.Addr().String()}, prefix: "p:"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if v, ok := mc.get(ctx, "slow"); !ok || v != "v1" {
+			t.Errorf("get slow = %q, %v", v, ok)
+		}
+	}()
+	<-slowSent
+	if v, ok := mc.get(ctx, "fast"); !ok || v != "v1" {
+		t.Errorf("get fast = %q, %v", v, ok)
+	}
+	close(fastDone)
+	wg.Wait()
+	if n := len(mc.idle); n != 2 {
+		t.Errorf("%d idle connections, want 2", n)
+	}
+}
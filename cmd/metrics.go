@@ -0,0 +1,413 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/module"
+)
+
+// /metrics exposes counters and histograms in the Prometheus text
+// format. The handful of metric types the proxy needs are implemented
+// here rather than pulling in the client library. Labels carry module
+// paths only in the opt-in per-prefix metrics, cut to prefix_depth path
+// elements and capped at max_prefixes values, so the number of series
+// stays bounded.
+
+// MetricsConfig configures the per-prefix metrics, which break traffic
+// down by module path prefix, e.g. by team.
+type MetricsConfig struct {
+	// PrefixDepth is the number of leading elements of module paths
+	// labeling the per-prefix metrics; 0 disables them.
+	PrefixDepth int `yaml:"prefix_depth"`
+
+	// MaxPrefixes caps the number of prefix label values (default 100).
+	// Modules under further prefixes are counted as "other".
+	MaxPrefixes int `yaml:"max_prefixes"`
+}
+
+func checkMetrics(c MetricsConfig) error {
+	if c.PrefixDepth < 0 || c.MaxPrefixes < 0 {
+		return fmt.Errorf("metrics.prefix_depth and metrics.max_prefixes must not be negative")
+	}
+	return nil
+}
+
+// durationBuckets are the upper bounds, in seconds, of the latency
+// histograms.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// counterVec is a counter with labels.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64  // by rendered label set
+	sets   map[string][]string // label values by rendered label set
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64), sets: make(map[string][]string)}
+}
+
+func (c *counterVec) inc(values ...string) {
+	key := labelSet(c.labels, values)
+	c.mu.Lock()
+	c.values[key]++
+	if _, ok := c.sets[key]; !ok {
+		c.sets[key] = append([]string(nil), values...)
+	}
+	c.mu.Unlock()
+}
+
+// sumBy returns the counts summed by the value of the label at index i.
+func (c *counterVec) sumBy(i int) map[string]float64 {
+	sums := make(map[string]float64)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, v := range c.values {
+		label := ""
+		if values := c.sets[key]; i < len(values) {
+			label = values[i]
+		}
+		sums[label] += v
+	}
+	return sums
+}
+
+func (c *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram with labels.
+type histogramVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(d time.Duration, values ...string) {
+	key := labelSet(h.labels, values)
+	s := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hs := h.series[key]
+	if hs == nil {
+		hs = &histogram{counts: make([]uint64, len(durationBuckets))}
+		h.series[key] = hs
+	}
+	if i := sort.SearchFloat64s(durationBuckets, s); i < len(durationBuckets) {
+		hs.counts[i]++
+	}
+	hs.sum += s
+	hs.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		hs := h.series[key]
+		// Insert le into the label set.
+		inner := strings.TrimSuffix(strings.TrimPrefix(key, "{"), "}")
+		if inner != "" {
+			inner += ","
+		}
+		var cum uint64
+		for i, le := range durationBuckets {
+			cum += hs.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, inner, formatFloat(le), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, inner, hs.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(hs.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, hs.count)
+	}
+}
+
+// labelSet renders names and values as {a="x",b="y"}.
+func labelSet(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, n := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		parts[i] = n + "=" + strconv.Quote(v)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var metrics = struct {
+	requests        *counterVec
+	requestSeconds  *histogramVec
+	cacheLookups    *counterVec
+	errors          *counterVec
+	execSeconds     *histogramVec
+	execFailures    *counterVec
+	execWaitSeconds *histogramVec
+	tlsHandshakes   *counterVec
+	tlsFailures     *counterVec
+	listRefreshes   *counterVec
+	corruptions     *counterVec
+
+	prefixRequests       *counterVec
+	prefixRequestSeconds *histogramVec
+	prefixCacheLookups   *counterVec
+}{
+	requests:        newCounterVec("goproxy_http_requests_total", "HTTP requests by endpoint and status code.", "endpoint", "code"),
+	requestSeconds:  newHistogramVec("goproxy_http_request_duration_seconds", "HTTP request latency by endpoint.", "endpoint"),
+	cacheLookups:    newCounterVec("goproxy_cache_lookups_total", "Version file lookups by result: hit, or a miss filled from the store or upstream.", "result"),
+	errors:          newCounterVec("goproxy_errors_total", "Error responses by kind.", "kind"),
+	execSeconds:     newHistogramVec("goproxy_subprocess_duration_seconds", "Duration of git and go subprocesses by command.", "cmd"),
+	execFailures:    newCounterVec("goproxy_subprocess_failures_total", "Failed subprocesses by command.", "cmd"),
+	execWaitSeconds: newHistogramVec("goproxy_subprocess_wait_seconds", "Time subprocesses waited for a slot of the pool by command.", "cmd"),
+	tlsHandshakes:   newCounterVec("goproxy_tls_handshakes_total", "Completed TLS handshakes by protocol version and whether a client certificate was presented.", "version", "client_cert"),
+	tlsFailures:     newCounterVec("goproxy_tls_handshake_failures_total", "Failed TLS handshakes by reason.", "reason"),
+	listRefreshes:   newCounterVec("goproxy_list_refreshes_total", "Version list refreshes by whether the upstream refs changed.", "result"),
+	corruptions:     newCounterVec("goproxy_cache_corruptions_total", "Cached versions evicted because a file no longer matched its recorded digest, by file.", "file"),
+
+	prefixRequests:       newCounterVec("goproxy_prefix_requests_total", "Module requests by module path prefix, endpoint and status code.", "prefix", "endpoint", "code"),
+	prefixRequestSeconds: newHistogramVec("goproxy_prefix_request_duration_seconds", "Module request latency by module path prefix and endpoint.", "prefix", "endpoint"),
+	prefixCacheLookups:   newCounterVec("goproxy_prefix_cache_lookups_total", "Version file lookups by module path prefix and result.", "prefix", "result"),
+}
+
+// prefixes are the prefix label values handed out so far.
+var prefixes = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: make(map[string]bool)}
+
+// prefixLabel returns the per-prefix metrics label of escaped module
+// path name, or "" if the metrics are disabled. A prefix without a label
+// yet takes one of the max_prefixes only if claim is set and the proxy
+// serves the module, and is "other" otherwise, so that requests for
+// garbage paths cannot use them up.
+func prefixLabel(name string, claim bool) string {
+	mc := config.Metrics
+	if mc.PrefixDepth == 0 || name == "" {
+		return ""
+	}
+	path, err := module.UnescapePath(name)
+	if err != nil {
+		return ""
+	}
+	elems := strings.Split(path, "/")
+	prefix := strings.Join(elems[:min(len(elems), mc.PrefixDepth)], "/")
+	limit := mc.MaxPrefixes
+	if limit == 0 {
+		limit = 100
+	}
+	prefixes.Lock()
+	defer prefixes.Unlock()
+	if !prefixes.seen[prefix] {
+		if !claim || len(prefixes.seen) >= limit || !servesModule(path) {
+			return "other"
+		}
+		prefixes.seen[prefix] = true
+		if len(prefixes.seen) == limit {
+			slog.Warn("metrics: max_prefixes reached; further prefixes are counted as other", "max_prefixes", limit)
+		}
+	}
+	return prefix
+}
+
+// countLookup counts a version file lookup of escaped module path name
+// by result: hit, or a miss filled from the store or upstream. Only
+// versions found in the cache or store claim a prefix label.
+func countLookup(name, result string) {
+	metrics.cacheLookups.inc(result)
+	if prefix := prefixLabel(name, result != "upstream"); prefix != "" {
+		metrics.prefixCacheLookups.inc(prefix, result)
+	}
+}
+
+// errorKind names the kind of err for goproxy_errors_total.
+func errorKind(err error) string {
+	switch statusOf(err) {
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusGone:
+		return "gone"
+	case http.StatusForbidden:
+		return "denied"
+	case http.StatusGatewayTimeout:
+		return "timeout"
+	case http.StatusBadGateway:
+		return "upstream_unavailable"
+	case http.StatusServiceUnavailable:
+		return "maintenance"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	}
+	return "internal"
+}
+
+// commandName returns the command label of argv0.
+func commandName(argv0 string) string {
+	return filepath.Base(argv0)
+}
+
+// observeExec records a finished subprocess.
+func observeExec(argv0 string, d time.Duration, err error) {
+	cmd := commandName(argv0)
+	metrics.execSeconds.observe(d, cmd)
+	if err != nil {
+		metrics.execFailures.inc(cmd)
+	}
+}
+
+// statusRecorder remembers the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// instrument is router middleware counting and timing every matched
+// request by endpoint.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		endpoint := endpointOf(r)
+		if strings.HasSuffix(r.URL.Path, "/@latest") {
+			endpoint = "latest"
+		}
+		metrics.requests.inc(endpoint, strconv.Itoa(rec.code))
+		metrics.requestSeconds.observe(time.Since(start), endpoint)
+		if prefix := prefixLabel(mux.Vars(r)["module"], rec.code < 400); prefix != "" {
+			metrics.prefixRequests.inc(prefix, endpoint, strconv.Itoa(rec.code))
+			metrics.prefixRequestSeconds.observe(time.Since(start), prefix, endpoint)
+		}
+	})
+}
+
+var cacheScan struct {
+	sync.Mutex
+	bytes   int64
+	entries int
+	at      time.Time
+}
+
+// cacheSize returns the size of the cache: as of the last eviction
+// sweep when eviction is enabled, else from a scan at most a minute old.
+func cacheSize() (int64, int) {
+	if config.Eviction.enabled() {
+		eviction.Lock()
+		defer eviction.Unlock()
+		return eviction.stats.Bytes, eviction.stats.Entries
+	}
+	cacheScan.Lock()
+	defer cacheScan.Unlock()
+	if time.Since(cacheScan.at) > time.Minute {
+		cacheScan.bytes, cacheScan.entries = 0, 0
+		walkCache(func(e cacheEntry) error {
+			cacheScan.bytes += dirSize(e.Dir)
+			cacheScan.entries++
+			return nil
+		})
+		cacheScan.at = time.Now()
+	}
+	return cacheScan.bytes, cacheScan.entries
+}
+
+// serveMetrics serves GET /metrics.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	metrics.requests.write(w)
+	metrics.requestSeconds.write(w)
+	metrics.cacheLookups.write(w)
+	metrics.errors.write(w)
+	metrics.execSeconds.write(w)
+	metrics.execFailures.write(w)
+	metrics.execWaitSeconds.write(w)
+	metrics.tlsHandshakes.write(w)
+	metrics.tlsFailures.write(w)
+	metrics.listRefreshes.write(w)
+	metrics.corruptions.write(w)
+	if config.Metrics.PrefixDepth > 0 {
+		metrics.prefixRequests.write(w)
+		metrics.prefixRequestSeconds.write(w)
+		metrics.prefixCacheLookups.write(w)
+	}
+
+	fmt.Fprintf(w, "# HELP goproxy_subprocesses_running Number of subprocesses running.\n# TYPE goproxy_subprocesses_running gauge\ngoproxy_subprocesses_running %d\n", inFlight.procs.Load())
+	fmt.Fprintf(w, "# HELP goproxy_subprocess_queue_depth Number of subprocesses waiting for a slot of the pool.\n# TYPE goproxy_subprocess_queue_depth gauge\ngoproxy_subprocess_queue_depth %d\n", procsWaiting.Load())
+
+	bytes, n := cacheSize()
+	fmt.Fprintf(w, "# HELP goproxy_cache_bytes Size of the local cache in bytes.\n# TYPE goproxy_cache_bytes gauge\ngoproxy_cache_bytes %d\n", bytes)
+	fmt.Fprintf(w, "# HELP goproxy_cache_entries Number of cached versions.\n# TYPE goproxy_cache_entries gauge\ngoproxy_cache_entries %d\n", n)
+	bytes, n = hotFiles.usage()
+	fmt.Fprintf(w, "# HELP goproxy_memory_cache_bytes Size of the .info and .mod files held in memory.\n# TYPE goproxy_memory_cache_bytes gauge\ngoproxy_memory_cache_bytes %d\n", bytes)
+	fmt.Fprintf(w, "# HELP goproxy_memory_cache_files Number of .info and .mod files held in memory.\n# TYPE goproxy_memory_cache_files gauge\ngoproxy_memory_cache_files %d\n", n)
+	if db := checksumDB; db != nil {
+		db.mu.Lock()
+		n = len(db.records)
+		db.mu.Unlock()
+		fmt.Fprintf(w, "# HELP goproxy_checksum_db_records Number of records in the private checksum database.\n# TYPE goproxy_checksum_db_records gauge\ngoproxy_checksum_db_records %d\n", n)
+	}
+}
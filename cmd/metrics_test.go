@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestPrefixLabel(t *testing.T) {
+	keepState(t)
+	defer func() { prefixes.seen = make(map[string]bool) }()
+	routing.Store(&routingTable{mappings: []*mapping{{repoMapping: repoMapping{Src: "go.example.com"}}}})
+	config.Metrics.PrefixDepth, config.Metrics.MaxPrefixes = 2, 2
+	prefixes.seen = make(map[string]bool)
+
+	for _, tt := range []struct {
+		name  string
+		claim bool
+		want  string
+	}{
+		{"github.com/garbage/repo", true, "other"},
+		{"go.example.com/team/repo", false, "other"},
+		{"go.example.com/team/repo", true, "go.example.com/team"},
+		{"go.example.com/team/other", false, "go.example.com/team"},
+		{"go.example.com/!team/repo", true, "go.example.com/Team"},
+		{"go.example.com/third/repo", true, "other"},
+		{"go.example.com/bad!", true, ""},
+	} {
+		if got := prefixLabel(tt.name, tt.claim); got != tt.want {
+			t.Errorf("prefixLabel(%q, %v) = %q, want %q", tt.name, tt.claim, got, tt.want)
+		}
+	}
+	if len(prefixes.seen) != 2 {
+		t.Errorf("%d prefixes seen, want 2", len(prefixes.seen))
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// A mirrorJob fetches every tagged version of a module into the cache.
+// Versions that are already cached are skipped, so re-running a job for
+// the same module resumes where an earlier run stopped.
+//
+// Jobs are checkpointed to CacheDir/.jobs/<id>.json after every
+// version; jobs that were still running when the process stopped are
+// resumed from their checkpoint by resumeJobs at startup.
+type mirrorJob struct {
+	mu   sync.Mutex
+	cpMu sync.Mutex // serializes checkpoints
+
+	ID          string            `json:"id"`
+	Module      string            `json:"module"`
+	Concurrency int               `json:"concurrency"`
+	State       string            `json:"state"` // running, done, failed
+	Total       int               `json:"total"`
+	Fetched     int               `json:"fetched"`
+	Skipped     int               `json:"skipped"`
+	Failed      int               `json:"failed"`
+	Errors      map[string]string `json:"errors,omitempty"`
+	Started     time.Time         `json:"started"`
+	Finished    *time.Time        `json:"finished,omitempty"`
+
+	// Pending holds the versions not yet processed; nil until the
+	// version list has been fetched.
+	Pending []string `json:"pending,omitempty"`
+	Resumed int      `json:"resumed,omitempty"`
+}
+
+const defaultMirrorConcurrency = 4
+
+var (
+	jobsMu sync.Mutex
+	jobs   = map[string]*mirrorJob{}
+	jobSeq int
+)
+
+// snapshot returns a copy of the job safe to encode.
+func (j *mirrorJob) snapshot() *mirrorJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	c := &mirrorJob{
+		ID: j.ID, Module: j.Module, Concurrency: j.Concurrency, State: j.State,
+		Total: j.Total, Fetched: j.Fetched, Skipped: j.Skipped, Failed: j.Failed,
+		Started: j.Started, Finished: j.Finished, Resumed: j.Resumed,
+		Pending: append([]string(nil), j.Pending...),
+	}
+	if len(j.Errors) > 0 {
+		c.Errors = make(map[string]string, len(j.Errors))
+		for k, v := range j.Errors {
+			c.Errors[k] = v
+		}
+	}
+	return c
+}
+
+func (j *mirrorJob) finish(state string) {
+	now := time.Now().UTC()
+	j.mu.Lock()
+	j.State = state
+	j.Finished = &now
+	j.mu.Unlock()
+	j.checkpoint()
+}
+
+func jobsDir() string {
+	return filepath.Join(CacheDir, ".jobs")
+}
+
+// checkpoint persists the job's progress. Writes go through a temporary
+// file so a crash never leaves a truncated checkpoint behind.
+func (j *mirrorJob) checkpoint() {
+	j.cpMu.Lock()
+	defer j.cpMu.Unlock()
+	data, err := json.MarshalIndent(j.snapshot(), "", "  ")
+	if err != nil {
+		slog.Error("mirror job: checkpoint", "job", j.ID, "err", err)
+		return
+	}
+	if err := writeFileAtomic(filepath.Join(jobsDir(), j.ID+".json"), data); err != nil {
+		slog.Error("mirror job: checkpoint", "job", j.ID, "err", err)
+	}
+}
+
+// writeFileAtomic replaces the file at path with data.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// resumeJobs loads the checkpointed jobs and restarts those that were
+// running when the process last stopped.
+func resumeJobs() {
+	entries, err := os.ReadDir(jobsDir())
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("loading mirror jobs", "err", err)
+		}
+		return
+	}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(jobsDir(), e.Name()))
+		if err != nil {
+			slog.Error("loading mirror jobs", "err", err)
+			continue
+		}
+		j := new(mirrorJob)
+		if err := json.Unmarshal(data, j); err != nil {
+			slog.Error("loading mirror job", "job", e.Name(), "err", err)
+			continue
+		}
+		jobs[j.ID] = j
+		if n, err := strconv.Atoi(j.ID); err == nil && n > jobSeq {
+			jobSeq = n
+		}
+		if j.State == "running" {
+			j.Resumed++
+			slog.Info("mirror job: resuming", "job", j.ID, "module", j.Module, "pending", len(j.Pending))
+			go j.run()
+		}
+	}
+}
+
+// startMirror registers and starts a mirror job for the module path.
+func startMirror(path string, concurrency int) *mirrorJob {
+	jobsMu.Lock()
+	jobSeq++
+	j := &mirrorJob{
+		ID:          strconv.Itoa(jobSeq),
+		Module:      path,
+		Concurrency: concurrency,
+		State:       "running",
+		Started:     time.Now().UTC(),
+	}
+	jobs[j.ID] = j
+	jobsMu.Unlock()
+
+	go j.run()
+	return j
+}
+
+func (j *mirrorJob) run() {
+	escaped, err := module.EscapePath(j.Module)
+	if err != nil {
+		j.fail(err)
+		return
+	}
+
+	j.mu.Lock()
+	todo := append([]string(nil), j.Pending...)
+	listed := j.Pending != nil
+	j.mu.Unlock()
+
+	if !listed {
+		ctx, cancel := budgetContext(context.Background(), j.Module)
+		versions, err := upstreamFor(j.Module).List(ctx, j.Module)
+		cancel()
+		if err != nil {
+			j.fail(err)
+			return
+		}
+		todo = []string{}
+		for _, v := range versions {
+			if semver.IsValid(v) && semver.Canonical(v) == v {
+				todo = append(todo, v)
+			}
+		}
+		sort.Slice(todo, func(a, b int) bool { return semver.Compare(todo[a], todo[b]) < 0 })
+
+		j.mu.Lock()
+		j.Total = len(todo)
+		j.Pending = append([]string{}, todo...)
+		j.mu.Unlock()
+		j.checkpoint()
+		slog.Info("mirror job: listed", "job", j.ID, "module", j.Module, "versions", len(todo))
+	}
+
+	sem := make(chan struct{}, j.Concurrency)
+	var wg sync.WaitGroup
+	for _, v := range todo {
+		if cached(escaped, v, filepath.Join(entryDir(escaped, v), v+".info")) {
+			j.mu.Lock()
+			j.Skipped++
+			j.done(v)
+			j.mu.Unlock()
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(v string) {
+			defer func() { <-sem; wg.Done() }()
+			ctx, cancel := budgetContext(context.Background(), j.Module)
+			err := fills.do(ctx, escaped+"@"+v, func(ctx context.Context) error {
+				if verifyCached(escaped, v, filepath.Join(entryDir(escaped, v), v+".info")) {
+					return nil
+				}
+				if err := checkMaintenance(); err != nil {
+					return err
+				}
+				return fetchWithRetries(ctx, escaped, v)
+			})
+			cancel()
+			j.mu.Lock()
+			if err != nil {
+				if j.Errors == nil {
+					j.Errors = map[string]string{}
+				}
+				j.Errors[v] = err.Error()
+				j.Failed++
+			} else {
+				j.Fetched++
+			}
+			j.done(v)
+			j.mu.Unlock()
+			j.checkpoint()
+		}(v)
+	}
+	wg.Wait()
+
+	s := j.snapshot()
+	slog.Info("mirror job: done", "job", j.ID, "module", j.Module, "fetched", s.Fetched, "skipped", s.Skipped, "failed", s.Failed)
+	if s.Failed > 0 {
+		j.finish("failed")
+	} else {
+		j.finish("done")
+	}
+}
+
+// done removes v from the pending versions. j.mu must be held.
+func (j *mirrorJob) done(v string) {
+	for i, p := range j.Pending {
+		if p == v {
+			j.Pending = append(j.Pending[:i], j.Pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (j *mirrorJob) fail(err error) {
+	slog.Error("mirror job failed", "job", j.ID, "err", err)
+	j.mu.Lock()
+	j.Errors = map[string]string{"": err.Error()}
+	j.mu.Unlock()
+	j.finish("failed")
+}
+
+// postMirror serves POST /admin/mirror/{module}?concurrency=N.
+func postMirror(w http.ResponseWriter, r *http.Request) {
+	path, err := module.UnescapePath(mux.Vars(r)["module"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := module.CheckPath(path); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	concurrency := defaultMirrorConcurrency
+	if v := r.URL.Query().Get("concurrency"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 64 {
+			http.Error(w, "concurrency must be between 1 and 64", http.StatusBadRequest)
+			return
+		}
+		concurrency = n
+	}
+
+	j := startMirror(path, concurrency)
+	w.Header().Set("Location", fmt.Sprintf("/admin/jobs/%s", j.ID))
+	writeJSON(w, http.StatusAccepted, j.snapshot())
+}
+
+// listJobs serves GET /admin/jobs.
+func listJobs(w http.ResponseWriter, r *http.Request) {
+	jobsMu.Lock()
+	list := make([]*mirrorJob, 0, len(jobs))
+	for _, j := range jobs {
+		list = append(list, j.snapshot())
+	}
+	jobsMu.Unlock()
+	sort.Slice(list, func(a, b int) bool { return list[a].Started.Before(list[b].Started) })
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getJob serves GET /admin/jobs/{id}.
+func getJob(w http.ResponseWriter, r *http.Request) {
+	jobsMu.Lock()
+	j := jobs[mux.Vars(r)["id"]]
+	jobsMu.Unlock()
+	if j == nil {
+		http.Error(w, "no such job", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, j.snapshot())
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// When go get fails, the message the go command prints rarely tells
+// why: every proxy error reads as "not found" or a bare status. GET
+// /api/modules/<module>/health gathers what this replica knows about a
+// module into one report: whether the caller may read it, its recent
+// upstream failures and last successful fetch, the negative answers
+// being served from memory, fills in flight, maintenance mode, and the
+// blocks, quarantines and hide rules that take versions away from the
+// caller.
+//
+// Fetch history is kept in memory per replica, for the last
+// moduleHealthFailures failures of up to moduleHealthModules modules.
+
+const (
+	moduleHealthFailures = 10
+	moduleHealthModules  = 4096
+)
+
+// fetchFailure is one failed upstream fetch or list.
+type fetchFailure struct {
+	Version string    `json:"version,omitempty"` // empty for a list
+	At      time.Time `json:"at"`
+	Kind    string    `json:"kind"`
+	Error   string    `json:"error"`
+}
+
+// fetchSuccess is the last successful fetch of a module.
+type fetchSuccess struct {
+	Version string    `json:"version"`
+	At      time.Time `json:"at"`
+}
+
+type fetchHistory struct {
+	failures []fetchFailure // oldest first
+	success  *fetchSuccess
+	last     time.Time
+}
+
+var fetchHistories = struct {
+	sync.Mutex
+	m map[string]*fetchHistory // by escaped module path
+}{m: make(map[string]*fetchHistory)}
+
+// historyOf returns the history of module, making room for it if
+// needed. fetchHistories must be locked.
+func historyOf(module string) *fetchHistory {
+	h, ok := fetchHistories.m[module]
+	if !ok {
+		if len(fetchHistories.m) >= moduleHealthModules {
+			var oldest string
+			for k, o := range fetchHistories.m {
+				if oldest == "" || o.last.Before(fetchHistories.m[oldest].last) {
+					oldest = k
+				}
+			}
+			delete(fetchHistories.m, oldest)
+		}
+		h = &fetchHistory{}
+		fetchHistories.m[module] = h
+	}
+	h.last = time.Now()
+	return h
+}
+
+// noteFetchFailure records a failed fetch of module@version, or list of
+// module if version is empty.
+func noteFetchFailure(module, version string, err error) {
+	f := fetchFailure{
+		Version: version,
+		At:      time.Now().UTC(),
+		Kind:    errorKind(err),
+		Error:   string(sanitize([]byte(err.Error()))),
+	}
+	fetchHistories.Lock()
+	defer fetchHistories.Unlock()
+	h := historyOf(module)
+	h.failures = append(h.failures, f)
+	if n := len(h.failures); n > moduleHealthFailures {
+		h.failures = slices.Clone(h.failures[n-moduleHealthFailures:])
+	}
+}
+
+// noteFetchSuccess records a successful fetch of module@version.
+func noteFetchSuccess(module, version string) {
+	fetchHistories.Lock()
+	defer fetchHistories.Unlock()
+	historyOf(module).success = &fetchSuccess{version, time.Now().UTC()}
+}
+
+// negativeEntry is a 404 or 410 being answered from memory.
+type negativeEntry struct {
+	Version    string    `json:"version"`
+	Status     int       `json:"status"`
+	Error      string    `json:"error"`
+	RetryAfter time.Time `json:"retry_after"`
+}
+
+// ModuleHealth is the response of /api/modules/<module>/health.
+type ModuleHealth struct {
+	Module string `json:"module"`
+
+	// Access is "allowed", or why the caller may not read the module.
+	// The rest of the report is left out unless it is allowed.
+	Access string `json:"access"`
+
+	Maintenance  string          `json:"maintenance,omitempty"`
+	LastSuccess  *fetchSuccess   `json:"last_success,omitempty"`
+	Failures     []fetchFailure  `json:"recent_failures,omitempty"`
+	Negative     []negativeEntry `json:"negative_cache,omitempty"`
+	InFlight     []string        `json:"fetching,omitempty"`
+	Blocked      []*versionBlock `json:"blocked,omitempty"`
+	Quarantined  []string        `json:"quarantined,omitempty"`
+	Hidden       []string        `json:"hidden_patterns,omitempty"`
+	FetchTimeout string          `json:"fetch_timeout"`
+	Retries      int             `json:"fetch_retries"`
+}
+
+// getModuleHealth serves GET /api/modules/{module}/health.
+func getModuleHealth(w http.ResponseWriter, r *http.Request) {
+	escaped := mux.Vars(r)["module"]
+	path, err := module.UnescapePath(escaped)
+	if err != nil {
+		httpError(w, kindError{err.Error(), errNotFound})
+		return
+	}
+	if !servesModule(path) {
+		httpError(w, kindError{fmt.Sprintf("%s is not served by this proxy", path), errNotFound})
+		return
+	}
+	h := ModuleHealth{Module: path, Access: "allowed"}
+	c := callerFrom(r.Context())
+	switch err := checkACL(r.Context(), path); {
+	case errors.Is(err, errAuthRequired):
+		h.Access = "authentication required: send a token for this module"
+	case errors.Is(err, errGroupsUnavailable):
+		h.Access = "group resolution unavailable: try again later"
+	case err != nil:
+		h.Access = err.Error()
+	}
+	if h.Access != "allowed" {
+		writeJSON(w, http.StatusOK, h)
+		return
+	}
+
+	if err := checkMaintenance(); err != nil {
+		h.Maintenance = err.Error()
+	}
+	policy := fetchPolicyFor(escaped)
+	h.FetchTimeout, h.Retries = policy.Timeout.String(), policy.Retries
+
+	fetchHistories.Lock()
+	if fh, ok := fetchHistories.m[escaped]; ok {
+		h.LastSuccess = fh.success
+		h.Failures = slices.Clone(fh.failures)
+		slices.Reverse(h.Failures)
+	}
+	fetchHistories.Unlock()
+
+	now := time.Now()
+	negatives.Lock()
+	for k, el := range negatives.keys {
+		a := el.Value.(*negativeAnswer)
+		if v, ok := strings.CutPrefix(k, escaped+"@"); ok && now.Before(a.expires) {
+			h.Negative = append(h.Negative, negativeEntry{v, statusOf(a.err), string(sanitize([]byte(a.err.Error()))), a.expires.UTC()})
+		}
+	}
+	negatives.Unlock()
+	slices.SortFunc(h.Negative, func(a, b negativeEntry) int { return semver.Compare(a.Version, b.Version) })
+
+	fills.mu.Lock()
+	for k := range fills.m {
+		if v, ok := strings.CutPrefix(k, escaped+"@"); ok {
+			h.InFlight = append(h.InFlight, v)
+		}
+	}
+	fills.mu.Unlock()
+	slices.SortFunc(h.InFlight, semver.Compare)
+
+	blocksMu.Lock()
+	for _, b := range blockList() {
+		if b.Module == escaped {
+			h.Blocked = append(h.Blocked, b)
+		}
+	}
+	blocksMu.Unlock()
+	if dirs, err := os.ReadDir(moduleDir(escaped)); err == nil {
+		for _, d := range dirs {
+			if v := d.Name(); semver.IsValid(v) && isQuarantined(c, escaped, v) {
+				h.Quarantined = append(h.Quarantined, v)
+			}
+		}
+	}
+	for i := range config.HideVersions {
+		if r := &config.HideVersions[i]; r.applies(path, c) {
+			h.Hidden = append(h.Hidden, r.Pattern)
+		}
+	}
+	writeJSON(w, http.StatusOK, h)
+}
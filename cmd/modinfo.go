@@ -0,0 +1,195 @@
+package main
+
+import (
+	clist "container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/semver"
+)
+
+// The go.mod of a cached version is parsed once into a ModInfo, which
+// @latest reads retractions from, the toolchain check reads the go
+// directive from, and /api/mod serves to tooling that needs a module's
+// dependencies, such as SBOM generators.
+
+// ModInfo is the content of a served go.mod.
+type ModInfo struct {
+	Module    string       `json:"module"`
+	Version   string       `json:"version"`
+	Go        string       `json:"go,omitempty"`
+	Toolchain string       `json:"toolchain,omitempty"`
+	Require   []ModRequire `json:"require"`
+	Exclude   []ModRequire `json:"exclude,omitempty"`
+	Retract   []ModRetract `json:"retract,omitempty"`
+}
+
+// ModRequire is a required (or excluded) module version.
+type ModRequire struct {
+	Path     string `json:"path"`
+	Version  string `json:"version"`
+	Indirect bool   `json:"indirect,omitempty"`
+}
+
+// ModRetract is a retracted version range.
+type ModRetract struct {
+	Low       string `json:"low"`
+	High      string `json:"high"`
+	Rationale string `json:"rationale,omitempty"`
+}
+
+// retracted reports whether m retracts version v.
+func (m *ModInfo) retracted(v string) bool {
+	for _, r := range m.Retract {
+		if semver.Compare(r.Low, v) <= 0 && semver.Compare(v, r.High) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// modInfos memoizes parsed go.mod files by path, the most recently
+// used first, up to maxModInfos of them. An entry is reused while the
+// file's modification time is unchanged, so a purged and fetched again
+// version is parsed again.
+var modInfos = struct {
+	sync.Mutex
+	lru   *clist.List // of *modInfoEntry
+	files map[string]*clist.Element
+}{lru: clist.New(), files: make(map[string]*clist.Element)}
+
+// maxModInfos bounds the parsed go.mod files kept in memory. The
+// toolchain check parses every cached one at startup.
+const maxModInfos = 4096
+
+type modInfoEntry struct {
+	gomod string
+	mtime time.Time
+	info  *ModInfo
+}
+
+// cachedModInfo returns the memoized parse of gomod if it was last
+// modified at mtime.
+func cachedModInfo(gomod string, mtime time.Time) (*ModInfo, bool) {
+	modInfos.Lock()
+	defer modInfos.Unlock()
+	e, ok := modInfos.files[gomod]
+	if !ok {
+		return nil, false
+	}
+	me := e.Value.(*modInfoEntry)
+	if !me.mtime.Equal(mtime) {
+		return nil, false
+	}
+	modInfos.lru.MoveToFront(e)
+	return me.info, true
+}
+
+// rememberModInfo memoizes info as the parse of gomod, last modified
+// at mtime, dropping the least recently used beyond maxModInfos.
+func rememberModInfo(gomod string, mtime time.Time, info *ModInfo) {
+	modInfos.Lock()
+	defer modInfos.Unlock()
+	if e, ok := modInfos.files[gomod]; ok {
+		modInfos.lru.Remove(e)
+	}
+	modInfos.files[gomod] = modInfos.lru.PushFront(&modInfoEntry{gomod, mtime, info})
+	for modInfos.lru.Len() > maxModInfos {
+		e := modInfos.lru.Back()
+		delete(modInfos.files, modInfos.lru.Remove(e).(*modInfoEntry).gomod)
+	}
+}
+
+// parseModInfo parses the go.mod file at gomod. A go.mod the strict
+// parser rejects is parsed as the go command reads a dependency's,
+// which keeps only the module, go, require and retract directives.
+func parseModInfo(gomod string) (*ModInfo, error) {
+	fi, err := os.Stat(gomod)
+	if err != nil {
+		return nil, err
+	}
+	if info, ok := cachedModInfo(gomod, fi.ModTime()); ok {
+		return info, nil
+	}
+
+	data, err := os.ReadFile(gomod)
+	if err != nil {
+		return nil, err
+	}
+	mf, err := modfile.Parse(gomod, data, nil)
+	if err != nil {
+		if mf, err = modfile.ParseLax(gomod, data, nil); err != nil {
+			return nil, err
+		}
+	}
+	info := &ModInfo{Require: []ModRequire{}}
+	if mf.Module != nil {
+		info.Module = mf.Module.Mod.Path
+	}
+	if mf.Go != nil {
+		info.Go = mf.Go.Version
+	}
+	if mf.Toolchain != nil {
+		info.Toolchain = mf.Toolchain.Name
+	}
+	for _, r := range mf.Require {
+		info.Require = append(info.Require, ModRequire{Path: r.Mod.Path, Version: r.Mod.Version, Indirect: r.Indirect})
+	}
+	for _, x := range mf.Exclude {
+		info.Exclude = append(info.Exclude, ModRequire{Path: x.Mod.Path, Version: x.Mod.Version})
+	}
+	for _, r := range mf.Retract {
+		info.Retract = append(info.Retract, ModRetract{Low: r.Low, High: r.High, Rationale: r.Rationale})
+	}
+
+	rememberModInfo(gomod, fi.ModTime(), info)
+	return info, nil
+}
+
+// readModInfo returns the parsed go.mod of escaped@version, fetching
+// the version if it is not cached.
+func readModInfo(ctx context.Context, escaped, version string) (*ModInfo, error) {
+	gomod := filepath.Join(entryDir(escaped, version), "go.mod")
+	if err := ensureCached(ctx, escaped, version, gomod); err != nil {
+		return nil, err
+	}
+	info, err := parseModInfo(gomod)
+	if err != nil {
+		return nil, fmt.Errorf("%s@%s: %v", escaped, version, err)
+	}
+	c := *info
+	c.Version = version
+	return &c, nil
+}
+
+// getModInfo serves GET /api/mod/{module}/@v/{version}, the parsed
+// go.mod of a version, subject to the same checks as its .mod file.
+func getModInfo(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	escaped, version := vars["module"], vars["version"]
+	if !semver.IsValid(version) || version != semver.Canonical(version) {
+		http.Error(w, "version must be canonical", http.StatusBadRequest)
+		return
+	}
+	if b := blockOf(escaped, version); b.blocks("mod") {
+		httpError(w, kindError{fmt.Sprintf("%s@%s has been blocked: %s", b.Module, b.Version, b.Advisory), errGone})
+		return
+	}
+	if isQuarantined(callerFrom(r.Context()), escaped, version) {
+		httpError(w, kindError{fmt.Sprintf("%s@%s is quarantined pending review", escaped, version), errPolicyDenied})
+		return
+	}
+	info, err := readModInfo(r.Context(), escaped, version)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
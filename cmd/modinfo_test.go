@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseModInfo(t *testing.T) {
+	gomod := filepath.Join(t.TempDir(), "go.mod")
+	data := "module example.com/m\n\ngo 1.22\n\nrequire example.com/dep v1.0.0 // indirect\n\nretract [v1.1.0, v1.2.0]\n"
+	if err := os.WriteFile(gomod, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := parseModInfo(gomod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Module != "example.com/m" || info.Go != "1.22" || len(info.Require) != 1 || !info.Require[0].Indirect {
+		t.Errorf("parseModInfo = %+v", info)
+	}
+	if !info.retracted("v1.1.5") || info.retracted("v1.0.0") {
+		t.Errorf("retractions = %+v", info.Retract)
+	}
+
+	// A rewritten file is parsed again.
+	if err := os.WriteFile(gomod, []byte("module example.com/m\n\ngo 1.23\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(gomod, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := parseModInfo(gomod); err != nil || info.Go != "1.23" {
+		t.Errorf("after rewrite: %+v, %v", info, err)
+	}
+}
+
+func TestModInfosBounded(t *testing.T) {
+	mtime := time.Now()
+	for i := range maxModInfos + 10 {
+		rememberModInfo("go.mod."+strconv.Itoa(i), mtime, &ModInfo{})
+	}
+	if n := len(modInfos.files); n != maxModInfos {
+		t.Errorf("%d entries, want %d", n, maxModInfos)
+	}
+	if _, ok := cachedModInfo("go.mod.0", mtime); ok {
+		t.Error("least recently used entry kept")
+	}
+	if _, ok := cachedModInfo("go.mod."+strconv.Itoa(maxModInfos+9), mtime); !ok {
+		t.Error("most recently used entry dropped")
+	}
+}
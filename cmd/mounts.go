@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// MountConfig serves the GOPROXY protocol under an additional root such
+// as /restricted, next to the default root at /. A mount has its own
+// authentication requirements and may map its own source prefix to its
+// own upstream. Everything keyed by module path (cache, quarantine,
+// blocks, ACLs) is shared between roots, so each module path must be
+// resolved from exactly one upstream: a mount that sets dest_repo,
+// repo_token or backend must set a src_repo that overlaps neither
+// SRC_REPO, the mappings nor another such mount.
+type MountConfig struct {
+	// Path is the mount point, a single path element such as /public.
+	Path string `yaml:"path"`
+
+	// RequireAuth rejects anonymous callers; Scope, if set, is required
+	// of every caller.
+	RequireAuth bool   `yaml:"require_auth"`
+	Scope       string `yaml:"scope"`
+
+	// SrcRepo, DestRepo and RepoToken default to SRC_REPO, DEST_REPO
+	// and REPO_TOKEN, Backend to the top-level backend.
+	SrcRepo   string         `yaml:"src_repo"`
+	DestRepo  string         `yaml:"dest_repo"`
+	RepoToken string         `yaml:"repo_token"`
+	Backend   *BackendConfig `yaml:"backend"`
+}
+
+// ownsUpstream reports whether the mount resolves modules from an
+// upstream of its own.
+func (mc MountConfig) ownsUpstream() bool {
+	return mc.DestRepo != "" || mc.RepoToken != "" || mc.Backend != nil
+}
+
+type mount struct {
+	MountConfig
+	mapping  repoMapping
+	upstream backend // nil if the mount uses the default upstream
+}
+
+// buildMounts returns the mounts of c, next to mappings, whose first
+// is the SRC_REPO mapping the mounts default to.
+func buildMounts(c Config, mappings []*mapping) ([]*mount, error) {
+	var mounts []*mount
+	root := mappings[0].repoMapping
+	for i, mc := range c.Mounts {
+		elem := strings.TrimPrefix(mc.Path, "/")
+		if elem == "" || strings.ContainsAny(elem, "/.") || elem == "admin" || elem == "api" || elem == "sumdb" || elem == "hooks" {
+			return nil, fmt.Errorf("mounts[%d]: path %q must be a single element without dots, other than /admin, /api, /sumdb and /hooks", i, mc.Path)
+		}
+		m := &mount{
+			MountConfig: mc,
+			mapping: repoMapping{
+				Src:   removeSchemeAndTrailingSlash(mc.SrcRepo),
+				Dest:  removeSchemeAndTrailingSlash(mc.DestRepo),
+				Token: mc.RepoToken,
+			},
+		}
+		m.Path = "/" + elem
+		if mc.SrcRepo != "" && !mc.ownsUpstream() {
+			return nil, fmt.Errorf("mount %s: src_repo needs the mount's own dest_repo, repo_token or backend", m.Path)
+		}
+		if m.mapping.Src == "" {
+			m.mapping.Src = root.Src
+		}
+		if m.mapping.Dest == "" {
+			m.mapping.Dest = root.Dest
+		}
+		if m.mapping.Token == "" {
+			m.mapping.Token = root.Token
+		}
+
+		if mc.ownsUpstream() {
+			for _, o := range mappings {
+				if hasPathPrefix(m.mapping.Src, o.Src) || hasPathPrefix(o.Src, m.mapping.Src) {
+					return nil, fmt.Errorf("mount %s: src_repo %q overlaps the mapping of %s", m.Path, m.mapping.Src, o.Src)
+				}
+			}
+			for _, o := range mounts {
+				if o.upstream != nil && (hasPathPrefix(m.mapping.Src, o.mapping.Src) || hasPathPrefix(o.mapping.Src, m.mapping.Src)) {
+					return nil, fmt.Errorf("mount %s: src_repo %q overlaps mount %s", m.Path, m.mapping.Src, o.Path)
+				}
+			}
+			bc := c.Backend
+			if mc.Backend != nil {
+				bc = *mc.Backend
+			}
+			if ns := namespaceFor(bc); ns != cacheNS {
+				return nil, fmt.Errorf("mount %s: backend uses cache namespace %s, the default backend %s", m.Path, ns, cacheNS)
+			}
+			var err error
+			if m.upstream, err = newBackend(bc, m.mapping); err != nil {
+				return nil, fmt.Errorf("mount %s: %v", m.Path, err)
+			}
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+// upstreamFor returns the backend module paths under name are resolved
+// from: the workspace if it publishes name, that of the mount owning its
+// prefix, that of the longest matching mapping, or the default upstream.
+func upstreamFor(name string) backend {
+	if ws := workspaceModule(name); ws != nil {
+		return ws
+	}
+	t := routes()
+	for _, m := range t.mounts {
+		if m.upstream != nil && hasPathPrefix(name, m.mapping.Src) {
+			return m.upstream
+		}
+	}
+	if m := mappingFor(name); m != nil {
+		return m.upstream
+	}
+	return t.upstream
+}
+
+// servesModule reports whether path is served from one of the proxy's
+// own upstreams.
+func servesModule(path string) bool {
+	t := routes()
+	prefixes := t.srcs()
+	for _, m := range t.mounts {
+		prefixes = append(prefixes, t.srcsOf(m)...)
+	}
+	for _, p := range prefixes {
+		if hasPathPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// srcsOf returns the module path prefixes served under the mount m of
+// t: its src_repo, or those of all mappings.
+func (t *routingTable) srcsOf(m *mount) []string {
+	if m.MountConfig.SrcRepo != "" {
+		return []string{m.mapping.Src}
+	}
+	return t.srcs()
+}
+
+// stripMount removes the mount point, if any, from a request path.
+func stripMount(path string) string {
+	for _, m := range routes().mounts {
+		if rest, ok := strings.CutPrefix(path, m.Path); ok && strings.HasPrefix(rest, "/") {
+			return rest
+		}
+	}
+	return path
+}
+
+// allows reports whether the mount lets c through.
+func (m *mount) allows(c *caller) bool {
+	if c.signed {
+		return true
+	}
+	if (m.RequireAuth || m.Scope != "") && c == anonymous {
+		return false
+	}
+	return m.Scope == "" || c.hasScope(m.Scope)
+}
+
+// authorize enforces the authentication requirements of the mount.
+func (m *mount) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := callerFrom(r.Context())
+		switch {
+		case m.allows(c):
+			next.ServeHTTP(w, r)
+		case c == anonymous:
+			w.Header().Set("WWW-Authenticate", `Basic realm="goproxy"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+		default:
+			http.Error(w, c.Identity+" lacks scope "+m.Scope, http.StatusForbidden)
+		}
+	})
+}
+
+// repoTokens returns the repository tokens in use, for redaction.
+func repoTokens() []string {
+	var toks []string
+	t := routes()
+	for _, m := range t.mappings {
+		if m.Token != "" {
+			toks = append(toks, m.Token)
+		}
+	}
+	for _, m := range t.mounts {
+		if m.RepoToken != "" {
+			toks = append(toks, m.RepoToken)
+		}
+	}
+	return toks
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// Artifacts produced by path-mapped backends (the module path served to
+// clients differs from the upstream one, so go.mod and zip contents are
+// rewritten) and by passthrough backends (served byte-for-byte as
+// upstream has them) must never be mixed. Each kind lives in its own
+// namespace below CacheDir, and every entry carries a provenance.json
+// that must match the running configuration for the entry to be served.
+const (
+	nsRewritten = "rewritten"
+	nsPristine  = "pristine"
+)
+
+// cacheNS is the namespace of the configured backend, set at startup.
+var cacheNS string
+
+// namespaceFor returns the cache namespace of artifacts fetched through
+// the given backend configuration.
+func namespaceFor(bc BackendConfig) string {
+	switch bc.Type {
+	case "artifactory", "nexus":
+		if bc.PathPrefix == "" {
+			return nsPristine
+		}
+	}
+	return nsRewritten
+}
+
+// moduleDir returns the cache directory of the escaped module path.
+func moduleDir(name string) string {
+	return filepath.Join(CacheDir, cacheNS, name)
+}
+
+// entryDir returns the cache directory of name@version.
+func entryDir(name, version string) string {
+	return filepath.Join(moduleDir(name), version)
+}
+
+// checkVersion returns an errNotFound error unless the escaped version
+// is canonical, as the go command requests them. Anything else, such as
+// ".." or a path, must not reach entryDir.
+func checkVersion(escaped string) error {
+	v, err := module.UnescapeVersion(escaped)
+	if err != nil || v != module.CanonicalVersion(v) {
+		return kindError{fmt.Sprintf("invalid version %q", escaped), errNotFound}
+	}
+	return nil
+}
+
+// provenance records where a cache entry came from.
+type provenance struct {
+	Namespace string    `json:"namespace"`
+	Backend   string    `json:"backend"`
+	Module    string    `json:"module"`
+	Version   string    `json:"version"`
+	FetchedAt time.Time `json:"fetched_at"`
+	Origin    *Origin   `json:"origin,omitempty"`
+	// Digests are the SHA-256 of the entry's other files, by file name.
+	Digests map[string]string `json:"digests,omitempty"`
+	// GoSum holds the go.sum hashes of the zip and go.mod, by extension.
+	GoSum map[string]string `json:"go_sum,omitempty"`
+}
+
+const provenanceFile = "provenance.json"
+
+func writeProvenance(name, version string) error {
+	backend := config.Backend.Type
+	if backend == "" {
+		backend = "git"
+	}
+	digests, err := artifactDigests(name, version)
+	if err != nil {
+		return err
+	}
+	// A zip that does not hash is hashed again, and fails, on demand.
+	gosum, _ := entryGoSum(entryDir(name, version))
+	data, err := json.MarshalIndent(provenance{
+		Namespace: cacheNS,
+		Backend:   backend,
+		Module:    name,
+		Version:   version,
+		FetchedAt: time.Now().UTC(),
+		Origin:    takeOrigin(entryDir(name, version)),
+		Digests:   digests,
+		GoSum:     gosum,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(entryDir(name, version), provenanceFile), data, 0644)
+}
+
+// readProvenance reads the provenance of the cache entry of
+// name@version.
+func readProvenance(name, version string) (*provenance, error) {
+	data, err := os.ReadFile(filepath.Join(entryDir(name, version), provenanceFile))
+	if err != nil {
+		return nil, err
+	}
+	var p provenance
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// validEntry reports whether the cache entry of name@version was
+// produced in the current namespace.
+func validEntry(name, version string) bool {
+	p, err := readProvenance(name, version)
+	if err != nil {
+		return false
+	}
+	return p.Namespace == cacheNS && p.Module == name && p.Version == version
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// A developer whose go get fails on a policy block or a missing token
+// sees the proxy's error body quoted by the go command, and little else
+// to go on. The notice tells them where to ask: it is appended as a
+// last line to the plain-text bodies of error responses with one of
+// Statuses, after they are sanitized.
+
+// NoticeConfig is the support notice appended to client-visible errors.
+type NoticeConfig struct {
+	// Text opens the notice (default "Need help with the module
+	// proxy?").
+	Text string `yaml:"text"`
+	// URL is a page to read, e.g. the proxy's runbook.
+	URL string `yaml:"url"`
+	// Contact is whom to ask, e.g. a chat channel or an address.
+	Contact string `yaml:"contact"`
+	// Statuses are the response statuses the notice is appended to
+	// (default 401, 403 and 410).
+	Statuses []int `yaml:"statuses"`
+}
+
+// checkNotice validates nc.
+func checkNotice(nc NoticeConfig) error {
+	if nc.Text != "" && nc.URL == "" && nc.Contact == "" {
+		return fmt.Errorf("notice.text needs a url or contact")
+	}
+	for _, code := range nc.Statuses {
+		if code < 400 || code > 599 {
+			return fmt.Errorf("notice.statuses: %d is not an error status", code)
+		}
+	}
+	return nil
+}
+
+// noticeLine returns the notice, or "" if none is configured.
+func noticeLine(nc NoticeConfig) string {
+	if nc.URL == "" && nc.Contact == "" {
+		return ""
+	}
+	parts := []string{nc.Text}
+	if nc.Text == "" {
+		parts[0] = "Need help with the module proxy?"
+	}
+	if nc.URL != "" {
+		parts = append(parts, "See "+nc.URL+".")
+	}
+	if nc.Contact != "" {
+		parts = append(parts, "Contact "+nc.Contact+".")
+	}
+	return strings.Join(parts, " ")
+}
+
+// appendNotice returns body, an error response with status code and
+// header h, with the notice appended if it applies.
+func appendNotice(h http.Header, code int, body []byte) []byte {
+	nc := config.Notice
+	line := noticeLine(nc)
+	if line == "" || !strings.HasPrefix(h.Get("Content-Type"), "text/plain") {
+		return body
+	}
+	statuses := nc.Statuses
+	if len(statuses) == 0 {
+		statuses = []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusGone}
+	}
+	if !slices.Contains(statuses, code) {
+		return body
+	}
+	body = bytes.TrimRight(body, "\n")
+	return append(body, "\n"+line+"\n"...)
+}
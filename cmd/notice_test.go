@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCheckNotice(t *testing.T) {
+	for _, tt := range []struct {
+		nc NoticeConfig
+		ok bool
+	}{
+		{NoticeConfig{}, true},
+		{NoticeConfig{URL: "https://wiki.example.com/proxy"}, true},
+		{NoticeConfig{Text: "Stuck?"}, false},
+		{NoticeConfig{Contact: "#proxy", Statuses: []int{404, 503}}, true},
+		{NoticeConfig{Contact: "#proxy", Statuses: []int{302}}, false},
+	} {
+		if err := checkNotice(tt.nc); (err == nil) != tt.ok {
+			t.Errorf("checkNotice(%+v) = %v", tt.nc, err)
+		}
+	}
+}
+
+func TestAppendNotice(t *testing.T) {
+	keepState(t)
+	config.Notice = NoticeConfig{URL: "https://wiki.example.com/proxy", Contact: "#proxy"}
+	const line = "Need help with the module proxy? See https://wiki.example.com/proxy. Contact #proxy."
+	text := http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+
+	if got := string(appendNotice(text, http.StatusForbidden, []byte("denied\n"))); got != "denied\n"+line+"\n" {
+		t.Errorf("403: got %q", got)
+	}
+	if got := string(appendNotice(text, http.StatusNotFound, []byte("not found\n"))); got != "not found\n" {
+		t.Errorf("404, not a default status: got %q", got)
+	}
+	json := http.Header{"Content-Type": {"application/json"}}
+	if got := string(appendNotice(json, http.StatusForbidden, []byte("{}"))); got != "{}" {
+		t.Errorf("JSON body: got %q", got)
+	}
+
+	config.Notice.Text, config.Notice.Statuses = "Stuck?", []int{http.StatusNotFound}
+	if got := string(appendNotice(text, http.StatusNotFound, []byte("not found"))); got != "not found\nStuck? See https://wiki.example.com/proxy. Contact #proxy.\n" {
+		t.Errorf("configured text and status: got %q", got)
+	}
+
+	config.Notice = NoticeConfig{}
+	if got := string(appendNotice(text, http.StatusForbidden, []byte("denied\n"))); got != "denied\n" {
+		t.Errorf("no notice configured: got %q", got)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// OCIConfig configures storage of module artifacts in an OCI registry.
+// Every module version becomes one artifact (in the style of ORAS) in
+// Repository, tagged with the SHA-256 of "module@version" since module
+// paths and versions do not fit the registry's naming rules. The
+// module path and version are recorded as manifest annotations.
+type OCIConfig struct {
+	// Repository is the full repository reference, for example
+	// registry.example.com/goproxy/modules.
+	Repository string `yaml:"repository"`
+	Username   string `yaml:"username"`
+	Password   string `yaml:"password"`
+	// PlainHTTP talks to the registry over http instead of https.
+	PlainHTTP bool `yaml:"plain_http"`
+}
+
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociEmptyType    = "application/vnd.oci.empty.v1+json"
+	ociTitle        = "org.opencontainers.image.title"
+
+	moduleArtifactType = "application/vnd.golang.module.v1"
+	modulePathAnn      = "org.golang.module.path"
+	moduleVersionAnn   = "org.golang.module.version"
+	moduleNamespaceAnn = "org.golang.module.namespace"
+)
+
+// The empty JSON object used as config blob of artifact manifests.
+var ociEmptyConfig = ociDescriptor{
+	MediaType: ociEmptyType,
+	Digest:    "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a",
+	Size:      2,
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ociStore is a minimal client of the OCI distribution API, covering
+// what is needed to push and pull module artifacts.
+type ociStore struct {
+	cfg    OCIConfig
+	base   string // scheme://host/v2/name
+	client *http.Client
+
+	mu    sync.Mutex
+	token string // bearer token from the last auth challenge
+}
+
+func newOCIStore(cfg OCIConfig) (*ociStore, error) {
+	host, name, ok := strings.Cut(cfg.Repository, "/")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("oci: repository %q must be <registry>/<name>", cfg.Repository)
+	}
+	scheme := "https"
+	if cfg.PlainHTTP {
+		scheme = "http"
+	}
+	return &ociStore{
+		cfg:    cfg,
+		base:   fmt.Sprintf("%s://%s/v2/%s", scheme, host, name),
+		client: http.DefaultClient,
+	}, nil
+}
+
+// ociTag returns the tag of name@version in the current cache namespace.
+func ociTag(name, version string) string {
+	sum := sha256.Sum256([]byte(cacheNS + "/" + name + "@" + version))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *ociStore) Push(ctx context.Context, name, version, dir string) error {
+	var layers []ociDescriptor
+	for _, file := range artifactFiles(version) {
+		d, err := s.pushBlob(ctx, filepath.Join(dir, file))
+		if err != nil {
+			return err
+		}
+		d.MediaType = layerType(file)
+		d.Annotations = map[string]string{ociTitle: file}
+		layers = append(layers, d)
+	}
+	if _, err := s.pushBytes(ctx, []byte("{}")); err != nil {
+		return err
+	}
+
+	m := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		ArtifactType:  moduleArtifactType,
+		Config:        ociEmptyConfig,
+		Layers:        layers,
+		Annotations: map[string]string{
+			modulePathAnn:      name,
+			moduleVersionAnn:   version,
+			moduleNamespaceAnn: cacheNS,
+		},
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.base+"/manifests/"+ociTag(name, version), bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", ociManifestType)
+		}
+		return req, err
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return expectStatus(resp, http.StatusCreated)
+}
+
+// manifest fetches and checks the manifest of name@version.
+func (s *ociStore) manifest(ctx context.Context, name, version string) (*ociManifest, error) {
+	resp, err := s.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.base+"/manifests/"+ociTag(name, version), nil)
+		if err == nil {
+			req.Header.Set("Accept", ociManifestType)
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("oci: %s@%s: %w", name, version, os.ErrNotExist)
+	}
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	var m ociManifest
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&m); err != nil {
+		return nil, fmt.Errorf("oci: decoding manifest: %v", err)
+	}
+	if m.Annotations[modulePathAnn] != name || m.Annotations[moduleVersionAnn] != version || m.Annotations[moduleNamespaceAnn] != cacheNS {
+		return nil, fmt.Errorf("oci: manifest for %s@%s is annotated as %s@%s", name, version, m.Annotations[modulePathAnn], m.Annotations[moduleVersionAnn])
+	}
+	return &m, nil
+}
+
+// Stat returns the digests of the stored files of name@version.
+func (s *ociStore) Stat(ctx context.Context, name, version string) (map[string]string, error) {
+	m, err := s.manifest(ctx, name, version)
+	if err != nil {
+		return nil, err
+	}
+	digests := map[string]string{}
+	for _, l := range m.Layers {
+		if title := l.Annotations[ociTitle]; title != "" {
+			digests[title] = l.Digest
+		}
+	}
+	return digests, nil
+}
+
+// Delete removes the manifest of name@version. Blobs are left to the
+// registry's garbage collection.
+func (s *ociStore) Delete(ctx context.Context, name, version string) error {
+	resp, err := s.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.base+"/manifests/"+ociTag(name, version), nil)
+		if err == nil {
+			req.Header.Set("Accept", ociManifestType)
+		}
+		return req, err
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("oci: %s@%s: %w", name, version, os.ErrNotExist)
+	}
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return err
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return fmt.Errorf("oci: registry did not report the manifest digest of %s@%s", name, version)
+	}
+
+	resp, err = s.do(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodDelete, s.base+"/manifests/"+digest, nil)
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return expectStatus(resp, http.StatusAccepted)
+}
+
+func (s *ociStore) Pull(ctx context.Context, name, version, dir string) error {
+	m, err := s.manifest(ctx, name, version)
+	if err != nil {
+		return err
+	}
+
+	want := map[string]bool{}
+	for _, f := range artifactFiles(version) {
+		want[f] = true
+	}
+	for _, l := range m.Layers {
+		title := l.Annotations[ociTitle]
+		if !want[title] {
+			continue
+		}
+		if err := s.pullBlob(ctx, l, filepath.Join(dir, title)); err != nil {
+			return err
+		}
+		delete(want, title)
+	}
+	if len(want) > 0 {
+		return fmt.Errorf("oci: artifact for %s@%s is incomplete", name, version)
+	}
+	return nil
+}
+
+func layerType(file string) string {
+	switch filepath.Ext(file) {
+	case ".info":
+		return "application/vnd.golang.module.info.v1+json"
+	case ".zip":
+		return "application/vnd.golang.module.zip.v1"
+	default:
+		return "application/vnd.golang.module.mod.v1"
+	}
+}
+
+// pushBlob uploads the file at path unless the registry already has it.
+func (s *ociStore) pushBlob(ctx context.Context, path string) (ociDescriptor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := copyBuffered(h, f)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	d := ociDescriptor{Digest: "sha256:" + hex.EncodeToString(h.Sum(nil)), Size: size}
+	return d, s.upload(ctx, d, func() (io.Reader, error) {
+		_, err := f.Seek(0, io.SeekStart)
+		return f, err
+	})
+}
+
+func (s *ociStore) pushBytes(ctx context.Context, b []byte) (ociDescriptor, error) {
+	sum := sha256.Sum256(b)
+	d := ociDescriptor{Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(b))}
+	return d, s.upload(ctx, d, func() (io.Reader, error) { return bytes.NewReader(b), nil })
+}
+
+// upload performs a monolithic blob upload of d.
+func (s *ociStore) upload(ctx context.Context, d ociDescriptor, body func() (io.Reader, error)) error {
+	resp, err := s.do(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodHead, s.base+"/blobs/"+d.Digest, nil)
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	resp, err = s.do(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPost, s.base+"/blobs/uploads/", nil)
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if err := expectStatus(resp, http.StatusAccepted); err != nil {
+		return err
+	}
+	loc, err := resp.Location()
+	if err != nil {
+		return fmt.Errorf("oci: upload session: %v", err)
+	}
+	q := loc.Query()
+	q.Set("digest", d.Digest)
+	loc.RawQuery = q.Encode()
+
+	resp, err = s.do(ctx, func() (*http.Request, error) {
+		r, err := body()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, loc.String(), r)
+		if err == nil {
+			req.ContentLength = d.Size
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+		return req, err
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return expectStatus(resp, http.StatusCreated)
+}
+
+// pullBlob downloads d to path, verifying its digest.
+func (s *ociStore) pullBlob(ctx context.Context, d ociDescriptor, path string) error {
+	resp, err := s.do(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, s.base+"/blobs/"+d.Digest, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = copyBuffered(io.MultiWriter(f, h), io.LimitReader(resp.Body, d.Size))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != d.Digest {
+		return fmt.Errorf("oci: blob %s: digest mismatch (got %s)", d.Digest, got)
+	}
+	return nil
+}
+
+// do sends the request built by newReq, answering a single auth
+// challenge from the registry if needed. newReq is called again for
+// the retry, so request bodies must be re-readable.
+func (s *ociStore) do(ctx context.Context, newReq func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		s.authorize(req)
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := s.authenticate(ctx, challenge); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *ociStore) authorize(req *http.Request) {
+	s.mu.Lock()
+	token := s.token
+	s.mu.Unlock()
+	switch {
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	case s.cfg.Username != "":
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+}
+
+// authenticate obtains a bearer token for a "Bearer realm=...,
+// service=..., scope=..." challenge. Basic challenges need no token;
+// the credentials are sent by authorize.
+func (s *ociStore) authenticate(ctx context.Context, challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		if s.cfg.Username == "" {
+			return fmt.Errorf("oci: registry requires credentials")
+		}
+		return nil
+	}
+
+	attrs := map[string]string{}
+	for _, p := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		attrs[k] = strings.Trim(v, `"`)
+	}
+	u, err := url.Parse(attrs["realm"])
+	if err != nil || attrs["realm"] == "" {
+		return fmt.Errorf("oci: bad auth challenge %q", challenge)
+	}
+	q := u.Query()
+	if attrs["service"] != "" {
+		q.Set("service", attrs["service"])
+	}
+	if attrs["scope"] != "" {
+		q.Set("scope", attrs["scope"])
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if s.cfg.Username != "" {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return err
+	}
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return fmt.Errorf("oci: decoding token: %v", err)
+	}
+	s.mu.Lock()
+	s.token = tok.Token
+	if s.token == "" {
+		s.token = tok.AccessToken
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func expectStatus(resp *http.Response, code int) error {
+	if resp.StatusCode != code {
+		return fmt.Errorf("oci: %s %s: %s", resp.Request.Method, resp.Request.URL.Redacted(), resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Developers can authenticate with short-lived JWTs issued by the
+// corporate identity provider, e.g. obtained by a GOAUTH command, in
+// place of long-lived tokens. A JWT is accepted when its signature
+// verifies against the issuer's published keys (JWKS) and its iss, aud,
+// exp and nbf claims hold. The keys are fetched on first use, refreshed
+// hourly, and refetched early when a token names an unknown key, so key
+// rotation at the IdP needs no restart. The standard library verifies
+// the signatures; only asymmetric algorithms are accepted.
+
+// OIDCConfig configures JWT authentication.
+type OIDCConfig struct {
+	// Issuer is the iss claim tokens must carry. Its discovery document
+	// locates the keys unless JWKSURL is set.
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	JWKSURL  string `yaml:"jwks_url"`
+
+	// IdentityClaim names the claim used as the identity (default sub).
+	IdentityClaim string `yaml:"identity_claim"`
+
+	// Scopes grants scopes to identities.
+	Scopes map[string][]string `yaml:"scopes"`
+}
+
+// jwtLeeway is the clock skew tolerated for exp and nbf.
+const jwtLeeway = time.Minute
+
+// checkOIDC validates the JWT configuration.
+func checkOIDC(oc OIDCConfig) error {
+	if oc.Issuer == "" {
+		if oc.Audience != "" || oc.JWKSURL != "" {
+			return fmt.Errorf("oidc: issuer is required")
+		}
+		return nil
+	}
+	if !strings.HasPrefix(oc.Issuer, "https://") {
+		return fmt.Errorf("oidc: issuer must be an https URL")
+	}
+	// Without an audience, tokens the IdP issued to any application
+	// would be accepted.
+	if oc.Audience == "" {
+		return fmt.Errorf("oidc: audience is required")
+	}
+	oidcKeys.reset()
+	return nil
+}
+
+// looksLikeJWT reports whether tok is shaped like a compact JWS with a
+// JSON header.
+func looksLikeJWT(tok string) bool {
+	return strings.HasPrefix(tok, "eyJ") && strings.Count(tok, ".") == 2
+}
+
+// jwtCaller verifies tok and returns its caller. Failures to fetch the
+// keys are errUpstreamUnavailable.
+func jwtCaller(ctx context.Context, tok string) (*caller, error) {
+	oc := config.OIDC
+	parts := strings.Split(tok, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %v", err)
+	}
+	keys, err := oidcKeys.get(ctx, oc, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range keys {
+		if verifyJWS(header.Alg, k, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("signature does not verify")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %v", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != oc.Issuer {
+		return nil, fmt.Errorf("issuer %q is not accepted", iss)
+	}
+	if !hasAudience(claims["aud"], oc.Audience) {
+		return nil, errors.New("token is not for this audience")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	claim := oc.IdentityClaim
+	if claim == "" {
+		claim = "sub"
+	}
+	id, _ := claims[claim].(string)
+	if id == "" || id == anonymous.Identity {
+		return nil, fmt.Errorf("token has no %s claim", claim)
+	}
+	return &caller{Identity: id, Scopes: oc.Scopes[id]}, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// hasAudience reports whether the aud claim, a string or a list of
+// strings, includes audience.
+func hasAudience(aud any, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyJWS reports whether sig is a valid alg signature of signed by
+// key.
+func verifyJWS(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	var hash crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, signed, sig)
+	}
+	if hash == 0 {
+		return false
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil
+		case "PS":
+			return rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		// The curve is fixed by the algorithm; ES512 uses P-521.
+		bits := pub.Curve.Params().BitSize
+		size := (bits + 7) / 8
+		if alg[:2] != "ES" || len(sig) != 2*size || bits != map[string]int{"256": 256, "384": 384, "512": 521}[alg[2:]] {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+// keySet is the issuer's keys as last fetched.
+type keySet struct {
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey // by kid
+	fetched time.Time
+	tried   time.Time // last fetch attempt, successful or not
+	err     error     // of the last fetch
+}
+
+var oidcKeys = &keySet{}
+
+func (ks *keySet) reset() {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys, ks.fetched, ks.tried, ks.err = nil, time.Time{}, time.Time{}, nil
+}
+
+// get returns the keys that may have signed a token naming kid: that
+// key, or all keys if kid is empty. The key set is refetched if older
+// than an hour or if kid is unknown, at most once a minute (every 5
+// seconds while no keys could be fetched yet).
+func (ks *keySet) get(ctx context.Context, oc OIDCConfig, kid string) ([]crypto.PublicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	_, known := ks.keys[kid]
+	wait := time.Minute
+	if ks.keys == nil {
+		wait = 5 * time.Second
+	}
+	if (time.Since(ks.fetched) > time.Hour || (kid != "" && !known)) && time.Since(ks.tried) > wait {
+		ks.tried = time.Now()
+		keys, err := fetchJWKS(ctx, oc)
+		if ks.err = err; err != nil {
+			slog.WarnContext(ctx, "fetching OIDC keys", "err", err)
+		} else {
+			ks.keys, ks.fetched = keys, time.Now()
+		}
+	}
+	if ks.keys == nil {
+		return nil, ks.err
+	}
+	if kid != "" {
+		if k, ok := ks.keys[kid]; ok {
+			return []crypto.PublicKey{k}, nil
+		}
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	keys := make([]crypto.PublicKey, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// fetchJWKS fetches the issuer's key set, locating it through the
+// discovery document unless oc.JWKSURL is set.
+func fetchJWKS(ctx context.Context, oc OIDCConfig) (map[string]crypto.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	url := oc.JWKSURL
+	if url == "" {
+		var disc struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := getJSON(ctx, strings.TrimSuffix(oc.Issuer, "/")+"/.well-known/openid-configuration", &disc); err != nil {
+			return nil, err
+		}
+		if disc.Issuer != oc.Issuer || disc.JWKSURI == "" {
+			return nil, kindError{"oidc: discovery document does not match the issuer", errUpstreamUnavailable}
+		}
+		url = disc.JWKSURI
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := getJSON(ctx, url, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+	if len(keys) == 0 {
+		return nil, kindError{"oidc: no usable signing keys in " + url, errUpstreamUnavailable}
+	}
+	return keys, nil
+}
+
+func getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("oidc: %w: %w", errUpstreamUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return kindError{fmt.Sprintf("oidc: %s: %s", url, resp.Status), errUpstreamUnavailable}
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return kindError{fmt.Sprintf("oidc: %s: %v", url, err), errUpstreamUnavailable}
+	}
+	return nil
+}
+
+// jwk is a JSON Web Key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, fmt.Errorf("bad exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := b64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := b64(k.X)
+		if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
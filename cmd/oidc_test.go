@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSigners are one key of each type jwtCaller accepts.
+type testSigners struct {
+	rsa   *rsa.PrivateKey
+	p256  *ecdsa.PrivateKey
+	p521  *ecdsa.PrivateKey
+	ed    ed25519.PrivateKey
+	edPub ed25519.PublicKey
+}
+
+var (
+	signersOnce sync.Once
+	signers     testSigners
+)
+
+func newTestSigners(t *testing.T) testSigners {
+	signersOnce.Do(func() {
+		var err error
+		if signers.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatal(err)
+		}
+		if signers.p256, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+		if signers.p521, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+		if signers.edPub, signers.ed, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return signers
+}
+
+// signJWS signs signed with key as alg would, without checking that the
+// two match, so that mismatches can be tested.
+func signJWS(t *testing.T, alg string, key crypto.Signer, signed []byte) []byte {
+	if alg == "EdDSA" {
+		return ed25519.Sign(key.(ed25519.PrivateKey), signed)
+	}
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[2:]]
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var sig []byte
+		var err error
+		if alg[:2] == "PS" {
+			sig, err = rsa.SignPSS(rand.Reader, k, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	}
+	t.Fatalf("cannot sign with %T", key)
+	return nil
+}
+
+func TestVerifyJWS(t *testing.T) {
+	k := newTestSigners(t)
+	signed := []byte("eyJhbGciOiJFUzI1NiJ9.eyJzdWIiOiJhbGljZSJ9")
+	mac := hmac.New(sha256.New, k.rsa.N.Bytes())
+	mac.Write(signed)
+	es256 := signJWS(t, "ES256", k.p256, signed)
+	for _, tt := range []struct {
+		name string
+		alg  string
+		key  crypto.PublicKey
+		sig  []byte
+		want bool
+	}{
+		{"RS256", "RS256", &k.rsa.PublicKey, signJWS(t, "RS256", k.rsa, signed), true},
+		{"RS512", "RS512", &k.rsa.PublicKey, signJWS(t, "RS512", k.rsa, signed), true},
+		{"PS256", "PS256", &k.rsa.PublicKey, signJWS(t, "PS256", k.rsa, signed), true},
+		{"PS384", "PS384", &k.rsa.PublicKey, signJWS(t, "PS384", k.rsa, signed), true},
+		{"ES256", "ES256", &k.p256.PublicKey, es256, true},
+		{"ES512 on P-521", "ES512", &k.p521.PublicKey, signJWS(t, "ES512", k.p521, signed), true},
+		{"EdDSA", "EdDSA", k.edPub, signJWS(t, "EdDSA", k.ed, signed), true},
+
+		{"RS256 header, EC key", "RS256", &k.p256.PublicKey, es256, false},
+		{"ES256 header, RSA key", "ES256", &k.rsa.PublicKey, signJWS(t, "RS256", k.rsa, signed), false},
+		{"EdDSA header, EC key", "EdDSA", &k.p256.PublicKey, es256, false},
+		{"RS256 signature as PS256", "PS256", &k.rsa.PublicKey, signJWS(t, "RS256", k.rsa, signed), false},
+		{"ES384 on P-256", "ES384", &k.p256.PublicKey, signJWS(t, "ES384", k.p256, signed), false},
+		{"none", "none", &k.rsa.PublicKey, nil, false},
+		{"empty alg", "", &k.rsa.PublicKey, nil, false},
+		{"HS256 keyed with the public key", "HS256", &k.rsa.PublicKey, mac.Sum(nil), false},
+		{"truncated ES signature", "ES256", &k.p256.PublicKey, es256[:len(es256)-1], false},
+		{"padded ES signature", "ES256", &k.p256.PublicKey, append([]byte{0}, es256...), false},
+		{"signature of other data", "ES256", &k.p256.PublicKey, signJWS(t, "ES256", k.p256, []byte("other")), false},
+	} {
+		if got := verifyJWS(tt.alg, tt.key, signed, tt.sig); got != tt.want {
+			t.Errorf("%s: verifyJWS = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// jwkOf returns the JSON Web Key of pub.
+func jwkOf(kid string, pub crypto.PublicKey) jwk {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return jwk{Kty: "RSA", Kid: kid, N: b64(pub.N.Bytes()), E: b64(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return jwk{Kty: "EC", Kid: kid, Crv: pub.Curve.Params().Name, X: b64(pub.X.FillBytes(make([]byte, size))), Y: b64(pub.Y.FillBytes(make([]byte, size)))}
+	case ed25519.PublicKey:
+		return jwk{Kty: "OKP", Kid: kid, Crv: "Ed25519", X: b64(pub)}
+	}
+	panic("unsupported key")
+}
+
+// jwksServer serves the key set *keys and counts the requests for it.
+// It configures JWT authentication against it.
+func jwksServer(t *testing.T, keys *[]jwk) *atomic.Int32 {
+	keepState(t)
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{"keys": *keys})
+	}))
+	t.Cleanup(srv.Close)
+	config.OIDC = OIDCConfig{Issuer: "https://idp.example.com", Audience: "goproxy", JWKSURL: srv.URL, Scopes: map[string][]string{"alice": {"admin"}}}
+	oidcKeys.reset()
+	t.Cleanup(oidcKeys.reset)
+	return &hits
+}
+
+// makeJWT returns a token with the given header and claims, signed with
+// key as alg.
+func makeJWT(t *testing.T, header, claims map[string]any, key crypto.Signer) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	var sig []byte
+	if key != nil {
+		sig = signJWS(t, header["alg"].(string), key, []byte(signed))
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTCaller(t *testing.T) {
+	k := newTestSigners(t)
+	keys := []jwk{jwkOf("rsa", &k.rsa.PublicKey), jwkOf("ec", &k.p256.PublicKey), jwkOf("ed", k.edPub)}
+	jwksServer(t, &keys)
+
+	now := time.Now().Unix()
+	claims := func(edit func(map[string]any)) map[string]any {
+		c := map[string]any{"iss": "https://idp.example.com", "aud": "goproxy", "sub": "alice", "exp": now + 3600}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	hdr := func(alg, kid string) map[string]any { return map[string]any{"alg": alg, "kid": kid} }
+	es := makeJWT(t, hdr("ES256", "ec"), claims(nil), k.p256)
+	for _, tt := range []struct {
+		name string
+		tok  string
+		err  string // substring of the error, "" if accepted
+	}{
+		{"RS256", makeJWT(t, hdr("RS256", "rsa"), claims(nil), k.rsa), ""},
+		{"PS256", makeJWT(t, hdr("PS256", "rsa"), claims(nil), k.rsa), ""},
+		{"ES256", es, ""},
+		{"EdDSA", makeJWT(t, hdr("EdDSA", "ed"), claims(nil), k.ed), ""},
+		{"no kid", makeJWT(t, map[string]any{"alg": "ES256"}, claims(nil), k.p256), ""},
+		{"audience list", makeJWT(t, hdr("ES256", "ec"), claims(func(c map[string]any) { c["aud"] = []string{"other", "goproxy"} }), k.p256), ""},
+		{"expired within the leeway", makeJWT(t, hdr("ES256", "ec"), claims(func(c map[string]any) { c["exp"] = now - 30 }), k.p256), ""},
+
+		{"RS256 header, EC key", makeJWT(t, hdr("RS256", "ec"), claims(nil), nil) + strings.Split(es, ".")[2], "does not verify"},
+		{"none", makeJWT(t, hdr("none", "ec"), claims(nil), nil), "does not verify"},
+		{"truncated ES signature", es[:len(es)-2], "does not verify"},
+		{"claims swapped", strings.Split(es, ".")[0] + "." + strings.Split(makeJWT(t, hdr("ES256", "ec"), claims(func(c map[string]any) { c["sub"] = "mallory" }), k.p256), ".")[1] + "." + strings.Split(es, ".")[2], "does not verify"},
+		{"wrong issuer", makeJWT(t, hdr("ES256", "ec"), claims(func(c map[string]any) { c["iss"] = "https://evil.example.com" }), k.p256), "issuer"},
+		{"wrong audience", makeJWT(t, hdr("ES256", "ec"), claims(func(c map[string]any) { c["aud"] = "other" }), k.p256), "audience"},
+		{"no audience", makeJWT(t, hdr("ES256", "ec"), claims(func(c map[string]any) { delete(c, "aud") }), k.p256), "audience"},
+		{"no expiry", makeJWT(t, hdr("ES256", "ec"), claims(func(c map[string]any) { delete(c, "exp") }), k.p256), "no expiry"},
+		{"expired beyond the leeway", makeJWT(t, hdr("ES256", "ec"), claims(func(c map[string]any) { c["exp"] = now - 120 }), k.p256), "expired"},
+		{"not valid yet", makeJWT(t, hdr("ES256", "ec"), claims(func(c map[string]any) { c["nbf"] = now + 120 }), k.p256), "not valid yet"},
+		{"no subject", makeJWT(t, hdr("ES256", "ec"), claims(func(c map[string]any) { delete(c, "sub") }), k.p256), "no sub claim"},
+		{"anonymous subject", makeJWT(t, hdr("ES256", "ec"), claims(func(c map[string]any) { c["sub"] = anonymous.Identity }), k.p256), "no sub claim"},
+		{"unknown kid", makeJWT(t, hdr("ES256", "other"), claims(nil), k.p256), "unknown key"},
+	} {
+		c, err := jwtCaller(context.Background(), tt.tok)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err == "" && (c.Identity != "alice" || len(c.Scopes) != 1 || c.Scopes[0] != "admin"):
+			t.Errorf("%s: caller = %+v, want alice with scope admin", tt.name, c)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got %v, want an error containing %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// TestKeySetRefetch checks that a token naming an unknown key refetches
+// the key set at most once a minute, and that a rotated key is picked up
+// once the minute has passed.
+func TestKeySetRefetch(t *testing.T) {
+	k := newTestSigners(t)
+	keys := []jwk{jwkOf("old", &k.p256.PublicKey)}
+	hits := jwksServer(t, &keys)
+	ctx, oc := context.Background(), config.OIDC
+
+	if _, err := oidcKeys.get(ctx, oc, "old"); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if _, err := oidcKeys.get(ctx, oc, "new"); err == nil || !strings.Contains(err.Error(), "unknown key") {
+			t.Fatalf("get(new) = %v, want unknown key", err)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("key set fetched %d times, want 1", n)
+	}
+
+	keys = append(keys, jwkOf("new", k.edPub))
+	oidcKeys.mu.Lock()
+	oidcKeys.tried = time.Now().Add(-2 * time.Minute)
+	oidcKeys.mu.Unlock()
+	got, err := oidcKeys.get(ctx, oc, "new")
+	if err != nil {
+		t.Fatalf("get(new) after a minute: %v", err)
+	}
+	if pub, ok := got[0].(ed25519.PublicKey); !ok || !pub.Equal(k.edPub) {
+		t.Errorf("get(new) = %v, want the rotated key", got)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("key set fetched %d times, want 2", n)
+	}
+	if _, err := oidcKeys.get(ctx, oc, "old"); err != nil {
+		t.Errorf("get(old) = %v", err)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("known key refetched the key set: %d fetches, want 2", n)
+	}
+}
+
+// TestKeySetUnavailable checks that a failing key set endpoint is
+// retried at most every 5 seconds and that its failure is
+// errUpstreamUnavailable.
+func TestKeySetUnavailable(t *testing.T) {
+	keepState(t)
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	config.OIDC = OIDCConfig{Issuer: "https://idp.example.com", Audience: "goproxy", JWKSURL: srv.URL}
+	oidcKeys.reset()
+	t.Cleanup(oidcKeys.reset)
+
+	for range 3 {
+		if _, err := oidcKeys.get(context.Background(), config.OIDC, "a"); !errors.Is(err, errUpstreamUnavailable) {
+			t.Fatalf("get = %v, want errUpstreamUnavailable", err)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("key set fetched %d times, want 1", n)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Origin records where a version came from, with the field names the
+// go command and proxy.golang.org use in the Origin of a .info.
+type Origin struct {
+	VCS    string `json:"VCS,omitempty"`
+	URL    string `json:"URL,omitempty"`
+	Subdir string `json:"Subdir,omitempty"`
+	Ref    string `json:"Ref,omitempty"`
+	Hash   string `json:"Hash,omitempty"`
+}
+
+// originFile is where a backend's Fetch leaves the Origin of a version
+// for writeProvenance, which moves it into the entry's provenance.
+const originFile = "origin.json"
+
+// recordOrigin is called by backends from Fetch.
+func recordOrigin(destDir string, o *Origin) error {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(destDir, originFile), data, 0644)
+}
+
+// takeOrigin reads and removes the Origin left in dir by the backend,
+// if any.
+func takeOrigin(dir string) *Origin {
+	path := filepath.Join(dir, originFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	os.Remove(path)
+	var o Origin
+	if err := json.Unmarshal(data, &o); err != nil {
+		return nil
+	}
+	return &o
+}
+
+// originMediaType, in Accept, asks for the extended .info.
+const originMediaType = "application/vnd.goproxy.info+json"
+
+// wantsOrigin reports whether r asks for the extended .info, with
+// ?origin=1 or by accepting originMediaType. The plain .info is what
+// the go command expects and stays the default.
+func wantsOrigin(r *http.Request) bool {
+	switch r.URL.Query().Get("origin") {
+	case "1", "true":
+		return true
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(part); err == nil && mt == originMediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// serveExtendedInfo serves the .info at filename with the Origin of the
+// cache entry added. Fields of the .info are kept as they are, so an
+// Origin that came with it from upstream is served when the entry
+// recorded none.
+func serveExtendedInfo(w http.ResponseWriter, module, version, filename string) bool {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return false
+	}
+	info := map[string]any{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return false
+	}
+	if p, err := readProvenance(module, version); err == nil && p.Origin != nil {
+		info["Origin"] = p.Origin
+	}
+	w.Header().Set("Content-Type", originMediaType)
+	json.NewEncoder(w).Encode(info)
+	return true
+}
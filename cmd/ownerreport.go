@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/smtp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// Module owners learn of a failing mirror or a blocked release when a
+// build breaks. Every owner_reports.interval, the proxy compiles a
+// report for each owner in owner_reports.owners, covering the modules
+// under the owner's prefixes since the previous report: versions newly
+// mirrored, fetch failures (as kept for /api/modules/<module>/health),
+// blocks, versions held in quarantine or awaiting approval, and team
+// members near their daily download quota. Reports are posted as JSON
+// to the owner's webhook and mailed to the owner's addresses; an owner
+// with nothing to report gets none.
+//
+// The period starts when the proxy does, so a restart shortens the
+// next report rather than repeating the previous one. Failures are
+// known only to the replica that saw them; in a cluster, enable reports
+// on one replica.
+
+// OwnerReportsConfig configures the scheduled owner reports.
+type OwnerReportsConfig struct {
+	// Interval is the time between reports (default 24h).
+	Interval time.Duration `yaml:"interval"`
+
+	// QuotaWarning is the share of a daily download quota from which a
+	// team member is reported (default 0.8).
+	QuotaWarning float64 `yaml:"quota_warning"`
+
+	SMTP   SMTPConfig    `yaml:"smtp"`
+	Owners []OwnerConfig `yaml:"owners"`
+}
+
+// SMTPConfig is the mail server owner reports are sent through.
+type SMTPConfig struct {
+	Addr     string `yaml:"addr"` // host:port
+	From     string `yaml:"from"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// OwnerConfig is an owner of the modules under Prefixes and where its
+// reports go.
+type OwnerConfig struct {
+	Name       string   `yaml:"name"`
+	Prefixes   []string `yaml:"prefixes"`
+	Email      []string `yaml:"email"`
+	WebhookURL string   `yaml:"webhook_url"`
+}
+
+func (o *OwnerConfig) owns(path string) bool {
+	return slices.ContainsFunc(o.Prefixes, func(p string) bool { return hasPathPrefix(path, p) })
+}
+
+func checkOwnerReports(c OwnerReportsConfig) error {
+	if c.QuotaWarning < 0 || c.QuotaWarning > 1 {
+		return fmt.Errorf("owner_reports.quota_warning must be between 0 and 1")
+	}
+	for i, o := range c.Owners {
+		switch {
+		case o.Name == "":
+			return fmt.Errorf("owner_reports.owners[%d]: name is required", i)
+		case len(o.Prefixes) == 0:
+			return fmt.Errorf("owner_reports.owners[%d]: prefixes are required", i)
+		case len(o.Email) == 0 && o.WebhookURL == "":
+			return fmt.Errorf("owner_reports.owners[%d]: email or webhook_url is required", i)
+		case len(o.Email) > 0 && (c.SMTP.Addr == "" || c.SMTP.From == ""):
+			return fmt.Errorf("owner_reports.owners[%d]: email requires owner_reports.smtp.addr and from", i)
+		}
+	}
+	return nil
+}
+
+// mirroredVersion is a version cached during the period.
+type mirroredVersion struct {
+	Module    string    `json:"module"`
+	Version   string    `json:"version"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// ownerFailure is a fetch failure of a module during the period.
+type ownerFailure struct {
+	Module string `json:"module"`
+	fetchFailure
+}
+
+// quotaUsage is a team member's downloads today against the quota.
+type quotaUsage struct {
+	Identity  string `json:"identity"`
+	Team      string `json:"team"`
+	Downloads int    `json:"downloads"`
+	Limit     int    `json:"limit"`
+}
+
+// OwnerReport is the report of one owner, as posted to its webhook.
+type OwnerReport struct {
+	Owner       string              `json:"owner"`
+	Prefixes    []string            `json:"prefixes"`
+	From        time.Time           `json:"from"`
+	To          time.Time           `json:"to"`
+	Mirrored    []mirroredVersion   `json:"mirrored,omitempty"`
+	Failures    []ownerFailure      `json:"failures,omitempty"`
+	Blocked     []*versionBlock     `json:"blocked,omitempty"`
+	Quarantined []*quarantineRecord `json:"quarantined,omitempty"`
+	Quota       []quotaUsage        `json:"quota,omitempty"`
+}
+
+func (r *OwnerReport) empty() bool {
+	return len(r.Mirrored)+len(r.Failures)+len(r.Blocked)+len(r.Quarantined)+len(r.Quota) == 0
+}
+
+var ownerReports = struct {
+	sync.Mutex
+	since  time.Time
+	latest []*OwnerReport
+}{since: time.Now().UTC()}
+
+// buildOwnerReports compiles the reports of every owner for the period
+// from since to now.
+func buildOwnerReports(since, now time.Time) ([]*OwnerReport, error) {
+	owners := config.OwnerReports.Owners
+	reports := make([]*OwnerReport, len(owners))
+	for i, o := range owners {
+		reports[i] = &OwnerReport{Owner: o.Name, Prefixes: o.Prefixes, From: since, To: now}
+	}
+	// each calls fn with the report of every owner of the escaped path.
+	each := func(escaped string, fn func(*OwnerReport)) {
+		path, err := module.UnescapePath(escaped)
+		if err != nil {
+			return
+		}
+		for i := range owners {
+			if owners[i].owns(path) {
+				fn(reports[i])
+			}
+		}
+	}
+
+	err := walkCache(func(e cacheEntry) error {
+		if p, err := readProvenance(e.Module, e.Version); err == nil && !p.FetchedAt.Before(since) {
+			each(e.Module, func(r *OwnerReport) {
+				r.Mirrored = append(r.Mirrored, mirroredVersion{e.Module, e.Version, p.FetchedAt.UTC()})
+			})
+		}
+		if q, err := readQuarantine(e.Module, e.Version); err == nil && q != nil && q.State == stateQuarantined {
+			each(e.Module, func(r *OwnerReport) { r.Quarantined = append(r.Quarantined, q) })
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fetchHistories.Lock()
+	for escaped, h := range fetchHistories.m {
+		for _, f := range h.failures {
+			if !f.At.Before(since) {
+				each(escaped, func(r *OwnerReport) { r.Failures = append(r.Failures, ownerFailure{escaped, f}) })
+			}
+		}
+	}
+	fetchHistories.Unlock()
+
+	blocksMu.Lock()
+	for _, b := range blockList() {
+		if !b.BlockedAt.Before(since) {
+			each(b.Module, func(r *OwnerReport) { r.Blocked = append(r.Blocked, b) })
+		}
+	}
+	blocksMu.Unlock()
+
+	warn := config.OwnerReports.QuotaWarning
+	if warn == 0 {
+		warn = 0.8
+	}
+	for i := range owners {
+		reports[i].Quota = quotaNear(&owners[i], warn)
+	}
+
+	for _, r := range reports {
+		slices.SortFunc(r.Mirrored, func(a, b mirroredVersion) int { return a.FetchedAt.Compare(b.FetchedAt) })
+		slices.SortFunc(r.Failures, func(a, b ownerFailure) int { return a.At.Compare(b.At) })
+	}
+	return reports, nil
+}
+
+// quotaNear returns the members of the teams with a quota on o's
+// modules who have used at least warn of their quota today.
+func quotaNear(o *OwnerConfig, warn float64) []quotaUsage {
+	scimMu.Lock()
+	var members map[string][]string
+	if scimLast != nil {
+		members = scimLast.Teams
+	}
+	scimMu.Unlock()
+
+	downloads.Lock()
+	counts := downloads.counts
+	if downloads.day != time.Now().UTC().Format(time.DateOnly) {
+		counts = nil
+	}
+	counts = maps.Clone(counts)
+	downloads.Unlock()
+
+	var near []quotaUsage
+	for _, tm := range config.SCIM.Teams {
+		if tm.DailyDownloads <= 0 || !slices.ContainsFunc(tm.Prefixes, o.owns) {
+			continue
+		}
+		for team, ids := range members {
+			if !strings.EqualFold(team, tm.Team) {
+				continue
+			}
+			for _, id := range ids {
+				limit := dailyQuota(id)
+				if n := counts[id]; limit > 0 && float64(n) >= warn*float64(limit) {
+					near = append(near, quotaUsage{id, tm.Team, n, limit})
+				}
+			}
+		}
+	}
+	return near
+}
+
+// runOwnerReports compiles the reports since the previous run and
+// delivers the ones that are not empty.
+func runOwnerReports(ctx context.Context) ([]*OwnerReport, error) {
+	ownerReports.Lock()
+	defer ownerReports.Unlock()
+	now := time.Now().UTC()
+	reports, err := buildOwnerReports(ownerReports.since, now)
+	if err != nil {
+		return nil, err
+	}
+	ownerReports.since, ownerReports.latest = now, reports
+
+	for i, r := range reports {
+		if r.empty() {
+			continue
+		}
+		if err := deliverOwnerReport(ctx, &config.OwnerReports.Owners[i], r); err != nil {
+			slog.Error("owner report: delivering", "owner", r.Owner, "err", err)
+			continue
+		}
+		slog.Info("owner report sent", "owner", r.Owner, "mirrored", len(r.Mirrored), "failures", len(r.Failures), "blocked", len(r.Blocked), "quarantined", len(r.Quarantined), "quota", len(r.Quota))
+	}
+	return reports, nil
+}
+
+// deliverOwnerReport posts r to the owner's webhook and mails it to the
+// owner's addresses.
+func deliverOwnerReport(ctx context.Context, o *OwnerConfig, r *OwnerReport) error {
+	if o.WebhookURL != "" {
+		body, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.WebhookURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("webhook: %s", resp.Status)
+		}
+	}
+	if len(o.Email) > 0 {
+		sc := config.OwnerReports.SMTP
+		var auth smtp.Auth
+		if sc.Username != "" {
+			host, _, _ := strings.Cut(sc.Addr, ":")
+			auth = smtp.PlainAuth("", sc.Username, sc.Password, host)
+		}
+		if err := smtp.SendMail(sc.Addr, auth, sc.From, o.Email, ownerReportMail(sc.From, o.Email, r)); err != nil {
+			return fmt.Errorf("mail: %v", err)
+		}
+	}
+	return nil
+}
+
+// ownerReportMail formats r as a plain text message.
+func ownerReportMail(from string, to []string, r *OwnerReport) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\n", from, strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: Go module report for %s\r\n", headerSafe(r.Owner))
+	fmt.Fprintf(&b, "Date: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", r.To.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Modules under %s, %s to %s.\r\n", strings.Join(r.Prefixes, ", "), r.From.Format(time.RFC3339), r.To.Format(time.RFC3339))
+	section := func(title string, n int, line func(i int) string) {
+		if n == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "\r\n%s (%d):\r\n", title, n)
+		for i := range n {
+			fmt.Fprintf(&b, "  %s\r\n", line(i))
+		}
+	}
+	section("Newly mirrored", len(r.Mirrored), func(i int) string {
+		m := r.Mirrored[i]
+		return fmt.Sprintf("%s@%s", m.Module, m.Version)
+	})
+	section("Fetch failures", len(r.Failures), func(i int) string {
+		f := r.Failures[i]
+		return fmt.Sprintf("%s %s@%s: %s (%s)", f.At.Format(time.RFC3339), f.Module, f.Version, f.Error, f.Kind)
+	})
+	section("Blocked", len(r.Blocked), func(i int) string {
+		bl := r.Blocked[i]
+		return fmt.Sprintf("%s@%s by %s: %s", bl.Module, bl.Version, bl.BlockedBy, bl.Advisory)
+	})
+	section("Held in quarantine or awaiting approval", len(r.Quarantined), func(i int) string {
+		q := r.Quarantined[i]
+		return fmt.Sprintf("%s@%s since %s", q.Module, q.Version, q.Since.Format(time.RFC3339))
+	})
+	section("Near the daily download quota", len(r.Quota), func(i int) string {
+		q := r.Quota[i]
+		return fmt.Sprintf("%s (%s): %d of %d", q.Identity, q.Team, q.Downloads, q.Limit)
+	})
+	return b.Bytes()
+}
+
+// startOwnerReports sends the owner reports on the configured interval.
+func startOwnerReports() {
+	oc := config.OwnerReports
+	if len(oc.Owners) == 0 {
+		return
+	}
+	interval := oc.Interval
+	if interval == 0 {
+		interval = 24 * time.Hour
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if _, err := runOwnerReports(context.Background()); err != nil {
+				slog.Error("owner reports", "err", err)
+			}
+		}
+	}()
+}
+
+// getOwnerReports serves GET /admin/reports/owners, the latest reports.
+func getOwnerReports(w http.ResponseWriter, r *http.Request) {
+	ownerReports.Lock()
+	reports := ownerReports.latest
+	ownerReports.Unlock()
+	if reports == nil {
+		http.Error(w, "no reports yet; POST to send them now", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, reports)
+}
+
+// postOwnerReports serves POST /admin/reports/owners, compiling and
+// sending the reports immediately. The next scheduled reports start
+// from now.
+func postOwnerReports(w http.ResponseWriter, r *http.Request) {
+	if len(config.OwnerReports.Owners) == 0 {
+		http.Error(w, "no owners are configured", http.StatusNotFound)
+		return
+	}
+	reports, err := runOwnerReports(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, reports)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// OwnershipConfig controls verification of module paths that have never
+// been mirrored before. When enabled, a path must either be listed in
+// Allow (exactly or as a prefix) or be approved by ApprovalsURL before
+// its first version is written to the cache. This keeps a typosquatted
+// path pulled in by a malicious go.mod from entering the cache.
+type OwnershipConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Allow   []string `yaml:"allow"`
+
+	// ApprovalsURL is queried as GET <url>?module=<path>; a 200 response
+	// approves the path, a 404 rejects it and anything else is an error.
+	ApprovalsURL   string        `yaml:"approvals_url"`
+	ApprovalsToken string        `yaml:"approvals_token"`
+	Timeout        time.Duration `yaml:"timeout"`
+}
+
+// errNotApproved is returned by verifyOwnership for paths that have no
+// ownership record.
+type errNotApproved struct {
+	path string
+}
+
+func (e *errNotApproved) Error() string {
+	return fmt.Sprintf("module path %s has no ownership record; ask the owning team to register it", e.path)
+}
+
+func (e *errNotApproved) Unwrap() error { return errPolicyDenied }
+
+// verifyOwnership checks that the escaped module path may be mirrored.
+// Paths that already have cache entries were verified when they were
+// first mirrored and are accepted without further checks.
+func verifyOwnership(ctx context.Context, escaped string) error {
+	oc := config.Ownership
+	if !oc.Enabled {
+		return nil
+	}
+
+	if _, err := os.Stat(moduleDir(escaped)); err == nil {
+		return nil
+	}
+
+	path, err := module.UnescapePath(escaped)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range oc.Allow {
+		if hasPathPrefix(path, p) {
+			return nil
+		}
+	}
+
+	if oc.ApprovalsURL == "" {
+		return &errNotApproved{path}
+	}
+	return queryApprovals(ctx, oc, path)
+}
+
+func queryApprovals(ctx context.Context, oc OwnershipConfig, path string) error {
+	timeout := oc.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	u, err := url.Parse(oc.ApprovalsURL)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("module", path)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if oc.ApprovalsToken != "" {
+		req.Header.Set("Authorization", "Bearer "+oc.ApprovalsToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("querying approvals API: %v", err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return &errNotApproved{path}
+	default:
+		return fmt.Errorf("querying approvals API: unexpected status %s", resp.Status)
+	}
+}
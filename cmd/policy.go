@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/module"
+)
+
+// PolicyConfig delegates authorization decisions to an Open Policy
+// Agent server, typically a sidecar loading policy bundles managed by
+// security. Every routed request not authorized by a signed URL is
+// checked in addition to the built-in scope checks, so a policy can
+// only narrow access, never widen it.
+type PolicyConfig struct {
+	// URL is the OPA data API document to query, for example
+	// http://localhost:8181/v1/data/goproxy/allow.
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"`
+
+	// FailOpen allows requests when OPA cannot be reached. By default
+	// they are refused with 503.
+	FailOpen bool `yaml:"fail_open"`
+}
+
+// policyInput is the input document sent to OPA.
+type policyInput struct {
+	Identity string   `json:"identity"`
+	Scopes   []string `json:"scopes"`
+	Method   string   `json:"method"`
+	Path     string   `json:"path"`
+	Endpoint string   `json:"endpoint"` // list, info, mod, zip, admin or api
+	Module   string   `json:"module,omitempty"`
+	Version  string   `json:"version,omitempty"`
+}
+
+// policyDecision is the result of the policy: either a bare boolean or
+// an object with allow and an optional reason. A notice on an allowed
+// request is passed to the client in policyHeader, e.g. to explain
+// that the .mod of a version is served while its zip is denied.
+type policyDecision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+	Notice string `json:"notice"`
+}
+
+func (d *policyDecision) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &d.Allow); err == nil {
+		return nil
+	}
+	type plain policyDecision
+	return json.Unmarshal(data, (*plain)(d))
+}
+
+// endpointOf classifies a matched request for the policy input.
+func endpointOf(r *http.Request) string {
+	if ext := mux.Vars(r)["ext"]; ext != "" {
+		return ext
+	}
+	if strings.HasSuffix(r.URL.Path, "/@v/list") {
+		return "list"
+	}
+	seg, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	return seg
+}
+
+// queryPolicy asks OPA whether the request described by in is allowed.
+func queryPolicy(ctx context.Context, pc PolicyConfig, in policyInput) (policyDecision, error) {
+	var d policyDecision
+	timeout := pc.Timeout
+	if timeout == 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, err := json.Marshal(map[string]any{"input": in})
+	if err != nil {
+		return d, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pc.URL, bytes.NewReader(body))
+	if err != nil {
+		return d, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return d, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return d, fmt.Errorf("policy server: %s", resp.Status)
+	}
+
+	var out struct {
+		Result *policyDecision `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return d, fmt.Errorf("policy server: %v", err)
+	}
+	if out.Result == nil {
+		// An undefined document denies, as OPA's own default would.
+		return policyDecision{Reason: "policy undefined"}, nil
+	}
+	return *out.Result, nil
+}
+
+// enforcePolicy is router middleware consulting the configured policy
+// for every matched route.
+func enforcePolicy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pc := config.Policy
+		if pc.URL == "" || callerFrom(r.Context()).signed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		c := callerFrom(r.Context())
+		vars := mux.Vars(r)
+		in := policyInput{
+			Identity: c.Identity,
+			Scopes:   c.Scopes,
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Endpoint: endpointOf(r),
+			Version:  vars["version"],
+		}
+		if in.Scopes == nil {
+			in.Scopes = []string{}
+		}
+		if m, err := module.UnescapePath(vars["module"]); err == nil {
+			in.Module = m
+		}
+
+		d, err := queryPolicy(r.Context(), pc, in)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "policy", "identity", c.Identity, "path", r.URL.Path, "err", err)
+			if !pc.FailOpen {
+				http.Error(w, "authorization unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			d.Allow = true
+		}
+		if !d.Allow {
+			err := errPolicyDenied
+			if d.Reason != "" {
+				err = fmt.Errorf("%w: %s", errPolicyDenied, d.Reason)
+			}
+			httpError(w, err)
+			return
+		}
+		if d.Notice != "" {
+			w.Header().Set(policyHeader, headerSafe(d.Notice))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// opaServer answers every query with status and body, after delay, and
+// records the last input.
+func opaServer(t *testing.T, status int, body string, delay time.Duration, input *policyInput) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var q struct{ Input policyInput }
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+			t.Errorf("policy query: %v", err)
+		}
+		*input = q.Input
+		time.Sleep(delay)
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/v1/data/goproxy/allow"
+}
+
+func TestEnforcePolicy(t *testing.T) {
+	keepState(t)
+	r := mux.NewRouter()
+	r.Use(enforcePolicy)
+	r.HandleFunc("/{module:.+}/@v/{version}.{ext}", func(w http.ResponseWriter, r *http.Request) {})
+	r.HandleFunc("/{module:.+}/@v/list", func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range []struct {
+		name     string
+		status   int
+		body     string
+		delay    time.Duration
+		failOpen bool
+		want     int
+		contains string // in the response body, or the policy header if allowed
+	}{
+		{"allowed", 200, `{"result": true}`, 0, false, 200, ""},
+		{"denied", 200, `{"result": false}`, 0, false, 403, "denied by policy"},
+		{"denied with a reason", 200, `{"result": {"allow": false, "reason": "license not approved"}}`, 0, false, 403, "license not approved"},
+		{"allowed with a notice", 200, `{"result": {"allow": true, "notice": "zip blocked"}}`, 0, false, 200, "zip blocked"},
+		{"undefined", 200, `{}`, 0, false, 403, "policy undefined"},
+		{"malformed", 200, `{"result": "yes"}`, 0, false, 503, "authorization unavailable"},
+		{"server error", 500, ``, 0, false, 503, "authorization unavailable"},
+		{"server error, fail open", 500, ``, 0, true, 200, ""},
+		{"timeout", 200, `{"result": true}`, 200 * time.Millisecond, false, 503, "authorization unavailable"},
+	} {
+		var in policyInput
+		config.Policy = PolicyConfig{URL: opaServer(t, tt.status, tt.body, tt.delay, &in), Timeout: 50 * time.Millisecond, FailOpen: tt.failOpen}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/!secret/@v/v1.0.0.zip", nil).WithContext(withCaller(&caller{Identity: "alice"})))
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+		got := w.Body.String()
+		if w.Code == http.StatusOK {
+			got = w.Header().Get(policyHeader)
+		}
+		if !strings.Contains(got, tt.contains) {
+			t.Errorf("%s: response %q, want it to contain %q", tt.name, got, tt.contains)
+		}
+	}
+
+	var in policyInput
+	config.Policy = PolicyConfig{URL: opaServer(t, 200, `{"result": true}`, 0, &in)}
+	for path, want := range map[string]policyInput{
+		"/example.com/!secret/@v/v1.0.0.zip": {Identity: "anonymous", Scopes: []string{}, Method: "GET", Path: "/example.com/!secret/@v/v1.0.0.zip", Endpoint: "zip", Module: "example.com/Secret", Version: "v1.0.0"},
+		"/example.com/secret/@v/list":        {Identity: "anonymous", Scopes: []string{}, Method: "GET", Path: "/example.com/secret/@v/list", Endpoint: "list", Module: "example.com/secret"},
+	} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		if !reflect.DeepEqual(in, want) {
+			t.Errorf("%s: policy input %+v, want %+v", path, in, want)
+		}
+	}
+
+	// A signed URL is not subject to the policy.
+	config.Policy = PolicyConfig{URL: opaServer(t, 200, `{"result": false}`, 0, &in)}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/secret/@v/v1.0.0.zip", nil).WithContext(withCaller(&caller{Identity: "signed-url:alice", signed: true})))
+	if w.Code != http.StatusOK {
+		t.Errorf("signed URL: status %d, want 200", w.Code)
+	}
+}
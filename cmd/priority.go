@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Nightly CI fan-outs can swamp the proxy with requests and downloads
+// while developers wait on go get. Every request is served in one of
+// three priority classes, named by a scope of the caller's token:
+// interactive, ci or batch, else PriorityConfig.Default. Classes take
+// turns for fetch slots in that order, and each may limit the request
+// rate of every caller in it and the bandwidth all its responses share.
+// Since only cache misses run git and go subprocesses, a class may also
+// limit the rate at which each caller starts filling the cache, so that
+// one pipeline resolving fresh commits cannot take all fetch capacity
+// while cache hits are still served.
+
+// Priority classes, in the order they are served.
+const (
+	classInteractive = "interactive"
+	classCI          = "ci"
+	classBatch       = "batch"
+)
+
+var priorityClasses = []string{classInteractive, classCI, classBatch}
+
+// PriorityConfig configures the priority classes.
+type PriorityConfig struct {
+	// Default is the class of callers without a class scope (default
+	// interactive).
+	Default string `yaml:"default"`
+
+	// Classes holds the limits of each class; classes not listed are
+	// unlimited.
+	Classes map[string]ClassLimits `yaml:"classes"`
+}
+
+// ClassLimits limits the requests of a priority class.
+type ClassLimits struct {
+	// Rate is the number of module requests per second each caller may
+	// make, with bursts of up to Burst (default Rate); 0 is unlimited.
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+
+	// FetchRate is the number of cache fills per second each caller may
+	// start, with bursts of up to FetchBurst (default FetchRate); 0 is
+	// unlimited.
+	FetchRate  float64 `yaml:"fetch_rate"`
+	FetchBurst int     `yaml:"fetch_burst"`
+
+	// Bandwidth, such as 50MiB, caps the bytes per second of all
+	// responses in the class together; empty is unlimited.
+	Bandwidth string `yaml:"bandwidth"`
+}
+
+// classRank returns the position of class in priorityClasses.
+func classRank(class string) int {
+	for i, c := range priorityClasses {
+		if c == class {
+			return i
+		}
+	}
+	return 0
+}
+
+// classOf returns the priority class of c.
+func classOf(c *caller) string {
+	for _, class := range priorityClasses {
+		if c.hasScope(class) {
+			return class
+		}
+	}
+	if config.Priority.Default != "" {
+		return config.Priority.Default
+	}
+	return classInteractive
+}
+
+// tokenBucket refills at rate tokens per second up to burst.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// take takes one token if there is one, and otherwise reports how long
+// until there is.
+func (b *tokenBucket) take() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// idle reports whether b has refilled completely by now, so that a new
+// bucket would behave the same.
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// reserve takes n tokens, going into debt if needed, and returns how
+// long to wait until the debt is paid.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// classState holds the limiters of one class.
+type classState struct {
+	rate, burst           float64
+	fetchRate, fetchBurst float64
+	bandwidth             *tokenBucket // nil if unlimited
+
+	mu      sync.Mutex
+	callers map[string]*tokenBucket
+	fetches map[string]*tokenBucket
+	swept   time.Time // when idle buckets were last dropped
+}
+
+// sweepIdleEvery is how often creating a bucket first drops the idle
+// ones, which keeps a class's buckets to the callers seen of late
+// rather than every client address ever seen.
+const sweepIdleEvery = time.Minute
+
+// bucket returns the bucket of key in m, one of st's maps, creating it
+// with rate and burst. st must be locked.
+func (st *classState) bucket(m map[string]*tokenBucket, key string, rate, burst float64) *tokenBucket {
+	b := m[key]
+	if b == nil {
+		if now := time.Now(); now.Sub(st.swept) >= sweepIdleEvery {
+			st.swept = now
+			dropIdle(st.callers, now)
+			dropIdle(st.fetches, now)
+		}
+		b = newTokenBucket(rate, burst)
+		m[key] = b
+	}
+	return b
+}
+
+// dropIdle deletes the buckets of m that are idle at now.
+func dropIdle(m map[string]*tokenBucket, now time.Time) {
+	for key, b := range m {
+		if b.idle(now) {
+			delete(m, key)
+		}
+	}
+}
+
+var classes map[string]*classState
+
+// setupPriority checks the priority config and builds the limiters.
+func setupPriority(pc PriorityConfig) error {
+	if pc.Default != "" && !slices.Contains(priorityClasses, pc.Default) {
+		return fmt.Errorf("unknown default priority class %q", pc.Default)
+	}
+	classes = make(map[string]*classState)
+	for _, class := range priorityClasses {
+		classes[class] = &classState{callers: make(map[string]*tokenBucket), fetches: make(map[string]*tokenBucket)}
+	}
+	for class, l := range pc.Classes {
+		st, ok := classes[class]
+		if !ok {
+			return fmt.Errorf("unknown priority class %q", class)
+		}
+		if l.Rate < 0 || l.Burst < 0 || l.FetchRate < 0 || l.FetchBurst < 0 {
+			return fmt.Errorf("priority class %s: rates and bursts must not be negative", class)
+		}
+		st.rate, st.burst = l.Rate, float64(l.Burst)
+		if st.burst == 0 {
+			st.burst = math.Max(1, l.Rate)
+		}
+		st.fetchRate, st.fetchBurst = l.FetchRate, float64(l.FetchBurst)
+		if st.fetchBurst == 0 {
+			st.fetchBurst = math.Max(1, l.FetchRate)
+		}
+		if l.Bandwidth != "" {
+			bps, err := parseSize(l.Bandwidth)
+			if err != nil || bps == 0 {
+				return fmt.Errorf("priority class %s: invalid bandwidth %q", class, l.Bandwidth)
+			}
+			// Allow a second's worth at once, and at least one copy
+			// buffer, so writes never wait on themselves.
+			st.bandwidth = newTokenBucket(float64(bps), float64(max(bps, 1<<20)))
+		}
+	}
+	return nil
+}
+
+// callerKeyOf returns the key of c's rate limit: its identity, or the
+// client address for anonymous requests.
+func callerKeyOf(c *caller, r *http.Request) string {
+	if c != anonymous {
+		return c.Identity
+	}
+	return clientIP(r)
+}
+
+type fetchBucketKey struct{}
+
+// takeFetch takes a token from the fetch bucket prioritize attached to
+// ctx, if any, for starting a cache fill.
+func takeFetch(ctx context.Context) error {
+	b, _ := ctx.Value(fetchBucketKey{}).(*tokenBucket)
+	if b == nil {
+		return nil
+	}
+	if ok, wait := b.take(); !ok {
+		c := callerFrom(ctx)
+		return rateLimitError{fmt.Sprintf("%s exceeded the fetch rate of class %s", c.Identity, classOf(c)), wait}
+	}
+	return nil
+}
+
+// prioritize is router middleware applying the caller's class: its rate
+// limit, answered with 429 and Retry-After, its fetch rate limit,
+// applied by ensureCached, and its bandwidth.
+func prioritize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := callerFrom(r.Context())
+		st := classes[classOf(c)]
+		if st == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := callerKeyOf(c, r)
+		if st.fetchRate > 0 {
+			st.mu.Lock()
+			b := st.bucket(st.fetches, key, st.fetchRate, st.fetchBurst)
+			st.mu.Unlock()
+			r = r.WithContext(context.WithValue(r.Context(), fetchBucketKey{}, b))
+		}
+		if st.rate > 0 {
+			st.mu.Lock()
+			b := st.bucket(st.callers, key, st.rate, st.burst)
+			st.mu.Unlock()
+			if ok, wait := b.take(); !ok {
+				w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, fmt.Sprintf("%s exceeded the request rate of class %s", c.Identity, classOf(c)), http.StatusTooManyRequests)
+				return
+			}
+		}
+		if st.bandwidth != nil {
+			w = &shapedWriter{ResponseWriter: w, ctx: r.Context(), bucket: st.bandwidth}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shapedWriter paces writes to the rate of bucket.
+type shapedWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	bucket *tokenBucket
+}
+
+func (s *shapedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), 32<<10)
+		if wait := s.bucket.reserve(n); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-s.ctx.Done():
+				t.Stop()
+				return written, s.ctx.Err()
+			}
+		}
+		m, err := s.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (s *shapedWriter) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// slotQueue is a counting semaphore whose waiters are served by class,
+// first come first served within a class.
+type slotQueue struct {
+	mu      sync.Mutex
+	size    int
+	free    int
+	waiting [][]chan struct{} // by class rank
+}
+
+func newSlotQueue(n int) *slotQueue {
+	return &slotQueue{size: n, free: n, waiting: make([][]chan struct{}, len(priorityClasses))}
+}
+
+// acquire waits for a slot. The returned function releases it.
+func (q *slotQueue) acquire(ctx context.Context, class string) (func(), error) {
+	q.mu.Lock()
+	if q.free > 0 {
+		q.free--
+		q.mu.Unlock()
+		return q.release, nil
+	}
+	rank := classRank(class)
+	ch := make(chan struct{})
+	q.waiting[rank] = append(q.waiting[rank], ch)
+	q.mu.Unlock()
+
+	select {
+	case <-ch:
+		return q.release, nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		granted := true
+		for i, w := range q.waiting[rank] {
+			if w == ch {
+				q.waiting[rank] = append(q.waiting[rank][:i], q.waiting[rank][i+1:]...)
+				granted = false
+				break
+			}
+		}
+		q.mu.Unlock()
+		if granted {
+			q.release()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// release hands the slot to the first waiter of the highest class.
+func (q *slotQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for rank, ws := range q.waiting {
+		if len(ws) > 0 {
+			q.waiting[rank] = ws[1:]
+			close(ws[0])
+			return
+		}
+	}
+	q.free++
+}
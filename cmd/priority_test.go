@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10, 2)
+	for i := range 2 {
+		if ok, _ := b.take(); !ok {
+			t.Fatalf("take %d of the burst failed", i+1)
+		}
+	}
+	ok, wait := b.take()
+	if ok {
+		t.Fatal("take beyond the burst succeeded")
+	}
+	if wait <= 0 || wait > 100*time.Millisecond {
+		t.Errorf("wait = %v, want up to 100ms", wait)
+	}
+
+	b.last = b.last.Add(-time.Second)
+	if ok, _ := b.take(); !ok {
+		t.Error("take after refilling failed")
+	}
+	if b.tokens > 1 {
+		t.Errorf("refilled beyond the burst: %v tokens left", b.tokens)
+	}
+
+	if wait := b.reserve(21); wait < 1900*time.Millisecond {
+		t.Errorf("reserve(21) wait = %v, want about 2s", wait)
+	}
+}
+
+func TestTokenBucketIdle(t *testing.T) {
+	b := newTokenBucket(1, 2)
+	now := time.Now()
+	if !b.idle(now) {
+		t.Error("new bucket not idle")
+	}
+	b.take()
+	if b.idle(now) {
+		t.Error("bucket idle right after a take")
+	}
+	if !b.idle(now.Add(2 * time.Second)) {
+		t.Error("bucket not idle once refilled")
+	}
+}
+
+func TestClassStateDropsIdleBuckets(t *testing.T) {
+	st := &classState{callers: make(map[string]*tokenBucket), fetches: make(map[string]*tokenBucket)}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for i := range 100 {
+		st.bucket(st.fetches, "10.0.0."+strconv.Itoa(i), 1, 1)
+	}
+	busy := st.bucket(st.callers, "busy", 1, 1)
+	busy.take()
+
+	// Buckets are dropped at most every sweepIdleEvery.
+	st.bucket(st.fetches, "new", 1, 1)
+	if len(st.fetches) != 101 {
+		t.Fatalf("%d fetch buckets before the sweep is due, want 101", len(st.fetches))
+	}
+	st.swept = time.Now().Add(-sweepIdleEvery)
+	st.bucket(st.fetches, "newer", 1, 1)
+	if len(st.fetches) != 1 {
+		t.Errorf("%d fetch buckets after the sweep, want 1", len(st.fetches))
+	}
+	if st.callers["busy"] != busy {
+		t.Error("bucket still refilling was dropped")
+	}
+}
+
+func TestSlotQueueServesByClass(t *testing.T) {
+	q := newSlotQueue(1)
+	release, err := q.acquire(context.Background(), classBatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Waiters queue in the order batch, ci, interactive, and are served
+	// in the order of their classes.
+	order := make(chan string, 3)
+	for _, class := range []string{classBatch, classCI, classInteractive} {
+		go func() {
+			r, err := q.acquire(context.Background(), class)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- class
+			r()
+		}()
+		waitFor(t, func() bool {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			return len(q.waiting[classRank(class)]) == 1
+		})
+	}
+	release()
+	for _, want := range []string{classInteractive, classCI, classBatch} {
+		if got := <-order; got != want {
+			t.Errorf("served %s, want %s", got, want)
+		}
+	}
+	waitFor(t, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return q.free == 1
+	})
+}
+
+func TestSlotQueueCanceledWaiter(t *testing.T) {
+	q := newSlotQueue(1)
+	release, _ := q.acquire(context.Background(), classInteractive)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := q.acquire(ctx, classInteractive)
+		done <- err
+	}()
+	waitFor(t, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return len(q.waiting[0]) == 1
+	})
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled acquire = %v", err)
+	}
+	release()
+	if q.free != 1 {
+		t.Errorf("%d slots free, want 1: the canceled waiter kept one", q.free)
+	}
+}
+
+// waitFor polls cond until it holds, failing t after a few seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
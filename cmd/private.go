@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The go command only falls back to the next entry of a comma-separated
+// GOPROXY list when a proxy answers 404 or 410. For a private module that
+// we cannot serve, that fallback is exactly how a dependency-confusion
+// attack succeeds: a public proxy happily resolves a look-alike module
+// published under the same path. guardPrivate closes that gap by turning
+// a 404/410 for a configured private prefix into a 403, which stops the
+// go command instead of letting it try the public upstream.
+//
+// Paths the proxy serves keep their 404 and 410: the go command probes
+// every prefix of a package path as a candidate module, e.g.
+// example.com/mod/pkg before example.com/mod, and stops on a 403 for
+// any of them. Only a blocked version, which the proxy refuses rather
+// than lacks, is still turned into a 403 there.
+
+// isPrivate reports whether the request path (escaped module path plus
+// endpoint suffix, under any mount) falls under one of
+// config.PrivatePrefixes.
+func isPrivate(path string) bool {
+	path = strings.TrimPrefix(stripMount(path), "/")
+	for _, p := range config.PrivatePrefixes {
+		if hasPathPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func guardPrivate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isPrivate(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		served := servesModule(strings.TrimPrefix(stripMount(r.URL.Path), "/"))
+		next.ServeHTTP(&fallbackGuard{ResponseWriter: w, r: r, served: served}, r)
+	})
+}
+
+// fallbackGuard rewrites 404 and 410 responses to 403, or only those
+// for blocked versions if served.
+type fallbackGuard struct {
+	http.ResponseWriter
+	r       *http.Request
+	served  bool
+	blocked bool
+}
+
+func (g *fallbackGuard) WriteHeader(code int) {
+	refuse := code == http.StatusNotFound || code == http.StatusGone
+	if g.served {
+		refuse = code == http.StatusGone && g.Header().Get(policyHeader) != ""
+	}
+	if !refuse {
+		g.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	g.blocked = true
+	sendAlert("dependency-confusion", "refused fallback to public upstream for private module", map[string]string{
+		"path":   g.r.URL.Path,
+		"client": g.r.RemoteAddr,
+		"status": fmt.Sprint(code),
+	})
+
+	h := g.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	g.ResponseWriter.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(g.ResponseWriter, "%s is a private module path and is not resolvable through public upstreams\n", g.r.URL.Path)
+}
+
+func (g *fallbackGuard) Unwrap() http.ResponseWriter { return g.ResponseWriter }
+
+func (g *fallbackGuard) Write(b []byte) (int, error) {
+	if g.blocked {
+		return len(b), nil
+	}
+	return g.ResponseWriter.Write(b)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGuardPrivate(t *testing.T) {
+	keepState(t)
+	rm := repoMapping{Src: "example.com/mods", Dest: "git.example.com/org"}
+	m := &mapping{repoMapping: rm, upstream: missingBackend{rm}}
+	routing.Store(&routingTable{mappings: []*mapping{m}, upstream: m.upstream})
+	config.PrivatePrefixes = []string{"example.com/mods", "private.example.com"}
+
+	for _, tt := range []struct {
+		path    string
+		code    int
+		blocked bool
+		want    int
+	}{
+		// Candidate module paths of a package of a served module.
+		{"/example.com/mods/alpha/util/@v/v1.1.0.info", http.StatusNotFound, false, http.StatusNotFound},
+		{"/example.com/mods/missing/@v/list", http.StatusNotFound, false, http.StatusNotFound},
+		{"/example.com/mods/alpha/@v/v1.0.0.zip", http.StatusGone, false, http.StatusGone},
+		{"/example.com/mods/alpha/@v/v1.0.0.zip", http.StatusGone, true, http.StatusForbidden},
+		{"/example.com/mods/alpha/@v/v1.0.0.zip", http.StatusOK, false, http.StatusOK},
+		// Private paths only a public upstream could answer.
+		{"/private.example.com/lib/@v/list", http.StatusNotFound, false, http.StatusForbidden},
+		{"/private.example.com/lib/@v/v1.0.0.info", http.StatusGone, false, http.StatusForbidden},
+		{"/public.example.com/lib/@v/list", http.StatusNotFound, false, http.StatusNotFound},
+	} {
+		h := guardPrivate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.blocked {
+				w.Header().Set(policyHeader, "blocked")
+			}
+			w.WriteHeader(tt.code)
+		}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("GET %s answered %d (blocked %v): status %d, want %d", tt.path, tt.code, tt.blocked, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/module"
+)
+
+// ClusterConfig describes the other replicas of this proxy and the bus
+// that connects them. With the peers bus, purges are applied to every
+// peer before they are acknowledged, which gives read-your-writes: once
+// a purge returns successfully, no replica serves the purged artifacts
+// any more.
+type ClusterConfig struct {
+	// Bus is "peers" (the default when Peers is set) or "redis".
+	Bus   string   `yaml:"bus"`
+	Peers []string `yaml:"peers"`
+	// Token is presented to peers; it needs the admin scope there.
+	Token   string        `yaml:"token"`
+	Timeout time.Duration `yaml:"timeout"`
+
+	Redis   RedisConfig `yaml:"redis"`
+	Channel string      `yaml:"channel"`
+}
+
+// A storeDeleter is a remoteStore that can delete stored versions.
+type storeDeleter interface {
+	Delete(ctx context.Context, name, version string) error
+}
+
+// A storeLister is a remoteStore that can list the stored versions of
+// a module.
+type storeLister interface {
+	Versions(ctx context.Context, name string) ([]string, error)
+}
+
+// invalidation identifies what to drop from the cache. An empty
+// Version means every version of Module.
+type invalidation struct {
+	Module  string `json:"module"` // escaped module path
+	Version string `json:"version,omitempty"`
+}
+
+func (inv invalidation) String() string {
+	if inv.Version == "" {
+		return inv.Module
+	}
+	return inv.Module + "@" + inv.Version
+}
+
+// check rejects invalidations that do not name a module version, so a
+// purge can never escape the module's cache directory.
+func (inv invalidation) check() error {
+	path, err := module.UnescapePath(inv.Module)
+	if err != nil {
+		return err
+	}
+	if err := module.CheckPath(path); err != nil {
+		return err
+	}
+	if v := inv.Version; v == "." || v == ".." || strings.ContainsAny(v, `/\`) {
+		return fmt.Errorf("invalid version %q", v)
+	}
+	return nil
+}
+
+// purgeLocal removes the invalidated entries from the local cache.
+func purgeLocal(inv invalidation) error {
+	dir := moduleDir(inv.Module)
+	if inv.Version != "" {
+		dir = entryDir(inv.Module, inv.Version)
+	}
+	slog.Info("purge", "invalidation", inv)
+	defer entries.forget(inv.Module, inv.Version)
+	defer forgetLatest(inv.Module)
+	defer forgetNegative(inv.Module, inv.Version)
+	versions := []string{inv.Version}
+	if inv.Version == "" {
+		versions = localVersions(inv.Module)
+	}
+	for _, v := range versions {
+		if _, err := os.Stat(filepath.Join(entryDir(inv.Module, v), v+".info")); err == nil {
+			addTombstone(inv.Module, v)
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// localVersions returns the cached versions of the escaped module path.
+func localVersions(name string) []string {
+	entries, err := os.ReadDir(moduleDir(name))
+	if err != nil {
+		return nil
+	}
+	var versions []string
+	for _, e := range entries {
+		if e.IsDir() {
+			versions = append(versions, e.Name())
+		}
+	}
+	return versions
+}
+
+// purgeStore removes the invalidated versions from the remote store so
+// that no replica can pull them back in.
+func purgeStore(ctx context.Context, inv invalidation) error {
+	sd, ok := store.(storeDeleter)
+	if !ok {
+		return nil
+	}
+	versions := []string{inv.Version}
+	if inv.Version == "" {
+		versions = localVersions(inv.Module)
+		if path, err := module.UnescapePath(inv.Module); err == nil {
+			if listed, err := upstreamFor(path).List(ctx, path); err == nil {
+				versions = append(versions, listed...)
+			}
+		}
+		if sl, ok := store.(storeLister); ok {
+			stored, err := sl.Versions(ctx, inv.Module)
+			if err != nil {
+				return err
+			}
+			versions = append(versions, stored...)
+		}
+	}
+	seen := map[string]bool{}
+	for _, v := range versions {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		if err := sd.Delete(ctx, inv.Module, v); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func postPeer(ctx context.Context, peer, path string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(peer, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.Cluster.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+config.Cluster.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// purge serves DELETE /admin/cache/{module} and
+// DELETE /admin/cache/{module}/@v/{version}. The remote store is purged
+// first, then this instance, then the invalidation is published on the
+// cluster bus; the response is 200 only if every peer acknowledged.
+func purge(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	inv := invalidation{Module: vars["module"], Version: vars["version"]}
+	if err := inv.check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := purgeStore(r.Context(), inv); err != nil {
+		http.Error(w, "purging remote store: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if err := purgeLocal(inv); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	peers, err := publish(r.Context(), busEvent{Kind: eventInvalidate, Invalidation: &inv})
+	if err != nil {
+		http.Error(w, "publishing invalidation: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	status := http.StatusOK
+	for _, res := range peers {
+		if res != "ok" {
+			status = http.StatusBadGateway
+		}
+	}
+	slog.InfoContext(r.Context(), "purge requested", "invalidation", inv, "by", callerFrom(r.Context()).Identity)
+	writeJSON(w, status, map[string]any{"purged": inv, "peers": peers})
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// QuarantineConfig enables the quarantine workflow: a module version
+// fetched for the first time is only served to callers with the canary
+// scope until ScanCommand passes or an admin releases it.
+type QuarantineConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Prefixes limits quarantine to these module prefixes. Empty means
+	// every module.
+	Prefixes []string `yaml:"prefixes"`
+
+	// ScanCommand is run as ScanCommand... <zip> with MODULE and VERSION
+	// in its environment. Exit status 0 releases the version.
+	ScanCommand []string      `yaml:"scan_command"`
+	ScanTimeout time.Duration `yaml:"scan_timeout"`
+}
+
+const (
+	stateQuarantined = "quarantined"
+	stateReleased    = "released"
+)
+
+// quarantineRecord is stored as quarantine.json next to the cached
+// artifacts of a version.
+type quarantineRecord struct {
+	Module     string      `json:"module"`
+	Version    string      `json:"version"`
+	State      string      `json:"state"`
+	Since      time.Time   `json:"since"`
+	Scan       *scanResult `json:"scan,omitempty"`
+	ReleasedBy string      `json:"released_by,omitempty"`
+	ReleasedAt *time.Time  `json:"released_at,omitempty"`
+
+	// RequiredApprovals is non-zero for versions under an approvals
+	// prefix. Such versions are served to nobody, canaries included,
+	// until that many distinct admins have approved them.
+	RequiredApprovals int        `json:"required_approvals,omitempty"`
+	Approvals         []approval `json:"approvals,omitempty"`
+}
+
+type scanResult struct {
+	Passed bool      `json:"passed"`
+	Output string    `json:"output,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// quarantineMu serializes read-modify-write cycles on quarantine records.
+var quarantineMu sync.Mutex
+
+const quarantineFile = "quarantine.json"
+
+func quarantinePath(module, version string) string {
+	return filepath.Join(entryDir(module, version), quarantineFile)
+}
+
+// removeEntry removes the cache entry in dir but for its quarantine
+// record, so that a version evicted and filled again keeps its state
+// and approvals instead of starting over. dir itself goes if nothing is
+// left in it.
+func removeEntry(dir string) error {
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.Name() == quarantineFile {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, f.Name())); err != nil {
+			return err
+		}
+	}
+	os.Remove(dir) // fails if the record is left
+	return nil
+}
+
+// quarantineApplies reports whether new versions of module start out
+// quarantined, either by the quarantine config or because they need
+// approvals.
+func quarantineApplies(module string) bool {
+	if approvalsRequired(module) > 0 {
+		return true
+	}
+	qc := config.Quarantine
+	if !qc.Enabled {
+		return false
+	}
+	if len(qc.Prefixes) == 0 {
+		return true
+	}
+	for _, p := range qc.Prefixes {
+		if hasPathPrefix(module, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// readQuarantine returns the record for module@version, or nil if the
+// version was never quarantined.
+func readQuarantine(module, version string) (*quarantineRecord, error) {
+	data, err := os.ReadFile(quarantinePath(module, version))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var q quarantineRecord
+	if err := json.Unmarshal(data, &q); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+func writeQuarantine(q *quarantineRecord) error {
+	data, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(quarantinePath(q.Module, q.Version), data, 0644)
+}
+
+// saveQuarantine writes q and announces the new state to the other
+// replicas, which keep their own record for their copy of the version.
+func saveQuarantine(q *quarantineRecord) error {
+	if err := writeQuarantine(q); err != nil {
+		return err
+	}
+	c := *q
+	publishAsync(busEvent{Kind: eventQuarantine, Quarantine: &c})
+	return nil
+}
+
+// mergeQuarantine applies a record announced by another replica to the
+// local record of the same version: approvals are merged and a release
+// is adopted. Versions this instance has not cached are ignored.
+func mergeQuarantine(remote *quarantineRecord) error {
+	inv := invalidation{Module: remote.Module, Version: remote.Version}
+	if err := inv.check(); err != nil || remote.Version == "" {
+		return fmt.Errorf("invalid quarantine record for %s", inv)
+	}
+
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+
+	q, err := readQuarantine(remote.Module, remote.Version)
+	if err != nil || q == nil || q.State == stateReleased {
+		return err
+	}
+	for _, a := range remote.Approvals {
+		seen := false
+		for _, b := range q.Approvals {
+			seen = seen || a.By == b.By
+		}
+		if !seen {
+			q.Approvals = append(q.Approvals, a)
+		}
+	}
+	if q.Scan == nil {
+		q.Scan = remote.Scan
+	}
+	if remote.State == stateReleased {
+		q.State = stateReleased
+		q.ReleasedBy = remote.ReleasedBy
+		q.ReleasedAt = remote.ReleasedAt
+		slog.Info("quarantine released on a peer", "module", q.Module, "version", q.Version, "by", q.ReleasedBy)
+	}
+	return writeQuarantine(q)
+}
+
+// quarantineNew records module@version as quarantined. It is called by
+// fetchAndCache before any artifact is written, so the version is never
+// visible outside the canary scope. The record of a version that was
+// evicted and is filled again is kept.
+func quarantineNew(module, version string) error {
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+	if q, err := readQuarantine(module, version); err != nil || q != nil {
+		return err
+	}
+	q := &quarantineRecord{
+		Module:            module,
+		Version:           version,
+		State:             stateQuarantined,
+		Since:             time.Now().UTC(),
+		RequiredApprovals: approvalsRequired(module),
+	}
+	return writeQuarantine(q)
+}
+
+// isQuarantined reports whether module@version is hidden from c.
+func isQuarantined(c *caller, module, version string) bool {
+	q, err := readQuarantine(module, version)
+	if err != nil {
+		slog.Error("quarantine", "module", module, "version", version, "err", err)
+		return true
+	}
+	if q == nil || q.State != stateQuarantined {
+		return false
+	}
+	return q.RequiredApprovals > 0 || !c.hasScope(scopeCanary)
+}
+
+// errNeedsApprovals is returned by releaseQuarantine for versions that
+// can only be released through the approvals workflow.
+var errNeedsApprovals = errors.New("version requires approvals and cannot be released directly")
+
+// releaseQuarantine promotes module@version to generally available.
+func releaseQuarantine(module, version, by string) (*quarantineRecord, error) {
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+
+	q, err := readQuarantine(module, version)
+	if err != nil || q == nil {
+		return nil, err
+	}
+	if q.State == stateReleased {
+		return q, nil
+	}
+	if q.RequiredApprovals > 0 {
+		return q, errNeedsApprovals
+	}
+	release(q, by)
+	return q, saveQuarantine(q)
+}
+
+func release(q *quarantineRecord, by string) {
+	now := time.Now().UTC()
+	q.State = stateReleased
+	q.ReleasedBy = by
+	q.ReleasedAt = &now
+	pushToStore(q.Module, q.Version)
+}
+
+// scanQuarantined runs the configured scan command against the zip of
+// a freshly fetched version and releases it if the scan passes.
+func scanQuarantined(module, version string) {
+	qc := config.Quarantine
+	if len(qc.ScanCommand) == 0 {
+		return
+	}
+	timeout := qc.ScanTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	zip := filepath.Join(entryDir(module, version), "source.zip")
+	args := append(append([]string{}, qc.ScanCommand[1:]...), zip)
+	cmd := exec.CommandContext(ctx, qc.ScanCommand[0], args...)
+	cmd.Env = append(os.Environ(), "MODULE="+module, "VERSION="+version)
+	output, err := runCombinedOutput(ctx, cmd)
+
+	res := &scanResult{Passed: err == nil, Output: string(output), At: time.Now().UTC()}
+	slog.Info("quarantine scan", "module", module, "version", version, "passed", res.Passed)
+
+	quarantineMu.Lock()
+	q, rerr := readQuarantine(module, version)
+	if rerr == nil && q != nil {
+		q.Scan = res
+		rerr = writeQuarantine(q)
+	}
+	quarantineMu.Unlock()
+	if rerr != nil {
+		slog.Error("quarantine", "module", module, "version", version, "err", rerr)
+		return
+	}
+
+	if res.Passed {
+		if _, err := releaseQuarantine(module, version, "scanner"); err != nil && err != errNeedsApprovals {
+			slog.Error("quarantine", "module", module, "version", version, "err", err)
+		}
+	}
+}
+
+// quarantinedRecords returns the records of all versions that are still
+// quarantined.
+func quarantinedRecords() ([]*quarantineRecord, error) {
+	records := []*quarantineRecord{}
+	err := walkCache(func(e cacheEntry) error {
+		q, err := readQuarantine(e.Module, e.Version)
+		if err != nil {
+			return err
+		}
+		if q != nil && q.State == stateQuarantined {
+			records = append(records, q)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// listQuarantined serves GET /admin/quarantine.
+func listQuarantined(w http.ResponseWriter, r *http.Request) {
+	records, err := quarantinedRecords()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// releaseQuarantined serves POST /admin/quarantine/{module}/@v/{version}/release.
+func releaseQuarantined(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	by := callerFrom(r.Context()).Identity
+
+	q, err := releaseQuarantine(vars["module"], vars["version"], by)
+	if err == errNeedsApprovals {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if q == nil {
+		http.Error(w, "not quarantined", http.StatusNotFound)
+		return
+	}
+	slog.InfoContext(r.Context(), "quarantine released", "module", q.Module, "version", q.Version, "by", by)
+	writeJSON(w, http.StatusOK, q)
+}
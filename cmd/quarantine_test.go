@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveEntryKeepsQuarantine(t *testing.T) {
+	const name, version = "example.com/m", "v1.0.0"
+	dir := writeTestEntry(t, name, version)
+	if err := quarantineNew(name, version); err != nil {
+		t.Fatal(err)
+	}
+	q, err := readQuarantine(name, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.State = stateReleased
+	if err := writeQuarantine(q); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeEntry(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, version+".info")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("info file after removeEntry: %v", err)
+	}
+	// Filling the version again must not quarantine it anew.
+	if err := quarantineNew(name, version); err != nil {
+		t.Fatal(err)
+	}
+	if q, err := readQuarantine(name, version); err != nil || q == nil || q.State != stateReleased {
+		t.Errorf("record after eviction and refill = %+v, %v; want released", q, err)
+	}
+
+	os.Remove(quarantinePath(name, version))
+	if err := removeEntry(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("entry without a record left behind: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Semantic version queries such as @latest, @<v1.5.0, @v1.2 or @~1.2
+// are resolved in process against the cached version list, without the
+// backend: only branch and commit queries need the repository. As in
+// the go command, a query matching release versions ignores
+// pre-releases, and versions retracted by the highest version are only
+// chosen when nothing else matches.
+
+// semverQuery is a parsed semantic version query.
+type semverQuery struct {
+	match  func(v string) bool
+	lowest bool // pick the lowest match rather than the highest
+}
+
+// parseSemverQuery parses query, reporting whether it is a semantic
+// version query:
+//
+//   - latest: the highest version
+//   - <v, <=v: the highest version below (or at) v
+//   - >v, >=v: the lowest version above (or at) v
+//   - v1, v1.2: the highest version with that prefix
+//   - ~1.2, ~v1.2.3: the highest version at or above it with the same
+//     major and minor version
+//
+// Canonical versions such as v1.2.3 are not queries.
+func parseSemverQuery(query string) (semverQuery, bool) {
+	if query == "latest" {
+		return semverQuery{match: func(string) bool { return true }}, true
+	}
+	for _, op := range []string{"<=", ">=", "<", ">"} {
+		rest, ok := strings.CutPrefix(query, op)
+		if !ok {
+			continue
+		}
+		if !semver.IsValid(rest) {
+			return semverQuery{}, false
+		}
+		cmp := map[string]func(int) bool{
+			"<":  func(c int) bool { return c < 0 },
+			"<=": func(c int) bool { return c <= 0 },
+			">":  func(c int) bool { return c > 0 },
+			">=": func(c int) bool { return c >= 0 },
+		}[op]
+		return semverQuery{
+			match:  func(v string) bool { return cmp(semver.Compare(v, rest)) },
+			lowest: op[0] == '>',
+		}, true
+	}
+	if rest, ok := strings.CutPrefix(query, "~"); ok {
+		low := "v" + strings.TrimPrefix(rest, "v")
+		if !semver.IsValid(low) || semver.Prerelease(low) != "" || semver.Build(low) != "" {
+			return semverQuery{}, false
+		}
+		mm := strings.Split(semver.MajorMinor(low), ".")
+		minor, _ := strconv.Atoi(mm[1])
+		// -0 is the lowest pre-release, so pre-releases of the next
+		// minor version are excluded too.
+		high := fmt.Sprintf("%s.%d.0-0", mm[0], minor+1)
+		return semverQuery{match: func(v string) bool {
+			return semver.Compare(v, low) >= 0 && semver.Compare(v, high) < 0
+		}}, true
+	}
+	if semver.IsValid(query) && query != semver.Canonical(query) &&
+		semver.Prerelease(query) == "" && semver.Build(query) == "" && strings.Count(query, ".") < 2 {
+		return semverQuery{match: func(v string) bool {
+			return strings.HasPrefix(v, query+".")
+		}}, true
+	}
+	return semverQuery{}, false
+}
+
+// resolveSemverQuery returns the version of escaped that q selects from
+// the versions visible to the caller of r.
+func resolveSemverQuery(ctx context.Context, r *http.Request, escaped, query string, q semverQuery) (string, error) {
+	versions, err := visibleVersions(r.WithContext(ctx), escaped)
+	if err != nil {
+		return "", err
+	}
+	var tagged []string
+	for _, v := range versions {
+		if semver.IsValid(v) && v == semver.Canonical(v) && !module.IsPseudoVersion(v) {
+			tagged = append(tagged, v)
+		}
+	}
+	if len(tagged) == 0 {
+		return "", kindError{fmt.Sprintf("no versions match %s", query), errNotFound}
+	}
+	retracted := retractionsOf(ctx, escaped, tagged[len(tagged)-1])
+
+	// Candidates by preference: releases, pre-releases, then retracted
+	// versions; tagged is sorted, so the last match wins unless lowest.
+	var picks [3]string
+	for _, v := range tagged {
+		if !q.match(v) {
+			continue
+		}
+		rank := 0
+		switch {
+		case retracted(v):
+			rank = 2
+		case semver.Prerelease(v) != "":
+			rank = 1
+		}
+		if !q.lowest || picks[rank] == "" {
+			picks[rank] = v
+		}
+	}
+	for _, v := range picks {
+		if v != "" {
+			return v, nil
+		}
+	}
+	return "", kindError{fmt.Sprintf("no versions match %s", query), errNotFound}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Adding a mapping or rotating a repository token should not take a
+// restart, which drops every download in flight. On SIGHUP, or POST
+// /admin/reload, the proxy reads its config file again and replaces the
+// routing table: the mappings, the mounts, the default upstream, the
+// client tokens, and the router serving them. The new table is built
+// and checked completely first, then swapped in with one atomic store,
+// so every lookup sees one complete table. A request is not pinned to a
+// table, though: one in flight during the swap may resolve its mapping
+// with the old table and its upstream, say, with the new. A config that
+// fails to load or check leaves the running table in place.
+//
+// Every other section is read once at startup. Changes to them are
+// listed in the reload's result and in the log, and take a restart.
+
+// routingTable is the configuration replaced by a reload.
+type routingTable struct {
+	// mappings holds the SRC_REPO mapping followed by the configured
+	// ones.
+	mappings []*mapping
+	mounts   []*mount
+
+	// upstream is the backend of the SRC_REPO mapping.
+	upstream backend
+
+	// tokens are the client tokens of the config file.
+	tokens []TokenConfig
+
+	// redactions redact the dest repositories from error responses.
+	redactions []*regexp.Regexp
+
+	// config is the configuration the table was built from.
+	config Config
+
+	handler http.Handler
+}
+
+var routing atomic.Pointer[routingTable]
+
+// routes returns the current routing table.
+func routes() *routingTable {
+	if t := routing.Load(); t != nil {
+		return t
+	}
+	return &routingTable{}
+}
+
+// srcs returns the module path prefixes served at the root.
+func (t *routingTable) srcs() []string {
+	srcs := make([]string, len(t.mappings))
+	for i, m := range t.mappings {
+		srcs[i] = m.Src
+	}
+	return srcs
+}
+
+// reloadable are the config keys a reload applies.
+var reloadable = map[string]bool{
+	"mappings": true, "mounts": true, "dual_stack": true, "tokens": true, "repo_token": true,
+}
+
+// buildRouting builds the routing table of c, with root, the SRC_REPO
+// mapping, resolved from up. The router is built by the caller, once
+// the table is complete.
+func buildRouting(c Config, root repoMapping, up backend) (*routingTable, error) {
+	t := &routingTable{upstream: up, tokens: c.Tokens, config: c}
+	var err error
+	if t.mappings, err = buildMappings(c, root, up); err != nil {
+		return nil, fmt.Errorf("configuring mappings: %v", err)
+	}
+	if t.mounts, err = buildMounts(c, t.mappings); err != nil {
+		return nil, fmt.Errorf("configuring mounts: %v", err)
+	}
+	if err := checkMiddleware(c, t.mounts); err != nil {
+		return nil, err
+	}
+	t.redactions = destRedactions(t)
+	return t, nil
+}
+
+// ReloadResult reports a reload.
+type ReloadResult struct {
+	Mappings int `json:"mappings"`
+	Mounts   int `json:"mounts"`
+
+	// RestartRequired lists the changed config keys that a reload does
+	// not apply.
+	RestartRequired []string `json:"restart_required,omitempty"`
+}
+
+var reloadMu sync.Mutex
+
+// current is the installed server, which reload rebuilds the routing
+// table of.
+var current *Server
+
+// reload reads the config file again and swaps in the routing table it
+// describes.
+func (s *Server) reload() (*ReloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	c, err := loadConfig(s.ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading config: %v", err)
+	}
+
+	// The token given by flag or environment wins over the file's, as
+	// at startup; the default upstream is rebuilt only if it changed.
+	root, up := s.Mapping, routes().upstream
+	root.Token = settingFrom(s.getenv, "REPO_TOKEN", c.RepoToken)
+	if root.Token == "" && (c.Backend.Type == "" || c.Backend.Type == "git") {
+		return nil, unsetError("REPO_TOKEN")
+	}
+	if root.Token != s.Mapping.Token {
+		if up, err = newBackend(config.Backend, root); err != nil {
+			return nil, fmt.Errorf("configuring backend: %v", err)
+		}
+	}
+	t, err := buildRouting(c, root, up)
+	if err != nil {
+		return nil, err
+	}
+	t.handler = s.handlerFor(t)
+	routing.Store(t)
+	s.Mapping = root
+
+	res := &ReloadResult{Mappings: len(t.mappings), Mounts: len(t.mounts), RestartRequired: changedSections(config, c)}
+	slog.Info("reloaded config", "file", s.ConfigFile, "mappings", res.Mappings, "mounts", res.Mounts, "restart_required", res.RestartRequired)
+	return res, nil
+}
+
+// currentConfig returns the configuration in effect: the one installed
+// at startup, with the reloadable keys as of the last reload.
+func currentConfig() Config {
+	c := config
+	t := routing.Load()
+	if t == nil {
+		return c
+	}
+	vc, vt := reflect.ValueOf(&c).Elem(), reflect.ValueOf(t.config)
+	for i := range vc.NumField() {
+		if reloadable[vc.Type().Field(i).Tag.Get("yaml")] {
+			vc.Field(i).Set(vt.Field(i))
+		}
+	}
+	return c
+}
+
+// changedSections returns the config keys other than the reloadable
+// ones whose values differ between a and b.
+func changedSections(a, b Config) []string {
+	var changed []string
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := range va.NumField() {
+		key := va.Type().Field(i).Tag.Get("yaml")
+		if !reloadable[key] && !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
+
+// reloadOnSIGHUP reloads the config whenever the process gets SIGHUP.
+func (s *Server) reloadOnSIGHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if _, err := s.reload(); err != nil {
+				slog.Error("reloading config; keeping the running one", "err", err)
+			}
+		}
+	}()
+}
+
+// postReload serves POST /admin/reload.
+func postReload(w http.ResponseWriter, r *http.Request) {
+	res, err := current.reload()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// RenameRule moves the modules under From to the same paths under To,
+// for migrating import paths. Requests for a module under From are
+// answered with 301 Moved Permanently to the module under To: the go
+// command follows the redirect and, finding the new path in go.mod,
+// fails with "module declares its path as: <To...> but was required
+// as: <From...>", which tells the user what to change. With Mode
+// "error" they are refused with 410 Gone and a message naming the new
+// path instead.
+//
+// Versions below Since, the first version published under To, are
+// still served from From by their exact version, so builds pinned to
+// them keep working; the version list and @latest are moved anyway.
+type RenameRule struct {
+	From  string `yaml:"from"`
+	To    string `yaml:"to"`
+	Mode  string `yaml:"mode"` // "redirect" (default) or "error"
+	Since string `yaml:"since"`
+}
+
+func checkRenames(rules []RenameRule) error {
+	for i, r := range rules {
+		if err := module.CheckImportPath(r.From); err != nil {
+			return fmt.Errorf("renames[%d]: from: %v", i, err)
+		}
+		if err := module.CheckImportPath(r.To); err != nil {
+			return fmt.Errorf("renames[%d]: to: %v", i, err)
+		}
+		if hasPathPrefix(r.To, r.From) || hasPathPrefix(r.From, r.To) {
+			return fmt.Errorf("renames[%d]: %s and %s overlap", i, r.From, r.To)
+		}
+		switch r.Mode {
+		case "", "redirect", "error":
+		default:
+			return fmt.Errorf("renames[%d]: mode must be redirect or error", i)
+		}
+		if r.Since != "" && !semver.IsValid(r.Since) {
+			return fmt.Errorf("renames[%d]: since %q is not a semantic version", i, r.Since)
+		}
+	}
+	return nil
+}
+
+// renamed returns the rule with the longest From covering path, and
+// the path it is renamed to.
+func renamed(path string) (*RenameRule, string) {
+	var best *RenameRule
+	for i := range config.Renames {
+		r := &config.Renames[i]
+		if hasPathPrefix(path, r.From) && (best == nil || len(r.From) > len(best.From)) {
+			best = r
+		}
+	}
+	if best == nil {
+		return nil, ""
+	}
+	return best, best.To + strings.TrimPrefix(path, best.From)
+}
+
+// redirectRenamed is router middleware answering the requests for
+// renamed modules.
+func redirectRenamed(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		escaped := mux.Vars(r)["module"]
+		path, err := module.UnescapePath(escaped)
+		if err != nil || len(config.Renames) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rule, to := renamed(path)
+		v := mux.Vars(r)["version"]
+		if rule == nil || rule.Since != "" && semver.IsValid(v) && semver.Compare(v, rule.Since) < 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if rule.Mode == "error" {
+			httpError(w, kindError{fmt.Sprintf("%s has been renamed to %s: update the imports and requirements of your module", path, to), errGone})
+			return
+		}
+		toEscaped, err := module.EscapePath(to)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u := *r.URL
+		u.Path = strings.Replace(u.Path, "/"+escaped+"/@", "/"+toEscaped+"/@", 1)
+		u.RawPath = ""
+		slog.DebugContext(r.Context(), "redirecting renamed module", "from", path, "to", to)
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// The files of a version never change once published, so the cache
+// entry of module@version, its .info, .mod and zip, is filled once and
+// then served from disk for good; entries remembers which entries were
+// verified so hits skip reading their provenance again. Clients and
+// caches in front of the proxy may keep responses for requests naming
+// a canonical version for ResponseCacheConfig.MaxAge, which is short by
+// default so that a block or purge reaches them soon; only with
+// Immutable are they told never to revalidate. Responses to
+// queries and @latest, whose answer changes as versions are published,
+// and to lists are never cached.
+
+// ResponseCacheConfig configures caching of version files downstream.
+type ResponseCacheConfig struct {
+	// MaxAge is how long a version file may be cached (default one
+	// hour); a negative value disables caching.
+	MaxAge time.Duration `yaml:"max_age"`
+
+	// Immutable marks cached version files immutable, so clients do
+	// not revalidate them even on reload.
+	Immutable bool `yaml:"immutable"`
+
+	// MemoryMB is the memory, in MiB, for serving .info and .mod files
+	// without disk I/O (see hotcache.go); 0 disables it.
+	MemoryMB int `yaml:"memory_mb"`
+}
+
+const defaultMaxAge = time.Hour
+
+// immutableVersion reports whether v names a version whose files cannot
+// change: a canonical semantic version, including pseudo-versions.
+func immutableVersion(v string) bool {
+	return semver.IsValid(v) && module.CanonicalVersion(v) == v
+}
+
+// cacheControl returns the Cache-Control of a response to r serving a
+// file of version.
+func cacheControl(r *http.Request, version string) string {
+	rc := config.ResponseCache
+	maxAge := rc.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultMaxAge
+	}
+	if maxAge < 0 || mux.Vars(r)["version"] != version || !immutableVersion(version) {
+		return "no-store"
+	}
+	cc := fmt.Sprintf("max-age=%d", int64(maxAge/time.Second))
+	if rc.Immutable {
+		cc += ", immutable"
+	}
+	return cc
+}
+
+// entries is the set of cache entries, by escaped module path and
+// version, known to be complete and of the current namespace.
+var entries = &entryIndex{m: make(map[string]map[string]bool)}
+
+type entryIndex struct {
+	mu sync.Mutex
+	m  map[string]map[string]bool
+}
+
+func (x *entryIndex) has(name, version string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.m[name][version]
+}
+
+func (x *entryIndex) add(name, version string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.m[name] == nil {
+		x.m[name] = make(map[string]bool)
+	}
+	x.m[name][version] = true
+}
+
+// forget drops name@version, or every version of name if version is
+// empty. Whatever removes a cache entry must call it.
+func (x *entryIndex) forget(name, version string) {
+	hotFiles.forget(name, version)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if version == "" {
+		delete(x.m, name)
+		return
+	}
+	delete(x.m[name], version)
+}
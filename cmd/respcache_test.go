@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCacheControl(t *testing.T) {
+	keepState(t)
+
+	for _, tt := range []struct {
+		rc       ResponseCacheConfig
+		version  string
+		resolved string
+		want     string
+	}{
+		{ResponseCacheConfig{}, "v1.0.0", "v1.0.0", "max-age=3600"},
+		{ResponseCacheConfig{MaxAge: 720 * time.Hour, Immutable: true}, "v1.0.0", "v1.0.0", "max-age=2592000, immutable"},
+		{ResponseCacheConfig{MaxAge: -1}, "v1.0.0", "v1.0.0", "no-store"},
+		{ResponseCacheConfig{Immutable: true}, "master", "v1.0.0", "no-store"},
+		{ResponseCacheConfig{}, "v1.0", "v1.0", "no-store"},
+	} {
+		config.ResponseCache = tt.rc
+		r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/", nil), map[string]string{"version": tt.version})
+		if got := cacheControl(r, tt.resolved); got != tt.want {
+			t.Errorf("cacheControl(%+v, %s for %s) = %q, want %q", tt.rc, tt.resolved, tt.version, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config configures a blob store in an S3 bucket, on AWS or any
+// compatible service such as MinIO. Credentials not given here are
+// taken from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN.
+type S3Config struct {
+	// Endpoint is the base URL of the service, for example
+	// https://s3.eu-central-1.amazonaws.com or http://minio:9000.
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"` // default us-east-1
+	Bucket   string `yaml:"bucket"`
+	// Prefix is prepended to every key.
+	Prefix          string `yaml:"prefix"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	SessionToken    string `yaml:"session_token"`
+	// PathStyle addresses the bucket as <endpoint>/<bucket>, as MinIO
+	// expects, instead of <bucket>.<endpoint>.
+	PathStyle bool `yaml:"path_style"`
+}
+
+// s3Meta is the user metadata holding the SHA-256 of an object, which
+// S3 does not report itself.
+const s3Meta = "X-Amz-Meta-Sha256"
+
+// s3PlainMeta holds the SHA-256 of a compressed object's content.
+const s3PlainMeta = "X-Amz-Meta-Plain-Sha256"
+
+// s3Store is a minimal S3 client signing its requests with AWS
+// Signature Version 4, covering what blobStore needs.
+type s3Store struct {
+	cfg    S3Config
+	base   *url.URL // bucket URL
+	client *http.Client
+}
+
+func newS3Store(cfg S3Config) (*s3Store, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3: endpoint and bucket are required")
+	}
+	base, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("s3: bad endpoint %q", cfg.Endpoint)
+	}
+	if cfg.PathStyle {
+		base.Path += "/" + cfg.Bucket
+	} else {
+		base.Host = cfg.Bucket + "." + base.Host
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.AccessKeyID == "" {
+		cfg.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		cfg.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		cfg.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	return &s3Store{cfg: cfg, base: base, client: http.DefaultClient}, nil
+}
+
+func (s *s3Store) key(key string) string {
+	if s.cfg.Prefix == "" {
+		return key
+	}
+	return s.cfg.Prefix + "/" + key
+}
+
+// do sends a signed request for key (empty for the bucket itself).
+// payloadHash is the hex SHA-256 of body.
+func (s *s3Store) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, payloadHash string, header http.Header) (*http.Response, error) {
+	u := *s.base
+	if key != "" {
+		u.Path += "/" + key
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (s *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := []byte("AWS4" + s.cfg.SecretAccessKey)
+	for _, part := range []string{date, s.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.cfg.AccessKeyID, scope, signed, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// emptySHA256 is the hex SHA-256 of an empty payload.
+var emptySHA256 = sha256Hex(nil)
+
+// s3Escape percent-encodes s as Signature Version 4 requires: every
+// byte but the unreserved characters, and slashes unless escapeSlash.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes q in canonical order and encoding.
+func s3Query(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Error turns an unsuccessful response into an error, wrapping
+// os.ErrNotExist for a missing key.
+func s3Error(resp *http.Response, key string) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("s3: %s: %w", key, os.ErrNotExist)
+	}
+	var e struct {
+		Code    string
+		Message string
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&e)
+	if e.Code != "" {
+		return fmt.Errorf("s3: %s %s: %s: %s %s", resp.Request.Method, key, resp.Status, e.Code, e.Message)
+	}
+	return fmt.Errorf("s3: %s %s: %s", resp.Request.Method, key, resp.Status)
+}
+
+func s3Info(resp *http.Response) blobInfo {
+	return blobInfo{Size: resp.ContentLength, SHA256: resp.Header.Get(s3Meta), PlainSHA256: resp.Header.Get(s3PlainMeta)}
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) (io.ReadCloser, blobInfo, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.key(key), nil, nil, 0, emptySHA256, nil)
+	if err != nil {
+		return nil, blobInfo{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, blobInfo{}, s3Error(resp, key)
+	}
+	return resp.Body, s3Info(resp), nil
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, body io.ReadSeeker, info blobInfo) error {
+	header := http.Header{s3Meta: {info.SHA256}}
+	if info.PlainSHA256 != "" {
+		header.Set(s3PlainMeta, info.PlainSHA256)
+	}
+	resp, err := s.do(ctx, http.MethodPut, s.key(key), nil, body, info.Size, info.SHA256, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp, key)
+	}
+	return nil
+}
+
+func (s *s3Store) Stat(ctx context.Context, key string) (blobInfo, error) {
+	resp, err := s.do(ctx, http.MethodHead, s.key(key), nil, nil, 0, emptySHA256, nil)
+	if err != nil {
+		return blobInfo{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return blobInfo{}, s3Error(resp, key)
+	}
+	return s3Info(resp), nil
+}
+
+func (s *s3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.key(prefix)}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", q, nil, 0, emptySHA256, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error(resp, prefix)
+		} else {
+			err = xml.NewDecoder(resp.Body).Decode(&page)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, s.key("")))
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.key(key), nil, nil, 0, emptySHA256, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error(resp, key)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// SanitizeConfig controls redaction of error responses. go and git
+// output quoted in errors routinely contains internal hostnames,
+// repository URLs and credentials. Before an error body (status 400 and
+// up) is sent, every match of the built-in patterns (credentials in
+// URLs, DEST_REPO and the dest repositories of mappings and mounts) and
+// of Patterns is replaced by Replacement. The unredacted text is
+// appended to LogFile, created with mode 0600, or to the standard log
+// if LogFile is empty.
+type SanitizeConfig struct {
+	Patterns    []string `yaml:"patterns"`
+	Replacement string   `yaml:"replacement"`
+	LogFile     string   `yaml:"log_file"`
+}
+
+// urlCredentials matches the userinfo of URLs such as
+// https://dummy:<token>@host.
+var urlCredentials = regexp.MustCompile(`([a-z][a-z0-9+.-]*://)[^/@\s]+@`)
+
+var (
+	redactions []*regexp.Regexp // configured patterns
+	errorLog   = log.Default()
+)
+
+// destRedactions returns the patterns redacting the dest repositories
+// of the mappings and mounts of t.
+func destRedactions(t *routingTable) []*regexp.Regexp {
+	var dests []string
+	for _, m := range t.mappings {
+		dests = append(dests, m.Dest)
+	}
+	for _, m := range t.mounts {
+		dests = append(dests, m.mapping.Dest)
+	}
+	var res []*regexp.Regexp
+	for _, d := range dests {
+		if d != "" {
+			res = append(res, regexp.MustCompile(regexp.QuoteMeta(d)))
+		}
+	}
+	return res
+}
+
+// setupSanitizer compiles the redaction patterns and opens the error
+// log.
+func setupSanitizer(sc SanitizeConfig) error {
+	redactions = nil
+	for _, p := range sc.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("sanitize pattern %q: %v", p, err)
+		}
+		redactions = append(redactions, re)
+	}
+	if sc.LogFile != "" {
+		f, err := os.OpenFile(sc.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		errorLog = log.New(f, "", log.LstdFlags|log.LUTC)
+	}
+	return nil
+}
+
+// sanitize returns text with credentials and configured patterns
+// redacted.
+func sanitize(text []byte) []byte {
+	repl := config.Sanitize.Replacement
+	if repl == "" {
+		repl = "[redacted]"
+	}
+	text = urlCredentials.ReplaceAll(text, []byte("${1}"+repl+"@"))
+	for _, re := range slices.Concat(routes().redactions, redactions) {
+		text = re.ReplaceAllLiteral(text, []byte(repl))
+	}
+	return text
+}
+
+// sanitizeErrors is middleware redacting error response bodies.
+func sanitizeErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &sanitizingWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		sw.flush(r)
+	})
+}
+
+// sanitizingWriter buffers the body of error responses so it can be
+// redacted as a whole.
+type sanitizingWriter struct {
+	http.ResponseWriter
+	code int
+	buf  bytes.Buffer
+}
+
+func (s *sanitizingWriter) WriteHeader(code int) {
+	if code < 400 {
+		s.ResponseWriter.WriteHeader(code)
+		return
+	}
+	s.code = code
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *sanitizingWriter) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+func (s *sanitizingWriter) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		return s.ResponseWriter.Write(b)
+	}
+	return s.buf.Write(b)
+}
+
+func (s *sanitizingWriter) flush(r *http.Request) {
+	if s.code == 0 {
+		return
+	}
+	body := sanitize(s.buf.Bytes())
+	if !bytes.Equal(body, s.buf.Bytes()) {
+		errorLog.Printf("%d %s %s: %s", s.code, r.Method, r.URL.Path, bytes.TrimSpace(s.buf.Bytes()))
+	}
+	body = appendNotice(s.Header(), s.code, body)
+	s.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	s.ResponseWriter.WriteHeader(s.code)
+	s.ResponseWriter.Write(body)
+}
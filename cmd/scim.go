@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SCIMConfig syncs teams and their members from the identity provider's
+// SCIM 2.0 API (RFC 7644). Synced teams act as groups in ACL rules, and
+// Teams and PrefixTemplate turn them into ACL rules and download quotas
+// without hand-editing the acl section.
+type SCIMConfig struct {
+	// URL is the SCIM base URL, e.g. https://idp.example.com/scim/v2.
+	URL      string        `yaml:"url"`
+	Token    string        `yaml:"token"`
+	Interval time.Duration `yaml:"interval"`
+
+	// PrefixTemplate, if set, gives every synced team an ACL rule for
+	// the prefix obtained by replacing {team} with the team name.
+	PrefixTemplate string `yaml:"prefix_template"`
+
+	Teams []TeamMapping `yaml:"teams"`
+}
+
+// TeamMapping grants a team access to module prefixes and limits the
+// number of zip downloads per member and UTC day. Zero means unlimited.
+type TeamMapping struct {
+	Team           string   `yaml:"team"`
+	Prefixes       []string `yaml:"prefixes"`
+	DailyDownloads int      `yaml:"daily_downloads"`
+}
+
+// scimState is the result of the last successful sync.
+type scimState struct {
+	SyncedAt time.Time           `json:"synced_at"`
+	Teams    map[string][]string `json:"teams"` // team -> identities
+	ACL      []ACLRule           `json:"acl"`
+
+	byUser map[string][]string // identity -> teams
+}
+
+var (
+	scimMu   sync.Mutex
+	scimLast *scimState
+)
+
+// teamsOf returns the synced teams of identity.
+func teamsOf(identity string) []string {
+	scimMu.Lock()
+	defer scimMu.Unlock()
+	if scimLast == nil {
+		return nil
+	}
+	return scimLast.byUser[identity]
+}
+
+// syncedACL returns the ACL rules derived from the last sync.
+func syncedACL() []ACLRule {
+	scimMu.Lock()
+	defer scimMu.Unlock()
+	if scimLast == nil {
+		return nil
+	}
+	return scimLast.ACL
+}
+
+type scimMember struct {
+	Value string `json:"value"`
+}
+
+type scimGroup struct {
+	ID          string       `json:"id"`
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members"`
+}
+
+type scimUser struct {
+	ID       string `json:"id"`
+	UserName string `json:"userName"`
+	Active   *bool  `json:"active"`
+}
+
+// scimList fetches every page of the resource collection at path.
+func scimList[T any](ctx context.Context, sc SCIMConfig, path string) ([]T, error) {
+	var all []T
+	start := 1
+	for {
+		u := fmt.Sprintf("%s/%s?startIndex=%d&count=100", strings.TrimSuffix(sc.URL, "/"), path, start)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/scim+json")
+		if sc.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+sc.Token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			TotalResults int `json:"totalResults"`
+			Resources    []T `json:"Resources"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("scim %s: %s", path, resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("scim %s: %v", path, err)
+		}
+		all = append(all, page.Resources...)
+		start += len(page.Resources)
+		if len(page.Resources) == 0 || start > page.TotalResults {
+			return all, nil
+		}
+	}
+}
+
+// syncSCIM fetches users and groups from the identity provider and
+// replaces the synced state.
+func syncSCIM(ctx context.Context) (*scimState, error) {
+	sc := config.SCIM
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	users, err := scimList[scimUser](ctx, sc, "Users")
+	if err != nil {
+		return nil, err
+	}
+	groups, err := scimList[scimGroup](ctx, sc, "Groups")
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string, len(users))
+	for _, u := range users {
+		if u.Active == nil || *u.Active {
+			names[u.ID] = u.UserName
+		}
+	}
+
+	st := &scimState{
+		SyncedAt: time.Now().UTC(),
+		Teams:    make(map[string][]string),
+		ACL:      []ACLRule{},
+		byUser:   make(map[string][]string),
+	}
+	for _, g := range groups {
+		members := []string{}
+		for _, m := range g.Members {
+			if name, ok := names[m.Value]; ok {
+				members = append(members, name)
+				st.byUser[name] = append(st.byUser[name], g.DisplayName)
+			}
+		}
+		sort.Strings(members)
+		st.Teams[g.DisplayName] = members
+
+		if sc.PrefixTemplate != "" {
+			prefix := strings.ReplaceAll(sc.PrefixTemplate, "{team}", strings.ToLower(g.DisplayName))
+			st.ACL = append(st.ACL, ACLRule{Prefix: prefix, Groups: []string{g.DisplayName}})
+		}
+	}
+	for _, tm := range sc.Teams {
+		for _, p := range tm.Prefixes {
+			st.ACL = append(st.ACL, ACLRule{Prefix: p, Groups: []string{tm.Team}})
+		}
+	}
+
+	scimMu.Lock()
+	scimLast = st
+	scimMu.Unlock()
+	slog.InfoContext(ctx, "scim: synced", "teams", len(st.Teams), "users", len(st.byUser))
+	return st, nil
+}
+
+// startSCIMSync runs the SCIM sync on the configured interval.
+func startSCIMSync() {
+	sc := config.SCIM
+	if sc.URL == "" {
+		return
+	}
+	interval := sc.Interval
+	if interval == 0 {
+		interval = 15 * time.Minute
+	}
+	go func() {
+		for {
+			if _, err := syncSCIM(context.Background()); err != nil {
+				slog.Error("scim sync", "err", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// getSCIM serves GET /admin/scim, the last synced state.
+func getSCIM(w http.ResponseWriter, r *http.Request) {
+	scimMu.Lock()
+	st := scimLast
+	scimMu.Unlock()
+	if st == nil {
+		http.Error(w, "not synced yet", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// postSCIMSync serves POST /admin/scim/sync, syncing immediately.
+func postSCIMSync(w http.ResponseWriter, r *http.Request) {
+	if config.SCIM.URL == "" {
+		http.Error(w, "scim is not configured", http.StatusNotFound)
+		return
+	}
+	st, err := syncSCIM(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// hasQuotas reports whether sc limits the downloads of any team.
+func hasQuotas(sc SCIMConfig) bool {
+	for _, tm := range sc.Teams {
+		if tm.DailyDownloads > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// dailyQuota returns the zip download limit of identity: the largest
+// limit among its teams that have one, or 0 for unlimited.
+func dailyQuota(identity string) int {
+	teams := teamsOf(identity)
+	limit := 0
+	for _, tm := range config.SCIM.Teams {
+		if tm.DailyDownloads <= 0 {
+			continue
+		}
+		for _, t := range teams {
+			if strings.EqualFold(t, tm.Team) && tm.DailyDownloads > limit {
+				limit = tm.DailyDownloads
+			}
+		}
+	}
+	return limit
+}
+
+var downloads = struct {
+	sync.Mutex
+	day    string
+	counts map[string]int
+}{counts: make(map[string]int)}
+
+// enforceQuota is router middleware counting zip downloads against the
+// caller's daily quota. A .sum request counts as one, since it fills and
+// reads the zip.
+func enforceQuota(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := callerFrom(r.Context())
+		if ext := mux.Vars(r)["ext"]; (ext != "zip" && ext != "sum") || c == anonymous {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limit := dailyQuota(c.Identity)
+		if limit == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		day := time.Now().UTC().Format(time.DateOnly)
+		downloads.Lock()
+		if downloads.day != day {
+			downloads.day, downloads.counts = day, make(map[string]int)
+		}
+		n := downloads.counts[c.Identity] + 1
+		if n <= limit {
+			downloads.counts[c.Identity] = n
+		}
+		downloads.Unlock()
+
+		if n > limit {
+			w.Header().Set("Retry-After", fmt.Sprint(secondsUntilMidnight()))
+			http.Error(w, fmt.Sprintf("%s exceeded the daily quota of %d downloads", c.Identity, limit), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func secondsUntilMidnight() int {
+	now := time.Now().UTC()
+	midnight := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+	return int(midnight.Sub(now).Seconds()) + 1
+}
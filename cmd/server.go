@@ -0,0 +1,287 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gorilla/mux"
+)
+
+// Server is the proxy's configuration and the dependencies built from
+// it. newServer builds everything from the environment and config file
+// without touching package state, so a bad configuration fails before
+// anything is published; install then publishes it, once, before any
+// goroutine starts.
+//
+// Server is not handed to the handlers: install copies it into package
+// variables (Listen, CacheDir, SrcRepo, DestRepo, user, config,
+// configFile, store, bus, cacheNS and the workspace), which the
+// handlers and helpers read. There is therefore one proxy per process,
+// and install refuses a second Server rather than let it overwrite the
+// first one's state. The package variables are written only by install
+// and are read-only afterwards. The routing
+// table (the mappings, mounts, default upstream and client tokens) is
+// stored by install and replaced whole by reload; see reload.go. State
+// that changes while serving (blocks, quarantine, version lists, commit
+// graphs, mirror jobs, group and SCIM caches, the exec log, in-flight
+// fetches) is owned by the file that declares it and guarded by the
+// mutex declared next to it; nothing else may touch it directly.
+type Server struct {
+	Listen     string
+	CacheDir   string
+	ConfigFile string
+	Config     Config
+
+	// Mapping maps SRC_REPO to DEST_REPO, accessed with REPO_TOKEN as
+	// RepoUser.
+	Mapping  repoMapping
+	RepoUser string
+	Upstream backend
+	Store    remoteStore
+	Bus      clusterBus
+
+	// TLS selects HTTPS; the zero value serves plain HTTP.
+	TLS TLSOptions
+
+	getenv func(string) string // for reload
+}
+
+// newServer reads the startup settings (see settings) with getenv,
+// falling back to the config file named by CONFIG_FILE, checks them and
+// builds the backend, remote store and cluster bus.
+func newServer(getenv func(string) string) (*Server, error) {
+	s := &Server{ConfigFile: getenv("CONFIG_FILE"), getenv: getenv}
+	var err error
+	if s.Config, err = loadConfig(s.ConfigFile); err != nil {
+		return nil, fmt.Errorf("loading config: %v", err)
+	}
+	c := &s.Config
+	useGit := c.Backend.Type == "" || c.Backend.Type == "git"
+
+	s.Listen = getenv("LISTEN_ADDR")
+	if port := getenv("PORT"); s.Listen == "" && port != "" {
+		s.Listen = ":" + port
+	}
+	if s.Listen == "" {
+		s.Listen = cmp.Or(c.Listen, ":8078")
+	}
+	s.CacheDir = cmp.Or(settingFrom(getenv, "CACHE_DIR", c.CacheDir), "/tmp/cache")
+	s.Mapping = repoMapping{
+		Src:   removeSchemeAndTrailingSlash(settingFrom(getenv, "SRC_REPO", c.SrcRepo)),
+		Dest:  removeSchemeAndTrailingSlash(settingFrom(getenv, "DEST_REPO", c.DestRepo)),
+		Token: settingFrom(getenv, "REPO_TOKEN", c.RepoToken),
+	}
+	s.RepoUser = cmp.Or(settingFrom(getenv, "REPO_USER", c.RepoUser), "dummy")
+	if err := s.checkSettings(useGit); err != nil {
+		return nil, fmt.Errorf("invalid settings:\n%v", err)
+	}
+
+	if s.Store, err = newRemoteStore(s.Config.Storage); err != nil {
+		return nil, fmt.Errorf("configuring storage: %v", err)
+	}
+	if s.Bus, err = newBus(s.Config.Cluster); err != nil {
+		return nil, fmt.Errorf("configuring cluster bus: %v", err)
+	}
+	if s.Upstream, err = newBackend(s.Config.Backend, s.Mapping); err != nil {
+		return nil, fmt.Errorf("configuring backend: %v", err)
+	}
+	return s, nil
+}
+
+// install publishes s as the process's configuration and builds the
+// state derived from it: the mappings, mounts, workspace, sanitizer,
+// blocks and the cache directory. It may be called only once per
+// process.
+func (s *Server) install() error {
+	if current != nil {
+		return fmt.Errorf("a server is already installed in this process")
+	}
+	current = s
+
+	config, configFile = s.Config, s.ConfigFile
+	CacheDir = s.CacheDir
+	Listen = s.Listen
+	user = s.RepoUser
+	SrcRepo, DestRepo = s.Mapping.Src, s.Mapping.Dest
+	cacheNS = namespaceFor(s.Config.Backend)
+
+	if err := setupLogging(s.Config.Log); err != nil {
+		return fmt.Errorf("configuring logging: %v", err)
+	}
+	store, bus = s.Store, s.Bus
+
+	if err := os.MkdirAll(CacheDir, 0755); err != nil {
+		return fmt.Errorf("creating cache: %v", err)
+	}
+	if err := loadBlocks(); err != nil {
+		return fmt.Errorf("loading blocks: %v", err)
+	}
+	if err := loadStats(); err != nil {
+		return fmt.Errorf("loading download stats: %v", err)
+	}
+	if err := setupSanitizer(s.Config.Sanitize); err != nil {
+		return fmt.Errorf("configuring error sanitization: %v", err)
+	}
+	if err := checkNotice(s.Config.Notice); err != nil {
+		return err
+	}
+	t, err := buildRouting(s.Config, s.Mapping, s.Upstream)
+	if err != nil {
+		return err
+	}
+	routing.Store(t)
+	// Legacy entries are checked against the upstreams.
+	if err := migrateLegacyCache(); err != nil {
+		return err
+	}
+	if err := setupWorkspace(s.Config.Workspace); err != nil {
+		return fmt.Errorf("configuring workspace: %v", err)
+	}
+	setupMetaCache(s.Config.ListCache)
+	if err := checkUnknownModuleList(s.Config.UnknownModuleList); err != nil {
+		return err
+	}
+	setupHotCache(s.Config.ResponseCache)
+	if err := setupTracing(s.Config.Tracing); err != nil {
+		return fmt.Errorf("configuring tracing: %v", err)
+	}
+	if err := checkHideRules(s.Config.HideVersions); err != nil {
+		return fmt.Errorf("configuring hidden versions: %v", err)
+	}
+	if err := checkRenames(s.Config.Renames); err != nil {
+		return err
+	}
+	if err := checkMetrics(s.Config.Metrics); err != nil {
+		return err
+	}
+	if err := setupMaintenance(s.Config.Maintenance); err != nil {
+		return fmt.Errorf("configuring maintenance mode: %v", err)
+	}
+	if err := setupPriority(s.Config.Priority); err != nil {
+		return fmt.Errorf("configuring priority classes: %v", err)
+	}
+	if err := setupSubprocesses(s.Config.MaxSubprocesses); err != nil {
+		return err
+	}
+	if err := checkOIDC(s.Config.OIDC); err != nil {
+		return err
+	}
+	if err := checkClientCerts(s.Config.ClientCerts); err != nil {
+		return err
+	}
+	if err := setupTokensFile(s.Config.TokensFile); err != nil {
+		return fmt.Errorf("loading tokens: %v", err)
+	}
+	if err := checkHealthConfig(s.Config.Health); err != nil {
+		return err
+	}
+	if err := checkWarm(s.Config.Warm); err != nil {
+		return err
+	}
+	if err := checkSumDB(s.Config.SumDB); err != nil {
+		return err
+	}
+	if err := setupChecksumDB(s.Config.ChecksumDB); err != nil {
+		return err
+	}
+	if err := checkOwnerReports(s.Config.OwnerReports); err != nil {
+		return err
+	}
+	if err := checkTelemetry(s.Config.Telemetry); err != nil {
+		return err
+	}
+	if err := checkEviction(s.Config.Eviction); err != nil {
+		return fmt.Errorf("configuring eviction: %v", err)
+	}
+	if err := checkBuilds(s.Config.Builds); err != nil {
+		return err
+	}
+	if err := checkToolchain(s.Config.Toolchain); err != nil {
+		return fmt.Errorf("preflight: %v", err)
+	}
+	t.handler = s.handlerFor(t)
+	// Events apply to the state set up above, so they are received
+	// only from here on.
+	startBus(s.Bus)
+	return nil
+}
+
+// Handler returns the proxy's root handler, which serves each request
+// with the router of the current routing table.
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes().handler.ServeHTTP(w, r)
+	})
+}
+
+// handlerFor returns the router of t: the admin and API routes, the
+// mounts and the default module routes, behind the global middleware.
+func (s *Server) handlerFor(t *routingTable) http.Handler {
+	router := mux.NewRouter()
+	router.Use(traceRequests)
+	router.Use(instrument)
+	router.Use(globalChain()...)
+	router.HandleFunc("/metrics", serveMetrics).Methods(http.MethodGet)
+	router.HandleFunc("/healthz", serveHealthz).Methods(http.MethodGet)
+	router.HandleFunc("/readyz", serveReadyz).Methods(http.MethodGet)
+	registerAdminRoutes(router.PathPrefix("/admin").Subrouter())
+	registerAPIRoutes(router.PathPrefix("/api").Subrouter())
+	registerSumDBRoutes(router.PathPrefix("/sumdb").Subrouter())
+	registerHookRoutes(router.PathPrefix("/hooks").Subrouter())
+	router.HandleFunc("/setup", serveSetup).Methods(http.MethodGet)
+
+	for _, m := range t.mounts {
+		registerSumDBRoutes(router.PathPrefix(m.Path + "/sumdb").Subrouter())
+		registerModuleRoutes(router.PathPrefix(m.Path).Subrouter(), m.Path, t.srcsOf(m), m.authorize)
+	}
+	registerModuleRoutes(router.PathPrefix("/").Subrouter(), "/", t.srcs(), dualStackPaths)
+	return withRequestID(sanitizeErrors(identify(guardPrivate(honeytokens(router)))))
+}
+
+// Run starts the background jobs and serves until the listener fails,
+// or until SIGTERM or SIGINT, after which it drains; see shutdown.
+func (s *Server) Run() error {
+	slog.Info("cache directory", "dir", s.CacheDir)
+	slog.Info("starting server", "listen", s.Listen, "tls", s.TLS.enabled())
+
+	startUsageReports()
+	startStats()
+	startOwnerReports()
+	startTelemetry()
+	startEviction()
+	startBuildSweep()
+	startVerification()
+	startSCIMSync()
+	resumeJobs()
+	startWarm()
+	startLegacyPush()
+	s.reloadOnSIGHUP()
+
+	srv := newHTTPServer(s.Listen, s.Handler())
+	serve := srv.ListenAndServe
+	if s.TLS.enabled() {
+		if err := configureTLS(srv, s.TLS); err != nil {
+			return err
+		}
+		serve = func() error { return srv.ListenAndServeTLS("", "") }
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	errc := make(chan error, 1)
+	go func() { errc <- serve() }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	stop() // a second signal exits at once
+	s.shutdown(srv)
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// The benchmarks serve synthetic modules from a fake version control
+// system through the proxy's whole handler, middleware included, with
+// a fresh cache per benchmark; go run ./bench measures the same paths
+// against the proxy binary.
+//
+//	go test -run '^$' -bench . ./cmd
+
+const benchSrc = "bench.example"
+
+// keepState restores, when tb ends, the package state that install
+// publishes and the routing table, so that a test may install a Server
+// or set the variables it needs.
+func keepState(tb testing.TB) {
+	c, cf, dir, ns, routes, st, b, ws, cur := config, configFile, CacheDir, cacheNS, routing.Load(), store, bus, workspace, current
+	listen, u, src, dest := Listen, user, SrcRepo, DestRepo
+	tb.Cleanup(func() {
+		config, configFile, CacheDir, cacheNS, store, bus, workspace, current = c, cf, dir, ns, st, b, ws, cur
+		Listen, user, SrcRepo, DestRepo = listen, u, src, dest
+		routing.Store(routes)
+	})
+}
+
+func TestInstallOnce(t *testing.T) {
+	keepState(t)
+	first := &Server{CacheDir: t.TempDir()}
+	current, CacheDir = first, first.CacheDir
+	if err := (&Server{CacheDir: t.TempDir()}).install(); err == nil {
+		t.Fatal("second server installed")
+	}
+	if current != first || CacheDir != first.CacheDir {
+		t.Error("refused server published its state")
+	}
+}
+
+// fakeVCS is a repository host whose every repository has tags v1.0.0
+// to v1.0.<tags-1>, and whose every tag, and any other version asked
+// for, holds the fixture tree at src.
+type fakeVCS struct {
+	repoMapping
+	src  string
+	tags int
+}
+
+func (v fakeVCS) List(ctx context.Context, name string) ([]string, error) {
+	if _, err := v.repoURL(name); err != nil {
+		return nil, err
+	}
+	var tags []string
+	for i := range v.tags {
+		tags = append(tags, fmt.Sprintf("v1.0.%d", i))
+	}
+	return tags, nil
+}
+
+func (v fakeVCS) Fetch(ctx context.Context, name, version, destDir string, policy FetchPolicy) error {
+	path, err := module.UnescapePath(name)
+	if err != nil {
+		return err
+	}
+	return writeDirArtifacts(path, version, v.src, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), destDir, policy)
+}
+
+// writeFixture writes a module tree of about kb KiB of Go source to dir.
+func writeFixture(tb testing.TB, dir string, kb int) {
+	tb.Helper()
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i*16 < kb; i++ {
+		var sb strings.Builder
+		sb.WriteString("package fixture\n\n")
+		for sb.Len() < 16<<10 {
+			fmt.Fprintf(&sb, "const c%d = %d\n", rng.Int63(), rng.Int63())
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d.go", i)), []byte(sb.String()), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// benchProxy installs a proxy serving fakeVCS from a fresh cache and
+// returns its handler.
+func benchProxy(b *testing.B) http.Handler {
+	b.Helper()
+	keepState(b)
+	b.Cleanup(func() { entries.forget(benchSrc+"/mod", "") })
+
+	work := b.TempDir()
+	src := filepath.Join(work, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		b.Fatal(err)
+	}
+	writeFixture(b, src, 256)
+	cfg := filepath.Join(work, "config.yaml")
+	if err := os.WriteFile(cfg, []byte("backend:\n  type: directory\n  dir: "+src+"\nlog:\n  level: error\n"), 0644); err != nil {
+		b.Fatal(err)
+	}
+	env := map[string]string{
+		"CACHE_DIR":   filepath.Join(work, "cache"),
+		"CONFIG_FILE": cfg,
+		"SRC_REPO":    benchSrc,
+	}
+	s, err := newServer(func(k string) string { return env[k] })
+	if err != nil {
+		b.Fatal(err)
+	}
+	s.Upstream = fakeVCS{s.Mapping, src, 10}
+	if err := s.install(); err != nil {
+		b.Fatal(err)
+	}
+	return s.Handler()
+}
+
+// get serves a GET of path with h and returns an error unless it is
+// answered 200.
+func get(h http.Handler, path string) error {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Code != http.StatusOK {
+		return fmt.Errorf("GET %s: %d %s", path, w.Code, w.Body)
+	}
+	io.Copy(io.Discard, w.Body)
+	return nil
+}
+
+// BenchmarkFill measures cache misses: every iteration fetches a new
+// version from the fake VCS.
+func BenchmarkFill(b *testing.B) {
+	h := benchProxy(b)
+	b.ResetTimer()
+	for i := range b.N {
+		if err := get(h, fmt.Sprintf("/%s/mod/@v/v0.1.%d.zip", benchSrc, i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkServe measures hits on each endpoint, with parallel clients
+// asking for the versions of one module.
+func BenchmarkServe(b *testing.B) {
+	h := benchProxy(b)
+	for v := range 10 {
+		if err := get(h, fmt.Sprintf("/%s/mod/@v/v1.0.%d.zip", benchSrc, v)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for _, file := range []string{"list", "info", "mod", "zip"} {
+		b.Run(file, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for v := 0; pb.Next(); v++ {
+					path := fmt.Sprintf("/%s/mod/@v/v1.0.%d.%s", benchSrc, v%10, file)
+					if file == "list" {
+						path = "/" + benchSrc + "/mod/@v/list"
+					}
+					if err := get(h, path); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
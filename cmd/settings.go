@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// The startup settings, which say where to listen, where to cache and
+// what to mirror from where, can each be given as a flag, an environment
+// variable or a key of the config file. A flag on the command line wins
+// over the environment variable, which wins over the config file, which
+// wins over the built-in default; an empty value counts as unset. They
+// are all checked before anything starts, and every problem is reported
+// at once, naming the three ways to fix it.
+
+// setting is a startup setting.
+type setting struct {
+	flag, env, key string
+	usage          string
+}
+
+var settings = []setting{
+	{"config", "CONFIG_FILE", "", "YAML config file"},
+	{"listen", "LISTEN_ADDR", "listen", "address to serve on (default :8078, or :$PORT)"},
+	{"cache-dir", "CACHE_DIR", "cache_dir", "directory of the module cache (default /tmp/cache)"},
+	{"src-repo", "SRC_REPO", "src_repo", "module path prefix the proxy serves, e.g. pegasus-cloud.com/aes"},
+	{"dest-repo", "DEST_REPO", "dest_repo", "repository prefix the modules are cloned from, e.g. github.com/trusted-cloud"},
+	{"repo-token", "REPO_TOKEN", "repo_token", "token to clone the repositories with (prefer the environment variable)"},
+	{"repo-user", "REPO_USER", "repo_user", "user name sent with the token (default dummy)"},
+}
+
+// settingFlags defines the flags of the startup settings on fs and
+// returns getenv with the flags set on the command line applied, for
+// newServer to read the settings with.
+func settingFlags(fs *flag.FlagSet, getenv func(string) string) func(string) string {
+	for _, st := range settings {
+		fs.String(st.flag, "", fmt.Sprintf("%s (env %s)", st.usage, st.env))
+	}
+	return func(env string) string {
+		v := getenv(env)
+		for _, st := range settings {
+			if st.env != env {
+				continue
+			}
+			fs.Visit(func(f *flag.Flag) {
+				if f.Name == st.flag {
+					v = f.Value.String()
+				}
+			})
+		}
+		return v
+	}
+}
+
+// settingFrom returns the setting read by env, from getenv or, failing
+// that, from the config file's value.
+func settingFrom(getenv func(string) string, env, fromFile string) string {
+	if v := getenv(env); v != "" {
+		return v
+	}
+	return fromFile
+}
+
+// unsetError reports that the setting read by env is missing.
+func unsetError(env string) error {
+	for _, st := range settings {
+		if st.env == env {
+			return fmt.Errorf("%s not set: use --%s, %s or %s in the config file", strings.ToLower(strings.ReplaceAll(st.key, "_", " ")), st.flag, st.env, st.key)
+		}
+	}
+	return fmt.Errorf("%s not set", env)
+}
+
+// checkSettings validates the startup settings of s; useGit requires
+// the destination repository and its token.
+func (s *Server) checkSettings(useGit bool) error {
+	var errs []error
+	if _, port, err := net.SplitHostPort(s.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen address %q: %v", s.Listen, err))
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		errs = append(errs, fmt.Errorf("listen address %q: port must be a number from 0 to 65535", s.Listen))
+	}
+
+	if fi, err := os.Stat(s.CacheDir); err == nil && !fi.IsDir() {
+		errs = append(errs, fmt.Errorf("cache dir %s is not a directory", s.CacheDir))
+	}
+
+	switch src := s.Mapping.Src; {
+	case src == "":
+		errs = append(errs, unsetError("SRC_REPO"))
+	case module.CheckImportPath(src) != nil:
+		errs = append(errs, fmt.Errorf("src repo %q is not a module path prefix: %v", src, module.CheckImportPath(src)))
+	}
+	switch dest := s.Mapping.Dest; {
+	case dest == "" && useGit:
+		errs = append(errs, unsetError("DEST_REPO"))
+	case dest != "":
+		if u, err := url.Parse("https://" + dest); err != nil || u.Host == "" || u.RawQuery != "" || u.Fragment != "" || strings.Contains(dest, " ") {
+			errs = append(errs, fmt.Errorf("dest repo %q is not a repository URL prefix, e.g. github.com/trusted-cloud", dest))
+		}
+	}
+	if s.Mapping.Token == "" && useGit {
+		errs = append(errs, unsetError("REPO_TOKEN"))
+	}
+	if strings.Contains(s.RepoUser, ":") {
+		errs = append(errs, fmt.Errorf("repo user %q must not contain a colon", s.RepoUser))
+	}
+	return errors.Join(errs...)
+}
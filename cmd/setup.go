@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Setting up a go client for this proxy takes knowing which module
+// paths it rewrites, which mounts serve what, and how checksums are
+// verified, all of which follow from the configuration. GET /setup
+// derives the go environment from the running configuration for the
+// caller: mounts the caller may not use are left out.
+//
+// Modules the proxy serves must still be fetched through it, so they
+// are listed in GOPRIVATE, which turns off the checksum database for
+// them, with GONOPROXY=none overriding GOPRIVATE's default of fetching
+// them directly. With a private checksum database that also covers
+// public modules, GOSUMDB names it instead and nothing is private.
+
+// SetupConfig configures the client setup endpoint.
+type SetupConfig struct {
+	// URL is the proxy's address as clients reach it (default: taken
+	// from the request, honoring X-Forwarded-Proto and -Host).
+	URL string `yaml:"url"`
+
+	// Fallback is appended to GOPROXY for the modules the proxy does
+	// not serve (default "https://proxy.golang.org,direct"); "off"
+	// appends nothing.
+	Fallback string `yaml:"fallback"`
+}
+
+// clientSetup is the response of /setup?format=json.
+type clientSetup struct {
+	Identity string            `json:"identity"`
+	Env      map[string]string `json:"env"`
+	Notes    []string          `json:"notes,omitempty"`
+}
+
+// setupURL returns the base URL clients reach the proxy at.
+func setupURL(r *http.Request) string {
+	if u := config.Setup.URL; u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); p == "http" || p == "https" {
+		scheme = p
+	}
+	host := r.Host
+	if h := r.Header.Get("X-Forwarded-Host"); h != "" {
+		host, _, _ = strings.Cut(h, ",")
+		host = strings.TrimSpace(host)
+	}
+	return scheme + "://" + host
+}
+
+// buildSetup derives the go environment for the caller of r.
+func buildSetup(r *http.Request) clientSetup {
+	c := callerFrom(r.Context())
+	base := setupURL(r)
+	s := clientSetup{Identity: c.Identity, Env: make(map[string]string)}
+
+	proxies := []string{base}
+	served := mappedSrcs()
+	for _, m := range routes().mounts {
+		if !m.ownsUpstream() || !m.allows(c) {
+			continue
+		}
+		proxies = append(proxies, base+m.Path)
+		served = append(served, m.mapping.Src)
+	}
+	switch fb := config.Setup.Fallback; fb {
+	case "":
+		proxies = append(proxies, "https://proxy.golang.org", "direct")
+	case "off":
+	default:
+		proxies = append(proxies, fb)
+	}
+	s.Env["GOPROXY"] = strings.Join(proxies, ",")
+
+	private := slices.Concat(served, config.PrivatePrefixes)
+	slices.Sort(private)
+	private = slices.Compact(private)
+	s.Env["GOPRIVATE"] = strings.Join(private, ",")
+	s.Env["GONOPROXY"] = "none"
+	if sumDBURL("sum.golang.org") != "" {
+		s.Notes = append(s.Notes, "public modules are verified against sum.golang.org through this proxy")
+	}
+
+	if u, err := url.Parse(base); err == nil && u.Hostname() != "" {
+		switch {
+		case c == anonymous && config.RequireAuth:
+			s.Notes = append(s.Notes, "this proxy requires a token; ask an administrator for one")
+		case c == anonymous:
+		case config.OIDC.Issuer != "":
+			s.Notes = append(s.Notes, "set GOAUTH to a command printing an Authorization header with your identity provider's token for "+u.Hostname())
+		default:
+			s.Notes = append(s.Notes, fmt.Sprintf("add to ~/.netrc: machine %s login %s password <your token>", u.Hostname(), c.Identity))
+		}
+	}
+	return s
+}
+
+// serveSetup serves GET /setup: shell exports of the go environment
+// for this proxy, or JSON with ?format=json.
+func serveSetup(w http.ResponseWriter, r *http.Request) {
+	s := buildSetup(r)
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, s)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, "# Go environment for %s, generated %s.\n", s.Identity, time.Now().UTC().Format(time.RFC3339))
+	for _, n := range s.Notes {
+		fmt.Fprintf(w, "# %s\n", n)
+	}
+	for _, k := range sortedKeys(s.Env) {
+		fmt.Fprintf(w, "export %s=%s\n", k, shellQuote(s.Env[k]))
+	}
+}
+
+// shellQuote quotes v for a POSIX shell if it needs it.
+func shellQuote(v string) string {
+	if v != "" && strings.Trim(v, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789,.:/_-+=@") == "" {
+		return v
+	}
+	return "'" + strings.ReplaceAll(v, "'", `'\''`) + "'"
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// On SIGTERM or SIGINT the proxy drains instead of dying mid-download:
+// it stops accepting connections, lets the requests in flight finish,
+// then waits for the fills and subprocesses that outlive their requests
+// (warm-up, webhook prefetches, mirror jobs, scans), all within
+// shutdown_timeout. Whatever is still running then is logged and
+// canceled, which kills the subprocesses of fills, and once they have
+// exited the temporary directories of clones and verifications are
+// removed, so a killed fetch leaves nothing in /tmp. A second signal
+// during the drain exits at once.
+
+// inFlight counts the work a shutdown waits for.
+var inFlight struct {
+	fills, procs atomic.Int64
+}
+
+// baseCtx is canceled when a shutdown gives up waiting. Fills derive
+// their contexts from it through detached.
+var baseCtx, cancelBase = context.WithCancel(context.Background())
+
+// tempDirs are the temporary directories in use, removed on shutdown.
+var tempDirs = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// mkdirTemp is os.MkdirTemp in the system temporary directory, with the
+// directory removed on shutdown if removeTemp was not called by then.
+func mkdirTemp(pattern string) (string, error) {
+	dir, err := os.MkdirTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	tempDirs.Lock()
+	tempDirs.m[dir] = true
+	tempDirs.Unlock()
+	return dir, nil
+}
+
+// removeTemp removes dir, made by mkdirTemp.
+func removeTemp(dir string) {
+	os.RemoveAll(dir)
+	tempDirs.Lock()
+	delete(tempDirs.m, dir)
+	tempDirs.Unlock()
+}
+
+// shutdown drains srv and the work in flight, bounded by
+// shutdown_timeout, removes the temporary directories and saves the
+// download statistics.
+func (s *Server) shutdown(srv *http.Server) {
+	timeout := config.ShutdownTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	slog.Info("shutting down", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("shutdown: requests still running at the deadline", "err", err)
+	}
+	if !waitInFlight(ctx) {
+		slog.Warn("shutdown: canceling work at the deadline", "fills", inFlight.fills.Load(), "subprocesses", inFlight.procs.Load())
+		cancelBase()
+		// Killed subprocesses are waited for at most waitDelay.
+		kctx, kcancel := context.WithTimeout(context.Background(), waitDelay+time.Second)
+		if !waitInFlight(kctx) {
+			slog.Warn("shutdown: work still running after cancellation", "fills", inFlight.fills.Load(), "subprocesses", inFlight.procs.Load())
+		}
+		kcancel()
+	}
+
+	tempDirs.Lock()
+	for dir := range tempDirs.m {
+		os.RemoveAll(dir)
+	}
+	tempDirs.Unlock()
+	if err := saveStats(); err != nil {
+		slog.Error("shutdown: saving download stats", "err", err)
+	}
+	slog.Info("shut down")
+}
+
+// waitInFlight waits until no fills or subprocesses are running and
+// reports whether that happened before ctx was done.
+func waitInFlight(ctx context.Context) bool {
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for inFlight.fills.Load() > 0 || inFlight.procs.Load() > 0 {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCancelBaseStopsFills(t *testing.T) {
+	oldCtx, oldCancel := baseCtx, cancelBase
+	defer func() { baseCtx, cancelBase = oldCtx, oldCancel }()
+	baseCtx, cancelBase = context.WithCancel(context.Background())
+
+	g := &flightGroup{m: make(map[string]*flight)}
+	started := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- g.do(context.Background(), "example.com/m@v1.0.0", func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}()
+	<-started
+	if n := inFlight.fills.Load(); n != 1 {
+		t.Errorf("%d fills in flight, want 1", n)
+	}
+	cancelBase()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("fill returned %v, want canceled", err)
+	}
+	if n := inFlight.fills.Load(); n != 0 {
+		t.Errorf("%d fills in flight after cancellation, want 0", n)
+	}
+	if !waitInFlight(context.Background()) {
+		t.Error("waitInFlight gave up")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// SignedURLConfig enables time-limited download links. A signed URL
+// carries expires, by (the admin who signed it) and sig, an HMAC-SHA256
+// under Key of the path, expiry and signer. It grants access to exactly
+// one artifact without credentials, bypassing ACLs and the external
+// policy; quarantine still applies.
+type SignedURLConfig struct {
+	Key    string        `yaml:"key"`
+	MaxTTL time.Duration `yaml:"max_ttl"`
+}
+
+// signable matches the artifact paths a URL may be signed for.
+var signable = regexp.MustCompile(`^/.+/@v/[^/]+\.(info|mod|zip)$`)
+
+func urlSignature(key, path string, expires int64, by string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%d\n%s", path, expires, by)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedCaller returns the caller for a request bearing a valid URL
+// signature, nil if the request is not signed, or an error if it is
+// signed but the signature is invalid or expired.
+func signedCaller(r *http.Request) (*caller, error) {
+	q := r.URL.Query()
+	sig := q.Get("sig")
+	if sig == "" {
+		return nil, nil
+	}
+	key := config.SignedURLs.Key
+	if key == "" || r.Method != http.MethodGet || !signable.MatchString(r.URL.Path) {
+		return nil, fmt.Errorf("signed URLs are not accepted for %s", r.URL.Path)
+	}
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expires")
+	}
+	by := q.Get("by")
+	want := urlSignature(key, r.URL.Path, expires, by)
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	if time.Now().Unix() > expires {
+		return nil, fmt.Errorf("signed URL expired")
+	}
+	return &caller{Identity: "signed-url:" + by, signed: true}, nil
+}
+
+// postSign serves POST /admin/sign?path=<artifact path>&ttl=<duration>,
+// returning a signed URL for the artifact.
+func postSign(w http.ResponseWriter, r *http.Request) {
+	sc := config.SignedURLs
+	if sc.Key == "" {
+		http.Error(w, "signed URLs are not configured", http.StatusNotFound)
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if !signable.MatchString(path) {
+		http.Error(w, "path must name a .info, .mod or .zip file", http.StatusBadRequest)
+		return
+	}
+
+	maxTTL := sc.MaxTTL
+	if maxTTL == 0 {
+		maxTTL = 24 * time.Hour
+	}
+	ttl := time.Hour
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	if ttl > maxTTL {
+		http.Error(w, fmt.Sprintf("ttl exceeds the maximum of %s", maxTTL), http.StatusBadRequest)
+		return
+	}
+
+	by := callerFrom(r.Context()).Identity
+	expires := time.Now().Add(ttl).Unix()
+	q := url.Values{
+		"expires": {strconv.FormatInt(expires, 10)},
+		"by":      {by},
+		"sig":     {urlSignature(sc.Key, path, expires, by)},
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"url":     path + "?" + q.Encode(),
+		"expires": time.Unix(expires, 0).UTC(),
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// signedQuery returns the query of a URL for path signed with key.
+func signedQuery(key, path string, expires time.Time, by string) string {
+	e := expires.Unix()
+	return url.Values{"expires": {strconv.FormatInt(e, 10)}, "by": {by}, "sig": {urlSignature(key, path, e, by)}}.Encode()
+}
+
+func TestSignedCaller(t *testing.T) {
+	keepState(t)
+	config.SignedURLs = SignedURLConfig{Key: "k1"}
+	zip := "/example.com/secret/@v/v1.0.0.zip"
+	later := time.Now().Add(time.Hour)
+	for _, tt := range []struct {
+		name   string
+		method string
+		target string
+		err    string // substring of the error, "" if accepted
+	}{
+		{"valid", "GET", zip + "?" + signedQuery("k1", zip, later, "admin"), ""},
+		{"expired", "GET", zip + "?" + signedQuery("k1", zip, time.Now().Add(-time.Second), "admin"), "expired"},
+		{"other key", "GET", zip + "?" + signedQuery("k2", zip, later, "admin"), "invalid signature"},
+		{"other path", "GET", "/example.com/secret/@v/v1.0.1.zip?" + signedQuery("k1", zip, later, "admin"), "invalid signature"},
+		{"extended expiry", "GET", zip + "?" + strings.Replace(signedQuery("k1", zip, later, "admin"), "expires=", "expires=9", 1), "invalid signature"},
+		{"other signer", "GET", zip + "?" + strings.Replace(signedQuery("k1", zip, later, "admin"), "by=admin", "by=root", 1), "invalid signature"},
+		{"no expiry", "GET", zip + "?sig=" + urlSignature("k1", zip, 0, ""), "invalid expires"},
+		{"not an artifact", "GET", "/example.com/secret/@v/list?" + signedQuery("k1", "/example.com/secret/@v/list", later, "admin"), "not accepted"},
+		{"POST", "POST", zip + "?" + signedQuery("k1", zip, later, "admin"), "not accepted"},
+	} {
+		c, err := signedCaller(httptest.NewRequest(tt.method, tt.target, nil))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err == "" && (c == nil || !c.signed || c.Identity != "signed-url:admin"):
+			t.Errorf("%s: caller = %+v, want a signed caller by admin", tt.name, c)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got %v, want an error containing %q", tt.name, err, tt.err)
+		}
+	}
+
+	if c, err := signedCaller(httptest.NewRequest("GET", zip, nil)); c != nil || err != nil {
+		t.Errorf("unsigned request: signedCaller = %v, %v, want neither", c, err)
+	}
+	config.SignedURLs.Key = ""
+	if _, err := signedCaller(httptest.NewRequest("GET", zip+"?"+signedQuery("", zip, later, "admin"), nil)); err == nil {
+		t.Error("URL signed with the empty key accepted while signed URLs are off")
+	}
+}
+
+// TestSignedURLBypassesACL checks that a URL signed by postSign serves
+// its artifact to an anonymous caller past the ACL and the policy, and
+// nothing else.
+func TestSignedURLBypassesACL(t *testing.T) {
+	keepState(t)
+	config.SignedURLs = SignedURLConfig{Key: "k1", MaxTTL: time.Hour}
+	config.ACL = []ACLRule{{Prefix: "example.com/secret", Identities: []string{"alice"}}}
+	config.Policy = PolicyConfig{URL: "http://127.0.0.1:1/v1/data/goproxy/allow"}
+	zip := "/example.com/secret/@v/v1.0.0.zip"
+
+	w := httptest.NewRecorder()
+	postSign(w, httptest.NewRequest("POST", "/admin/sign?ttl=2h&path="+url.QueryEscape(zip), nil).WithContext(withCaller(&caller{Identity: "alice"})))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("ttl above max_ttl: status %d, want 400", w.Code)
+	}
+	w = httptest.NewRecorder()
+	postSign(w, httptest.NewRequest("POST", "/admin/sign?path="+url.QueryEscape(zip), nil).WithContext(withCaller(&caller{Identity: "alice"})))
+	var signed struct{ URL string }
+	if err := json.NewDecoder(w.Body).Decode(&signed); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("sign: status %d, %v", w.Code, err)
+	}
+
+	r := mux.NewRouter()
+	r.Use(identify, enforcePolicy, enforceACL)
+	r.HandleFunc("/{module:.+}/@v/{version}.{ext}", func(w http.ResponseWriter, r *http.Request) {})
+	_, query, _ := strings.Cut(signed.URL, "?")
+	for target, want := range map[string]int{
+		signed.URL: http.StatusOK,
+		zip:        http.StatusServiceUnavailable, // the policy server is down
+		"/example.com/secret/@v/v1.0.0.mod?" + query: http.StatusForbidden,
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != want {
+			t.Errorf("GET %s: status %d, want %d", target, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// Download statistics tell which internal modules are actually used,
+// and by whom. Every zip served counts as a download of its version by
+// the caller's identity: the go command fetches .info and .mod files
+// while resolving versions it may never build, but a zip only for code
+// it compiles. The counts are kept in $CACHE_DIR/.stats.json, saved
+// every minute and on shutdown, and served at GET /admin/stats.
+
+// VersionStats counts the downloads of one module version.
+type VersionStats struct {
+	Downloads     int64            `json:"downloads"`
+	ByIdentity    map[string]int64 `json:"by_identity"`
+	FirstDownload time.Time        `json:"first_download"`
+	LastDownload  time.Time        `json:"last_download"`
+}
+
+var stats = struct {
+	sync.Mutex
+	since    time.Time
+	versions map[string]*VersionStats // keyed by module@version
+	dirty    bool
+}{versions: make(map[string]*VersionStats)}
+
+func statsPath() string {
+	return filepath.Join(CacheDir, ".stats.json")
+}
+
+// statsFile is the content of the stats file.
+type statsFile struct {
+	Since    time.Time                `json:"since"`
+	Versions map[string]*VersionStats `json:"versions"`
+}
+
+// loadStats reads the saved statistics; it must be called once before
+// the server starts.
+func loadStats() error {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.since = time.Now().UTC()
+	data, err := os.ReadFile(statsPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var f statsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("%s: %v", statsPath(), err)
+	}
+	if f.Versions != nil {
+		stats.since, stats.versions = f.Since, f.Versions
+	}
+	return nil
+}
+
+// saveStats writes the statistics if they changed since the last save.
+func saveStats() error {
+	stats.Lock()
+	defer stats.Unlock()
+	if !stats.dirty {
+		return nil
+	}
+	data, err := json.Marshal(statsFile{Since: stats.since, Versions: stats.versions})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(statsPath(), data); err != nil {
+		return err
+	}
+	stats.dirty = false
+	return nil
+}
+
+// startStats saves the statistics every minute.
+func startStats() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			if err := saveStats(); err != nil {
+				slog.Error("saving download stats", "err", err)
+			}
+		}
+	}()
+}
+
+// recordDownload counts a download of escaped module path name at
+// version by the caller of r.
+func recordDownload(r *http.Request, name, version string) {
+	path, err := module.UnescapePath(name)
+	if err != nil {
+		return
+	}
+	identity := callerFrom(r.Context()).Identity
+	now := time.Now().UTC()
+
+	stats.Lock()
+	defer stats.Unlock()
+	key := path + "@" + version
+	vs := stats.versions[key]
+	if vs == nil {
+		vs = &VersionStats{ByIdentity: make(map[string]int64), FirstDownload: now}
+		stats.versions[key] = vs
+	}
+	vs.Downloads++
+	vs.ByIdentity[identity]++
+	vs.LastDownload = now
+	stats.dirty = true
+}
+
+// ModuleStats summarizes the downloads of a module.
+type ModuleStats struct {
+	Module       string                   `json:"module"`
+	Downloads    int64                    `json:"downloads"`
+	ByIdentity   map[string]int64         `json:"by_identity"`
+	LastDownload time.Time                `json:"last_download"`
+	Versions     map[string]*VersionStats `json:"versions"`
+}
+
+// StatsReport is the response of GET /admin/stats.
+type StatsReport struct {
+	Since      time.Time      `json:"since"`
+	Downloads  int64          `json:"downloads"`
+	Identities int            `json:"identities"`
+	Modules    []*ModuleStats `json:"modules"`
+}
+
+// statsReport summarizes the downloads of the modules under prefix, or
+// of all modules, most downloaded first.
+func statsReport(prefix string) *StatsReport {
+	stats.Lock()
+	defer stats.Unlock()
+	rep := &StatsReport{Since: stats.since, Modules: []*ModuleStats{}}
+	identities := make(map[string]bool)
+	byModule := make(map[string]*ModuleStats)
+	for key, vs := range stats.versions {
+		i := strings.LastIndex(key, "@")
+		path, version := key[:i], key[i+1:]
+		if prefix != "" && !hasPathPrefix(path, prefix) {
+			continue
+		}
+		ms := byModule[path]
+		if ms == nil {
+			ms = &ModuleStats{Module: path, ByIdentity: make(map[string]int64), Versions: make(map[string]*VersionStats)}
+			byModule[path] = ms
+			rep.Modules = append(rep.Modules, ms)
+		}
+		cp := *vs
+		cp.ByIdentity = make(map[string]int64, len(vs.ByIdentity))
+		for id, n := range vs.ByIdentity {
+			cp.ByIdentity[id] = n
+			ms.ByIdentity[id] += n
+			identities[id] = true
+		}
+		ms.Versions[version] = &cp
+		ms.Downloads += vs.Downloads
+		if vs.LastDownload.After(ms.LastDownload) {
+			ms.LastDownload = vs.LastDownload
+		}
+		rep.Downloads += vs.Downloads
+	}
+	rep.Identities = len(identities)
+	sort.Slice(rep.Modules, func(i, j int) bool {
+		a, b := rep.Modules[i], rep.Modules[j]
+		if a.Downloads != b.Downloads {
+			return a.Downloads > b.Downloads
+		}
+		return a.Module < b.Module
+	})
+	return rep
+}
+
+// getStats serves GET /admin/stats?module=<prefix>&format=json|csv. The
+// CSV has one row per module, version and identity, with the version's
+// last download.
+func getStats(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	rep := statsReport(q.Get("module"))
+	switch q.Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, rep)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="download-stats.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"module", "version", "identity", "downloads", "version_last_download"})
+		for _, ms := range rep.Modules {
+			versions := make([]string, 0, len(ms.Versions))
+			for v := range ms.Versions {
+				versions = append(versions, v)
+			}
+			sort.Strings(versions)
+			for _, v := range versions {
+				vs := ms.Versions[v]
+				ids := make([]string, 0, len(vs.ByIdentity))
+				for id := range vs.ByIdentity {
+					ids = append(ids, id)
+				}
+				sort.Strings(ids)
+				for _, id := range ids {
+					cw.Write([]string{ms.Module, v, id, strconv.FormatInt(vs.ByIdentity[id], 10), vs.LastDownload.Format(time.RFC3339)})
+				}
+			}
+		}
+		cw.Flush()
+	default:
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+	}
+}
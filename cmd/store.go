@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// A remoteStore is shared storage behind the local cache directory.
+// Versions missing from the local cache are pulled from it before the
+// backend is asked to fetch them, and every generally available version
+// is pushed to it, so replicas and restarted instances reuse each
+// other's work. Quarantined versions are only pushed once released.
+type remoteStore interface {
+	// Pull copies the artifacts of name@version into dir. It returns an
+	// error wrapping os.ErrNotExist if the store does not have them.
+	Pull(ctx context.Context, name, version, dir string) error
+
+	// Push uploads the artifacts of name@version found in dir.
+	Push(ctx context.Context, name, version, dir string) error
+}
+
+// store is the configured remote store, or nil for local-only caching.
+var store remoteStore
+
+// StorageConfig selects the remote store.
+type StorageConfig struct {
+	// Type is "" (local cache only), "oci", "s3", "gcs" or "disk".
+	Type string            `yaml:"type"`
+	OCI  OCIConfig         `yaml:"oci"`
+	S3   S3Config          `yaml:"s3"`
+	GCS  GCSConfig         `yaml:"gcs"`
+	Disk DiskStorageConfig `yaml:"disk"`
+
+	// Compress is "zstd" to recompress evicted versions in the store.
+	Compress string `yaml:"compress"`
+}
+
+// artifactFiles returns the names of the files that make up a cached
+// version, as laid out by fetchAndCache.
+func artifactFiles(version string) []string {
+	return []string{version + ".info", "go.mod", "source.zip", provenanceFile}
+}
+
+func newRemoteStore(sc StorageConfig) (remoteStore, error) {
+	if err := checkCompress(sc); err != nil {
+		return nil, err
+	}
+	switch sc.Type {
+	case "":
+		return nil, nil
+	case "oci":
+		return newOCIStore(sc.OCI)
+	case "s3":
+		s, err := newS3Store(sc.S3)
+		if err != nil {
+			return nil, err
+		}
+		return blobRemote{s}, nil
+	case "gcs":
+		s, err := newGCSStore(sc.GCS)
+		if err != nil {
+			return nil, err
+		}
+		return blobRemote{s}, nil
+	case "disk":
+		d, err := newDiskBlobs(sc.Disk)
+		if err != nil {
+			return nil, err
+		}
+		return blobRemote{d}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", sc.Type)
+	}
+}
+
+// pullFromStore tries to populate the local cache entry of name@version
+// from the remote store and reports whether it succeeded.
+func pullFromStore(ctx context.Context, name, version string) bool {
+	if store == nil {
+		return false
+	}
+	destDir := entryDir(name, version)
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		slog.WarnContext(ctx, "store pull", "module", name, "version", version, "err", err)
+		return false
+	}
+	ctx, span := startSpan(ctx, "store.pull", spanClient)
+	span.set("module", name)
+	span.set("version", version)
+	err := store.Pull(ctx, name, version, destDir)
+	span.end(err)
+	if err != nil {
+		removeEntry(destDir)
+		entries.forget(name, version)
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.WarnContext(ctx, "store pull", "module", name, "version", version, "err", err)
+		}
+		return false
+	}
+	slog.InfoContext(ctx, "store pull", "module", name, "version", version)
+	return true
+}
+
+// pushToStore uploads name@version to the remote store in the
+// background. Failures are logged; the version stays served locally.
+func pushToStore(name, version string) {
+	if store == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+		defer cancel()
+		dir := entryDir(name, version)
+		ctx, span := startSpan(ctx, "store.push", spanClient)
+		span.set("module", name)
+		span.set("version", version)
+		err := store.Push(ctx, name, version, dir)
+		span.end(err)
+		if err != nil {
+			slog.Error("store push", "module", name, "version", version, "err", err)
+			return
+		}
+		slog.Info("store push", "module", name, "version", version)
+	}()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Fetches, version lists, commit lookups and quarantine scans run git,
+// go or scanner subprocesses, each with memory of its own that the
+// proxy's memory limit does not see. max_subprocesses (default four per
+// CPU) bounds how many run at once: the others wait in a queue, by
+// priority class as for fetch slots, until a slot is free or their
+// context is done. goproxy_subprocess_queue_depth and the
+// goproxy_subprocess_wait_seconds histogram tell whether the bound is
+// too tight.
+
+var (
+	// procSlots bounds concurrent subprocesses; nil if unbounded.
+	procSlots *slotQueue
+
+	// procsWaiting counts the subprocesses waiting for a slot.
+	procsWaiting atomic.Int64
+)
+
+// setupSubprocesses sizes the subprocess pool to n, or to four per CPU
+// if n is 0.
+func setupSubprocesses(n int) error {
+	if n < 0 {
+		return fmt.Errorf("max_subprocesses must not be negative")
+	}
+	if n == 0 {
+		n = 4 * runtime.NumCPU()
+	}
+	procSlots = newSlotQueue(n)
+	slog.Info("subprocess pool", "max_subprocesses", n)
+	return nil
+}
+
+// acquireProc waits for a slot to run argv0, behind waiters of a higher
+// priority class than the caller in ctx. The returned function releases
+// it.
+func acquireProc(ctx context.Context, argv0 string) (func(), error) {
+	if procSlots == nil {
+		return func() {}, nil
+	}
+	start := time.Now()
+	procsWaiting.Add(1)
+	release, err := procSlots.acquire(ctx, classOf(callerFrom(ctx)))
+	procsWaiting.Add(-1)
+	metrics.execWaitSeconds.observe(time.Since(start), commandName(argv0))
+	if err != nil {
+		return nil, fmt.Errorf("waiting to run %s: %w", commandName(argv0), err)
+	}
+	return release, nil
+}
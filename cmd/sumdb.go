@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/module"
+)
+
+// The GOPROXY protocol lets a proxy also serve the checksum database:
+// the go command asks <proxy>/sumdb/<db>/supported and, on 200, reads
+// the database through the proxy instead of contacting it directly.
+// Proxying sum.golang.org keeps checksum verification on for public
+// modules when the proxy is the only host build agents can reach, so
+// GONOSUMDB has to name only the modules this proxy rewrites.
+//
+// Requests are forwarded as they are; the database's signatures make
+// the proxy untrusted. Full tiles never change and are cached under
+// CacheDir/.sumdb. Lookups of modules the proxy serves itself are
+// refused without contacting the database, which would not know them
+// and must not learn their paths.
+
+// SumDBConfig configures the checksum database proxy.
+type SumDBConfig struct {
+	// Databases maps the names of the proxied checksum databases to
+	// their URLs. Without it, sum.golang.org is proxied; an empty map
+	// proxies none.
+	Databases map[string]string `yaml:"databases"`
+
+	// Timeout bounds a request to a database (default 30s).
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Internal names databases that are private checksum databases of
+	// this proxy's cluster: lookups of the modules it serves are
+	// forwarded to them rather than refused.
+	Internal []string `yaml:"internal"`
+}
+
+var defaultSumDBs = map[string]string{"sum.golang.org": "https://sum.golang.org"}
+
+// sumDBPath matches the database endpoints the go command requests.
+var sumDBPath = regexp.MustCompile(`^(latest|lookup/.+|tile/[0-9]+/(data|[0-9]+)/(x[0-9]{3}/)*[0-9]{3}(\.p/[0-9]+)?)$`)
+
+// sumDBURL returns the URL of the checksum database db, or "" if it is
+// not proxied.
+func sumDBURL(db string) string {
+	dbs := config.SumDB.Databases
+	if dbs == nil {
+		dbs = defaultSumDBs
+	}
+	return strings.TrimSuffix(dbs[db], "/")
+}
+
+// checkSumDB validates the database URLs.
+func checkSumDB(sc SumDBConfig) error {
+	for name, u := range sc.Databases {
+		if name == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+			return fmt.Errorf("sumdb: invalid database name %q", name)
+		}
+		if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+			return fmt.Errorf("sumdb: %s: url must be http or https", name)
+		}
+	}
+	for _, name := range sc.Internal {
+		if sumDBURL(name) == "" {
+			return fmt.Errorf("sumdb: internal database %s is not listed in databases", name)
+		}
+	}
+	return nil
+}
+
+func registerSumDBRoutes(r *mux.Router) {
+	r.HandleFunc("/{db}/supported", sumDBSupported).Methods(http.MethodGet)
+	r.HandleFunc("/{db}/{path:.+}", proxySumDB).Methods(http.MethodGet)
+}
+
+// sumDBSupported answers 404 for databases that are not proxied, which
+// makes the go command try the next GOPROXY entry.
+func sumDBSupported(w http.ResponseWriter, r *http.Request) {
+	db := mux.Vars(r)["db"]
+	if checksumDB != nil && db == checksumDB.name {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if sumDBURL(db) == "" {
+		http.Error(w, "checksum database not proxied", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// proxySumDB forwards a checksum database request.
+func proxySumDB(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	db, path := vars["db"], vars["path"]
+	local := checksumDB != nil && db == checksumDB.name
+	base := sumDBURL(db)
+	if base == "" && !local {
+		http.Error(w, "checksum database not proxied", http.StatusNotFound)
+		return
+	}
+	if !sumDBPath.MatchString(path) {
+		http.Error(w, "invalid checksum database path", http.StatusBadRequest)
+		return
+	}
+	if local {
+		// Records added before a module came under an ACL stay in the
+		// log; at least do not look them up for callers it excludes.
+		if mv, ok := strings.CutPrefix(path, "lookup/"); ok {
+			if err := checkLocalLookup(r.Context(), mv); err != nil {
+				httpError(w, err)
+				return
+			}
+		}
+		serveChecksumDB(w, r, path)
+		return
+	}
+	if mv, ok := strings.CutPrefix(path, "lookup/"); ok && !slices.Contains(config.SumDB.Internal, db) {
+		if err := checkSumDBLookup(mv); err != nil {
+			httpError(w, err)
+			return
+		}
+	}
+
+	// Partial tiles grow as the log does; full ones never change.
+	cacheable := strings.HasPrefix(path, "tile/") && !strings.Contains(path, ".p/")
+	file := filepath.Join(CacheDir, ".sumdb", db, filepath.FromSlash(path))
+	if cacheable {
+		if data, err := os.ReadFile(file); err == nil {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+			w.Write(data)
+			return
+		}
+	}
+
+	timeout := config.SumDB.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/"+path, nil)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		httpError(w, kindError{fmt.Sprintf("checksum database %s: %v", db, err), errUpstreamUnavailable})
+		return
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		httpError(w, kindError{fmt.Sprintf("checksum database %s: %v", db, err), errUpstreamUnavailable})
+		return
+	}
+	if resp.StatusCode >= 500 {
+		httpError(w, upstreamStatusError("checksum database "+db, resp.StatusCode, resp.Status))
+		return
+	}
+	if cacheable && resp.StatusCode == http.StatusOK {
+		if err := writeFileAtomic(file, data); err != nil {
+			slog.Warn("sumdb: caching tile", "db", db, "tile", path, "err", err)
+		}
+	}
+	for _, h := range []string{"Content-Type", "Cache-Control"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(data)
+}
+
+// checkLocalLookup checks a lookup of mv, as escaped module@version, in
+// the private checksum database against the ACLs of the caller of ctx.
+func checkLocalLookup(ctx context.Context, mv string) error {
+	escaped, _, ok := strings.Cut(mv, "@")
+	path, err := module.UnescapePath(escaped)
+	if !ok || err != nil {
+		return kindError{fmt.Sprintf("invalid lookup %q", mv), errNotFound}
+	}
+	if !servesModule(path) {
+		return kindError{fmt.Sprintf("%s is not served by this proxy", path), errNotFound}
+	}
+	if err := checkACL(ctx, path); err != nil {
+		return kindError{fmt.Sprintf("%s: %v", path, err), errNotFound}
+	}
+	return nil
+}
+
+// checkSumDBLookup refuses the lookup of mv, an escaped module@version,
+// if the proxy serves the module itself or it is private.
+func checkSumDBLookup(mv string) error {
+	escaped, _, ok := strings.Cut(mv, "@")
+	path, err := module.UnescapePath(escaped)
+	if !ok || err != nil {
+		return kindError{fmt.Sprintf("invalid lookup %q", mv), errNotFound}
+	}
+	t := routes()
+	prefixes := slices.Concat(t.srcs(), config.PrivatePrefixes)
+	for _, m := range t.mounts {
+		prefixes = append(prefixes, t.srcsOf(m)...)
+	}
+	for _, p := range prefixes {
+		if hasPathPrefix(path, p) {
+			return kindError{fmt.Sprintf("%s is private or served by this proxy and is not looked up in the checksum database; add it to GONOSUMDB", path), errPolicyDenied}
+		}
+	}
+	return nil
+}
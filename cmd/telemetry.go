@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The platform team runs no proxy itself and cannot see how the fleet
+// is used. With telemetry.enabled, which is off by default, a proxy
+// periodically posts an aggregate report to telemetry.endpoint: its
+// version, the requests it served by endpoint kind, and its cache hit
+// ratio, over the period since the last report. Reports carry no module
+// paths, identities, host names or addresses; the instance is named by
+// a random ID kept in the cache directory, and by the optional unit
+// label the operator chooses. GET /admin/telemetry shows the next
+// report exactly as it would be sent.
+
+// TelemetryConfig configures the opt-in usage telemetry.
+type TelemetryConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Endpoint string `yaml:"endpoint"`
+
+	// Interval is the time between reports (default 24h).
+	Interval time.Duration `yaml:"interval"`
+
+	// Unit labels the reports, e.g. with the business unit running the
+	// proxy.
+	Unit string `yaml:"unit"`
+}
+
+func checkTelemetry(c TelemetryConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("telemetry.endpoint must be an http or https URL")
+	}
+	return nil
+}
+
+// telemetryEndpoints are the endpoint kinds reported; every other
+// endpoint, e.g. a mount path, counts as "other".
+var telemetryEndpoints = []string{"info", "mod", "zip", "list", "latest", "sumdb", "api", "admin", "metrics", "healthz", "readyz"}
+
+// TelemetryReport is the payload posted to the telemetry endpoint.
+type TelemetryReport struct {
+	Instance      string             `json:"instance"`
+	Unit          string             `json:"unit,omitempty"`
+	Version       string             `json:"version"`
+	GoVersion     string             `json:"go_version"`
+	Platform      string             `json:"platform"`
+	Backend       string             `json:"backend"`
+	From          time.Time          `json:"from"`
+	To            time.Time          `json:"to"`
+	Requests      map[string]float64 `json:"requests"`
+	CacheLookups  map[string]float64 `json:"cache_lookups"`
+	CacheHitRatio float64            `json:"cache_hit_ratio"`
+}
+
+var telemetry = struct {
+	sync.Mutex
+	from     time.Time
+	requests map[string]float64 // totals as of from
+	lookups  map[string]float64
+}{from: time.Now().UTC(), requests: map[string]float64{}, lookups: map[string]float64{}}
+
+// proxyVersion returns the module version the proxy was built as, or
+// the VCS revision it was built from.
+func proxyVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := bi.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	version := "devel"
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			version += " " + s.Value[:min(12, len(s.Value))]
+		case "vcs.modified":
+			if s.Value == "true" {
+				version += "+dirty"
+			}
+		}
+	}
+	return version
+}
+
+// telemetryID returns the random ID of this instance, created on first
+// use.
+func telemetryID() (string, error) {
+	path := filepath.Join(CacheDir, ".telemetry-id")
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	if err := writeFileAtomic(path, []byte(id+"\n")); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// buildTelemetry returns the report of the period since the last one
+// sent, and the counter totals it was computed from. telemetry must be
+// locked.
+func buildTelemetry() (*TelemetryReport, map[string]float64, map[string]float64, error) {
+	id, err := telemetryID()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	backend := config.Backend.Type
+	if backend == "" {
+		backend = "git"
+	}
+	rep := &TelemetryReport{
+		Instance:     id,
+		Unit:         config.Telemetry.Unit,
+		Version:      proxyVersion(),
+		GoVersion:    runtime.Version(),
+		Platform:     runtime.GOOS + "/" + runtime.GOARCH,
+		Backend:      backend,
+		From:         telemetry.from,
+		To:           time.Now().UTC(),
+		Requests:     make(map[string]float64),
+		CacheLookups: make(map[string]float64),
+	}
+
+	requests := make(map[string]float64)
+	for endpoint, n := range metrics.requests.sumBy(0) {
+		if !slices.Contains(telemetryEndpoints, endpoint) {
+			endpoint = "other"
+		}
+		requests[endpoint] += n
+	}
+	for k, n := range requests {
+		if d := n - telemetry.requests[k]; d > 0 {
+			rep.Requests[k] = d
+		}
+	}
+	lookups := metrics.cacheLookups.sumBy(0)
+	var total float64
+	for k, n := range lookups {
+		if d := n - telemetry.lookups[k]; d > 0 {
+			rep.CacheLookups[k] = d
+			total += d
+		}
+	}
+	if total > 0 {
+		rep.CacheHitRatio = rep.CacheLookups["hit"] / total
+	}
+	return rep, requests, lookups, nil
+}
+
+// sendTelemetry posts the report of the period since the last one. The
+// period is closed only once the report is delivered, so a failed
+// report is covered by the next.
+func sendTelemetry(ctx context.Context) error {
+	telemetry.Lock()
+	defer telemetry.Unlock()
+	rep, requests, lookups, err := buildTelemetry()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.Telemetry.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	telemetry.from, telemetry.requests, telemetry.lookups = rep.To, requests, lookups
+	return nil
+}
+
+// startTelemetry sends the telemetry reports, if enabled, on the
+// configured interval.
+func startTelemetry() {
+	tc := config.Telemetry
+	if !tc.Enabled {
+		return
+	}
+	interval := tc.Interval
+	if interval == 0 {
+		interval = 24 * time.Hour
+	}
+	slog.Info("telemetry enabled", "endpoint", tc.Endpoint, "interval", interval)
+	go func() {
+		for range time.Tick(interval) {
+			if err := sendTelemetry(context.Background()); err != nil {
+				slog.Warn("telemetry: sending report", "err", err)
+			}
+		}
+	}()
+}
+
+// getTelemetry serves GET /admin/telemetry, the report that would be
+// sent next.
+func getTelemetry(w http.ResponseWriter, r *http.Request) {
+	telemetry.Lock()
+	rep, _, _, err := buildTelemetry()
+	telemetry.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"enabled": config.Telemetry.Enabled, "report": rep})
+}
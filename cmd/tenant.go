@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+// A tenant is the set of modules under a path prefix, such as a team's
+// or a product's, with the configuration that applies to them: the
+// mappings and mounts serving the prefix, ACL rules, team download
+// quotas, fetch policy overrides and hidden versions. GET
+// /admin/tenants/{prefix} exports it as one JSON document, to promote a
+// tenant's settings from one proxy to another, e.g. from dev to prod.
+//
+// The configuration is read-only while the proxy runs, so importing
+// does not change the running proxy: POST of the document to the same
+// path merges it into this proxy's config file, checks the result and
+// returns the tenant's entries of it, to be reviewed and deployed like
+// any other config change. Secrets are neither exported nor returned:
+// the file holds those of other tenants too. An import keeps the
+// secrets of the entries it replaces and lists the ones that still have
+// to be filled in.
+
+// redacted replaces secrets in exported documents.
+const redacted = "<redacted>"
+
+// tenantSections are the config entries that belong to a tenant.
+type tenantSections struct {
+	Mappings     []MappingConfig  `yaml:"mappings"`
+	Mounts       []MountConfig    `yaml:"mounts"`
+	ACL          []ACLRule        `yaml:"acl"`
+	Quotas       []TeamMapping    `yaml:"quotas"` // scim.teams
+	Modules      []ModuleOverride `yaml:"modules"`
+	HideVersions []HideRule       `yaml:"hide_versions"`
+}
+
+// tenantDoc is the exported document.
+type tenantDoc struct {
+	Prefix         string `yaml:"prefix"`
+	ExportedAt     string `yaml:"exported_at"`
+	tenantSections `yaml:",inline"`
+}
+
+// under reports whether paths is not empty and all of them fall under
+// prefix.
+func under(prefix string, paths ...string) bool {
+	for _, p := range paths {
+		if !hasPathPrefix(removeSchemeAndTrailingSlash(p), prefix) {
+			return false
+		}
+	}
+	return len(paths) > 0
+}
+
+// The predicates below select the entries of the tenant at prefix.
+
+func ownsMapping(prefix string) func(MappingConfig) bool {
+	return func(m MappingConfig) bool { return under(prefix, m.Src) }
+}
+
+func ownsMount(prefix string) func(MountConfig) bool {
+	return func(m MountConfig) bool { return m.SrcRepo != "" && under(prefix, m.SrcRepo) }
+}
+
+func ownsACL(prefix string) func(ACLRule) bool {
+	return func(a ACLRule) bool { return under(prefix, a.Prefix) }
+}
+
+func ownsQuota(prefix string) func(TeamMapping) bool {
+	return func(t TeamMapping) bool { return under(prefix, t.Prefixes...) }
+}
+
+func ownsOverride(prefix string) func(ModuleOverride) bool {
+	return func(m ModuleOverride) bool { return under(prefix, m.Prefix) }
+}
+
+func ownsHideRule(prefix string) func(HideRule) bool {
+	return func(h HideRule) bool { return under(prefix, h.Prefixes...) }
+}
+
+func filter[T any](items []T, keep func(T) bool) []T {
+	var out []T
+	for _, it := range items {
+		if keep(it) {
+			out = append(out, it)
+		}
+	}
+	return out
+}
+
+// tenantOf returns the entries of c that belong to the tenant at
+// prefix, with their secrets redacted.
+func tenantOf(c Config, prefix string) tenantSections {
+	t := tenantSections{
+		Mappings:     filter(c.Mappings, ownsMapping(prefix)),
+		Mounts:       filter(c.Mounts, ownsMount(prefix)),
+		ACL:          filter(c.ACL, ownsACL(prefix)),
+		Quotas:       filter(c.SCIM.Teams, ownsQuota(prefix)),
+		Modules:      filter(c.Modules, ownsOverride(prefix)),
+		HideVersions: filter(c.HideVersions, ownsHideRule(prefix)),
+	}
+	redact := func(s *string) {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+	for i := range t.Mappings {
+		redact(&t.Mappings[i].Token)
+	}
+	for i := range t.Mounts {
+		m := &t.Mounts[i]
+		redact(&m.RepoToken)
+		if m.Backend != nil {
+			b := *m.Backend
+			redact(&b.Password)
+			redact(&b.Token)
+			m.Backend = &b
+		}
+	}
+	return t
+}
+
+// compactNode encodes v, leaving out fields with zero values, which are
+// the defaults of every config field.
+func compactNode(v any) (*yaml.Node, error) {
+	var n yaml.Node
+	if err := n.Encode(v); err != nil {
+		return nil, err
+	}
+	pruneZero(&n)
+	return &n, nil
+}
+
+func pruneZero(n *yaml.Node) {
+	for _, c := range n.Content {
+		pruneZero(c)
+	}
+	if n.Kind != yaml.MappingNode {
+		return
+	}
+	var kept []*yaml.Node
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		v := n.Content[i+1]
+		switch {
+		case v.Kind == yaml.ScalarNode && (v.Tag == "!!null" || v.Tag == "!!bool" && v.Value == "false" ||
+			v.Tag == "!!int" && v.Value == "0" || v.Tag == "!!str" && (v.Value == "" || v.Value == "0s")):
+			continue
+		case (v.Kind == yaml.SequenceNode || v.Kind == yaml.MappingNode) && len(v.Content) == 0:
+			continue
+		}
+		kept = append(kept, n.Content[i], v)
+	}
+	n.Content = kept
+}
+
+// exportTenant serves GET /admin/tenants/{prefix}.
+func exportTenant(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.Trim(mux.Vars(r)["prefix"], "/")
+	n, err := compactNode(tenantDoc{
+		Prefix:         prefix,
+		ExportedAt:     time.Now().UTC().Format(time.RFC3339),
+		tenantSections: tenantOf(currentConfig(), prefix),
+	})
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	var doc map[string]any
+	if err := n.Decode(&doc); err != nil {
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, doc)
+}
+
+// importTenant serves POST /admin/tenants/{prefix} with a document
+// exported by exportTenant. It merges the document into the config file
+// and responds with the tenant's entries of the result, redacted: the
+// file holds the secrets of every other tenant.
+func importTenant(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.Trim(mux.Vars(r)["prefix"], "/")
+	doc, err := decodeTenantDoc(r)
+	if err == nil && doc.Prefix != prefix {
+		err = fmt.Errorf("document is for tenant %q", doc.Prefix)
+	}
+	if err == nil {
+		err = checkTenantDoc(doc)
+	}
+	if err != nil {
+		http.Error(w, "invalid tenant document: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var data []byte
+	if configFile != "" {
+		if data, err = os.ReadFile(configFile); err != nil {
+			httpError(w, err)
+			return
+		}
+	}
+	merged, missing, err := mergeTenant(data, doc)
+	var entries *yaml.Node
+	if err == nil {
+		var c Config
+		if c, err = parseConfig("merged config", merged); err == nil {
+			entries, err = compactNode(tenantOf(c, prefix))
+		}
+	}
+	if err != nil {
+		http.Error(w, "merging tenant: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Tenant %s imported from a document exported at %s.\n", doc.Prefix, doc.ExportedAt)
+	fmt.Fprintf(&buf, "# Replace the tenant's entries of the config file with these; %s stands for the secrets the file already has.\n", redacted)
+	for _, m := range missing {
+		fmt.Fprintf(&buf, "# Secret to fill in: %s\n", m)
+	}
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(entries); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
+}
+
+// decodeTenantDoc decodes the JSON document of the request, rejecting
+// unknown fields.
+func decodeTenantDoc(r *http.Request) (tenantDoc, error) {
+	var doc tenantDoc
+	var raw map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		return doc, err
+	}
+	// The document has the structure of the config file, so it is
+	// decoded like one.
+	data, err := yaml.Marshal(raw)
+	if err != nil {
+		return doc, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&doc); err != nil {
+		return doc, err
+	}
+	if doc.Prefix == "" {
+		return doc, fmt.Errorf("prefix is required")
+	}
+	return doc, nil
+}
+
+// checkTenantDoc checks that every entry of doc belongs to its tenant.
+func checkTenantDoc(doc tenantDoc) error {
+	p := doc.Prefix
+	check := func(section string, n, owned int) error {
+		if owned != n {
+			return fmt.Errorf("%s: %d of %d entries are not under %s", section, n-owned, n, p)
+		}
+		return nil
+	}
+	t := doc.tenantSections
+	for _, err := range []error{
+		check("mappings", len(t.Mappings), len(filter(t.Mappings, ownsMapping(p)))),
+		check("mounts", len(t.Mounts), len(filter(t.Mounts, ownsMount(p)))),
+		check("acl", len(t.ACL), len(filter(t.ACL, ownsACL(p)))),
+		check("quotas", len(t.Quotas), len(filter(t.Quotas, ownsQuota(p)))),
+		check("modules", len(t.Modules), len(filter(t.Modules, ownsOverride(p)))),
+		check("hide_versions", len(t.HideVersions), len(filter(t.HideVersions, ownsHideRule(p)))),
+		checkHideRules(t.HideVersions),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeTenant replaces the entries of the tenant of doc in the config
+// file data and returns the result, with the secrets it could not
+// restore from the replaced entries. The result is validated as the
+// proxy does at startup; checks that need the environment, such as
+// overlapping mappings, still run when it is deployed.
+func mergeTenant(data []byte, doc tenantDoc) ([]byte, []string, error) {
+	var file yaml.Node
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, nil, err
+	}
+	if file.Kind == 0 {
+		file = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := file.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("config file is not a mapping")
+	}
+
+	p, t := doc.Prefix, doc.tenantSections
+	var missing []string
+	var errs []error
+	add := func(m []string, err error) {
+		missing = append(missing, m...)
+		errs = append(errs, err)
+	}
+	add(replaceEntries(root, []string{"mappings"}, ownsMapping(p), t.Mappings, restoreMapping))
+	add(replaceEntries(root, []string{"mounts"}, ownsMount(p), t.Mounts, restoreMount))
+	add(replaceEntries(root, []string{"acl"}, ownsACL(p), t.ACL, nil))
+	add(replaceEntries(root, []string{"scim", "teams"}, ownsQuota(p), t.Quotas, nil))
+	add(replaceEntries(root, []string{"modules"}, ownsOverride(p), t.Modules, nil))
+	add(replaceEntries(root, []string{"hide_versions"}, ownsHideRule(p), t.HideVersions, nil))
+	for _, err := range errs {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&file); err != nil {
+		return nil, nil, err
+	}
+	name := configFile
+	if name == "" {
+		name = "config"
+	}
+	if _, err := parseConfig(name, buf.Bytes()); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), missing, nil
+}
+
+// replaceEntries replaces the entries of the sequence at path in root
+// that owned selects with items. restore, if set, fills in the redacted
+// secrets of an item from the replaced entries and returns the names of
+// those it could not.
+func replaceEntries[T any](root *yaml.Node, path []string, owned func(T) bool, items []T, restore func(old []T, item *T) []string) ([]string, error) {
+	seq, err := sequenceAt(root, path, len(items) > 0)
+	if err != nil || seq == nil {
+		return nil, err
+	}
+	var kept []*yaml.Node
+	var old []T
+	for _, n := range seq.Content {
+		var v T
+		if err := n.Decode(&v); err != nil {
+			return nil, fmt.Errorf("%s: %v", strings.Join(path, "."), err)
+		}
+		if owned(v) {
+			old = append(old, v)
+			continue
+		}
+		kept = append(kept, n)
+	}
+	var missing []string
+	for i := range items {
+		if restore != nil {
+			missing = append(missing, restore(old, &items[i])...)
+		}
+		n, err := compactNode(items[i])
+		if err != nil {
+			return nil, err
+		}
+		kept = append(kept, n)
+	}
+	seq.Content = kept
+	return missing, nil
+}
+
+// sequenceAt returns the sequence at path in the mapping root, creating
+// it if create is set, or nil.
+func sequenceAt(root *yaml.Node, path []string, create bool) (*yaml.Node, error) {
+	n := root
+	for i, key := range path {
+		var v *yaml.Node
+		for j := 0; j+1 < len(n.Content); j += 2 {
+			if n.Content[j].Value == key {
+				v = n.Content[j+1]
+			}
+		}
+		if v == nil {
+			if !create {
+				return nil, nil
+			}
+			v = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null"}
+			n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, v)
+		}
+		last := i == len(path)-1
+		switch {
+		case v.Kind == yaml.ScalarNode && v.Tag == "!!null":
+			v.Kind, v.Tag, v.Value = yaml.MappingNode, "!!map", ""
+			if last {
+				v.Kind, v.Tag = yaml.SequenceNode, "!!seq"
+			}
+		case last && v.Kind != yaml.SequenceNode, !last && v.Kind != yaml.MappingNode:
+			return nil, fmt.Errorf("%s: unexpected type", strings.Join(path[:i+1], "."))
+		}
+		n = v
+	}
+	return n, nil
+}
+
+// restoreSecret replaces a redacted secret with the one of the replaced
+// entry, if there is one, and returns name otherwise.
+func restoreSecret(s *string, old *string, name string) []string {
+	if *s != redacted {
+		return nil
+	}
+	if old != nil && *old != "" {
+		*s = *old
+		return nil
+	}
+	*s = ""
+	return []string{name}
+}
+
+func restoreMapping(old []MappingConfig, m *MappingConfig) []string {
+	var prev *string
+	for i := range old {
+		if removeSchemeAndTrailingSlash(old[i].Src) == removeSchemeAndTrailingSlash(m.Src) {
+			prev = &old[i].Token
+		}
+	}
+	return restoreSecret(&m.Token, prev, fmt.Sprintf("mappings[src=%s].token", m.Src))
+}
+
+func restoreMount(old []MountConfig, m *MountConfig) []string {
+	var prev *MountConfig
+	for i := range old {
+		if old[i].Path == m.Path {
+			prev = &old[i]
+		}
+	}
+	var prevToken, prevPassword, prevBackendToken *string
+	if prev != nil {
+		prevToken = &prev.RepoToken
+		if prev.Backend != nil {
+			prevPassword, prevBackendToken = &prev.Backend.Password, &prev.Backend.Token
+		}
+	}
+	where := fmt.Sprintf("mounts[path=%s]", m.Path)
+	missing := restoreSecret(&m.RepoToken, prevToken, where+".repo_token")
+	if m.Backend != nil {
+		missing = append(missing, restoreSecret(&m.Backend.Password, prevPassword, where+".backend.password")...)
+		missing = append(missing, restoreSecret(&m.Backend.Token, prevBackendToken, where+".backend.token")...)
+	}
+	return missing
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The proxy serves HTTPS with a certificate and key from files, or with
+// certificates obtained from Let's Encrypt for the configured host
+// names. Certificate files are reloaded when they change, so rotating
+// them (e.g. by cert-manager) needs no restart. With a client CA, build
+// agents must present a certificate it signed. The handshake only asks
+// for one; it is required per request, so that the health probes and
+// the GitHub webhook, whose callers have no certificate, stay reachable.
+//
+// Handshakes are counted by negotiated version, and failures by reason
+// and logged with the client address, so that agents that cannot
+// connect can be diagnosed from the proxy's side.
+
+// TLSOptions selects how the proxy serves TLS. The zero value serves
+// plain HTTP.
+type TLSOptions struct {
+	CertFile, KeyFile string
+
+	// ClientCAFile is a PEM bundle of the CAs client certificates must
+	// be signed by. Without it, no client certificate is asked for.
+	ClientCAFile string
+
+	// ClientCertOptional lets clients without a certificate connect, to
+	// authenticate otherwise; one that is presented is still verified.
+	ClientCertOptional bool
+
+	// ACMEDomains are the host names certificates are obtained for.
+	ACMEDomains []string
+	ACMEEmail   string
+
+	// ACMECache is where obtained certificates are kept (default
+	// <CACHE_DIR>/.acme).
+	ACMECache string
+
+	// ACMEHTTPAddr, e.g. ":80", serves the HTTP-01 challenge and
+	// redirects everything else to HTTPS. Without it only the
+	// TLS-ALPN-01 challenge is answered, on the proxy's own port.
+	ACMEHTTPAddr string
+}
+
+func (o TLSOptions) enabled() bool {
+	return o.CertFile != "" || len(o.ACMEDomains) > 0
+}
+
+// check validates the combination of options.
+func (o TLSOptions) check() error {
+	switch {
+	case (o.CertFile == "") != (o.KeyFile == ""):
+		return fmt.Errorf("--tls-cert and --tls-key must be given together")
+	case o.CertFile != "" && len(o.ACMEDomains) > 0:
+		return fmt.Errorf("--tls-cert and --acme-domains are mutually exclusive")
+	case o.ACMEHTTPAddr != "" && len(o.ACMEDomains) == 0:
+		return fmt.Errorf("--acme-http requires --acme-domains")
+	case o.ClientCAFile != "" && o.CertFile == "":
+		// The TLS-ALPN-01 challenge cannot present a client certificate.
+		return fmt.Errorf("--tls-client-ca requires --tls-cert")
+	case o.ClientCertOptional && o.ClientCAFile == "":
+		return fmt.Errorf("--tls-client-cert-optional requires --tls-client-ca")
+	}
+	return nil
+}
+
+// splitList splits a comma-separated flag value.
+func splitList(s string) []string {
+	var out []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// configureTLS sets up srv to serve TLS as selected by o.
+func configureTLS(srv *http.Server, o TLSOptions) error {
+	if o.CertFile != "" {
+		kp := &keyPair{cert: o.CertFile, key: o.KeyFile}
+		if _, err := kp.get(nil); err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: kp.get, VerifyConnection: observeHandshake}
+		srv.ErrorLog = log.New(serverErrorLog{}, "", 0)
+		if o.ClientCAFile == "" {
+			return nil
+		}
+		pem, err := os.ReadFile(o.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no PEM certificates", o.ClientCAFile)
+		}
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if !o.ClientCertOptional {
+			srv.Handler = requireClientCert(srv.Handler)
+		}
+		return nil
+	}
+	cache := o.ACMECache
+	if cache == "" {
+		cache = filepath.Join(CacheDir, ".acme")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cache),
+		HostPolicy: autocert.HostWhitelist(o.ACMEDomains...),
+		Email:      o.ACMEEmail,
+	}
+	srv.TLSConfig = m.TLSConfig()
+	srv.TLSConfig.MinVersion = tls.VersionTLS12
+	srv.TLSConfig.VerifyConnection = observeHandshake
+	srv.ErrorLog = log.New(serverErrorLog{}, "", 0)
+	if o.ACMEHTTPAddr != "" {
+		go func() {
+			err := (&http.Server{Addr: o.ACMEHTTPAddr, Handler: m.HTTPHandler(nil), ReadHeaderTimeout: 10 * time.Second}).ListenAndServe()
+			slog.Error("acme http listener", "addr", o.ACMEHTTPAddr, "err", err)
+		}()
+	}
+	slog.Info("serving TLS with ACME certificates", "domains", o.ACMEDomains)
+	return nil
+}
+
+// keyPair is a certificate loaded from files, reloaded when the files
+// change.
+type keyPair struct {
+	cert, key string
+
+	mu      sync.Mutex
+	current *tls.Certificate
+	mtime   time.Time // of the newer file when loaded
+	checked time.Time
+}
+
+// get returns the current certificate, checking the files for changes
+// at most every 10 seconds.
+func (kp *keyPair) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	if kp.current != nil && time.Since(kp.checked) < 10*time.Second {
+		return kp.current, nil
+	}
+	kp.checked = time.Now()
+	var mtime time.Time
+	for _, f := range []string{kp.cert, kp.key} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			if kp.current != nil {
+				return kp.current, nil
+			}
+			return nil, err
+		}
+		if fi.ModTime().After(mtime) {
+			mtime = fi.ModTime()
+		}
+	}
+	if kp.current != nil && mtime.Equal(kp.mtime) {
+		return kp.current, nil
+	}
+	c, err := tls.LoadX509KeyPair(kp.cert, kp.key)
+	if err != nil {
+		if kp.current != nil {
+			// Likely caught between writing the two files.
+			slog.Warn("reloading TLS certificate", "err", err)
+			return kp.current, nil
+		}
+		return nil, fmt.Errorf("loading TLS certificate: %v", err)
+	}
+	if kp.current != nil {
+		slog.Info("reloaded TLS certificate", "cert", kp.cert)
+	}
+	kp.current, kp.mtime = &c, mtime
+	return kp.current, nil
+}
+
+// observeHandshake counts a completed handshake. It is the
+// VerifyConnection hook, so it runs for every handshake, after the
+// client certificate, if any, has been verified.
+func observeHandshake(cs tls.ConnectionState) error {
+	metrics.tlsHandshakes.inc(tls.VersionName(cs.Version), strconv.FormatBool(len(cs.PeerCertificates) > 0))
+	return nil
+}
+
+// requireClientCert rejects requests on connections without a verified
+// client certificate with 403, other than to the open paths.
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) > 0 || openPath(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		metrics.tlsFailures.inc("client_cert_missing")
+		slog.Warn("client certificate required", "client_ip", clientIP(r), "path", r.URL.Path)
+		http.Error(w, "client certificate required", http.StatusForbidden)
+	})
+}
+
+// serverErrorLog receives the error log of the http.Server. Handshake
+// failures, which net/http only logs, are counted and logged by reason;
+// other lines are passed on.
+type serverErrorLog struct{}
+
+func (serverErrorLog) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	rest, ok := strings.CutPrefix(line, "http: TLS handshake error from ")
+	if !ok {
+		slog.Error("http server", "err", line)
+		return len(p), nil
+	}
+	addr, msg, _ := strings.Cut(rest, ": ")
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	reason := handshakeFailure(msg)
+	metrics.tlsFailures.inc(reason)
+	level := slog.LevelWarn
+	if reason == "eof" {
+		// Mostly load balancer connection checks.
+		level = slog.LevelDebug
+	}
+	slog.Log(context.Background(), level, "TLS handshake failed", "client_ip", addr, "reason", reason, "err", msg)
+	return len(p), nil
+}
+
+// handshakeFailure classifies a handshake error message as logged by
+// net/http.
+func handshakeFailure(msg string) string {
+	switch {
+	case msg == "EOF" || strings.HasSuffix(msg, "connection reset by peer"):
+		return "eof"
+	case strings.HasSuffix(msg, "i/o timeout"):
+		return "timeout"
+	case strings.Contains(msg, "client didn't provide a certificate"):
+		return "client_cert_missing"
+	case strings.HasPrefix(msg, "tls: failed to verify certificate"), strings.HasPrefix(msg, "tls: failed to parse client certificate"):
+		return "client_cert_invalid"
+	case strings.HasPrefix(msg, "remote error: tls: bad certificate"), strings.HasPrefix(msg, "remote error: tls: unknown certificate"),
+		strings.HasPrefix(msg, "remote error: tls: certificate"):
+		// The client rejected the proxy's certificate.
+		return "server_cert_rejected"
+	case strings.Contains(msg, "unsupported versions"), strings.Contains(msg, "protocol version not supported"):
+		return "protocol_version"
+	case strings.Contains(msg, "no cipher suite supported"):
+		return "no_shared_cipher"
+	case strings.Contains(msg, "does not look like a TLS handshake"):
+		return "not_tls"
+	case strings.HasPrefix(msg, "acme/autocert:"):
+		return "unknown_host"
+	}
+	return "other"
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its
+// key to dir, and returns their paths.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "goproxy test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// TestClientCARequiredPerRequest checks that with a client CA the
+// handshake succeeds without a certificate, and that the health probes
+// are served while other paths are refused.
+func TestClientCARequiredPerRequest(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	if err := configureTLS(srv, TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile}); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for path, want := range map[string]int{"/healthz": http.StatusOK, "/readyz": http.StatusOK, "/example.com/m/@v/list": http.StatusForbidden} {
+		resp, err := client.Get("https://" + ln.Addr().String() + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s without a certificate: %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	h := requireClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	for _, tt := range []struct {
+		method, path string
+		tls          *tls.ConnectionState
+		code         int
+	}{
+		{"GET", "/example.com/m/@v/list", &tls.ConnectionState{}, http.StatusForbidden},
+		{"GET", "/example.com/m/@v/list", verified, http.StatusOK},
+		{"GET", "/example.com/m/@v/list", nil, http.StatusOK},
+		{"GET", "/healthz", &tls.ConnectionState{}, http.StatusOK},
+		{"GET", "/readyz", &tls.ConnectionState{}, http.StatusOK},
+		{"POST", githubHookPath, &tls.ConnectionState{}, http.StatusOK},
+		{"GET", githubHookPath, &tls.ConnectionState{}, http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		r.TLS = tt.tls
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s %s (verified %v): %d, want %d", tt.method, tt.path, tt.tls == verified, w.Code, tt.code)
+		}
+	}
+}
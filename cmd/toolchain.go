@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+// ToolchainConfig sets the go toolchain the host must provide, for
+// deployments whose scan_command or tooling runs the go command on
+// served modules. With MinVersion set, startup fails unless the
+// installed go binary is at least MinVersion and at least the highest
+// go directive of the cached go.mod files; without it, skew is only
+// logged. Modules fetched later that require a newer go than installed
+// raise a toolchain-skew alert.
+type ToolchainConfig struct {
+	// MinVersion is e.g. 1.22 or go1.22.3.
+	MinVersion string `yaml:"min_version"`
+}
+
+// goVersionTimeout bounds the go env GOVERSION probe at startup.
+const goVersionTimeout = time.Minute
+
+var toolchain = struct {
+	sync.Mutex
+	installed string // go env GOVERSION, empty if there is no go binary
+	required  string // highest go directive seen
+	module    string // module@version that declared it
+}{}
+
+// goSemver converts a go version (1.21, 1.21.3, go1.22rc1) to semver
+// for comparison, or returns "" if it cannot be parsed.
+func goSemver(v string) string {
+	v = strings.TrimPrefix(v, "go")
+	pre := ""
+	if i := strings.IndexAny(v, "abcdefghijklmnopqrstuvwxyz"); i >= 0 {
+		v, pre = v[:i], "-"+v[i:]
+	}
+	parts := strings.Split(v, ".")
+	for len(parts) < 3 {
+		parts = append(parts, "0")
+	}
+	sv := "v" + strings.Join(parts, ".") + pre
+	if !semver.IsValid(sv) {
+		return ""
+	}
+	return sv
+}
+
+// olderGo reports whether go version a is older than b. Unparsable
+// versions, such as development builds, are never older.
+func olderGo(a, b string) bool {
+	sa, sb := goSemver(a), goSemver(b)
+	return sa != "" && sb != "" && semver.Compare(sa, sb) < 0
+}
+
+// noteGoDirective records the go directive of a served go.mod and
+// reports whether it requires a newer go than is installed.
+func noteGoDirective(gomod, where string) (string, bool) {
+	info, err := parseModInfo(gomod)
+	if err != nil || info.Go == "" {
+		return "", false
+	}
+	v := info.Go
+	toolchain.Lock()
+	defer toolchain.Unlock()
+	if toolchain.required == "" || olderGo(toolchain.required, v) {
+		toolchain.required, toolchain.module = v, where
+	}
+	return v, toolchain.installed != "" && olderGo(toolchain.installed, v)
+}
+
+// checkToolchain detects the installed go binary and scans the go.mod
+// files in the cache. It returns an error if the binary is missing or
+// too old for what is configured or served.
+func checkToolchain(tc ToolchainConfig) error {
+	if goBin, err := exec.LookPath("go"); err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), goVersionTimeout)
+		defer cancel()
+		out, err := runOutput(ctx, exec.CommandContext(ctx, goBin, "env", "GOVERSION"))
+		if err != nil {
+			return fmt.Errorf("toolchain: %s env GOVERSION: %v", goBin, err)
+		}
+		toolchain.installed = strings.TrimSpace(string(out))
+		slog.Info("go toolchain", "version", toolchain.installed)
+	}
+
+	root := filepath.Join(CacheDir, cacheNS)
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() != "go.mod" {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, filepath.Dir(path))
+		dir, version := filepath.Split(filepath.ToSlash(rel))
+		noteGoDirective(path, strings.TrimSuffix(dir, "/")+"@"+version)
+		return nil
+	})
+
+	skew := olderGo(toolchain.installed, toolchain.required)
+	if tc.MinVersion == "" {
+		if skew {
+			slog.Warn("toolchain: cached module needs a newer go", "installed", toolchain.installed, "module", toolchain.module, "go", toolchain.required)
+		}
+		return nil
+	}
+	switch {
+	case goSemver(tc.MinVersion) == "":
+		return fmt.Errorf("toolchain: invalid min_version %q", tc.MinVersion)
+	case toolchain.installed == "":
+		return fmt.Errorf("toolchain: go %s or newer is required, but no go binary was found in PATH", strings.TrimPrefix(tc.MinVersion, "go"))
+	case olderGo(toolchain.installed, tc.MinVersion):
+		return fmt.Errorf("toolchain: %s is installed, but toolchain.min_version requires go %s; upgrade go or lower min_version", toolchain.installed, strings.TrimPrefix(tc.MinVersion, "go"))
+	case skew:
+		return fmt.Errorf("toolchain: %s is installed, but cached module %s declares go %s; upgrade go", toolchain.installed, toolchain.module, toolchain.required)
+	}
+	return nil
+}
+
+// checkFetchedToolchain alerts if a newly fetched version declares a go
+// version newer than the installed toolchain.
+func checkFetchedToolchain(module, version string) {
+	v, skew := noteGoDirective(filepath.Join(entryDir(module, version), "go.mod"), module+"@"+version)
+	if !skew {
+		return
+	}
+	toolchain.Lock()
+	installed := toolchain.installed
+	toolchain.Unlock()
+	slog.Warn("toolchain: fetched module needs a newer go", "module", module, "version", version, "go", v, "installed", installed)
+	sendAlert("toolchain-skew", "module requires a newer go toolchain than installed", map[string]string{
+		"module":    module,
+		"version":   version,
+		"go":        v,
+		"installed": installed,
+	})
+}
+
+// getVersion serves GET /api/version: the go runtime the proxy was
+// built with, the installed go binary and the highest go directive of
+// the modules served.
+func getVersion(w http.ResponseWriter, r *http.Request) {
+	toolchain.Lock()
+	defer toolchain.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"runtime":     runtime.Version(),
+		"go":          toolchain.installed,
+		"min_version": config.Toolchain.MinVersion,
+		"required":    toolchain.required,
+		"required_by": toolchain.module,
+		"skew":        toolchain.installed != "" && olderGo(toolchain.installed, toolchain.required),
+	})
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With tracing.endpoint set, the proxy records a span for every routed
+// request, with child spans for backend fetches, git subprocesses and
+// remote store transfers, and exports them to an OpenTelemetry
+// collector with OTLP over HTTP in its JSON encoding. Incoming W3C
+// traceparent headers are honored, so the proxy's spans join the
+// caller's trace. The few parts of the SDK needed are implemented here.
+
+// TracingConfig configures trace export.
+type TracingConfig struct {
+	// Endpoint is the base URL of the collector's OTLP/HTTP receiver,
+	// for example http://otel-collector:4318; spans are posted to
+	// <endpoint>/v1/traces. Empty disables tracing.
+	Endpoint string `yaml:"endpoint"`
+
+	// Headers are sent with every export, e.g. for authentication.
+	Headers map[string]string `yaml:"headers"`
+
+	// ServiceName is reported as service.name (default goproxy).
+	ServiceName string `yaml:"service_name"`
+
+	// SampleRatio is the fraction of new traces recorded, between 0 and
+	// 1 (default 1). Traces started by a caller follow its decision.
+	SampleRatio *float64 `yaml:"sample_ratio"`
+}
+
+// Span kinds and status codes of OTLP.
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+
+	statusError = 2
+)
+
+// span is one timed operation of a trace. A nil *span, as returned
+// while tracing is disabled, ignores all calls.
+type span struct {
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	sampled bool
+
+	name  string
+	kind  int
+	start time.Time
+	attrs map[string]string
+}
+
+type spanKey struct{}
+
+var tracer struct {
+	cfg   TracingConfig
+	ratio float64
+	spans chan otlpSpan // to the exporter; nil if tracing is disabled
+}
+
+// setupTracing validates the tracing config and starts the exporter.
+func setupTracing(tc TracingConfig) error {
+	tracer.cfg, tracer.spans = tc, nil
+	if tc.Endpoint == "" {
+		return nil
+	}
+	tracer.ratio = 1
+	if tc.SampleRatio != nil {
+		if r := *tc.SampleRatio; r < 0 || r > 1 || math.IsNaN(r) {
+			return fmt.Errorf("sample_ratio must be between 0 and 1")
+		}
+		tracer.ratio = *tc.SampleRatio
+	}
+	if tracer.cfg.ServiceName == "" {
+		tracer.cfg.ServiceName = "goproxy"
+	}
+	tracer.spans = make(chan otlpSpan, 4096)
+	go exportSpans(tracer.cfg, tracer.spans)
+	return nil
+}
+
+// startSpan starts a span named name as a child of the span in ctx, or
+// as the root of a new trace.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if tracer.spans == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: map[string]string{}}
+	if p, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID, s.parent, s.sampled = p.traceID, p.id, p.sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = mrand.Float64() < tracer.ratio
+	}
+	rand.Read(s.id[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// set adds an attribute.
+func (s *span) set(key, value string) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// end finishes the span, marking it failed if err is not nil, and
+// queues it for export.
+func (s *span) end(err error) {
+	if s == nil || !s.sampled {
+		return
+	}
+	end := time.Now()
+	sp := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.id[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.attrs),
+	}
+	if s.parent != [8]byte{} {
+		sp.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if err != nil {
+		sp.Status = &otlpStatus{Code: statusError, Message: err.Error()}
+	}
+	select {
+	case tracer.spans <- sp:
+	default:
+		// The exporter is behind; drop rather than block the request.
+	}
+}
+
+// parseTraceparent parses a W3C traceparent header into a remote
+// parent span.
+func parseTraceparent(h string) (*span, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, false
+	}
+	p := &span{}
+	if _, err := hex.Decode(p.traceID[:], []byte(parts[1])); err != nil || p.traceID == [16]byte{} {
+		return nil, false
+	}
+	if _, err := hex.Decode(p.id[:], []byte(parts[2])); err != nil || p.id == [8]byte{} {
+		return nil, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return nil, false
+	}
+	p.sampled = flags&1 == 1
+	return p, true
+}
+
+// traceRequests is router middleware recording a server span per
+// request.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tracer.spans == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		if p, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, spanKey{}, p)
+		}
+		endpoint := endpointOf(r)
+		if strings.HasSuffix(r.URL.Path, "/@latest") {
+			endpoint = "latest"
+		}
+		ctx, s := startSpan(ctx, r.Method+" "+endpoint, spanServer)
+		s.set("http.request.method", r.Method)
+		s.set("url.path", r.URL.Path)
+		s.set("enduser.id", callerFrom(ctx).Identity)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		s.set("http.response.status_code", strconv.Itoa(rec.code))
+		var err error
+		if rec.code >= 500 {
+			err = fmt.Errorf("%s", http.StatusText(rec.code))
+		}
+		s.end(err)
+	})
+}
+
+// OTLP/JSON documents, as in ExportTraceServiceRequest.
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpAttributes(m map[string]string) []otlpAttribute {
+	attrs := make([]otlpAttribute, 0, len(m))
+	for _, k := range sortedKeys(m) {
+		a := otlpAttribute{Key: k}
+		a.Value.StringValue = m[k]
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+// exportSpans posts finished spans to the collector in batches of up to
+// 512, at least every 5 seconds while there are any.
+func exportSpans(tc TracingConfig, spans <-chan otlpSpan) {
+	var batch []otlpSpan
+	tick := time.NewTicker(5 * time.Second)
+	for {
+		select {
+		case s := <-spans:
+			batch = append(batch, s)
+			if len(batch) < 512 {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := postSpans(tc, batch); err != nil {
+			slog.Warn("tracing: exporting spans", "spans", len(batch), "err", err)
+		}
+		batch = nil
+	}
+}
+
+func postSpans(tc TracingConfig, batch []otlpSpan) error {
+	resource := otlpAttributes(map[string]string{"service.name": tc.ServiceName, "service.instance.id": instanceID})
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": resource},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "goproxy"},
+				"spans": batch,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(tc.Endpoint, "/")+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range tc.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector: %s", resp.Status)
+	}
+	return nil
+}
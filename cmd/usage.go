@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UsageConfig configures the stale-module report. Every Interval the
+// cache is scanned for versions not downloaded within StaleAfter; the
+// result is available at /admin/reports/usage. Action "flag" also
+// writes a stale.json marker into each stale entry, and "evict"
+// removes stale entries from the local cache.
+type UsageConfig struct {
+	Interval   time.Duration `yaml:"interval"`
+	StaleAfter time.Duration `yaml:"stale_after"`
+	Action     string        `yaml:"action"` // "", "flag" or "evict"
+}
+
+// accessMarker is touched whenever a file of the version is served; its
+// modification time is the version's last download.
+const accessMarker = ".accessed"
+
+// cacheEntry is one cached module version.
+type cacheEntry struct {
+	Module  string // escaped module path
+	Version string
+	Dir     string
+}
+
+// walkCache calls fn for every cached module version in the current
+// namespace.
+func walkCache(fn func(e cacheEntry) error) error {
+	root := filepath.Join(CacheDir, cacheNS)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		version := d.Name()
+		if _, err := os.Stat(filepath.Join(path, version+".info")); err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if err := fn(cacheEntry{Module: filepath.ToSlash(rel), Version: version, Dir: path}); err != nil {
+			return err
+		}
+		return filepath.SkipDir
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// touchAccess records a download of module@version.
+func touchAccess(module, version string) {
+	marker := filepath.Join(entryDir(module, version), accessMarker)
+	now := time.Now()
+	if err := os.Chtimes(marker, now, now); err != nil {
+		if f, err := os.Create(marker); err == nil {
+			f.Close()
+		}
+	}
+	countDownload(module, version)
+}
+
+// lastAccess returns the last download time of the entry, falling back
+// to the time it was cached.
+func lastAccess(dir string) time.Time {
+	if fi, err := os.Stat(filepath.Join(dir, accessMarker)); err == nil {
+		return fi.ModTime()
+	}
+	if fi, err := os.Stat(dir); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+func dirSize(dir string) int64 {
+	var n int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if fi, err := d.Info(); err == nil {
+				n += fi.Size()
+			}
+		}
+		return nil
+	})
+	return n
+}
+
+// StaleVersion is one entry of a usage report.
+type StaleVersion struct {
+	Module       string    `json:"module"`
+	Version      string    `json:"version"`
+	LastDownload time.Time `json:"last_download"`
+	Bytes        int64     `json:"bytes"`
+}
+
+// UsageReport lists the versions not downloaded within StaleAfter.
+type UsageReport struct {
+	GeneratedAt      time.Time      `json:"generated_at"`
+	StaleAfter       string         `json:"stale_after"`
+	Action           string         `json:"action,omitempty"`
+	TotalVersions    int            `json:"total_versions"`
+	Stale            []StaleVersion `json:"stale"`
+	ReclaimableBytes int64          `json:"reclaimable_bytes"`
+}
+
+var (
+	usageMu     sync.Mutex
+	usageReport *UsageReport
+)
+
+// runUsageReport scans the cache and applies action to stale entries.
+func runUsageReport(staleAfter time.Duration, action string) (*UsageReport, error) {
+	rep := &UsageReport{
+		GeneratedAt: time.Now().UTC(),
+		StaleAfter:  staleAfter.String(),
+		Action:      action,
+		Stale:       []StaleVersion{},
+	}
+	cutoff := rep.GeneratedAt.Add(-staleAfter)
+
+	var stale []cacheEntry
+	err := walkCache(func(e cacheEntry) error {
+		rep.TotalVersions++
+		last := lastAccess(e.Dir)
+		if last.After(cutoff) {
+			return nil
+		}
+		size := dirSize(e.Dir)
+		rep.Stale = append(rep.Stale, StaleVersion{Module: e.Module, Version: e.Version, LastDownload: last.UTC(), Bytes: size})
+		rep.ReclaimableBytes += size
+		stale = append(stale, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(rep.Stale, func(i, j int) bool { return rep.Stale[i].LastDownload.Before(rep.Stale[j].LastDownload) })
+
+	for _, e := range stale {
+		switch action {
+		case "flag":
+			data, _ := json.Marshal(map[string]any{"flagged_at": rep.GeneratedAt, "stale_after": rep.StaleAfter})
+			if err := os.WriteFile(filepath.Join(e.Dir, "stale.json"), data, 0644); err != nil {
+				slog.Error("usage: flagging", "module", e.Module, "version", e.Version, "err", err)
+			}
+		case "evict":
+			if err := removeEntry(e.Dir); err != nil {
+				slog.Error("usage: evicting", "module", e.Module, "version", e.Version, "err", err)
+			}
+			entries.forget(e.Module, e.Version)
+			addTombstone(e.Module, e.Version)
+		}
+	}
+
+	usageMu.Lock()
+	usageReport = rep
+	usageMu.Unlock()
+	slog.Info("usage report", "stale", len(rep.Stale), "versions", rep.TotalVersions, "reclaimable_bytes", rep.ReclaimableBytes, "action", action)
+	return rep, nil
+}
+
+// startUsageReports runs the usage report on the configured interval.
+func startUsageReports() {
+	uc := config.Usage
+	if uc.Interval == 0 || uc.StaleAfter == 0 {
+		return
+	}
+	go func() {
+		for {
+			if _, err := runUsageReport(uc.StaleAfter, uc.Action); err != nil {
+				slog.Error("usage report", "err", err)
+			}
+			time.Sleep(uc.Interval)
+		}
+	}()
+}
+
+// getUsageReport serves GET /admin/reports/usage, the latest report.
+func getUsageReport(w http.ResponseWriter, r *http.Request) {
+	usageMu.Lock()
+	rep := usageReport
+	usageMu.Unlock()
+	if rep == nil {
+		http.Error(w, "no report yet; POST to generate one", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// postUsageReport serves POST /admin/reports/usage, generating a report
+// immediately. Query parameters stale_after and action override the
+// configured values.
+func postUsageReport(w http.ResponseWriter, r *http.Request) {
+	staleAfter, action := config.Usage.StaleAfter, config.Usage.Action
+	if v := r.URL.Query().Get("stale_after"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		staleAfter = d
+	}
+	if r.URL.Query().Has("action") {
+		action = r.URL.Query().Get("action")
+	}
+	if action != "" && action != "flag" && action != "evict" {
+		http.Error(w, "action must be flag or evict", http.StatusBadRequest)
+		return
+	}
+	if staleAfter <= 0 {
+		http.Error(w, "stale_after is required", http.StatusBadRequest)
+		return
+	}
+
+	rep, err := runUsageReport(staleAfter, action)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
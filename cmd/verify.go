@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// A cached version can stop matching its upstream: a tag is moved by a
+// force push, or the bytes on disk rot. The verifier fetches cached
+// versions again from their backend into a scratch directory and
+// compares the go.sum hashes of the go.mod and zip, and the commit of
+// the Origin where both have one. Every drift raises an alert; nothing
+// is changed in the cache, since which side is right is for an operator
+// to decide.
+
+// VerifyConfig configures the periodic re-verification of the cache.
+type VerifyConfig struct {
+	// Interval is the time between runs; 0 disables them.
+	Interval time.Duration `yaml:"interval"`
+
+	// Sample is the number of randomly chosen versions checked per run;
+	// 0 checks all.
+	Sample int `yaml:"sample"`
+}
+
+// VerifyReport is the result of a verification run. Divergences are of
+// kind zip_mismatch, mod_mismatch, origin_mismatch, missing_upstream or
+// error.
+type VerifyReport struct {
+	StartedAt   time.Time    `json:"started_at"`
+	FinishedAt  time.Time    `json:"finished_at"`
+	Total       int          `json:"total"`
+	Checked     int          `json:"checked"`
+	Divergences []Divergence `json:"divergences"`
+}
+
+var errVerifying = errors.New("a verification run is in progress")
+
+var verification struct {
+	run    sync.Mutex // held while a run is in progress
+	mu     sync.Mutex
+	report *VerifyReport
+}
+
+// runVerification checks sample cached versions, or all if sample is 0,
+// against their upstream.
+func runVerification(ctx context.Context, sample int) (*VerifyReport, error) {
+	if !verification.run.TryLock() {
+		return nil, errVerifying
+	}
+	defer verification.run.Unlock()
+
+	rep := &VerifyReport{StartedAt: time.Now().UTC(), Divergences: []Divergence{}}
+	var all []cacheEntry
+	if err := walkCache(func(e cacheEntry) error {
+		if validEntry(e.Module, e.Version) {
+			all = append(all, e)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	rep.Total = len(all)
+	if sample > 0 && sample < len(all) {
+		rand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+		all = all[:sample]
+	}
+
+	for _, e := range all {
+		if ctx.Err() != nil {
+			break
+		}
+		d := verifyEntry(ctx, e)
+		rep.Checked++
+		if d == nil {
+			continue
+		}
+		rep.Divergences = append(rep.Divergences, *d)
+		fields := map[string]string{"module": d.Module, "version": d.Version, "kind": d.Kind, "detail": d.Detail}
+		switch d.Kind {
+		case "error":
+			slog.WarnContext(ctx, "verify: divergence", "module", d.Module, "version", d.Version, "detail", d.Detail)
+		case "missing_upstream":
+			sendAlert("artifact-missing-upstream", "cached version no longer exists upstream", fields)
+		default:
+			sendHighPriorityAlert("artifact-drift", "cached version differs from upstream", fields)
+		}
+	}
+	rep.FinishedAt = time.Now().UTC()
+
+	verification.mu.Lock()
+	verification.report = rep
+	verification.mu.Unlock()
+	slog.InfoContext(ctx, "verify", "checked", rep.Checked, "versions", rep.Total, "divergences", len(rep.Divergences))
+	return rep, ctx.Err()
+}
+
+// verifyEntry fetches e again and compares it to the cache, returning
+// the first difference found, if any.
+func verifyEntry(ctx context.Context, e cacheEntry) *Divergence {
+	div := func(kind, detail string) *Divergence {
+		return &Divergence{Module: e.Module, Version: e.Version, Kind: kind, Detail: detail}
+	}
+	path, err := module.UnescapePath(e.Module)
+	if err != nil {
+		return div("error", err.Error())
+	}
+	policy := fetchPolicyFor(path)
+	ctx, cancel := context.WithTimeout(ctx, policy.Timeout)
+	defer cancel()
+
+	tmp, err := mkdirTemp("verify-")
+	if err != nil {
+		return div("error", err.Error())
+	}
+	defer removeTemp(tmp)
+
+	release, err := acquireFetchSlot(ctx)
+	if err != nil {
+		return div("error", err.Error())
+	}
+	err = upstreamFor(e.Module).Fetch(ctx, e.Module, e.Version, tmp, policy)
+	if err == nil && cacheNS == nsRewritten {
+		err = rewriteArtifacts(ctx, tmp, e.Module, e.Version, policy)
+	}
+	release()
+	if errors.Is(err, errNotFound) || errors.Is(err, errGone) {
+		return div("missing_upstream", err.Error())
+	}
+	if err != nil {
+		return div("error", err.Error())
+	}
+
+	if p, err := readProvenance(e.Module, e.Version); err == nil && p.Origin != nil {
+		if o := takeOrigin(tmp); o != nil && o.Hash != "" && p.Origin.Hash != "" && o.Hash != p.Origin.Hash {
+			return div("origin_mismatch", fmt.Sprintf("cached %s, upstream %s", p.Origin.Hash, o.Hash))
+		}
+	}
+	for _, c := range []struct {
+		kind string
+		hash func(dir string) (string, error)
+	}{
+		{"mod_mismatch", modHash},
+		{"zip_mismatch", func(dir string) (string, error) {
+			return dirhash.HashZip(filepath.Join(dir, "source.zip"), dirhash.Hash1)
+		}},
+	} {
+		cached, err := c.hash(e.Dir)
+		if err != nil {
+			return div("error", err.Error())
+		}
+		current, err := c.hash(tmp)
+		if err != nil {
+			return div("error", err.Error())
+		}
+		if cached != current {
+			return div(c.kind, fmt.Sprintf("cached %s, upstream %s", cached, current))
+		}
+	}
+	return nil
+}
+
+// modHash returns the go.sum hash of the go.mod in dir.
+func modHash(dir string) (string, error) {
+	return dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(dir, "go.mod"))
+	})
+}
+
+// startVerification runs the verifier on the configured interval.
+func startVerification() {
+	vc := config.Verify
+	if vc.Interval == 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(vc.Interval)
+			if _, err := runVerification(context.Background(), vc.Sample); err != nil {
+				slog.Error("verify", "err", err)
+			}
+		}
+	}()
+}
+
+// getVerifyReport serves GET /admin/verify, the latest report.
+func getVerifyReport(w http.ResponseWriter, r *http.Request) {
+	verification.mu.Lock()
+	rep := verification.report
+	verification.mu.Unlock()
+	if rep == nil {
+		http.Error(w, "no report yet; POST to generate one", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// postVerify serves POST /admin/verify, running the verifier now. The
+// query parameter sample overrides the configured sample size.
+func postVerify(w http.ResponseWriter, r *http.Request) {
+	sample := config.Verify.Sample
+	if v := r.URL.Query().Get("sample"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "sample must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		sample = n
+	}
+	rep, err := runVerification(r.Context(), sample)
+	if errors.Is(err, errVerifying) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
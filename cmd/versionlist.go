@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Listing the tags of a repository with thousands of them is slow, so
+// the sorted version list of each module is cached. A list older than
+// ListCacheConfig.TTL is still served while a single background refresh
+// runs; the refresh merges new versions into the sorted list instead of
+// sorting it again from scratch.
+
+// ListCacheConfig configures the version list cache.
+type ListCacheConfig struct {
+	// TTL is how long a list is served without a refresh (default 1m).
+	TTL time.Duration `yaml:"ttl"`
+
+	// LatestTTL is how long a resolved @latest is reused (default TTL).
+	LatestTTL time.Duration `yaml:"latest_ttl"`
+
+	// Redis, if set, shares version lists and @latest results between
+	// replicas, under keys starting with Prefix (default
+	// "goproxy:meta:").
+	Redis  RedisConfig `yaml:"redis"`
+	Prefix string      `yaml:"prefix"`
+}
+
+// Values of Config.UnknownModuleList, the answer to /@v/list for a
+// module under a mapping whose repository does not exist upstream. On
+// the 404 the go command resolves the module through the next proxy in
+// GOPROXY. It takes the empty list as a module without tagged versions:
+// @latest and queries such as @v1 then fail with "no matching versions"
+// without trying the next proxy; only exact versions still do.
+const (
+	unknownListNotFound = "not_found" // 404, the default
+	unknownListEmpty    = "empty"     // 200 with no versions
+)
+
+// checkUnknownModuleList validates Config.UnknownModuleList.
+func checkUnknownModuleList(v string) error {
+	switch v {
+	case "", unknownListNotFound, unknownListEmpty:
+		return nil
+	}
+	return fmt.Errorf("unknown_module_list must be %s or %s", unknownListNotFound, unknownListEmpty)
+}
+
+type versionList struct {
+	mu         sync.Mutex
+	versions   []string // sorted by compareVersions
+	refs       string   // hash of the ref advertisement versions came from
+	fetched    time.Time
+	refreshing bool
+	ready      chan struct{} // closed once the first fetch completed
+	err        error         // of the first fetch
+}
+
+var versionLists = struct {
+	sync.Mutex
+	m map[string]*versionList
+}{m: make(map[string]*versionList)}
+
+// refLister is implemented by backends that list versions from a ref
+// advertisement. ListRefs also returns a hash of the advertisement and,
+// when it equals since, skips parsing it and returns no versions.
+type refLister interface {
+	ListRefs(ctx context.Context, name, since string) ([]string, string, error)
+}
+
+// refsHash returns the hash by which ref advertisements are compared.
+func refsHash(adv []byte) string {
+	sum := sha256.Sum256(adv)
+	return hex.EncodeToString(sum[:])
+}
+
+// compareVersions orders valid semantic versions by precedence, before
+// any other tags in lexical order.
+func compareVersions(a, b string) int {
+	va, vb := semver.IsValid(a), semver.IsValid(b)
+	switch {
+	case va && vb:
+		if c := semver.Compare(a, b); c != 0 {
+			return c
+		}
+	case va:
+		return -1
+	case vb:
+		return 1
+	}
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// mergeVersions returns the sorted list old updated to the set latest:
+// versions no longer listed are dropped and new ones are inserted.
+func mergeVersions(old, latest []string) []string {
+	seen := make(map[string]bool, len(latest))
+	for _, v := range latest {
+		seen[v] = true
+	}
+	kept := make([]string, 0, len(latest))
+	for _, v := range old {
+		if seen[v] {
+			kept = append(kept, v)
+			delete(seen, v)
+		}
+	}
+	if len(seen) == 0 {
+		return kept
+	}
+	added := make([]string, 0, len(seen))
+	for v := range seen {
+		added = append(added, v)
+	}
+	sort.Slice(added, func(i, j int) bool { return compareVersions(added[i], added[j]) < 0 })
+
+	merged := make([]string, 0, len(kept)+len(added))
+	i, j := 0, 0
+	for i < len(kept) && j < len(added) {
+		if compareVersions(kept[i], added[j]) <= 0 {
+			merged = append(merged, kept[i])
+			i++
+		} else {
+			merged = append(merged, added[j])
+			j++
+		}
+	}
+	merged = append(merged, kept[i:]...)
+	return append(merged, added[j:]...)
+}
+
+// refresh lists the module upstream, or takes the list from the shared
+// cache, and merges the result. When the upstream advertises the same
+// refs as last time, only the TTL is renewed.
+func (l *versionList) refresh(ctx context.Context, path string) error {
+	l.mu.Lock()
+	prev := listing{versions: l.versions, refs: l.refs}
+	l.mu.Unlock()
+	latest, unchanged, err := listVersions(ctx, path, prev)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refreshing = false
+	if err != nil {
+		if escaped, eerr := module.EscapePath(path); eerr == nil {
+			noteFetchFailure(escaped, "", err)
+		}
+		return err
+	}
+	if unchanged {
+		metrics.listRefreshes.inc("unchanged")
+	} else {
+		metrics.listRefreshes.inc("changed")
+		l.versions = mergeVersions(l.versions, latest.versions)
+		l.refs = latest.refs
+	}
+	l.fetched = time.Now()
+	return nil
+}
+
+// fill lists path for the first time. ready is closed, and a failed
+// list forgotten, even if the listing panics, so that no later caller
+// waits on it for good.
+func (l *versionList) fill(ctx context.Context, path string) {
+	l.err = errors.New("listing failed")
+	defer func() {
+		if l.err != nil {
+			versionLists.Lock()
+			delete(versionLists.m, path)
+			versionLists.Unlock()
+		}
+		close(l.ready)
+	}()
+	l.err = l.refresh(ctx, path)
+}
+
+// moduleVersions returns the sorted versions of the module path,
+// listing the upstream only on first use or after the TTL expired.
+func moduleVersions(ctx context.Context, path string) ([]string, error) {
+	versionLists.Lock()
+	l, ok := versionLists.m[path]
+	if !ok {
+		l = &versionList{ready: make(chan struct{})}
+		versionLists.m[path] = l
+	}
+	versionLists.Unlock()
+
+	if !ok {
+		l.fill(ctx, path)
+	}
+	select {
+	case <-l.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if l.err != nil {
+		return nil, l.err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.fetched) > listCacheTTL() && !l.refreshing {
+		l.refreshing = true
+		go func() {
+			if err := l.refresh(context.Background(), path); err != nil {
+				slog.Warn("refreshing version list", "module", path, "err", err)
+			}
+		}()
+	}
+	return l.versions, nil
+}
+
+// addListedVersion adds version to the cached list of path, if any,
+// ahead of the next refresh. The list is reparsed at that refresh.
+func addListedVersion(ctx context.Context, path, version string) {
+	versionLists.Lock()
+	l, ok := versionLists.m[path]
+	versionLists.Unlock()
+	if ok {
+		l.mu.Lock()
+		if !slices.Contains(l.versions, version) {
+			l.versions = mergeVersions(l.versions, append(slices.Clone(l.versions), version))
+			l.refs = ""
+		}
+		l.mu.Unlock()
+	}
+	if sharedMeta != nil {
+		sharedMeta.del(ctx, "list:"+path, "refs:"+path)
+	}
+}
+
+// visibleVersions returns the versions of the escaped module path that
+// c may see, hiding quarantined and blocked ones and those hidden from
+// c by a HideRule.
+func visibleVersions(r *http.Request, escaped string) ([]string, error) {
+	path, err := module.UnescapePath(escaped)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, errNotFound)
+	}
+	versions, err := moduleVersions(r.Context(), path)
+	if err != nil {
+		return nil, err
+	}
+	c := callerFrom(r.Context())
+	hidden := hiddenFrom(escaped, c)
+	visible := make([]string, 0, len(versions))
+	for _, v := range versions {
+		if isQuarantined(c, escaped, v) || blockOf(escaped, v) != nil || (hidden != nil && hidden(v)) {
+			continue
+		}
+		visible = append(visible, v)
+	}
+	return visible, nil
+}
+
+// streamVersions writes versions one per line through a buffer.
+func streamVersions(w http.ResponseWriter, versions []string) {
+	bw := bufio.NewWriterSize(w, 32<<10)
+	for _, v := range versions {
+		bw.WriteString(v)
+		bw.WriteByte('\n')
+	}
+	bw.Flush()
+}
+
+// getVersions serves GET /api/versions/{module}?limit=&after=, a page
+// of the sorted version list for tooling. after is the last version of
+// the previous page; the response's next is empty on the last page.
+func getVersions(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	versions, err := visibleVersions(r, mux.Vars(r)["module"])
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	start := 0
+	if after := r.URL.Query().Get("after"); after != "" {
+		start = sort.Search(len(versions), func(i int) bool { return compareVersions(versions[i], after) > 0 })
+	}
+	end := min(start+limit, len(versions))
+	page := versions[start:end]
+	next := ""
+	if end < len(versions) && len(page) > 0 {
+		next = page[len(page)-1]
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"total":    len(versions),
+		"versions": page,
+		"next":     next,
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// missingBackend has no repositories.
+type missingBackend struct{ repoMapping }
+
+func (b missingBackend) List(ctx context.Context, name string) ([]string, error) {
+	repo, err := b.repoURL(name)
+	if err != nil {
+		return nil, err
+	}
+	return nil, kindError{fmt.Sprintf("%s: repository not found", repo), errNotFound}
+}
+
+func (missingBackend) Fetch(ctx context.Context, name, version, destDir string, policy FetchPolicy) error {
+	return kindError{fmt.Sprintf("%s@%s: repository not found", name, version), errNotFound}
+}
+
+func TestListUnknownModule(t *testing.T) {
+	keepState(t)
+	rm := repoMapping{Src: "example.com", Dest: "git.example.com/org"}
+	m := &mapping{repoMapping: rm, upstream: missingBackend{rm}}
+	routing.Store(&routingTable{mappings: []*mapping{m}, upstream: m.upstream})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/{module:.+}/@v/list", list)
+	for _, tt := range []struct {
+		choice, path string
+		want         int
+	}{
+		{unknownListNotFound, "/example.com/missing/@v/list", http.StatusNotFound},
+		{unknownListEmpty, "/example.com/missing/@v/list", http.StatusOK},
+		// Paths naming no module are not found either way.
+		{unknownListEmpty, "/example.com/Missing/@v/list", http.StatusNotFound},
+		{unknownListEmpty, "/example.com/@v/list", http.StatusNotFound},
+	} {
+		config.UnknownModuleList = tt.choice
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: GET %s: status %d, want %d", tt.choice, tt.path, w.Code, tt.want)
+		}
+		if w.Code == http.StatusOK && w.Body.Len() != 0 {
+			t.Errorf("%s: GET %s: body %q, want none", tt.choice, tt.path, w.Body)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// A fresh replica can fill its cache only as fast as the upstream
+// allows, so the first builds it serves are slow. The warm list names
+// the modules that matter most; they are fetched at startup and, with
+// GateReadiness, /readyz fails until all of them are cached, keeping
+// the replica out of rotation meanwhile. The list may be extended by
+// manifests, such as the go.sum of the builds the proxy serves, and
+// warmed again on a schedule, which keeps an air-gapped replica's cache
+// complete as the manifests change.
+
+// WarmConfig configures the startup warm-up.
+type WarmConfig struct {
+	// Modules lists module@version, or a module path alone for its
+	// @latest as anonymous callers see it.
+	Modules []string `yaml:"modules"`
+
+	// GateReadiness fails /readyz until every module is cached.
+	GateReadiness bool `yaml:"gate_readiness"`
+
+	// Concurrency is the number of modules fetched at once (default 4).
+	Concurrency int `yaml:"concurrency"`
+
+	// MaxWait stops gating readiness after this long even if some
+	// modules failed; 0 waits until all are cached. Failed modules are
+	// retried every RetryInterval (default 30s) until then.
+	MaxWait       time.Duration `yaml:"max_wait"`
+	RetryInterval time.Duration `yaml:"retry_interval"`
+
+	// Manifests names files listing more modules: go.sum and go.mod
+	// files, by name, or else lists of module@version, one per line.
+	// Only the modules this proxy serves are taken from them.
+	Manifests []string `yaml:"manifests"`
+
+	// Interval, if set, warms the list again at this interval,
+	// rereading the manifests, so new entries and evicted versions are
+	// fetched before they are asked for.
+	Interval time.Duration `yaml:"interval"`
+}
+
+var warm struct {
+	sync.Mutex
+	pending map[string]string // by entry, the last error
+	total   int
+	started time.Time
+	done    bool // all cached, or MaxWait passed
+}
+
+// checkWarm validates the warm list.
+func checkWarm(wc WarmConfig) error {
+	for _, m := range wc.Modules {
+		if err := checkWarmEntry(m); err != nil {
+			return fmt.Errorf("warm: %v", err)
+		}
+	}
+	if _, err := warmList(wc); err != nil {
+		return fmt.Errorf("warm: %v", err)
+	}
+	return nil
+}
+
+// checkWarmEntry validates m, a module path with an optional canonical
+// version or latest.
+func checkWarmEntry(m string) error {
+	path, version, _ := strings.Cut(m, "@")
+	if err := module.CheckPath(path); err != nil {
+		return fmt.Errorf("%s: %v", m, err)
+	}
+	if version != "" && version != "latest" && (!semver.IsValid(version) || version != semver.Canonical(version)) {
+		return fmt.Errorf("%s: version must be canonical or latest", m)
+	}
+	return nil
+}
+
+// warmList returns the entries of the warm list and of the manifests,
+// without duplicates.
+func warmList(wc WarmConfig) ([]string, error) {
+	seen := make(map[string]bool)
+	var list []string
+	add := func(m string) {
+		if !seen[m] {
+			seen[m] = true
+			list = append(list, m)
+		}
+	}
+	for _, m := range wc.Modules {
+		add(m)
+	}
+	for _, file := range wc.Manifests {
+		entries, err := readWarmManifest(file)
+		if err != nil {
+			return list, err
+		}
+		for _, m := range entries {
+			if path, _, _ := strings.Cut(m, "@"); servesModule(path) {
+				add(m)
+			}
+		}
+	}
+	return list, nil
+}
+
+// readWarmManifest returns the module@version entries of a manifest.
+func readWarmManifest(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	switch filepath.Base(file) {
+	case "go.mod":
+		f, err := modfile.ParseLax(file, data, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range f.Require {
+			entries = append(entries, r.Mod.Path+"@"+r.Mod.Version)
+		}
+		return entries, nil
+	case "go.sum":
+		for i, line := range strings.Split(string(data), "\n") {
+			f := strings.Fields(line)
+			if len(f) == 0 {
+				continue
+			}
+			if len(f) != 3 {
+				return nil, fmt.Errorf("%s:%d: malformed go.sum line", file, i+1)
+			}
+			entries = append(entries, f[0]+"@"+strings.TrimSuffix(f[1], "/go.mod"))
+		}
+		return entries, nil
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if err := checkWarmEntry(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, i+1, err)
+		}
+		entries = append(entries, line)
+	}
+	return entries, nil
+}
+
+// startWarm fetches the warm list in the background.
+func startWarm() {
+	wc := config.Warm
+	if wc.Interval > 0 {
+		go rewarm(wc)
+	}
+	list, err := warmList(wc)
+	if err != nil {
+		slog.Warn("warm: reading manifests", "err", err)
+	}
+	warm.Lock()
+	warm.started = time.Now()
+	warm.pending = make(map[string]string)
+	for _, m := range list {
+		warm.pending[m] = "not cached yet"
+	}
+	warm.total = len(warm.pending)
+	warm.done = warm.total == 0
+	warm.Unlock()
+	if len(list) == 0 {
+		return
+	}
+	retry := wc.RetryInterval
+	if retry == 0 {
+		retry = 30 * time.Second
+	}
+	go func() {
+		for {
+			warmPending(wc)
+			warm.Lock()
+			n, gaveUp := len(warm.pending), false
+			if n == 0 || (!warm.done && wc.MaxWait > 0 && time.Since(warm.started) > wc.MaxWait) {
+				warm.done, gaveUp = true, n > 0
+			}
+			warm.Unlock()
+			if n == 0 {
+				slog.Info("warm: all modules cached", "took", time.Since(warm.started))
+				return
+			}
+			if gaveUp && wc.GateReadiness {
+				slog.Warn("warm: no longer gating readiness", "pending", n, "max_wait", wc.MaxWait)
+			}
+			time.Sleep(retry)
+		}
+	}()
+}
+
+// warmPending fetches the entries not cached yet.
+func warmPending(wc WarmConfig) {
+	warm.Lock()
+	todo := sortedKeys(warm.pending)
+	warm.Unlock()
+
+	warmEach(wc, todo, func(m string, err error) {
+		warm.Lock()
+		if err != nil {
+			warm.pending[m] = err.Error()
+		} else {
+			delete(warm.pending, m)
+		}
+		warm.Unlock()
+	})
+}
+
+// rewarm warms the list again every wc.Interval. Readiness is no
+// longer gated on it.
+func rewarm(wc WarmConfig) {
+	for range time.Tick(wc.Interval) {
+		list, err := warmList(wc)
+		if err != nil {
+			slog.Warn("warm: reading manifests", "err", err)
+		}
+		start := time.Now()
+		var mu sync.Mutex
+		failed := 0
+		warmEach(wc, list, func(m string, err error) {
+			if err != nil {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		})
+		slog.Info("warm: scheduled run", "modules", len(list), "failed", failed, "took", time.Since(start))
+	}
+}
+
+// warmEach fetches the entries of todo, wc.Concurrency at a time, and
+// reports the result of each to done.
+func warmEach(wc WarmConfig, todo []string, done func(m string, err error)) {
+	n := wc.Concurrency
+	if n <= 0 {
+		n = 4
+	}
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for _, m := range todo {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			err := warmModule(context.Background(), m)
+			done(m, err)
+			if err != nil {
+				slog.Warn("warm", "module", m, "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// warmModule caches the .info, go.mod and zip of m, a warm list entry.
+func warmModule(ctx context.Context, m string) error {
+	path, version, _ := strings.Cut(m, "@")
+	escaped, err := module.EscapePath(path)
+	if err != nil {
+		return err
+	}
+	if version == "" || version == "latest" {
+		if version, err = warmLatest(ctx, path, escaped); err != nil {
+			return err
+		}
+	}
+	dir := entryDir(escaped, version)
+	for _, f := range []string{version + ".info", "go.mod", "source.zip"} {
+		if err := ensureCached(ctx, escaped, version, filepath.Join(dir, f)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warmLatest returns the @latest of path for anonymous callers.
+func warmLatest(ctx context.Context, path, escaped string) (string, error) {
+	versions, err := moduleVersions(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	hidden := hiddenFrom(escaped, anonymous)
+	var tagged []string
+	for _, v := range versions {
+		if !semver.IsValid(v) || v != semver.Canonical(v) || module.IsPseudoVersion(v) {
+			continue
+		}
+		if isQuarantined(anonymous, escaped, v) || blockOf(escaped, v) != nil || (hidden != nil && hidden(v)) {
+			continue
+		}
+		tagged = append(tagged, v)
+	}
+	if len(tagged) == 0 {
+		return "", kindError{fmt.Sprintf("%s has no versions", path), errNotFound}
+	}
+	sort.Slice(tagged, func(i, j int) bool { return semver.Compare(tagged[i], tagged[j]) < 0 })
+	return pickLatest(ctx, escaped, tagged), nil
+}
+
+// warmError reports the progress of the warm-up while it gates
+// readiness.
+func warmError() error {
+	warm.Lock()
+	defer warm.Unlock()
+	if warm.done || len(warm.pending) == 0 {
+		return nil
+	}
+	var parts []string
+	for _, m := range sortedKeys(warm.pending) {
+		parts = append(parts, m+": "+warm.pending[m])
+	}
+	return fmt.Errorf("%d of %d modules not cached: %s", len(warm.pending), warm.total, strings.Join(parts, "; "))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+	modzip "golang.org/x/mod/zip"
+)
+
+// WorkspaceConfig publishes modules from a local workspace through the
+// proxy, so a test build can use what is on a developer's disk without
+// editing its go.mod. File is a go.work, whose use directives are
+// published, or a go.mod, whose replace directives with a local target
+// are. Modules, if set, restricts publishing to these module path
+// prefixes. Published modules take precedence over the upstream.
+type WorkspaceConfig struct {
+	File    string   `yaml:"file"`
+	Modules []string `yaml:"modules"`
+}
+
+// workspaceBackend serves one module from a directory. It has a single
+// version, a pseudo-version derived from the newest modification time
+// and the hash of the files that would go into the zip, so it changes
+// whenever the directory does and cached artifacts never go stale. Any
+// version query, e.g. @workspace, resolves to it.
+type workspaceBackend struct {
+	path string
+	dir  string
+}
+
+// workspace maps the published module paths to their backends.
+var workspace map[string]*workspaceBackend
+
+// setupWorkspace reads the workspace file and records the modules it
+// publishes.
+func setupWorkspace(wc WorkspaceConfig) error {
+	workspace = nil
+	if wc.File == "" {
+		return nil
+	}
+	data, err := os.ReadFile(wc.File)
+	if err != nil {
+		return err
+	}
+	base := filepath.Dir(wc.File)
+
+	dirs := make(map[string]string) // module path, if known, by directory
+	if filepath.Base(wc.File) == "go.work" {
+		wf, err := modfile.ParseWork(wc.File, data, nil)
+		if err != nil {
+			return err
+		}
+		for _, u := range wf.Use {
+			dirs[resolveDir(base, u.Path)] = ""
+		}
+	} else {
+		mf, err := modfile.ParseLax(wc.File, data, nil)
+		if err != nil {
+			return err
+		}
+		for _, r := range mf.Replace {
+			if r.New.Version == "" && modfile.IsDirectoryPath(r.New.Path) {
+				dirs[resolveDir(base, r.New.Path)] = r.Old.Path
+			}
+		}
+	}
+
+	workspace = make(map[string]*workspaceBackend)
+	for dir, path := range dirs {
+		if gomod, err := os.ReadFile(filepath.Join(dir, "go.mod")); err == nil {
+			path = modfile.ModulePath(gomod)
+		}
+		if path == "" {
+			return fmt.Errorf("workspace: %s has no go.mod", dir)
+		}
+		if !publishes(wc, path) {
+			continue
+		}
+		workspace[path] = &workspaceBackend{path: path, dir: dir}
+		slog.Info("workspace: publishing", "module", path, "dir", dir)
+	}
+	return nil
+}
+
+// publishes reports whether wc publishes the module path.
+func publishes(wc WorkspaceConfig, path string) bool {
+	if len(wc.Modules) == 0 {
+		return true
+	}
+	for _, p := range wc.Modules {
+		if hasPathPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// workspaceModule returns the backend publishing the module path name
+// (escaped or not), or nil.
+func workspaceModule(name string) *workspaceBackend {
+	if workspace == nil {
+		return nil
+	}
+	if p, err := module.UnescapePath(name); err == nil {
+		name = p
+	}
+	return workspace[name]
+}
+
+// version returns the current version of the module.
+func (b *workspaceBackend) version() (string, error) {
+	cf, err := modzip.CheckDir(b.dir)
+	if err != nil {
+		return "", err
+	}
+	if err := cf.Err(); err != nil {
+		return "", err
+	}
+	var newest time.Time
+	files := make([]string, 0, len(cf.Valid))
+	for _, f := range cf.Valid {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return "", err
+		}
+		if fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+		rel, err := filepath.Rel(b.dir, f)
+		if err != nil {
+			return "", err
+		}
+		files = append(files, filepath.ToSlash(rel))
+	}
+	h1, err := dirhash.Hash1(files, func(name string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(b.dir, filepath.FromSlash(name)))
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(h1))
+	_, pathMajor, _ := module.SplitPathVersion(b.path)
+	return module.PseudoVersion(strings.TrimPrefix(pathMajor, "/"), "", newest, hex.EncodeToString(sum[:6])), nil
+}
+
+func (b *workspaceBackend) List(ctx context.Context, name string) ([]string, error) {
+	v, err := b.version()
+	if err != nil {
+		return nil, err
+	}
+	return []string{v}, nil
+}
+
+func (b *workspaceBackend) Resolve(ctx context.Context, path, query string) (string, error) {
+	return b.version()
+}
+
+func (b *workspaceBackend) Fetch(ctx context.Context, name, version, destDir string, policy FetchPolicy) error {
+	current, err := b.version()
+	if err != nil {
+		return err
+	}
+	if version != current {
+		return fmt.Errorf("%s@%s: not the workspace version %s: %w", b.path, version, current, errNotFound)
+	}
+	slog.DebugContext(ctx, "workspace", "dir", b.dir)
+
+	t, err := module.PseudoVersionTime(version)
+	if err != nil {
+		return err
+	}
+	return writeDirArtifacts(b.path, version, b.dir, t, destDir, policy)
+}
+
+// resolveDir returns dir, a use or replace directory of the workspace
+// file in base, as a path usable from the proxy's working directory.
+func resolveDir(base, dir string) string {
+	if filepath.IsAbs(dir) {
+		return filepath.Clean(dir)
+	}
+	return filepath.Join(base, dir)
+}
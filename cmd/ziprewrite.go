@@ -0,0 +1,192 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+// RewriteConfig configures how zips in the rewritten namespace are
+// repackaged.
+type RewriteConfig struct {
+	// Imports also rewrites import paths under the mapped upstreams in
+	// .go files, for repositories whose packages import each other by
+	// their upstream paths.
+	Imports bool `yaml:"imports"`
+}
+
+// zipEntry is a file of a module zip being repackaged.
+type zipEntry struct {
+	f    *zip.File
+	path string // relative to the module root
+	data []byte // rewritten content, or nil to copy f
+}
+
+func (e zipEntry) Path() string { return e.path }
+
+func (e zipEntry) Lstat() (os.FileInfo, error) {
+	fi := e.f.FileInfo()
+	if e.data == nil {
+		return fi, nil
+	}
+	return resizedInfo{fi, int64(len(e.data))}, nil
+}
+
+func (e zipEntry) Open() (io.ReadCloser, error) {
+	if e.data == nil {
+		return e.f.Open()
+	}
+	return io.NopCloser(bytes.NewReader(e.data)), nil
+}
+
+// resizedInfo is the FileInfo of a rewritten entry.
+type resizedInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (fi resizedInfo) Size() int64 { return fi.size }
+
+// rewriteZip repackages the zip at file under path@version with
+// golang.org/x/mod/zip when its entries carry another prefix, its go.mod
+// names upstream paths or, with RewriteConfig.Imports, its .go files
+// import them. Files that cannot be rewritten are kept as they are.
+// Files the go command would not extract, such as those of nested
+// modules, are dropped as it would drop them.
+func rewriteZip(ctx context.Context, file, path, version string, rw []pathRewrite, maxBytes int64) error {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	sep := "@" + version + "/"
+	var files []modzip.File
+	changed := false
+	for _, f := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		i := strings.Index(f.Name, sep)
+		if i < 0 {
+			return fmt.Errorf("%s: unexpected entry %s", file, f.Name)
+		}
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		e := zipEntry{f: f, path: f.Name[i+len(sep):]}
+		changed = changed || f.Name[:i] != path
+
+		var rewrite func([]byte, []pathRewrite) ([]byte, bool, error)
+		switch {
+		case e.path == "go.mod":
+			rewrite = rewriteGoMod
+		case config.Rewrite.Imports && strings.HasSuffix(e.path, ".go"):
+			rewrite = rewriteImports
+		}
+		if rewrite != nil {
+			var ok bool
+			data, err := readZipFile(f, modzip.MaxGoMod)
+			if err == nil {
+				data, ok, err = rewrite(data, rw)
+			}
+			if err != nil {
+				slog.WarnContext(ctx, "rewrite", "module", path, "version", version, "file", e.path, "err", err)
+			} else if ok {
+				e.data = data
+				changed = true
+			}
+		}
+		files = append(files, e)
+	}
+	if !changed {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	lw := &limitedWriter{w: tmp, n: maxBytes}
+	err = modzip.Create(lw, module.Version{Path: path, Version: version}, files)
+	if lw.exceeded {
+		tmp.Close()
+		return fmt.Errorf("%s@%s: %w (> %d bytes)", path, version, errTooLarge, maxBytes)
+	}
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("repackaging %s@%s: %v", path, version, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	slog.DebugContext(ctx, "rewrote module paths", "module", path, "version", version)
+	return os.Rename(tmp.Name(), file)
+}
+
+// readZipFile reads f, failing if it is larger than max.
+func readZipFile(f *zip.File, max int64) ([]byte, error) {
+	if f.UncompressedSize64 > uint64(max) {
+		return nil, fmt.Errorf("file too large (%d bytes)", f.UncompressedSize64)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, max))
+}
+
+// rewriteImports rewrites the import paths of a Go source file. Only
+// the quoted paths are replaced, so formatting and comments are kept.
+// Files that do not parse are left alone, as the go command ignores
+// them too unless they are built.
+func rewriteImports(src []byte, rw []pathRewrite) ([]byte, bool, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ImportsOnly)
+	if err != nil {
+		return src, false, nil
+	}
+	type edit struct {
+		start, end int
+		lit        string
+	}
+	var edits []edit
+	for _, spec := range f.Imports {
+		p, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		if np, ok := rewritePath(p, rw); ok {
+			edits = append(edits, edit{fset.Position(spec.Path.Pos()).Offset, fset.Position(spec.Path.End()).Offset, strconv.Quote(np)})
+		}
+	}
+	if len(edits) == 0 {
+		return src, false, nil
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var out bytes.Buffer
+	last := 0
+	for _, e := range edits {
+		out.Write(src[last:e.start])
+		out.WriteString(e.lit)
+		last = e.end
+	}
+	out.Write(src[last:])
+	return out.Bytes(), true, nil
+}
@@ -0,0 +1,833 @@
+// Command e2e tests the proxy end to end with a real go command. It
+// serves fake upstream repositories through git http-backend over
+// HTTPS, runs the proxy binary against them with the git backend and an
+// in-memory S3 store, and drives go list, go mod download (also of
+// several modules at once), go get and go build through GOPROXY,
+// checking what the go command reports, the proxy's cache, its go.sum
+// fragments and the store. For each unknown_module_list setting, the go
+// command's answers for a module the upstream lacks, with a fallback
+// proxy after this one, are checked, and with private_prefixes a
+// package of a served module must still resolve. A second proxy with an
+// empty cache must then serve the same versions from the store while
+// the upstream is down. Every check is printed; the command exits
+// non-zero if any failed.
+//
+//	go run ./e2e
+//	go run ./e2e -proxy tmp/goproxy -v -keep
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	proxyBin = flag.String("proxy", "", "proxy binary (default: build ./cmd)")
+	goBin    = flag.String("go", "go", "go command to test with")
+	keep     = flag.Bool("keep", false, "keep the work directory")
+	verbose  = flag.Bool("v", false, "print the output of every command")
+)
+
+const (
+	srcRepo  = "e2e.example/mods"
+	destRepo = "git.e2e.test/org"
+	token    = "e2e-token"
+	bucket   = "e2e"
+)
+
+func main() {
+	flag.Parse()
+	log.SetFlags(0)
+
+	work, err := os.MkdirTemp("", "goproxy-e2e")
+	if err != nil {
+		log.Fatal(err)
+	}
+	code := run(work)
+	if *keep || code != 0 {
+		log.Printf("work directory, with the proxy logs: %s", work)
+	} else {
+		os.RemoveAll(work)
+	}
+	os.Exit(code)
+}
+
+func run(work string) int {
+	bin := *proxyBin
+	if bin == "" {
+		bin = filepath.Join(work, "goproxy")
+		build := exec.Command("go", "build", "-o", bin, "./cmd")
+		build.Stdout, build.Stderr = os.Stdout, os.Stderr
+		if err := build.Run(); err != nil {
+			log.Printf("building proxy: %v", err)
+			return 1
+		}
+	}
+
+	repos := filepath.Join(work, "git")
+	pseudoHash, err := makeRepos(work, repos)
+	if err != nil {
+		log.Printf("creating repositories: %v", err)
+		return 1
+	}
+	vcs := newGitServer(repos)
+	defer vcs.srv.Close()
+	caFile := filepath.Join(work, "ca.pem")
+	err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: vcs.srv.Certificate().Raw}), 0644)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	s3 := newMemS3()
+	s3Srv := httptest.NewServer(s3)
+	defer s3Srv.Close()
+
+	cfg := filepath.Join(work, "config.yaml")
+	err = os.WriteFile(cfg, []byte(fmt.Sprintf(`storage:
+  type: s3
+  s3:
+    endpoint: %s
+    bucket: %s
+    path_style: true
+    access_key_id: e2e
+    secret_access_key: e2e
+`, s3Srv.URL, bucket)), 0644)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	// The proxy's git reaches the fake upstream under the DEST_REPO
+	// host name and trusts its certificate.
+	upstreamURL := vcs.srv.URL + "/"
+	env := []string{
+		"CONFIG_FILE=" + cfg,
+		"SRC_REPO=" + srcRepo,
+		"DEST_REPO=" + destRepo,
+		"REPO_TOKEN=" + token,
+		"GIT_SSL_CAINFO=" + caFile,
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_CONFIG_COUNT=2",
+		"GIT_CONFIG_KEY_0=url." + upstreamURL + ".insteadOf",
+		"GIT_CONFIG_VALUE_0=https://dummy:" + token + "@" + strings.Split(destRepo, "/")[0] + "/",
+		"GIT_CONFIG_KEY_1=url." + upstreamURL + ".insteadOf",
+		"GIT_CONFIG_VALUE_1=https://" + strings.Split(destRepo, "/")[0] + "/",
+	}
+
+	h := &harness{work: work}
+	base, stop, err := startProxy(bin, work, "proxy1", env)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer stop()
+	client := h.goEnv("client1", base)
+
+	alpha, beta := srcRepo+"/alpha", srcRepo+"/beta"
+	h.check("go list -m -versions", func() error {
+		out, err := h.goCmd(client, "list", "-m", "-versions", alpha)
+		if err != nil {
+			return err
+		}
+		if want := alpha + " v1.0.0 v1.1.0"; strings.TrimSpace(out) != want {
+			return fmt.Errorf("got %q, want %q", strings.TrimSpace(out), want)
+		}
+		return nil
+	})
+
+	var first download
+	h.check("go mod download", func() error {
+		var err error
+		if first, err = h.download(client, alpha+"@v1.1.0"); err != nil {
+			return err
+		}
+		gomod, err := os.ReadFile(first.GoMod)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(string(gomod), "module "+alpha+"\n") {
+			return fmt.Errorf("go.mod not rewritten:\n%s", gomod)
+		}
+		return cached(work, "proxy1", alpha, "v1.1.0")
+	})
+
+	h.check("versions pushed to the store", func() error {
+		prefix := "rewritten/" + alpha + "/@v/v1.1.0"
+		for i := 0; i < 50; i++ {
+			if n := len(s3.keys(prefix)); n >= 4 {
+				return nil
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		return fmt.Errorf("store holds %v", s3.keys(""))
+	})
+
+	h.check("go get and go build", func() error {
+		if _, err := h.goCmd(client, "get", beta+"@latest"); err != nil {
+			return err
+		}
+		gomod, err := os.ReadFile(filepath.Join(client.dir, "go.mod"))
+		if err != nil {
+			return err
+		}
+		for _, want := range []string{beta + " v0.1.0", alpha + " v1.0.0 // indirect"} {
+			if !strings.Contains(string(gomod), want) {
+				return fmt.Errorf("go.mod lacks %q:\n%s", want, gomod)
+			}
+		}
+		exe := filepath.Join(client.dir, "client")
+		if _, err := h.goCmd(client, "build", "-o", exe, "."); err != nil {
+			return err
+		}
+		out, err := exec.Command(exe).Output()
+		if err != nil {
+			return err
+		}
+		if got := strings.TrimSpace(string(out)); got != "hello from beta, alpha v1.0.0" {
+			return fmt.Errorf("client printed %q", got)
+		}
+		return nil
+	})
+
+	h.check("pseudo-version of a commit", func() error {
+		d, err := h.download(client, alpha+"@"+pseudoHash[:12])
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(d.Version, "v1.1.1-0.") || !strings.HasSuffix(d.Version, "-"+pseudoHash[:12]) {
+			return fmt.Errorf("resolved to %s", d.Version)
+		}
+		return nil
+	})
+
+	h.check("batch go mod download", func() error {
+		missing := srcRepo + "/missing@v1.0.0"
+		ds, err := h.downloads(client, alpha+"@v1.0.0", beta+"@v0.1.0", missing)
+		if err == nil {
+			return fmt.Errorf("downloading %s succeeded", missing)
+		}
+		got := make(map[string]download)
+		for _, d := range ds {
+			got[d.Path] = d
+		}
+		for _, path := range []string{alpha, beta} {
+			if d, ok := got[path]; !ok || d.Error != "" || d.Zip == "" {
+				return fmt.Errorf("%s: got %+v", path, d)
+			}
+		}
+		if d := got[srcRepo+"/missing"]; d.Error == "" {
+			return fmt.Errorf("no error reported for %s in %+v", missing, ds)
+		}
+		return nil
+	})
+
+	h.check("protocol endpoints", func() error {
+		var info struct{ Version, Time string }
+		for _, p := range []string{"/@latest", "/@v/v1.1.0.info"} {
+			if err := getJSON(base+"/"+alpha+p, &info); err != nil {
+				return err
+			}
+			if info.Version != "v1.1.0" || info.Time == "" {
+				return fmt.Errorf("%s: got %+v", p, info)
+			}
+		}
+		// The go command falls back to the next proxy only on 404 and 410.
+		for _, p := range []string{"/" + srcRepo + "/missing/@v/list", "/" + alpha + "/@v/v9.9.9.info"} {
+			code, err := status(base + p)
+			if err != nil {
+				return err
+			}
+			if code != http.StatusNotFound && code != http.StatusGone {
+				return fmt.Errorf("%s: status %d, want 404 or 410", p, code)
+			}
+		}
+		return nil
+	})
+
+	h.check("go.sum fragment", func() error {
+		resp, err := http.Get(base + "/" + alpha + "/@v/v1.1.0.sum")
+		if err != nil {
+			return err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("status %d: %s", resp.StatusCode, body)
+		}
+		want := fmt.Sprintf("%s v1.1.0 %s\n%s v1.1.0/go.mod %s\n", alpha, first.Sum, alpha, first.GoModSum)
+		if string(body) != want {
+			return fmt.Errorf("got %q, want the hashes of go mod download %q", body, want)
+		}
+		return nil
+	})
+
+	// How the go command treats the answers of unknown_module_list for
+	// a module the upstream lacks, with a proxy after this one that has
+	// it. See the table in the README.
+	missing := srcRepo + "/missing"
+	fallback := httptest.NewServer(newFallbackProxy(missing, "v1.0.0"))
+	defer fallback.Close()
+	for _, choice := range []string{"not_found", "empty"} {
+		h.check("unknown_module_list: "+choice, func() error {
+			listCfg := filepath.Join(work, "list-"+choice+".yaml")
+			if err := os.WriteFile(listCfg, []byte("unknown_module_list: "+choice+"\n"), 0644); err != nil {
+				return err
+			}
+			base, stop, err := startProxy(bin, work, "list-"+choice, append(env, "CONFIG_FILE="+listCfg))
+			if err != nil {
+				return err
+			}
+			defer stop()
+			e := h.goEnv("client-list-"+choice, base+","+fallback.URL)
+
+			out, err := h.goCmd(e, "list", "-m", "-versions", missing)
+			if err != nil {
+				return err
+			}
+			want := map[string]string{"not_found": missing + " v1.0.0", "empty": missing}[choice]
+			if got := strings.TrimSpace(out); got != want {
+				return fmt.Errorf("go list -m -versions: got %q, want %q", got, want)
+			}
+			d, err := h.download(e, missing+"@latest")
+			switch {
+			case choice == "not_found" && (err != nil || d.Version != "v1.0.0"):
+				return fmt.Errorf("@latest: got %+v, %v; want v1.0.0 from the next proxy", d, err)
+			case choice == "empty" && err == nil:
+				return fmt.Errorf("@latest: got %+v, want no matching versions", d)
+			}
+			if d, err := h.download(e, missing+"@v1.0.0"); err != nil || d.Version != "v1.0.0" {
+				return fmt.Errorf("@v1.0.0: got %+v, %v; want it from the next proxy", d, err)
+			}
+			return nil
+		})
+	}
+
+	// Under private_prefixes, the go command still resolves a package of
+	// a served module, which makes it look up longer candidate module
+	// paths first, while a private path the proxy does not serve is
+	// refused rather than left to a public proxy.
+	h.check("private_prefixes", func() error {
+		privateCfg := filepath.Join(work, "private.yaml")
+		if err := os.WriteFile(privateCfg, []byte("private_prefixes: ["+srcRepo+", e2e.private]\n"), 0644); err != nil {
+			return err
+		}
+		base, stop, err := startProxy(bin, work, "private", append(env, "CONFIG_FILE="+privateCfg))
+		if err != nil {
+			return err
+		}
+		defer stop()
+		e := h.goEnv("client-private", base+","+fallback.URL)
+		if _, err := h.goCmd(e, "get", alpha+"/util@v1.1.0"); err != nil {
+			return err
+		}
+		for p, want := range map[string]int{
+			"/" + srcRepo + "/missing/@v/list":   http.StatusNotFound,
+			"/" + alpha + "/util/@v/v1.1.0.info": http.StatusNotFound,
+			"/e2e.private/lib/@v/list":           http.StatusForbidden,
+		} {
+			code, err := status(base + p)
+			if err != nil {
+				return err
+			}
+			if code != want {
+				return fmt.Errorf("%s: status %d, want %d", p, code, want)
+			}
+		}
+		return nil
+	})
+
+	// A new replica with an empty cache and no upstream.
+	stop()
+	vcs.down.Store(true)
+	h.check("versions restored from the store", func() error {
+		base2, stop2, err := startProxy(bin, work, "proxy2", env)
+		if err != nil {
+			return err
+		}
+		defer stop2()
+		d, err := h.download(h.goEnv("client2", base2), alpha+"@v1.1.0")
+		if err != nil {
+			return err
+		}
+		if d.Sum != first.Sum || d.GoModSum != first.GoModSum {
+			return fmt.Errorf("hashes differ: %s %s, first %s %s", d.Sum, d.GoModSum, first.Sum, first.GoModSum)
+		}
+		if n := vcs.requests.Load(); n != vcs.served.Load() {
+			return fmt.Errorf("%d requests reached the stopped upstream", n-vcs.served.Load())
+		}
+		return cached(work, "proxy2", alpha, "v1.1.0")
+	})
+
+	if h.failed > 0 {
+		log.Printf("%d checks failed", h.failed)
+		return 1
+	}
+	return 0
+}
+
+// harness runs the checks.
+type harness struct {
+	work   string
+	failed int
+}
+
+func (h *harness) check(name string, f func() error) {
+	start := time.Now()
+	if err := f(); err != nil {
+		h.failed++
+		fmt.Printf("FAIL %s: %v\n", name, err)
+		return
+	}
+	fmt.Printf("ok   %s (%s)\n", name, time.Since(start).Round(time.Millisecond))
+}
+
+// goEnv is the environment of a go command using the proxy at base,
+// with its own module cache and a client module in dir.
+type goEnv struct {
+	dir string
+	env []string
+}
+
+func (h *harness) goEnv(name, base string) goEnv {
+	root := filepath.Join(h.work, name)
+	dir := filepath.Join(root, "src")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module e2e.test/client\n\ngo 1.21\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "main.go"), []byte(`package main
+
+import (
+	"fmt"
+
+	"`+srcRepo+`/beta"
+)
+
+func main() { fmt.Println(beta.Hello()) }
+`), 0644)
+	return goEnv{dir: dir, env: append(os.Environ(),
+		"GOPROXY="+base,
+		"GONOSUMDB="+srcRepo,
+		"GOPRIVATE=",
+		"GONOPROXY=",
+		"GOFLAGS=-modcacherw",
+		"GOTOOLCHAIN=local",
+		"GOWORK=off",
+		"GO111MODULE=on",
+		"GOPATH="+filepath.Join(root, "gopath"),
+		"GOMODCACHE="+filepath.Join(root, "modcache"),
+		"GOCACHE="+filepath.Join(h.work, "gocache"),
+	)}
+}
+
+// goCmd runs the go command in e and returns its standard output, also
+// when it fails.
+func (h *harness) goCmd(e goEnv, args ...string) (string, error) {
+	cmd := exec.Command(*goBin, args...)
+	cmd.Dir, cmd.Env = e.dir, e.env
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if *verbose {
+		fmt.Printf("$ go %s\n%s%s", strings.Join(args, " "), out, stderr.Bytes())
+	}
+	if err != nil {
+		return string(out), fmt.Errorf("go %s: %v\n%s%s", strings.Join(args, " "), err, out, stderr.Bytes())
+	}
+	return string(out), nil
+}
+
+// download is the output of go mod download -json.
+type download struct {
+	Path, Version, Error string
+	GoMod, Zip           string
+	Sum, GoModSum        string
+}
+
+func (h *harness) download(e goEnv, query string) (download, error) {
+	ds, err := h.downloads(e, query)
+	if len(ds) == 0 {
+		return download{}, err
+	}
+	return ds[0], err
+}
+
+// downloads runs go mod download -json with several queries. The go
+// command prints one object per module, and exits non-zero if any of
+// them failed: the results decoded are returned along with the errors.
+func (h *harness) downloads(e goEnv, queries ...string) ([]download, error) {
+	out, err := h.goCmd(e, append([]string{"mod", "download", "-json"}, queries...)...)
+	var ds []download
+	var errs []error
+	dec := json.NewDecoder(strings.NewReader(out))
+	for {
+		var d download
+		if jerr := dec.Decode(&d); jerr == io.EOF {
+			break
+		} else if jerr != nil {
+			errs = append(errs, fmt.Errorf("decoding go mod download output: %v", jerr))
+			break
+		}
+		if d.Error != "" {
+			errs = append(errs, errors.New(d.Error))
+		}
+		ds = append(ds, d)
+	}
+	if len(errs) == 0 && err != nil {
+		errs = append(errs, err)
+	}
+	return ds, errors.Join(errs...)
+}
+
+// cached checks that the proxy instance has a complete cache entry of
+// path@version.
+func cached(work, instance, path, version string) error {
+	dir := filepath.Join(work, instance, "cache", "rewritten", path, version)
+	for _, f := range []string{version + ".info", "go.mod", "source.zip", "provenance.json"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			return fmt.Errorf("cache entry incomplete: %v", err)
+		}
+	}
+	return nil
+}
+
+func getJSON(url string, v any) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func status(url string) (int, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// startProxy runs the proxy on a free port with its cache in
+// work/instance and waits until it answers.
+func startProxy(bin, work, instance string, env []string) (string, func(), error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	port := fmt.Sprint(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	dir := filepath.Join(work, instance)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, err
+	}
+	logf, err := os.Create(filepath.Join(dir, "proxy.log"))
+	if err != nil {
+		return "", nil, err
+	}
+	cmd := exec.Command(bin)
+	cmd.Env = append(append(os.Environ(), env...),
+		"PORT="+port,
+		"CACHE_DIR="+filepath.Join(dir, "cache"),
+	)
+	cmd.Stdout, cmd.Stderr = logf, logf
+	if err := cmd.Start(); err != nil {
+		return "", nil, err
+	}
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+			logf.Close()
+		})
+	}
+
+	base := "http://127.0.0.1:" + port
+	for i := 0; i < 100; i++ {
+		if resp, err := http.Get(base + "/api/version"); err == nil {
+			resp.Body.Close()
+			return base, stop, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	stop()
+	return "", nil, fmt.Errorf("proxy did not start; see %s", logf.Name())
+}
+
+// makeRepos creates the upstream repositories below root as bare
+// repositories: alpha, tagged v1.0.0 and v1.1.0 with one commit after
+// the last tag, and beta v0.1.0, which requires alpha v1.0.0. Their
+// go.mod files declare the upstream paths under DEST_REPO. It returns
+// the hash of alpha's untagged commit.
+func makeRepos(work, root string) (string, error) {
+	commitTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	git := func(dir string, args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		date := commitTime.Format(time.RFC3339)
+		cmd.Env = append(os.Environ(),
+			"GIT_CONFIG_NOSYSTEM=1",
+			"GIT_AUTHOR_NAME=e2e", "GIT_AUTHOR_EMAIL=e2e@example.com", "GIT_AUTHOR_DATE="+date,
+			"GIT_COMMITTER_NAME=e2e", "GIT_COMMITTER_EMAIL=e2e@example.com", "GIT_COMMITTER_DATE="+date,
+		)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	// commit writes files to the work tree of repo, commits them and
+	// tags the commit if tag is set.
+	commit := func(repo, tag string, files map[string]string) (string, error) {
+		dir := filepath.Join(work, "src", repo)
+		if _, err := os.Stat(dir); err != nil {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return "", err
+			}
+			if _, err := git(dir, "init", "-q", "-b", "main"); err != nil {
+				return "", err
+			}
+		}
+		for name, content := range files {
+			if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+				return "", err
+			}
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				return "", err
+			}
+		}
+		commitTime = commitTime.Add(time.Hour)
+		if _, err := git(dir, "add", "."); err != nil {
+			return "", err
+		}
+		if _, err := git(dir, "commit", "-q", "-m", "commit "+commitTime.Format(time.DateTime)); err != nil {
+			return "", err
+		}
+		if tag != "" {
+			if _, err := git(dir, "tag", tag); err != nil {
+				return "", err
+			}
+		}
+		return git(dir, "rev-parse", "HEAD")
+	}
+
+	alphaMod := "module " + destRepo + "/alpha\n\ngo 1.21\n"
+	alphaGo := func(v string) string {
+		return "package alpha\n\n// Version is the release of the package.\nconst Version = \"" + v + "\"\n"
+	}
+	steps := []struct {
+		repo, tag string
+		files     map[string]string
+	}{
+		{"alpha", "v1.0.0", map[string]string{"go.mod": alphaMod, "alpha.go": alphaGo("v1.0.0")}},
+		{"alpha", "v1.1.0", map[string]string{"alpha.go": alphaGo("v1.1.0"), "util/util.go": "package util\n\n// Name names the package.\nconst Name = \"util\"\n"}},
+		{"alpha", "", map[string]string{"alpha.go": alphaGo("main")}},
+		{"beta", "v0.1.0", map[string]string{
+			"go.mod": "module " + destRepo + "/beta\n\ngo 1.21\n\nrequire " + destRepo + "/alpha v1.0.0\n",
+			"beta.go": "package beta\n\nimport \"" + srcRepo + "/alpha\"\n\n" +
+				"func Hello() string { return \"hello from beta, alpha \" + alpha.Version }\n",
+		}},
+	}
+	var pseudoHash string
+	for _, s := range steps {
+		hash, err := commit(s.repo, s.tag, s.files)
+		if err != nil {
+			return "", err
+		}
+		if s.repo == "alpha" && s.tag == "" {
+			pseudoHash = hash
+		}
+	}
+
+	for _, repo := range []string{"alpha", "beta"} {
+		bare := filepath.Join(root, "org", repo)
+		if _, err := git(work, "clone", "-q", "--bare", filepath.Join(work, "src", repo), bare); err != nil {
+			return "", err
+		}
+		// Shallow, partial and by-hash fetches as the proxy makes them.
+		for _, kv := range [][2]string{{"uploadpack.allowFilter", "true"}, {"uploadpack.allowAnySHA1InWant", "true"}} {
+			if _, err := git(bare, "config", kv[0], kv[1]); err != nil {
+				return "", err
+			}
+		}
+	}
+	return pseudoHash, nil
+}
+
+// gitServer serves the repositories below a root with git http-backend.
+// While down, it answers 503.
+type gitServer struct {
+	srv      *httptest.Server
+	down     atomic.Bool
+	requests atomic.Int64
+	served   atomic.Int64
+}
+
+func newGitServer(root string) *gitServer {
+	g := &gitServer{}
+	backend := &cgi.Handler{
+		Path: gitPath(),
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	if !*verbose {
+		backend.Stderr = io.Discard
+	}
+	g.srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.requests.Add(1)
+		if g.down.Load() {
+			http.Error(w, "upstream stopped", http.StatusServiceUnavailable)
+			return
+		}
+		g.served.Add(1)
+		backend.ServeHTTP(w, r)
+	}))
+	return g
+}
+
+func gitPath() string {
+	p, err := exec.LookPath("git")
+	if err != nil {
+		log.Fatalf("the git backend needs git: %v", err)
+	}
+	return p
+}
+
+// newFallbackProxy serves version of module path, and nothing else, by
+// the module proxy protocol.
+func newFallbackProxy(path, version string) http.Handler {
+	gomod := "module " + path + "\n\ngo 1.21\n"
+	var zbuf bytes.Buffer
+	zw := zip.NewWriter(&zbuf)
+	for name, data := range map[string]string{"go.mod": gomod, "m.go": "package missing\n"} {
+		f, err := zw.Create(path + "@" + version + "/" + name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		io.WriteString(f, data)
+	}
+	if err := zw.Close(); err != nil {
+		log.Fatal(err)
+	}
+	info := fmt.Sprintf(`{"Version":%q,"Time":"2024-01-01T00:00:00Z"}`, version)
+	files := map[string]string{
+		"/@v/list":                 version + "\n",
+		"/@latest":                 info,
+		"/@v/" + version + ".info": info,
+		"/@v/" + version + ".mod":  gomod,
+		"/@v/" + version + ".zip":  zbuf.String(),
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, "/"+path)
+		data, found := files[rest]
+		if !ok || !found {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, data)
+	})
+}
+
+// memS3 is a path-style S3 bucket in memory, covering the requests of
+// the proxy's S3 store. Signatures are not checked.
+type memS3 struct {
+	mu      sync.Mutex
+	objects map[string]memObject
+}
+
+type memObject struct {
+	data   []byte
+	sha256 string
+}
+
+func newMemS3() *memS3 { return &memS3{objects: map[string]memObject{}} }
+
+// keys returns the keys under prefix, sorted.
+func (s *memS3) keys(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *memS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if b != bucket {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+	if key == "" && r.Method == http.MethodGet {
+		type content struct{ Key string }
+		var list struct {
+			XMLName     xml.Name `xml:"ListBucketResult"`
+			Contents    []content
+			IsTruncated bool
+		}
+		for _, k := range s.keys(r.URL.Query().Get("prefix")) {
+			list.Contents = append(list.Contents, content{k})
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(list)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		obj, ok := s.objects[key]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-Amz-Meta-Sha256", obj.sha256)
+		w.Header().Set("Content-Length", fmt.Sprint(len(obj.data)))
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = memObject{data, r.Header.Get("X-Amz-Meta-Sha256")}
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}